@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"thechat/pkg/coverage"
+	"thechat/pkg/webhook"
+)
+
+var coverageCmd = &cobra.Command{
+	Use:   "coverage",
+	Short: "Check which objects the webhook configuration and server filters cover",
+	Long: `Evaluate sample objects against a MutatingWebhookConfiguration and the
+server-side filters of the webhook.
+
+For every object and webhook entry, the report tells whether the API server
+would send the object to the webhook (rules, namespaceSelector and
+objectSelector) and whether the server would then run scripts for it
+(--skip-namespaces and --only-kinds). Objects matched by one layer but not
+the other are flagged with '!!'.
+
+Namespace labels come from Namespace objects among the samples and, with
+--kubeconfig, from the cluster. The configuration is read from --config or,
+with --kubeconfig, fetched by --config-name.`,
+	Example: `  # Check sample manifests against a generated configuration
+  glua-webhook coverage --config webhook.yaml --objects ./manifests \
+    --skip-namespaces kube-system --only-kinds Pod,Deployment
+
+  # Check against the live configuration and namespace labels
+  glua-webhook coverage --kubeconfig ~/.kube/config \
+    --config-name glua-mutating-webhook --objects ./manifests`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runCoverage(cmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// coverage command flags
+var (
+	coverageConfig           string
+	coverageConfigName       string
+	coverageObjects          string
+	coverageKubeconfig       string
+	coverageSkipNamespaces   []string
+	coverageOnlyKinds        []string
+	coverageOperation        string
+	coverageDefaultNamespace string
+	coverageOnlyMismatches   bool
+	coverageJSON             bool
+)
+
+func init() {
+	coverageCmd.Flags().StringVar(&coverageConfig, "config", "", "Path to a MutatingWebhookConfiguration file")
+	coverageCmd.Flags().StringVar(&coverageConfigName, "config-name", "", "Name of a MutatingWebhookConfiguration fetched from the cluster (requires --kubeconfig)")
+	coverageCmd.Flags().StringVar(&coverageObjects, "objects", "", "Directory or file of sample objects (YAML or JSON, required)")
+	coverageCmd.Flags().StringVar(&coverageKubeconfig, "kubeconfig", "", "Path to kubeconfig file, enables reading namespace labels from the cluster")
+	coverageCmd.Flags().StringSliceVar(&coverageSkipNamespaces, "skip-namespaces", nil, "Namespaces skipped by the server (as passed to the webhook command)")
+	coverageCmd.Flags().StringSliceVar(&coverageOnlyKinds, "only-kinds", nil, "Kinds processed by the server (as passed to the webhook command)")
+	coverageCmd.Flags().StringVar(&coverageOperation, "operation", string(admissionregistrationv1.Create), "Admission operation the objects are evaluated for")
+	coverageCmd.Flags().StringVar(&coverageDefaultNamespace, "default-namespace", "default", "Namespace of namespaced objects without metadata.namespace")
+	coverageCmd.Flags().BoolVar(&coverageOnlyMismatches, "only-mismatches", false, "Only report objects matched by one layer but not the other")
+	coverageCmd.Flags().BoolVar(&coverageJSON, "json", false, "Print the report as JSON (same as --output=json)")
+	if err := coverageCmd.MarkFlagRequired("objects"); err != nil {
+		panic(fmt.Sprintf("failed to mark objects flag as required: %v", err))
+	}
+}
+
+func runCoverage(cmd *cobra.Command, args []string) error {
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+	if (coverageConfig == "") == (coverageConfigName == "") {
+		return fmt.Errorf("exactly one of --config and --config-name is required")
+	}
+	if coverageConfigName != "" && coverageKubeconfig == "" {
+		return fmt.Errorf("--config-name requires --kubeconfig")
+	}
+
+	objects, err := coverage.LoadObjects(coverageObjects)
+	if err != nil {
+		return err
+	}
+
+	options := coverage.Options{
+		Operation:        admissionregistrationv1.OperationType(coverageOperation),
+		DefaultNamespace: coverageDefaultNamespace,
+		Filters: webhook.ServerFilters{
+			SkipNamespaces: coverageSkipNamespaces,
+			OnlyKinds:      coverageOnlyKinds,
+		},
+	}
+
+	var config *admissionregistrationv1.MutatingWebhookConfiguration
+	if coverageKubeconfig != "" {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", coverageKubeconfig)
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes config: %w", err)
+		}
+		clientset, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create Kubernetes clientset: %w", err)
+		}
+
+		ctx := cmd.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to list namespaces: %w", err)
+		}
+		options.NamespaceLabels = make(map[string]map[string]string, len(namespaces.Items))
+		for _, ns := range namespaces.Items {
+			options.NamespaceLabels[ns.Name] = ns.Labels
+		}
+
+		if coverageConfigName != "" {
+			config, err = clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, coverageConfigName, metav1.GetOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to get MutatingWebhookConfiguration %s: %w", coverageConfigName, err)
+			}
+		}
+	}
+
+	if config == nil {
+		config, err = coverage.LoadWebhookConfiguration(coverageConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	results, err := coverage.Evaluate(config, objects, options)
+	if err != nil {
+		return err
+	}
+
+	if coverageJSON || outputFormat == outputJSON {
+		return writeJSON(os.Stdout, results)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	coverage.FormatReport(w, results, coverageOnlyMismatches)
+	return w.Flush()
+}
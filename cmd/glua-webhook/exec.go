@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/mattbaird/jsonpatch"
 	"github.com/spf13/cobra"
 
 	"thechat/pkg/luarunner"
+	"thechat/pkg/pipeline"
 )
 
 var execCmd = &cobra.Command{
@@ -28,9 +34,21 @@ it in place. The modified object is printed to stdout.`,
 	Example: `  # Test script on existing Pod
   kubectl get pod nginx -o json | glua-webhook exec --script add-label.lua
 
+  # Show the input and output objects next to the diff
+  kubectl get pod nginx -o json | glua-webhook exec --script add-label.lua --show-both
+
   # Test script on file
   glua-webhook exec --script inject-sidecar.lua --input pod.json --output modified.json
 
+  # Reproducible output for golden files, whatever the time and the random numbers scripts use
+  glua-webhook exec --script add-label.lua --input pod.json --frozen-time 2025-01-01T00:00:00Z --seed 42
+
+  # Run the script under the sandbox of the webhook server, fs disabled and http restricted
+  glua-webhook exec --script add-label.lua --input pod.json --profile webhook --http-allowed-hosts '*.example.com'
+
+  # Run a chain of scripts described by a pipeline file, printing a report per step
+  glua-webhook exec --pipeline pipeline.yaml --input pod.json
+
   # Test multiple scripts in sequence (simulating webhook chaining)
   kubectl get pod nginx -o json | \
     glua-webhook exec --script add-labels.lua | \
@@ -40,20 +58,45 @@ it in place. The modified object is printed to stdout.`,
 
 // exec command flags
 var (
-	execScript  string
-	execInput   string
-	execOutput  string
-	execVerbose bool
+	execScript   string
+	execInput    string
+	execOutput   string
+	execVerbose  bool
+	execShowBoth bool
+	execFrozen   string
+	execSeed     int64
+	execProfile  string
+	execPipeline string
 )
 
+// Sandbox profiles of the exec command
+const (
+	// profileDev: scripts may require every module, fs reads any file and http reaches any host
+	profileDev = "dev"
+	// profileWebhook: scripts run under the sandbox of the webhook server, as set by the sandbox
+	// flags and their defaults
+	profileWebhook = "webhook"
+)
+
+// sandboxFlagNames: flags registered by addSandboxFlags, only meaningful with profileWebhook
+var sandboxFlagNames = []string{
+	"allowed-modules", "safe-mode", "scripts-data-dir", "http-allowed-hosts", "http-allowed-methods",
+	"http-timeout", "http-max-response-bytes", "http-max-calls",
+}
+
 func init() {
-	execCmd.Flags().StringVarP(&execScript, "script", "s", "", "Path to Lua script file (required)")
+	execCmd.Flags().StringVarP(&execScript, "script", "s", "", "Path to Lua script file (required unless --pipeline is set)")
 	execCmd.Flags().StringVarP(&execInput, "input", "i", "", "Path to input JSON file (default: stdin)")
 	execCmd.Flags().StringVarP(&execOutput, "output", "o", "", "Path to output JSON file (default: stdout)")
 	execCmd.Flags().BoolVarP(&execVerbose, "verbose", "v", false, "Verbose logging")
-	if err := execCmd.MarkFlagRequired("script"); err != nil {
-		panic(fmt.Sprintf("failed to mark script flag as required: %v", err))
-	}
+	execCmd.Flags().BoolVar(&execShowBoth, "show-both", false, "Print the input and output objects and the diff between them to stderr")
+	execCmd.Flags().StringVar(&execFrozen, "frozen-time", "", "RFC 3339 time scripts see through os.time, os.date and time.now, for reproducible output")
+	execCmd.Flags().Int64Var(&execSeed, "seed", 0, "Seed of math.random, for reproducible output (0 leaves it unseeded)")
+	execCmd.Flags().StringVar(&execProfile, "profile", profileDev, "Sandbox of the scripts: webhook applies the sandbox flags with the defaults of the webhook server, dev leaves every module unrestricted")
+	execCmd.Flags().StringVar(&execPipeline, "pipeline", "", "Path to a pipeline YAML file describing a chain of scripts, with their priority, timeout, failure policy and params, run instead of --script")
+	addSandboxFlags(execCmd)
+	execCmd.MarkFlagsOneRequired("script", "pipeline")
+	execCmd.MarkFlagsMutuallyExclusive("script", "pipeline")
 }
 
 func runExec(cmd *cobra.Command, args []string) {
@@ -63,13 +106,25 @@ func runExec(cmd *cobra.Command, args []string) {
 		logger.SetOutput(io.Discard)
 	}
 
-	// Read script file
-	scriptContent, err := os.ReadFile(execScript)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading script file %s: %v\n", execScript, err)
-		os.Exit(1)
+	// Read script file, or the scripts of the pipeline
+	var scriptContent []byte
+	var chain *pipeline.Pipeline
+	var err error
+	if execPipeline != "" {
+		chain, err = pipeline.Load(execPipeline)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		logger.Printf("Loaded pipeline from %s (%d steps)", execPipeline, len(chain.Steps))
+	} else {
+		scriptContent, err = os.ReadFile(execScript)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading script file %s: %v\n", execScript, err)
+			os.Exit(1)
+		}
+		logger.Printf("Loaded script from %s (%d bytes)", execScript, len(scriptContent))
 	}
-	logger.Printf("Loaded script from %s (%d bytes)", execScript, len(scriptContent))
 
 	// Read input (stdin or file)
 	var inputData []byte
@@ -93,21 +148,70 @@ func runExec(cmd *cobra.Command, args []string) {
 	}
 	logger.Printf("Validated input JSON (%d bytes)", len(inputData))
 
-	// Create script runner
-	runner := luarunner.NewScriptRunner(logger)
+	// Options of the script runners, with a stopped clock and a seeded generator for reproducible runs
+	options, err := execRunnerOptions(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if execFrozen != "" {
+		frozen, err := time.Parse(time.RFC3339, execFrozen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --frozen-time %q: %v\n", execFrozen, err)
+			os.Exit(1)
+		}
+		options.Clock = luarunner.FrozenClock(frozen)
+	}
+
+	var outputData []byte
+	if chain != nil {
+		logger.Printf("Executing pipeline %s", execPipeline)
+		var results []pipeline.StepResult
+		outputData, results, err = chain.Run(context.Background(), logger, options, inputData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error executing pipeline: %v\n", err)
+			os.Exit(1)
+		}
+		for _, result := range results {
+			if result.Result.Err != nil && !errors.Is(result.Result.Err, pipeline.ErrAborted) {
+				logger.Printf("Step %s failed: %v", result.Step, result.Result.Err)
+			}
+		}
+		if err := pipeline.WriteReport(os.Stderr, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing pipeline report: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		runner := luarunner.NewScriptRunnerWithOptions(logger, options)
+
+		// Execute script
+		scripts := map[string]string{
+			execScript: string(scriptContent),
+		}
 
-	// Execute script
-	scripts := map[string]string{
-		execScript: string(scriptContent),
+		logger.Printf("Executing script %s", execScript)
+		var results []luarunner.ScriptResult
+		outputData, results, err = runner.RunScriptsWithResults(scripts, inputData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error executing script: %v\n", err)
+			os.Exit(1)
+		}
+		// The chain carries on past failing scripts, which the webhook would ignore as well
+		for _, result := range results {
+			if result.Err != nil {
+				logger.Printf("Script %s failed: %v", result.Name, result.Err)
+			}
+		}
+		printScriptStatus(os.Stderr, results)
 	}
+	logger.Printf("Script execution completed")
 
-	logger.Printf("Executing script %s", execScript)
-	outputData, err := runner.RunScriptsSequentially(scripts, inputData)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error executing script: %v\n", err)
-		os.Exit(1)
+	if execShowBoth {
+		if err := printSideBySide(os.Stderr, inputData, outputData); err != nil {
+			fmt.Fprintf(os.Stderr, "Error comparing input and output: %v\n", err)
+			os.Exit(1)
+		}
 	}
-	logger.Printf("Script execution completed successfully")
 
 	// Write output (stdout or file)
 	if execOutput == "" {
@@ -120,3 +224,60 @@ func runExec(cmd *cobra.Command, args []string) {
 		logger.Printf("Output written to %s (%d bytes)", execOutput, len(outputData))
 	}
 }
+
+// execRunnerOptions: returns the options of the runner of the exec command for its sandbox profile
+func execRunnerOptions(cmd *cobra.Command) (luarunner.Options, error) {
+	options := luarunner.Options{Seed: execSeed}
+	switch execProfile {
+	case profileWebhook:
+		sandboxOptions(cmd, &options)
+	case profileDev:
+		for _, name := range sandboxFlagNames {
+			if cmd.Flags().Changed(name) {
+				return options, fmt.Errorf("--%s only applies with --profile=%s", name, profileWebhook)
+			}
+		}
+	default:
+		return options, fmt.Errorf("invalid --profile %q, must be %s or %s", execProfile, profileWebhook, profileDev)
+	}
+	return options, nil
+}
+
+// printScriptStatus: prints a line per script, ok or failed with the reason, along with its duration
+// The reason is the first line of the error, the Lua traceback being logged with --verbose
+func printScriptStatus(w io.Writer, results []luarunner.ScriptResult) {
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Fprintf(w, "failed  %s (%s): %s\n", result.Name, result.Duration.Round(time.Microsecond), result.ErrSummary())
+			continue
+		}
+		fmt.Fprintf(w, "ok      %s (%s)\n", result.Name, result.Duration.Round(time.Microsecond))
+	}
+}
+
+// printSideBySide: prints the pretty input and output objects followed by the JSON patch between them
+func printSideBySide(w io.Writer, input, output []byte) error {
+	patch, err := jsonpatch.CreatePatch(input, output)
+	if err != nil {
+		return fmt.Errorf("failed to create JSON patch: %w", err)
+	}
+
+	sections := []struct {
+		title string
+		value interface{}
+	}{
+		{title: "Input object", value: json.RawMessage(input)},
+		{title: "Output object", value: json.RawMessage(output)},
+		{title: "Diff (JSON Patch)", value: patch},
+	}
+
+	for _, section := range sections {
+		pretty, err := json.MarshalIndent(section.value, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to format %s: %w", strings.ToLower(section.title), err)
+		}
+		fmt.Fprintf(w, "=== %s ===\n%s\n", section.title, pretty)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"thechat/pkg/luarunner"
+)
+
+func TestPrintScriptStatus(t *testing.T) {
+	runner := luarunner.NewScriptRunner(log.New(io.Discard, "", 0))
+	_, results, err := runner.RunScriptsWithResults(map[string]string{
+		"a-ok.lua":     `object.metadata.labels = {team = "platform"}`,
+		"b-broken.lua": `error("no team given")`,
+	}, []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test"}}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	printScriptStatus(&stderr, results)
+
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a status line per script, got %q", stderr.String())
+	}
+	if !strings.HasPrefix(lines[0], "ok      a-ok.lua (") {
+		t.Errorf("Expected a-ok.lua to be reported ok, got %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "failed  b-broken.lua (") || !strings.Contains(lines[1], "no team given") {
+		t.Errorf("Expected b-broken.lua to be reported failed with its reason, got %q", lines[1])
+	}
+}
+
+func TestExecRunnerOptions_Profiles(t *testing.T) {
+	t.Cleanup(func() { execProfile = profileDev })
+	script := map[string]string{"read.lua": `local fs = require("fs")`}
+	object := []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test"}}`)
+	logger := log.New(io.Discard, "", 0)
+
+	run := func(options luarunner.Options) error {
+		t.Helper()
+		_, results, err := luarunner.NewScriptRunnerWithOptions(logger, options).RunScriptsWithResults(script, object)
+		if err != nil {
+			t.Fatalf("RunScriptsWithResults failed: %v", err)
+		}
+		return results[0].Err
+	}
+
+	execProfile = profileDev
+	options, err := execRunnerOptions(execCmd)
+	if err != nil {
+		t.Fatalf("execRunnerOptions failed: %v", err)
+	}
+	if err := run(options); err != nil {
+		t.Errorf("Expected fs to be available under the dev profile, got %v", err)
+	}
+
+	// The webhook profile fails the script exactly as the server would
+	var server luarunner.Options
+	sandboxOptions(webhookCmd, &server)
+	expected := run(server)
+	if expected == nil {
+		t.Fatal("Expected the server to refuse fs by default")
+	}
+	execProfile = profileWebhook
+	options, err = execRunnerOptions(execCmd)
+	if err != nil {
+		t.Fatalf("execRunnerOptions failed: %v", err)
+	}
+	if err := run(options); err == nil || err.Error() != expected.Error() {
+		t.Errorf("Expected the webhook profile to fail with %q, got %v", expected, err)
+	}
+
+	execProfile = "prod"
+	if _, err := execRunnerOptions(execCmd); err == nil {
+		t.Error("Expected an unknown profile to be rejected")
+	}
+}
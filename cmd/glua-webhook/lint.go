@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+var lintCmd = &cobra.Command{
+	Use:   "lint [FILE...]",
+	Short: "Check Lua scripts for syntax errors",
+	Long: `Parse and compile Lua scripts without running them.
+
+With --annotation, also check values of the scripts annotation, reporting the
+references the webhook would skip, such as "default:my-script" or
+"Default/My-Script".
+
+Every issue is reported with its file and line, annotations being reported
+as the "annotation" file and their position in the flags as the line. The command exits with a
+non-zero status when any script has an issue. With --output=json, the issues
+are printed as a JSON array of {file, line, message} objects.`,
+	Example: `  # Check scripts before creating their ConfigMaps
+  glua-webhook lint examples/scripts/*.lua
+
+  # Machine-readable issues for CI annotations
+  glua-webhook lint --output=json scripts/*.lua
+
+  # Check a scripts annotation before applying the object
+  glua-webhook lint --annotation "default/labels,default/sidecar#10-inject.lua"`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && len(lintAnnotations) == 0 {
+			return fmt.Errorf("requires at least one script file or --annotation")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runLint(cmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// lint command flags
+var lintAnnotations []string
+
+func init() {
+	lintCmd.Flags().StringArrayVar(&lintAnnotations, "annotation", nil, "Value of a scripts annotation to check (repeatable)")
+}
+
+func runLint(cmd *cobra.Command, args []string) error {
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+
+	issues := []luarunner.LintIssue{}
+	for _, file := range args {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read script: %w", err)
+		}
+		issues = append(issues, luarunner.Lint(file, string(content))...)
+	}
+	for i, annotation := range lintAnnotations {
+		_, errs := scriptloader.ParseAnnotationErrors(annotation)
+		for _, err := range errs {
+			issues = append(issues, luarunner.LintIssue{File: "annotation", Line: i + 1, Message: err.Error()})
+		}
+	}
+
+	if outputFormat == outputJSON {
+		if err := writeJSON(os.Stdout, issues); err != nil {
+			return err
+		}
+	} else {
+		for _, issue := range issues {
+			fmt.Printf("%s:%d: %s\n", issue.File, issue.Line, issue.Message)
+		}
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("%d issue(s) found", len(issues))
+	}
+	return nil
+}
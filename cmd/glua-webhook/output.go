@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+// Output formats accepted by --output
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputFormat: value of the global --output flag
+// The exec command keeps its own --output flag, naming the file the result is written to
+var outputFormat string
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", outputText, "Output format of informational commands (text or json)")
+	if err := rootCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{outputText, outputJSON}, cobra.ShellCompDirectiveNoFileComp
+	}); err != nil {
+		panic(fmt.Sprintf("failed to register output flag completion: %v", err))
+	}
+}
+
+// validateOutputFormat: rejects unknown --output values
+func validateOutputFormat() error {
+	switch outputFormat {
+	case outputText, outputJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid --output %q (expected %s or %s)", outputFormat, outputText, outputJSON)
+	}
+}
+
+// writeJSON: prints v as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"thechat/pkg/coverage"
+	"thechat/pkg/render"
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/webhook"
+)
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Show what the mutating webhook would do to a bundle of manifests",
+	Long: `Run every object of a directory of rendered manifests through the mutating
+webhook, offline, and print the mutated manifests or a report of the changes.
+
+Objects are sent as CREATE requests to the same handler as the webhook
+command, so that the scripts annotations, default scripts, ordering, params
+and sandbox flags apply as they would in the cluster. Scripts and params are
+read from the ConfigMaps of the bundle and of --scripts-dir.
+
+Objects that fail to render are reported and printed unchanged, the others are
+rendered regardless. Exits with status 1 when an object was denied or could
+not be rendered.`,
+	Example: `  # Print the manifests as the API server would store them
+  kustomize build overlays/prod > bundle/all.yaml
+  glua-webhook render --manifests bundle/ --scripts-dir scripts/
+
+  # Markdown report of the changes, for a pull request comment
+  glua-webhook render --manifests bundle/ --scripts-dir scripts/ --report`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runRender(cmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// render command flags
+var (
+	renderManifests        string
+	renderScriptsDir       string
+	renderDefaultsFile     string
+	renderDefaultNamespace string
+	renderReport           bool
+)
+
+func init() {
+	addSandboxFlags(renderCmd)
+	renderCmd.Flags().StringVar(&renderManifests, "manifests", "", "Directory or file of the manifests to render (YAML or JSON, required)")
+	renderCmd.Flags().StringVar(&renderScriptsDir, "scripts-dir", "", "Directory or file of the script and params ConfigMaps, along with the ones of the manifests")
+	renderCmd.Flags().StringVar(&renderDefaultsFile, "default-scripts", "", "Default scripts file, as passed to the webhook command")
+	renderCmd.Flags().StringVar(&renderDefaultNamespace, "default-namespace", "default", "Namespace of the ConfigMaps without metadata.namespace")
+	renderCmd.Flags().BoolVar(&renderReport, "report", false, "Print a Markdown report of the changes instead of the manifests")
+	if err := renderCmd.MarkFlagRequired("manifests"); err != nil {
+		panic(fmt.Sprintf("failed to mark manifests flag as required: %v", err))
+	}
+}
+
+func runRender(cmd *cobra.Command, args []string) error {
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+
+	manifests, err := coverage.LoadObjects(renderManifests)
+	if err != nil {
+		return err
+	}
+	var scripts []unstructured.Unstructured
+	if renderScriptsDir != "" {
+		if scripts, err = coverage.LoadObjects(renderScriptsDir); err != nil {
+			return err
+		}
+	}
+
+	options := render.Options{DefaultNamespace: renderDefaultNamespace}
+	sandboxOptions(cmd, &options.HandlerOptions.RunnerOptions)
+	if renderDefaultsFile != "" {
+		if options.HandlerOptions.DefaultScripts, err = scriptloader.LoadDefaultScriptsFile(renderDefaultsFile); err != nil {
+			return fmt.Errorf("failed to load default scripts: %w", err)
+		}
+	}
+	options.HandlerOptions.Filters = webhook.ServerFilters{PreFilters: webhook.DefaultPreFilters()}
+
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	results, err := render.Render(ctx, manifests, scripts, options)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case outputFormat == outputJSON:
+		err = writeJSON(os.Stdout, results)
+	case renderReport:
+		err = render.WriteReport(os.Stdout, results)
+	default:
+		err = render.WriteManifests(os.Stdout, results)
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Failed() {
+			failed++
+			if !renderReport && outputFormat != outputJSON {
+				fmt.Fprintf(os.Stderr, "%s: not rendered: %s%s\n", result.Object, result.Message, result.Error)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects denied or not rendered", failed, len(results))
+	}
+	return nil
+}
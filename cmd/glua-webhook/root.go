@@ -16,11 +16,19 @@ The primary use case is running as a webhook server that processes admission
 requests from the Kubernetes API server. Scripts are stored in ConfigMaps and
 referenced via annotations on resources.
 
-The 'exec' command allows testing scripts locally before deploying them.`,
+The 'exec' command allows testing scripts locally before deploying them.
+
+Shell completion scripts are printed by 'completion bash|zsh|fish'.`,
 }
 
 func init() {
+	rootCmd.AddCommand(coverageCmd)
 	rootCmd.AddCommand(execCmd)
+	rootCmd.AddCommand(lintCmd)
+	rootCmd.AddCommand(renderCmd)
+	rootCmd.AddCommand(selftestCmd)
+	rootCmd.AddCommand(stubsCmd)
+	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(webhookCmd)
 }
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"thechat/pkg/luarunner"
+)
+
+var selftestHTTPURL string
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Check that every Lua module behaves as configured",
+	Long: `Run a script exercising each Lua module with the sandbox flags of the
+webhook (--allowed-modules, --safe-mode, --scripts-data-dir, --http-*), and
+report whether each behaves as configured: enabled modules must work,
+disabled ones must fail to load.
+
+The http module only reaches out when --http-url is given, the request then
+goes through the same host, method and size limits as in the webhook. The
+cluster module needs an API server and is not checked.
+
+Exits with status 1 when a module does not behave as configured.`,
+	Example: `  # Check the environment of a webhook running in safe mode
+  glua-webhook selftest --safe-mode
+
+  # Also check that scripts can reach an internal service
+  glua-webhook selftest --http-allowed-hosts '*.corp.example.com' --http-url https://api.corp.example.com/healthz`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runSelftest(cmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	addSandboxFlags(selftestCmd)
+	selftestCmd.Flags().StringVar(&selftestHTTPURL, "http-url", "", "URL the http module fetches, the http module is only loaded when empty")
+}
+
+func runSelftest(cmd *cobra.Command, args []string) error {
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+
+	var options luarunner.Options
+	sandboxOptions(cmd, &options)
+	runner := luarunner.NewScriptRunnerWithOptions(log.New(io.Discard, "", 0), options)
+	results := runner.SelfTest(context.Background(), selftestHTTPURL)
+
+	failed := 0
+	for _, result := range results {
+		if !result.Passed {
+			failed++
+		}
+	}
+
+	if outputFormat == outputJSON {
+		if err := writeJSON(os.Stdout, results); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MODULE\tSTATE\tRESULT")
+		for _, result := range results {
+			state, outcome := "enabled", "pass"
+			if !result.Enabled {
+				state = "disabled"
+			}
+			if !result.Passed {
+				outcome = "FAIL: " + result.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", result.Module, state, outcome)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d modules did not behave as configured", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"thechat/pkg/luarunner"
+)
+
+var stubsOutputDir string
+
+var stubsCmd = &cobra.Command{
+	Use:   "stubs",
+	Short: "Print LuaLS definitions of the built-in Lua libraries",
+	Long: `Print lua-language-server definitions of the Lua libraries shipped with the
+webhook (k8s.podspec, k8s.policy), for autocompletion and type checking of
+scripts requiring them.
+
+With --output-dir, every library is written to its own <module>.lua file in
+the directory, ready to be added to the workspace.library setting. With
+--output=json, the definitions are printed as a JSON object keyed by module.`,
+	Example: `  # Write the definitions next to the Kubernetes type annotations
+  glua-webhook stubs --output-dir annotations
+
+  # Print them
+  glua-webhook stubs`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runStubs(cmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	stubsCmd.Flags().StringVar(&stubsOutputDir, "output-dir", "", "Directory to write one definition file per library into, instead of printing them")
+}
+
+func runStubs(cmd *cobra.Command, args []string) error {
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+
+	stubs := luarunner.EmbeddedLibraryStubs()
+	if outputFormat == outputJSON && stubsOutputDir == "" {
+		return writeJSON(os.Stdout, stubs)
+	}
+
+	names := make([]string, 0, len(stubs))
+	for name := range stubs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if stubsOutputDir == "" {
+		for i, name := range names {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Print(stubs[name])
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(stubsOutputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	for _, name := range names {
+		path := filepath.Join(stubsOutputDir, name+".lua")
+		if err := os.WriteFile(path, []byte(stubs[name]), 0644); err != nil {
+			return fmt.Errorf("failed to write stubs: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// version: set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version of glua-webhook",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runVersion(cmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runVersion(cmd *cobra.Command, args []string) error {
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+
+	if outputFormat == outputJSON {
+		return writeJSON(os.Stdout, map[string]string{
+			"version":   version,
+			"goVersion": runtime.Version(),
+			"platform":  runtime.GOOS + "/" + runtime.GOARCH,
+		})
+	}
+
+	fmt.Printf("glua-webhook %s (%s, %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
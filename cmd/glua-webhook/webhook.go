@@ -1,17 +1,23 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 
+	"thechat/pkg/cluster"
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/server"
+	"thechat/pkg/tracing"
 	"thechat/pkg/webhook"
 )
 
@@ -37,8 +43,75 @@ var (
 	webhookCert           string
 	webhookKey            string
 	webhookKubeconfig     string
+	webhookTokenFile      string
+	webhookReadyzSkipAPI  bool
 	webhookMutatingPath   string
 	webhookValidatingPath string
+	webhookScriptCacheTTL time.Duration
+	webhookMaxStaleness   time.Duration
+	webhookScriptKeys     []string
+	webhookKindKeys       bool
+	webhookEnableDebug    bool
+	webhookStrictDecoding bool
+	webhookStrictAnnots   bool
+	webhookSecretData     bool
+	webhookConsistency    bool
+	webhookInjectedAnnot  string
+	webhookLogFormat      string
+	webhookLogLevel       string
+	webhookResponseTTL    time.Duration
+	webhookMaxInFlight    int
+	webhookShedWait       time.Duration
+	webhookShedFailure    string
+	webhookWatchScripts   bool
+	webhookAllowedModules []string
+	webhookDefaultsFile   string
+	webhookDefaultsCM     string
+	webhookSkipNamespaces []string
+	webhookOnlyKinds      []string
+	webhookPreFilters     []string
+	webhookMatchConds     string
+	webhookNamespaceTTL   time.Duration
+	webhookBestEffort     bool
+	webhookRejectDupes    bool
+	webhookPreserveOrder  bool
+	webhookTimeout        time.Duration
+	webhookScriptTimeout  time.Duration
+	webhookMaxConversion  time.Duration
+	webhookNoCPUTime      bool
+	webhookBudgetFailure  string
+	webhookSafeMode       bool
+	webhookDataDir        string
+	webhookNoRemove       string
+	webhookMetadataOnly   bool
+	webhookSubResources   bool
+	webhookShadowScripts  string
+	webhookShadowTimeout  time.Duration
+	webhookPatchGen       string
+	webhookComparePatches bool
+	webhookMaxRequest     int64
+	webhookCopyTemplate   bool
+	webhookOTelEndpoint   string
+	webhookHTTPHosts      []string
+	webhookHTTPMethods    []string
+	webhookHTTPTimeout    time.Duration
+	webhookHTTPMaxBytes   int64
+	webhookHTTPMaxCalls   int
+	webhookMaxDepth       int
+	webhookAuditLogs      bool
+	webhookAuditSinkURL   string
+	webhookAuditEntries   int
+	webhookValidateSource string
+	webhookScriptLabel    string
+	webhookDefaultParams  string
+	webhookSkipUsers      []string
+	webhookChangeSummary  bool
+	webhookAppliedScripts bool
+	webhookApplyDefaults  bool
+	webhookTrackGen       bool
+
+	webhookEnableMutating   bool
+	webhookEnableValidation bool
 )
 
 func init() {
@@ -46,84 +119,263 @@ func init() {
 	webhookCmd.Flags().StringVar(&webhookCert, "cert", "/etc/webhook/certs/tls.crt", "TLS certificate file")
 	webhookCmd.Flags().StringVar(&webhookKey, "key", "/etc/webhook/certs/tls.key", "TLS key file")
 	webhookCmd.Flags().StringVar(&webhookKubeconfig, "kubeconfig", "", "Path to kubeconfig file (leave empty for in-cluster)")
+	webhookCmd.Flags().StringVar(&webhookTokenFile, "token-file", "", "Bearer token file (e.g. a ServiceAccount token) used instead of the kubeconfig credentials, re-read as it rotates")
+	webhookCmd.Flags().BoolVar(&webhookReadyzSkipAPI, "readyz-skip-apiserver", false, "Answer /readyz ready without checking the API server, to keep serving stale cached scripts (--max-staleness) while it is down")
 	webhookCmd.Flags().StringVar(&webhookMutatingPath, "mutating-path", "/mutate", "Path for mutating webhook")
 	webhookCmd.Flags().StringVar(&webhookValidatingPath, "validating-path", "/validate", "Path for validating webhook")
+	webhookCmd.Flags().BoolVar(&webhookEnableMutating, "enable-mutating", true, "Enable mutating webhook endpoint")
+	webhookCmd.Flags().BoolVar(&webhookEnableValidation, "enable-validation", true, "Enable validating webhook endpoint")
+	webhookCmd.Flags().DurationVar(&webhookScriptCacheTTL, "script-cache-ttl", 0, "How long loaded scripts are cached before their ConfigMap is fetched again (0 disables caching)")
+	webhookCmd.Flags().DurationVar(&webhookMaxStaleness, "max-staleness", 0, "How old a cached script may be when served because the API server is unreachable (0 disables stale serving)")
+	webhookCmd.Flags().BoolVar(&webhookRejectDupes, "reject-duplicate-scripts", false, "Deny objects whose scripts annotations reference a script more than once, instead of running it once")
+	webhookCmd.Flags().BoolVar(&webhookBestEffort, "best-effort-scripts", false, "Skip script references whose ConfigMap cannot be loaded instead of failing the request")
+	webhookCmd.Flags().StringSliceVar(&webhookScriptKeys, "script-keys", scriptloader.DefaultKeySearchOrder, "ConfigMap keys searched in order when a script reference has no explicit #key")
+	webhookCmd.Flags().BoolVar(&webhookKindKeys, "kind-script-keys", false, "Search the key named after the kind of the object, lowercased (e.g. pod.lua), before --script-keys")
+	webhookCmd.Flags().IntVar(&webhookMaxInFlight, "max-in-flight", 0, "Admission requests processed at once by each webhook, others are shed once --shed-wait elapses (0 = unlimited)")
+	webhookCmd.Flags().DurationVar(&webhookShedWait, "shed-wait", webhook.DefaultShedWait, "How long a request waits for an in-flight slot before being shed")
+	webhookCmd.Flags().StringVar(&webhookShedFailure, "shed-failure-mode", webhook.FailureModeDeny, "What to do with shed requests: allow (as-is, with a warning) or deny (503, the failurePolicy applies)")
+	webhookCmd.Flags().DurationVar(&webhookResponseTTL, "response-cache-ttl", 0, "How long the response to a request is reused for identical requests run through identical scripts (0 = disabled)")
+	webhookCmd.Flags().StringVar(&webhookLogFormat, "log-format", "text", "Format of the server logs: text or json")
+	webhookCmd.Flags().StringVar(&webhookLogLevel, "log-level", "info", "Level of the server logs: debug, info, warn or error. At info, each request logs a single summary line")
+	webhookCmd.Flags().BoolVar(&webhookEnableDebug, "enable-debug", false, "Enable debug endpoints that modify server state (script, compiled script, response and namespace cache flush)")
+	webhookCmd.Flags().Int64Var(&webhookMaxRequest, "max-request-bytes", webhook.DefaultMaxRequestBytes, "Largest admission request body, checked before and after gzip decompression")
+	webhookCmd.Flags().BoolVar(&webhookStrictDecoding, "strict-decoding", false, "Reject request bodies containing anything after the AdmissionReview JSON document")
+	webhookCmd.Flags().BoolVar(&webhookWatchScripts, "watch-configmaps", false, "Watch ConfigMaps and invalidate cached scripts as soon as they change")
+	addSandboxFlags(webhookCmd)
+	webhookCmd.Flags().StringVar(&webhookDefaultsFile, "default-scripts-file", "", "YAML file mapping GroupVersionKinds to scripts run for every object of that kind")
+	webhookCmd.Flags().StringSliceVar(&webhookSkipNamespaces, "skip-namespaces", nil, "Namespaces whose objects are allowed without running any script")
+	webhookCmd.Flags().StringSliceVar(&webhookOnlyKinds, "only-kinds", nil, "Kinds processed by the server (default: all kinds)")
+	webhookCmd.Flags().StringSliceVar(&webhookPreFilters, "pre-filters", webhook.DefaultPreFilterExpressions, "Conditions allowing matching objects without loading any script, as [Kind:]path[=|!=value] (empty to disable)")
+	webhookCmd.Flags().StringVar(&webhookMatchConds, "match-conditions", "", "YAML file of CEL matchConditions requests must all meet for scripts to run, for clusters not evaluating them")
+	webhookCmd.Flags().DurationVar(&webhookNamespaceTTL, "namespace-cache-ttl", cluster.DefaultNamespaceTTL, "How long namespaces looked up by scripts are reused across requests (negative disables)")
+	webhookCmd.Flags().BoolVar(&webhookPreserveOrder, "preserve-key-order", false, "Make pairs() iterate over object fields in their original JSON order")
+	webhookCmd.Flags().DurationVar(&webhookTimeout, "handler-timeout", 0, "Latency budget of a request, remaining scripts are skipped once it cannot cover them (0 disables)")
+	webhookCmd.Flags().DurationVar(&webhookScriptTimeout, "script-timeout", 0, "Maximum run time of a single script (0 disables)")
+	webhookCmd.Flags().DurationVar(&webhookMaxConversion, "max-conversion-time", 0, "Maximum time an object may take to convert to or from Lua, scripts fail beyond it (0 disables)")
+	webhookCmd.Flags().BoolVar(&webhookNoCPUTime, "disable-cpu-time", false, "Do not lock scripts to their OS thread to measure the CPU time they consume, report their wall time instead")
+	webhookCmd.Flags().StringVar(&webhookBudgetFailure, "budget-failure-mode", webhook.FailureModeAllow, "What to do once the latency budget is exhausted: allow (keep mutations made so far) or deny")
+	webhookCmd.Flags().IntVar(&webhookMaxDepth, "max-depth", luarunner.DefaultMaxDepth, "Deepest nesting of the object a script may leave, deeper or cyclic structures fail the script")
+	webhookCmd.Flags().StringVar(&webhookNoRemove, "no-remove", "", "Forbid scripts to remove fields: reject the request, or drop the removals from the patch (--no-remove=drop)")
+	webhookCmd.Flags().BoolVar(&webhookMetadataOnly, "metadata-only", false, "Drop every change scripts make outside metadata from the patch, with a warning")
+	webhookCmd.Flags().BoolVar(&webhookSubResources, "process-subresources", false, "Run scripts against the Eviction, Binding, Scale or TokenRequest of subresource requests instead of allowing them as-is")
+	webhookCmd.Flags().StringVar(&webhookShadowScripts, "shadow-scripts", "", "Scripts (namespace/name[#key], comma-separated) run in the shadow of the scripts of objects without the '"+webhook.AnnotationShadowScripts+"' annotation, their diverging outcomes logged and counted")
+	webhookCmd.Flags().DurationVar(&webhookShadowTimeout, "shadow-timeout", webhook.DefaultShadowTimeout, "Time shadow scripts are given to complete, they are not compared beyond it")
+	webhookCmd.Flags().StringVar(&webhookPatchGen, "patch-generator", webhook.PatchGeneratorDiff, "How patches of mutated objects are built: diff (an RFC 6902 operation per changed field) or replace (each changed top-level field as a whole)")
+	webhookCmd.Flags().BoolVar(&webhookComparePatches, "compare-patch-generators", false, "Build patches with both generators, logging and counting the objects the diff patch would not mutate as the scripts did")
+	webhookCmd.Flags().Lookup("no-remove").NoOptDefVal = webhook.RemoveModeReject
+	webhookCmd.Flags().BoolVar(&webhookStrictAnnots, "strict-annotations", false, "Deny objects whose scripts annotations hold malformed references instead of warning about them")
+	webhookCmd.Flags().BoolVar(&webhookSecretData, "allow-secret-data", false, "Let scripts read and write Secret data in plaintext through the k8s.secret module")
+	webhookCmd.Flags().StringVar(&webhookInjectedAnnot, "injected-annotation", "", "Annotation marking objects already injected, which the mutating webhook leaves alone (empty = disabled)")
+	webhookCmd.Flags().BoolVar(&webhookConsistency, "check-consistency", false, "Run the mutating scripts again against the object they mutated, warning when one of them would deny it")
+	webhookCmd.Flags().BoolVar(&webhookCopyTemplate, "copy-annotation-to-template", false, "Copy the scripts annotation of Deployments, StatefulSets, DaemonSets and Jobs to their pod template when only their metadata has it")
+	webhookCmd.Flags().StringVar(&webhookOTelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint to export OpenTelemetry traces of admission requests to, such as http://otel-collector:4318 (empty disables tracing)")
+	webhookCmd.Flags().BoolVar(&webhookAuditLogs, "audit-script-logs", false, "Write messages logged by scripts into the '"+webhook.AuditAnnotationScriptLog+"' audit annotation, and the version of the scripts run into the '"+webhook.AuditAnnotationScriptVersions+"' one")
+	webhookCmd.Flags().IntVar(&webhookAuditEntries, "audit-max-entries", webhook.DefaultAuditMaxEntries, "Script log entries kept per request in the audit annotation")
+	webhookCmd.Flags().StringVar(&webhookAuditSinkURL, "audit-sink-url", "", "Ship the patch of every mutation, with its request UID, object and scripts, to this http(s) URL as a JSON POST or to a file:// URL as a JSON line, asynchronously")
+	webhookCmd.Flags().StringVar(&webhookValidateSource, "validation-source", webhook.ValidationSourceRequest, "Object validating scripts run against: request (as received) or mutated (after running the scripts as the mutating webhook would)")
+	webhookCmd.Flags().StringVar(&webhookScriptLabel, "script-label", scriptloader.LabelScript, "Label (set to \"true\") marking ConfigMaps whose scripts are compiled on admission, denying them on syntax errors")
+	webhookCmd.Flags().BoolVar(&webhookApplyDefaults, "apply-defaults", false, "Set the fields the API server defaults on Pods, workloads and Services before running scripts, the patch only holds what scripts changed")
+	webhookCmd.Flags().BoolVar(&webhookTrackGen, "track-generation", false, "Record the generation mutated in the '"+webhook.AnnotationProcessedGeneration+"' annotation and skip mutating a generation already processed")
+	webhookCmd.Flags().BoolVar(&webhookChangeSummary, "change-summary", false, "Write the '"+webhook.AnnotationChangeSummary+"' annotation, a JSON list of the paths scripts changed and the scripts responsible, on mutated objects")
+	webhookCmd.Flags().BoolVar(&webhookAppliedScripts, "applied-scripts", false, "Write the '"+webhook.AnnotationAppliedScripts+"' annotation, a JSON list of the scripts that ran with the hash and ConfigMap resourceVersion of their content, on mutated objects")
+	webhookCmd.Flags().StringSliceVar(&webhookSkipUsers, "skip-allowed-users", nil, "Users allowed to bypass the scripts with the '"+webhook.AnnotationSkip+"' annotation (default: anyone)")
+	webhookCmd.Flags().StringVar(&webhookDefaultParams, "default-params", "", "ConfigMap (namespace/name) exposed to scripts as the params global for objects without the '"+scriptloader.AnnotationParams+"' annotation")
+	webhookCmd.Flags().StringVar(&webhookDefaultsCM, "default-scripts-configmap", "", "ConfigMap (namespace/name) holding the default scripts configuration under the '"+scriptloader.DefaultScriptsKey+"' key")
+}
+
+// addSandboxFlags: registers the flags restricting what scripts may reach, shared by the commands
+// running scripts with the webhook configuration
+func addSandboxFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&webhookAllowedModules, "allowed-modules", nil, "Modules scripts may require (default: all built-in modules)")
+	cmd.Flags().BoolVar(&webhookSafeMode, "safe-mode", false, "Never load the fs, http and cluster modules and strip dofile, loadfile, io and os.execute-like functions from scripts")
+	cmd.Flags().StringVar(&webhookDataDir, "scripts-data-dir", "", "Read-only directory the fs module is confined to, scripts read mounted reference data from it (fs is disabled when empty)")
+	cmd.Flags().StringSliceVar(&webhookHTTPHosts, "http-allowed-hosts", nil, "Host globs (*.example.com) or domains (.example.com) the http module may reach, requests and redirects to other hosts are refused, every host when empty")
+	cmd.Flags().StringSliceVar(&webhookHTTPMethods, "http-allowed-methods", []string{http.MethodGet}, "HTTP methods the http module may use, every method when empty")
+	cmd.Flags().DurationVar(&webhookHTTPTimeout, "http-timeout", 5*time.Second, "Maximum duration of a request of the http module (0 disables)")
+	cmd.Flags().Int64Var(&webhookHTTPMaxBytes, "http-max-response-bytes", 1<<20, "Largest response body the http module reads, larger responses fail the request (0 disables)")
+	cmd.Flags().IntVar(&webhookHTTPMaxCalls, "http-max-calls", 10, "Requests the scripts of an admission request may make through the http module together (0 disables)")
+}
+
+// sandboxOptions: applies the sandbox flags registered by addSandboxFlags to runner options
+func sandboxOptions(cmd *cobra.Command, options *luarunner.Options) {
+	options.SafeMode = webhookSafeMode
+	// Files of the machine running exec do not exist in the cluster, scripts only get the data directory
+	options.FSRoot = webhookDataDir
+	options.DisableFS = webhookDataDir == ""
+	options.HTTP = luarunner.HTTPPolicy{
+		AllowedHosts:     webhookHTTPHosts,
+		AllowedMethods:   webhookHTTPMethods,
+		Timeout:          webhookHTTPTimeout,
+		MaxResponseBytes: webhookHTTPMaxBytes,
+		MaxCalls:         webhookHTTPMaxCalls,
+	}
+	if cmd.Flags().Changed("allowed-modules") {
+		options.Allowlist = webhookAllowedModules
+	}
 }
 
 func runWebhook(cmd *cobra.Command, args []string) {
 	// Set up logging
 	logger := log.New(os.Stdout, "[glua-webhook] ", log.LstdFlags|log.Lshortfile)
 	logger.Printf("Starting glua-webhook in webhook mode")
-	logger.Printf("Mutating webhook path: %s", webhookMutatingPath)
-	logger.Printf("Validating webhook path: %s", webhookValidatingPath)
+	if webhookEnableMutating {
+		logger.Printf("Mutating webhook path: %s", webhookMutatingPath)
+	}
+	if webhookEnableValidation {
+		logger.Printf("Validating webhook path: %s", webhookValidatingPath)
+	}
 	logger.Printf("Server port: %d", webhookPort)
 
-	// Create Kubernetes clientset
-	var config *rest.Config
-	var err error
-
-	if webhookKubeconfig != "" {
-		logger.Printf("Using kubeconfig file: %s", webhookKubeconfig)
-		config, err = clientcmd.BuildConfigFromFlags("", webhookKubeconfig)
-	} else {
-		logger.Printf("Using in-cluster configuration")
-		config, err = rest.InClusterConfig()
+	preFilters, err := webhook.ParsePreFilters(webhookPreFilters)
+	if err != nil {
+		logger.Fatalf("Invalid pre-filters: %v", err)
 	}
 
-	if err != nil {
-		logger.Fatalf("Failed to create Kubernetes config: %v", err)
+	var matchConditions []webhook.MatchCondition
+	if webhookMatchConds != "" {
+		matchConditions, err = webhook.LoadMatchConditions(webhookMatchConds)
+		if err != nil {
+			logger.Fatalf("Invalid match conditions: %v", err)
+		}
+		logger.Printf("Loaded %d match conditions from %s", len(matchConditions), webhookMatchConds)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	summaryLogger, err := newSlogLogger(webhookLogFormat, webhookLogLevel)
 	if err != nil {
-		logger.Fatalf("Failed to create Kubernetes clientset: %v", err)
+		logger.Fatalf("Invalid logging configuration: %v", err)
 	}
 
-	logger.Printf("Successfully connected to Kubernetes API")
-
-	// Create webhook handlers
-	mutatingHandler := webhook.NewWebhookHandler(clientset, logger, "mutating")
-	validatingHandler := webhook.NewWebhookHandler(clientset, logger, "validating")
+	config := server.DefaultConfig()
+	config.Port = webhookPort
+	config.CertFile = webhookCert
+	config.KeyFile = webhookKey
+	config.Kubeconfig = webhookKubeconfig
+	config.TokenFile = webhookTokenFile
+	config.ReadyzSkipAPIServer = webhookReadyzSkipAPI
+	config.MutatingPath = webhookMutatingPath
+	config.ValidatingPath = webhookValidatingPath
+	config.EnableMutating = webhookEnableMutating
+	config.EnableValidation = webhookEnableValidation
+	config.EnableDebug = webhookEnableDebug
+	config.WatchConfigMaps = webhookWatchScripts
+	config.DefaultScriptsFile = webhookDefaultsFile
+	config.DefaultScriptsConfigMap = webhookDefaultsCM
+	config.ClusterOptions = cluster.Options{
+		NamespaceTTL: webhookNamespaceTTL,
+	}
+	config.Logger = server.LevelLogger(summaryLogger)
 
-	// Set up HTTP server
-	mux := http.NewServeMux()
-	mux.Handle(webhookMutatingPath, mutatingHandler)
-	mux.Handle(webhookValidatingPath, validatingHandler)
+	config.HandlerOptions = webhook.HandlerOptions{
+		LoaderOptions: scriptloader.Options{
+			CacheTTL:         webhookScriptCacheTTL,
+			MaxStaleness:     webhookMaxStaleness,
+			KeySearchOrder:   webhookScriptKeys,
+			KindKeys:         webhookKindKeys,
+			BestEffort:       webhookBestEffort,
+			RejectDuplicates: webhookRejectDupes,
+		},
+		StrictDecoding:           webhookStrictDecoding,
+		MaxRequestBytes:          webhookMaxRequest,
+		AuditScriptLogs:          webhookAuditLogs,
+		AuditMaxEntries:          webhookAuditEntries,
+		Timeout:                  webhookTimeout,
+		BudgetFailureMode:        webhookBudgetFailure,
+		ValidationSource:         webhookValidateSource,
+		ScriptLabel:              webhookScriptLabel,
+		DefaultParams:            webhookDefaultParams,
+		SkipAllowedUsers:         webhookSkipUsers,
+		ChangeSummary:            webhookChangeSummary,
+		AppliedScripts:           webhookAppliedScripts,
+		ApplyDefaults:            webhookApplyDefaults,
+		TrackGeneration:          webhookTrackGen,
+		RemoveMode:               webhookNoRemove,
+		MetadataOnly:             webhookMetadataOnly,
+		ProcessSubResources:      webhookSubResources,
+		ShadowScripts:            webhookShadowScripts,
+		ShadowTimeout:            webhookShadowTimeout,
+		PatchGenerator:           webhookPatchGen,
+		ComparePatchGenerators:   webhookComparePatches,
+		CopyAnnotationToTemplate: webhookCopyTemplate,
+		StrictAnnotations:        webhookStrictAnnots,
+		AllowSecretData:          webhookSecretData,
+		CheckConsistency:         webhookConsistency,
+		InjectedAnnotation:       webhookInjectedAnnot,
+		SummaryLogger:            summaryLogger,
+		ResponseCacheTTL:         webhookResponseTTL,
+		MaxInFlight:              webhookMaxInFlight,
+		ShedWait:                 webhookShedWait,
+		ShedFailureMode:          webhookShedFailure,
+		Filters: webhook.ServerFilters{
+			SkipNamespaces:  webhookSkipNamespaces,
+			OnlyKinds:       webhookOnlyKinds,
+			PreFilters:      preFilters,
+			MatchConditions: matchConditions,
+		},
+	}
+	var sink *webhook.AuditSink
+	if webhookAuditSinkURL != "" {
+		var err error
+		sink, err = webhook.NewAuditSink(webhookAuditSinkURL, logger)
+		if err != nil {
+			logger.Fatalf("Failed to set up the audit sink: %v", err)
+		}
+		config.HandlerOptions.AuditSink = sink
+	}
+	config.HandlerOptions.RunnerOptions.PreserveKeyOrder = webhookPreserveOrder
+	config.HandlerOptions.RunnerOptions.ScriptTimeout = webhookScriptTimeout
+	config.HandlerOptions.RunnerOptions.MaxConversionTime = webhookMaxConversion
+	config.HandlerOptions.RunnerOptions.DisableCPUTime = webhookNoCPUTime
+	config.HandlerOptions.RunnerOptions.MaxDepth = webhookMaxDepth
+	sandboxOptions(cmd, &config.HandlerOptions.RunnerOptions)
+	if webhookDataDir != "" {
+		logger.Printf("The fs module is confined to %s, read-only", webhookDataDir)
+	}
+	if webhookSafeMode {
+		logger.Printf("Safe mode enabled: fs, http and cluster modules and host access functions are unavailable to scripts")
+	}
+	if cmd.Flags().Changed("allowed-modules") {
+		logger.Printf("Allowed modules: %v", webhookAllowedModules)
+	}
 
-	// Health check endpoint
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, "ok")
-	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Readiness check endpoint
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, "ready")
-	})
+	shutdownTracing, err := tracing.Setup(ctx, webhookOTelEndpoint)
+	if err != nil {
+		logger.Fatalf("Failed to set up tracing: %v", err)
+	}
+	if webhookOTelEndpoint != "" {
+		logger.Printf("Exporting traces to %s", webhookOTelEndpoint)
+	}
 
-	logger.Printf("Registered handlers:")
-	logger.Printf("  - %s (mutating webhook)", webhookMutatingPath)
-	logger.Printf("  - %s (validating webhook)", webhookValidatingPath)
-	logger.Printf("  - /healthz (health check)")
-	logger.Printf("  - /readyz (readiness check)")
+	runErr := server.Run(ctx, config)
 
-	// Configure TLS
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+	// Flush the traces and the audit entries still queued before logger.Fatalf exits the process
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Printf("WARNING: Failed to flush traces: %v", err)
 	}
-
-	server := &http.Server{
-		Addr:      fmt.Sprintf(":%d", webhookPort),
-		Handler:   mux,
-		TLSConfig: tlsConfig,
+	if sink != nil {
+		sink.Close()
 	}
+	if runErr != nil {
+		logger.Fatalf("Server failed: %v", runErr)
+	}
+}
 
-	logger.Printf("Starting HTTPS server on port %d", webhookPort)
-	logger.Printf("Using TLS certificate: %s", webhookCert)
-	logger.Printf("Using TLS key: %s", webhookKey)
+// newSlogLogger: returns the structured logger of the server, writing to stdout in format at level
+func newSlogLogger(format, level string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
 
-	if err := server.ListenAndServeTLS(webhookCert, webhookKey); err != nil {
-		logger.Fatalf("Failed to start server: %v", err)
+	options := &slog.HandlerOptions{Level: minLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be text or json", format)
 	}
 }
@@ -1,7 +1,8 @@
 -- add-label.lua: Adds processing labels to any resource
 
-object.metadata = object.metadata or {}
-object.metadata.labels = object.metadata.labels or {}
+local helpers = require("helpers")
 
-object.metadata.labels["glua.maurice.fr/processed"] = "true"
-object.metadata.labels["glua.maurice.fr/timestamp"] = os.date("%Y-%m-%dT%H:%M:%SZ")
+local labels = helpers.ensure(object, "metadata.labels")
+
+labels["glua.maurice.fr/processed"] = "true"
+labels["glua.maurice.fr/timestamp"] = os.date("%Y-%m-%dT%H:%M:%SZ")
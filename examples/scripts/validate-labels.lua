@@ -1,15 +1,10 @@
 -- validate-labels.lua: Validates required labels are present
 
-local required_labels = {"app", "env"}
+local policy = require("k8s.policy")
 
-if not object.metadata or not object.metadata.labels then
-	error("Resource must have labels")
-end
-
-for _, label in ipairs(required_labels) do
-	if not object.metadata.labels[label] or object.metadata.labels[label] == "" then
-		error("Required label '" .. label .. "' is missing")
-	end
+local ok, message = policy.require_labels(object, {"app", "env"})
+if not ok then
+	deny_invalid(message)
 end
 
 print("All required labels present")
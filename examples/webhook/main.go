@@ -1,6 +1,7 @@
 // Package main implements a complete, production-ready example webhook using glua-webhook.
 //
 // This example demonstrates:
+//   - Embedding the complete webhook server of pkg/server
 //   - Full webhook server setup with proper TLS configuration
 //   - Comprehensive error handling and logging
 //   - Script execution with all available glua modules
@@ -29,18 +30,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
-	"thechat/pkg/webhook"
+	"thechat/pkg/server"
 )
 
 var (
@@ -78,10 +77,6 @@ func main() {
 	logger := log.New(os.Stdout, "[webhook-example] ", log.LstdFlags)
 
 	logger.Printf("Starting glua-webhook example server on port %d", port)
-	logger.Printf("Mutating endpoint: %s", mutatingPath)
-	if enableValidation {
-		logger.Printf("Validating endpoint: %s", validatingPath)
-	}
 
 	// Create Kubernetes client
 	clientset, err := createKubernetesClient()
@@ -89,71 +84,32 @@ func main() {
 		logger.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
 
-	// Create webhook handlers
-	mutatingHandler := webhook.NewWebhookHandler(clientset, logger, "mutating")
-	var validatingHandler *webhook.WebhookHandler
-	if enableValidation {
-		validatingHandler = webhook.NewWebhookHandler(clientset, logger, "validating")
-	}
-
-	// Setup HTTP mux
-	mux := http.NewServeMux()
-
-	// Register webhook endpoints
-	mux.Handle(mutatingPath, mutatingHandler)
-	if enableValidation {
-		mux.Handle(validatingPath, validatingHandler)
-	}
-
-	// Register health check endpoints
-	mux.HandleFunc("/healthz", healthzHandler)
-	mux.HandleFunc("/readyz", readyzHandler(clientset))
-
 	// Configure TLS
 	tlsConfig, err := loadTLSConfig()
 	if err != nil {
 		logger.Fatalf("Failed to load TLS configuration: %v", err)
 	}
 
-	// Create HTTPS server with production-ready settings
-	server := &http.Server{
-		Addr:           fmt.Sprintf(":%d", port),
-		Handler:        mux,
-		TLSConfig:      tlsConfig,
-		ReadTimeout:    time.Duration(readTimeoutSec) * time.Second,
-		WriteTimeout:   time.Duration(writeTimeoutSec) * time.Second,
-		MaxHeaderBytes: maxHeaderBytes,
-		ErrorLog:       logger,
-	}
-
-	// Setup graceful shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-
-	// Start server in goroutine
-	go func() {
-		logger.Printf("Server listening on https://0.0.0.0:%d", port)
-		logger.Printf("TLS certificate: %s", certFile)
-		logger.Printf("TLS key: %s", keyFile)
-
-		if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
-			logger.Fatalf("Failed to start server: %v", err)
-		}
-	}()
-
-	// Wait for interrupt signal
-	<-stop
-	logger.Println("Shutting down server gracefully...")
-
-	// Create shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeout)*time.Second)
-	defer cancel()
-
-	// Attempt graceful shutdown
-	if err := server.Shutdown(ctx); err != nil {
-		logger.Printf("Server forced to shutdown: %v", err)
-	} else {
-		logger.Println("Server stopped gracefully")
+	// Configure the server with production-ready settings
+	config := server.DefaultConfig()
+	config.Port = port
+	config.Clientset = clientset
+	config.TLSConfig = tlsConfig
+	config.MutatingPath = mutatingPath
+	config.ValidatingPath = validatingPath
+	config.EnableValidation = enableValidation
+	config.ReadTimeout = time.Duration(readTimeoutSec) * time.Second
+	config.WriteTimeout = time.Duration(writeTimeoutSec) * time.Second
+	config.MaxHeaderBytes = maxHeaderBytes
+	config.ShutdownTimeout = time.Duration(shutdownTimeout) * time.Second
+	config.Logger = logger
+
+	// Serve until interrupted, then shut down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := server.Run(ctx, config); err != nil {
+		logger.Fatalf("Server failed: %v", err)
 	}
 }
 
@@ -214,29 +170,10 @@ func loadTLSConfig() (*tls.Config, error) {
 // healthzHandler handles liveness probe requests.
 //
 // Always returns 200 OK if the server is running.
-func healthzHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("ok"))
-}
+var healthzHandler = server.HealthzHandler
 
 // readyzHandler handles readiness probe requests.
 //
 // Checks if the Kubernetes API server is accessible.
 // Returns 200 OK if ready, 503 Service Unavailable if not ready.
-func readyzHandler(clientset kubernetes.Interface) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-
-		// Try to list namespaces as a readiness check
-		_, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{Limit: 1})
-		if err != nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			_, _ = w.Write([]byte(fmt.Sprintf("not ready: %v", err)))
-			return
-		}
-
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ready"))
-	}
-}
+var readyzHandler = server.APIServerReadyzHandler
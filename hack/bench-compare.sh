@@ -0,0 +1,65 @@
+#!/usr/bin/env bash
+# bench-compare.sh: compares two `go test -bench -benchmem` outputs and flags regressions
+#
+# Usage: hack/bench-compare.sh OLD NEW [THRESHOLD_PERCENT]
+#
+# Prints ns/op, B/op and allocs/op of every benchmark found in both files and exits
+# with status 1 when any of them grew by more than THRESHOLD_PERCENT (default 20).
+# Benchmarks run several times (-count) are averaged.
+set -euo pipefail
+
+if [ $# -lt 2 ]; then
+	echo "Usage: $0 OLD NEW [THRESHOLD_PERCENT]" >&2
+	exit 2
+fi
+
+old=$1
+new=$2
+threshold=${3:-20}
+
+awk -v threshold="$threshold" '
+	# Averages the value preceding each unit of a benchmark line into sum[file, name, unit]
+	/^Benchmark/ {
+		file = (FILENAME == ARGV[1]) ? "old" : "new"
+		name = $1
+		sub(/-[0-9]+$/, "", name)
+		count[file, name]++
+		if (file == "new" && !(name in seen)) {
+			seen[name] = 1
+			order[++n] = name
+		}
+		for (i = 3; i <= NF; i++) {
+			if ($i == "ns/op" || $i == "B/op" || $i == "allocs/op") {
+				sum[file, name, $i] += $(i - 1)
+			}
+		}
+	}
+
+	END {
+		split("ns/op B/op allocs/op", units, " ")
+		printf "%-50s %-10s %14s %14s %9s\n", "benchmark", "unit", "old", "new", "delta"
+		failed = 0
+		for (j = 1; j <= n; j++) {
+			name = order[j]
+			if (!(("old", name) in count)) {
+				continue
+			}
+			for (u = 1; u <= 3; u++) {
+				unit = units[u]
+				if (!(("old", name, unit) in sum)) {
+					continue
+				}
+				before = sum["old", name, unit] / count["old", name]
+				after = sum["new", name, unit] / count["new", name]
+				delta = (before == 0) ? 0 : (after - before) * 100 / before
+				flag = ""
+				if (delta > threshold) {
+					flag = "  REGRESSION"
+					failed = 1
+				}
+				printf "%-50s %-10s %14.0f %14.0f %+8.1f%%%s\n", name, unit, before, after, delta, flag
+			}
+		}
+		exit failed
+	}
+' "$old" "$new"
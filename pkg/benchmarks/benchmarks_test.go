@@ -0,0 +1,203 @@
+package benchmarks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/webhook"
+)
+
+// scriptsByMode: script run by the benchmarks of each mode
+var scriptsByMode = []struct {
+	name   string
+	script string
+}{
+	{"noop", NoopScript},
+	{"mutate", MutatingScript},
+}
+
+func TestFixtures(t *testing.T) {
+	for _, fixture := range Fixtures() {
+		var object map[string]interface{}
+		if err := json.Unmarshal(fixture.Object, &object); err != nil {
+			t.Fatalf("Fixture %s is not valid JSON: %v", fixture.Name, err)
+		}
+		if object["kind"] != fixture.Kind.Kind {
+			t.Errorf("Fixture %s: expected kind %s, got %v", fixture.Name, fixture.Kind.Kind, object["kind"])
+		}
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, LargeCustomResource(LargeLines).Object, "", "  "); err != nil {
+		t.Fatalf("Failed to indent large fixture: %v", err)
+	}
+	if lines := bytes.Count(indented.Bytes(), []byte("\n")) + 1; lines < LargeLines {
+		t.Errorf("Expected the large fixture to span at least %d lines, got %d", LargeLines, lines)
+	}
+
+	review := AdmissionReview(SmallPod(), map[string]string{scriptloader.AnnotationScripts: "default/noop"})
+	if !bytes.Contains(review, []byte(`glua.maurice.fr/scripts`)) {
+		t.Errorf("Expected the annotations to be set on the object, got %s", review)
+	}
+}
+
+// discardLogger: keeps benchmark output readable
+func discardLogger() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+// BenchmarkServeHTTP: full admission requests with scripts served from the loader cache
+func BenchmarkServeHTTP(b *testing.B) {
+	clientset := fake.NewSimpleClientset(
+		ScriptConfigMap("default", "noop", NoopScript),
+		ScriptConfigMap("default", "mutate", MutatingScript),
+	)
+
+	handler := webhook.NewWebhookHandlerWithOptions(clientset, discardLogger(), "mutating", webhook.HandlerOptions{
+		LoaderOptions: scriptloader.Options{CacheTTL: time.Hour},
+	})
+
+	for _, fixture := range Fixtures() {
+		for _, mode := range scriptsByMode {
+			body := AdmissionReview(fixture, map[string]string{scriptloader.AnnotationScripts: "default/" + mode.name})
+
+			b.Run(fixture.Name+"/"+mode.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(body)))
+				for i := 0; i < b.N; i++ {
+					req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, req)
+					if rec.Code != http.StatusOK {
+						b.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body.String())
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkServeHTTP_WithoutScripts: admission requests of a 500KB object no script applies to
+// Unannotated objects are allowed after decoding their annotations only, an empty scripts
+// annotation forces the decoding of the whole object, as every request paid before
+func BenchmarkServeHTTP_WithoutScripts(b *testing.B) {
+	handler := webhook.NewWebhookHandler(fake.NewSimpleClientset(), discardLogger(), "mutating")
+	fixture := CustomResource(UnannotatedShards)
+
+	for _, mode := range []struct {
+		name        string
+		annotations map[string]string
+	}{
+		{"unannotated", nil},
+		{"empty-annotation", map[string]string{scriptloader.AnnotationScripts: ""}},
+	} {
+		body := AdmissionReview(fixture, mode.annotations)
+
+		b.Run(mode.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLoader: script loading served from the cache, and fetched from the API server
+func BenchmarkLoader(b *testing.B) {
+	clientset := fake.NewSimpleClientset(
+		ScriptConfigMap("default", "noop", NoopScript),
+		ScriptConfigMap("default", "mutate", MutatingScript),
+	)
+	annotations := map[string]string{scriptloader.AnnotationScripts: "default/noop,default/mutate"}
+
+	cases := []struct {
+		name    string
+		options scriptloader.Options
+	}{
+		{"hit", scriptloader.Options{CacheTTL: time.Hour}},
+		{"miss", scriptloader.Options{}},
+	}
+
+	for _, tc := range cases {
+		loader := scriptloader.NewScriptLoaderWithOptions(clientset, discardLogger(), tc.options)
+
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations); err != nil {
+					b.Fatalf("Failed to load scripts: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRunner: a single script run with its bytecode cached, and compiled on every run
+func BenchmarkRunner(b *testing.B) {
+	for _, fixture := range Fixtures() {
+		for _, compiled := range []bool{true, false} {
+			name := fixture.Name + "/compiled"
+			if !compiled {
+				name = fixture.Name + "/uncompiled"
+			}
+
+			runner := luarunner.NewScriptRunner(discardLogger())
+			scripts := map[string]string{"default/mutate": MutatingScript}
+
+			b.Run(name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(fixture.Object)))
+				for i := 0; i < b.N; i++ {
+					if !compiled {
+						runner.FlushCompiled()
+					}
+					if _, _, err := runner.RunScriptsWithContext(context.Background(), scripts, fixture.Object); err != nil {
+						b.Fatalf("Failed to run scripts: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkRunner_CPUTime: a single script run with its thread CPU time measured, and with the
+// measurement and the locking of the OS thread it requires disabled
+func BenchmarkRunner_CPUTime(b *testing.B) {
+	fixture := SmallPod()
+	scripts := map[string]string{"default/mutate": MutatingScript}
+
+	for _, disabled := range []bool{false, true} {
+		name := "measured"
+		if disabled {
+			name = "disabled"
+		}
+		runner := luarunner.NewScriptRunnerWithOptions(discardLogger(), luarunner.Options{DisableCPUTime: disabled})
+
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(fixture.Object)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := runner.RunScriptsWithContext(context.Background(), scripts, fixture.Object); err != nil {
+					b.Fatalf("Failed to run scripts: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Package benchmarks: programmatically generated admission fixtures shared by the
+// benchmarks of the hot path and usable as seed corpus by fuzz targets
+package benchmarks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// MediumContainers: containers of the medium Deployment fixture
+	MediumContainers = 10
+	// LargeLines: lines of the large custom resource fixture once indented
+	LargeLines = 5000
+	// CRDShards: shards of the CRD fixture, each holding nested arrays, a long numeric series and a
+	// configuration block, about 1KB per shard
+	CRDShards = 300
+	// UnannotatedShards: shards of the CRD fixture of about 500KB the no-script benchmarks admit
+	UnannotatedShards = 450
+
+	// NoopScript: script reading the object without changing it
+	NoopScript = `
+		local name = object.metadata.name
+		if object.metadata.labels == nil then
+			name = name .. ""
+		end
+	`
+	// MutatingScript: script adding a label and an annotation to the object
+	MutatingScript = `
+		object.metadata.labels = object.metadata.labels or {}
+		object.metadata.labels["bench.glua.maurice.fr/mutated"] = "true"
+		object.metadata.annotations = object.metadata.annotations or {}
+		object.metadata.annotations["bench.glua.maurice.fr/by"] = "glua"
+	`
+)
+
+// Fixture: an object as sent in an admission request
+type Fixture struct {
+	// Name: short identifier, used as benchmark name
+	Name string
+	// Kind: group, version and kind of the object
+	Kind metav1.GroupVersionKind
+	// Object: JSON encoding of the object
+	Object []byte
+}
+
+// Fixtures: returns the small, medium, large and CRD fixtures
+func Fixtures() []Fixture {
+	return []Fixture{SmallPod(), MediumDeployment(MediumContainers), LargeCustomResource(LargeLines), CustomResource(CRDShards)}
+}
+
+// SmallPod: a Pod with a single container
+func SmallPod() Fixture {
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: objectMeta("small"),
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{container(0)},
+		},
+	}
+
+	return Fixture{
+		Name:   "small",
+		Kind:   metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Object: mustMarshal(pod),
+	}
+}
+
+// MediumDeployment: a Deployment whose pod template holds the given number of containers
+func MediumDeployment(containers int) Fixture {
+	replicas := int32(3)
+	deployment := appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: objectMeta("medium"),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "medium"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "medium"}},
+			},
+		},
+	}
+	for i := 0; i < containers; i++ {
+		deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, container(i))
+	}
+
+	return Fixture{
+		Name:   "medium",
+		Kind:   metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Object: mustMarshal(deployment),
+	}
+}
+
+// LargeCustomResource: a custom resource whose indented JSON spans at least the given number of lines
+func LargeCustomResource(lines int) Fixture {
+	// Each entry takes 8 lines once indented, the envelope about 20
+	entries := make([]interface{}, 0, lines/8+1)
+	for i := 0; len(entries)*8+20 < lines; i++ {
+		entries = append(entries, map[string]interface{}{
+			"name":     fmt.Sprintf("entry-%d", i),
+			"enabled":  i%2 == 0,
+			"weight":   i,
+			"selector": map[string]interface{}{"tier": fmt.Sprintf("tier-%d", i%5)},
+			"target":   fmt.Sprintf("backend-%d.example.svc:8080", i),
+		})
+	}
+
+	object := map[string]interface{}{
+		"apiVersion": "bench.glua.maurice.fr/v1",
+		"kind":       "RoutingTable",
+		"metadata":   objectMeta("large"),
+		"spec": map[string]interface{}{
+			"routes": entries,
+		},
+	}
+
+	return Fixture{
+		Name:   "large",
+		Kind:   metav1.GroupVersionKind{Group: "bench.glua.maurice.fr", Version: "v1", Kind: "RoutingTable"},
+		Object: mustMarshal(object),
+	}
+}
+
+// CustomResource: a custom resource shaped like the large operator-managed ones found in clusters,
+// a spec of deeply nested arrays, long numeric series written the way humans and other encoders
+// write numbers (1.0, 2.50, 1e3, integers beyond float64 precision) and multi-line configuration
+// blocks, and a status block of the same size
+func CustomResource(shards int) Fixture {
+	literals := []string{"1.0", "2.50", "1e3", "-0", "0.1", "42", "9007199254740993", "3.14159", "1E-7", "100"}
+	block := strings.Repeat("server {\n  listen 8080;\n  location / { proxy_pass \"http://backend\"; }\n}\n", 8)
+
+	specShards := make([]interface{}, 0, shards)
+	statusShards := make([]interface{}, 0, shards)
+	for i := 0; i < shards; i++ {
+		series := make([]interface{}, 0, 40)
+		for j := 0; j < 40; j++ {
+			series = append(series, json.Number(literals[(i+j)%len(literals)]))
+		}
+		specShards = append(specShards, map[string]interface{}{
+			"name":   fmt.Sprintf("shard-%d", i),
+			"series": series,
+			"topology": []interface{}{
+				[]interface{}{fmt.Sprintf("zone-%d", i%3), []interface{}{json.Number("1"), nil, map[string]interface{}{"weight": json.Number("0.5"), "tags": []interface{}{}}}},
+				map[string]interface{}{},
+			},
+			"config": block,
+		})
+		statusShards = append(statusShards, map[string]interface{}{
+			"name":               fmt.Sprintf("shard-%d", i),
+			"observedGeneration": json.Number("7"),
+			"lag":                []interface{}{json.Number("0.0"), json.Number("12.5"), json.Number("1e2")},
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "True", "lastTransitionTime": "2024-01-01T00:00:00Z"},
+			},
+		})
+	}
+
+	object := map[string]interface{}{
+		"apiVersion": "bench.glua.maurice.fr/v1",
+		"kind":       "ShardSet",
+		"metadata":   objectMeta("crd"),
+		"spec":       map[string]interface{}{"shards": specShards},
+		"status":     map[string]interface{}{"shards": statusShards},
+	}
+
+	return Fixture{
+		Name:   "crd",
+		Kind:   metav1.GroupVersionKind{Group: "bench.glua.maurice.fr", Version: "v1", Kind: "ShardSet"},
+		Object: mustMarshal(object),
+	}
+}
+
+// AdmissionReview: encodes a CREATE admission review for the fixture, with the given annotations set on the object
+func AdmissionReview(fixture Fixture, annotations map[string]string) []byte {
+	var object map[string]interface{}
+	if err := json.Unmarshal(fixture.Object, &object); err != nil {
+		panic(fmt.Sprintf("invalid fixture %s: %v", fixture.Name, err))
+	}
+	if len(annotations) > 0 {
+		metadata, _ := object["metadata"].(map[string]interface{})
+		existing, _ := metadata["annotations"].(map[string]interface{})
+		if existing == nil {
+			existing = make(map[string]interface{}, len(annotations))
+		}
+		for k, v := range annotations {
+			existing[k] = v
+		}
+		metadata["annotations"] = existing
+	}
+
+	return mustMarshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "bench-uid",
+			Kind:      fixture.Kind,
+			Namespace: "default",
+			Name:      fixture.Name,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: mustMarshal(object)},
+		},
+	})
+}
+
+// ScriptConfigMap: a ConfigMap holding script under the default key
+func ScriptConfigMap(namespace, name, script string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       map[string]string{"script.lua": script},
+	}
+}
+
+// objectMeta: metadata shared by the fixtures
+func objectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: "default",
+		Labels: map[string]string{
+			"app":                       name,
+			"app.kubernetes.io/part-of": "glua-webhook-bench",
+		},
+	}
+}
+
+// container: a container with resources, ports and environment, as found in real workloads
+func container(i int) corev1.Container {
+	return corev1.Container{
+		Name:  fmt.Sprintf("container-%d", i),
+		Image: fmt.Sprintf("registry.example.com/team/app-%d:1.2.%d", i, i),
+		Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: int32(8080 + i)}},
+		Env: []corev1.EnvVar{
+			{Name: "LOG_LEVEL", Value: "info"},
+			{Name: "INDEX", Value: fmt.Sprint(i)},
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("256Mi"),
+			},
+		},
+	}
+}
+
+// mustMarshal: encodes fixtures, which are always encodable
+func mustMarshal(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal fixture: %v", err))
+	}
+	return data
+}
@@ -0,0 +1,291 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thomas-maurice/glua/pkg/glua"
+	lua "github.com/yuin/gopher-lua"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ModuleName: name scripts require the lookup module by
+const ModuleName = "cluster"
+
+// DefaultNamespaceTTL: how long namespace objects are shared across requests by default
+const DefaultNamespaceTTL = 30 * time.Second
+
+// Options: tunables for a Lookup
+type Options struct {
+	// NamespaceTTL: how long fetched namespaces are reused across admission requests
+	// Zero uses DefaultNamespaceTTL, a negative value disables the cross-request cache
+	NamespaceTTL time.Duration
+}
+
+// Stats: counters describing how cluster lookups were served
+type Stats struct {
+	// Fetches: lookups sent to the API server
+	Fetches int64 `json:"fetches"`
+	// RequestHits: lookups served from the memo of the current admission request
+	RequestHits int64 `json:"requestHits"`
+	// NamespaceHits: namespace lookups served from the cross-request cache
+	NamespaceHits int64 `json:"namespaceHits"`
+	// Errors: lookups that failed for a reason other than the object not existing
+	Errors int64 `json:"errors"`
+}
+
+// namespaceEntry: namespace object shared across requests
+type namespaceEntry struct {
+	object    map[string]interface{}
+	fetchedAt time.Time
+}
+
+// Lookup: read-only access to cluster objects for scripts
+// Lookups are memoized per admission request, namespaces are also cached across requests
+type Lookup struct {
+	clientset kubernetes.Interface
+	logger    *log.Logger
+	options   Options
+
+	mu         sync.Mutex
+	namespaces map[string]namespaceEntry
+	now        func() time.Time
+
+	fetches       atomic.Int64
+	requestHits   atomic.Int64
+	namespaceHits atomic.Int64
+	errors        atomic.Int64
+}
+
+// getter: fetches one object of a resource from the API server
+type getter func(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (runtime.Object, error)
+
+// getters: resources scripts may look up
+var getters = map[string]getter{
+	"namespaces": func(ctx context.Context, c kubernetes.Interface, _, name string) (runtime.Object, error) {
+		return c.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	},
+	"configmaps": func(ctx context.Context, c kubernetes.Interface, namespace, name string) (runtime.Object, error) {
+		return c.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	},
+	"services": func(ctx context.Context, c kubernetes.Interface, namespace, name string) (runtime.Object, error) {
+		return c.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	},
+	"serviceaccounts": func(ctx context.Context, c kubernetes.Interface, namespace, name string) (runtime.Object, error) {
+		return c.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	},
+}
+
+// NewLookup: creates a cluster lookup backed by the given clientset
+func NewLookup(clientset kubernetes.Interface, logger *log.Logger, options Options) *Lookup {
+	if options.NamespaceTTL == 0 {
+		options.NamespaceTTL = DefaultNamespaceTTL
+	}
+
+	return &Lookup{
+		clientset:  clientset,
+		logger:     logger,
+		options:    options,
+		namespaces: make(map[string]namespaceEntry),
+		now:        time.Now,
+	}
+}
+
+// Stats: returns the lookup counters since the Lookup was created
+func (l *Lookup) Stats() Stats {
+	return Stats{
+		Fetches:       l.fetches.Load(),
+		RequestHits:   l.requestHits.Load(),
+		NamespaceHits: l.namespaceHits.Load(),
+		Errors:        l.errors.Load(),
+	}
+}
+
+// FlushNamespaces: drops the cross-request namespace cache
+func (l *Lookup) FlushNamespaces() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.namespaces = make(map[string]namespaceEntry)
+}
+
+// Session: per admission request view of a Lookup, memoizing every lookup made by the script chain
+type Session struct {
+	ctx        context.Context
+	lookup     *Lookup
+	translator *glua.Translator
+
+	mu   sync.Mutex
+	memo map[string]map[string]interface{}
+}
+
+// NewSession: starts the lookups of one admission request
+func (l *Lookup) NewSession(ctx context.Context) *Session {
+	return &Session{
+		ctx:        ctx,
+		lookup:     l,
+		translator: glua.NewTranslator(),
+		memo:       make(map[string]map[string]interface{}),
+	}
+}
+
+// Close: drops the objects memoized for the request
+func (s *Session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memo = nil
+}
+
+// Get: returns an object as unstructured content, nil when it does not exist
+func (s *Session) Get(resource, namespace, name string) (map[string]interface{}, error) {
+	get, ok := getters[resource]
+	if !ok {
+		return nil, fmt.Errorf("unsupported resource %q", resource)
+	}
+	if resource == "namespaces" {
+		namespace = ""
+	}
+
+	key := fmt.Sprintf("%s/%s/%s", resource, namespace, name)
+
+	s.mu.Lock()
+	object, memoized := s.memo[key]
+	s.mu.Unlock()
+	if memoized {
+		s.lookup.requestHits.Add(1)
+		return object, nil
+	}
+
+	if resource == "namespaces" {
+		if object, cached := s.lookup.cachedNamespace(name); cached {
+			s.remember(key, object)
+			return object, nil
+		}
+	}
+
+	object, err := s.lookup.fetch(s.ctx, get, resource, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if resource == "namespaces" {
+		s.lookup.storeNamespace(name, object)
+	}
+	s.remember(key, object)
+	return object, nil
+}
+
+// remember: memoizes an object for the rest of the request
+func (s *Session) remember(key string, object map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.memo != nil {
+		s.memo[key] = object
+	}
+}
+
+// fetch: gets an object from the API server, a missing object is returned as nil without error
+func (l *Lookup) fetch(ctx context.Context, get getter, resource, namespace, name string) (map[string]interface{}, error) {
+	l.fetches.Add(1)
+
+	obj, err := get(ctx, l.clientset, namespace, name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		l.errors.Add(1)
+		l.logger.Printf("ERROR: Cluster lookup of %s %s/%s failed: %v", resource, namespace, name, err)
+		return nil, fmt.Errorf("failed to get %s %s/%s: %w", resource, namespace, name, err)
+	}
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		l.errors.Add(1)
+		return nil, fmt.Errorf("failed to convert %s %s/%s: %w", resource, namespace, name, err)
+	}
+
+	return object, nil
+}
+
+// cachedNamespace: returns a namespace from the cross-request cache when it is fresh enough
+func (l *Lookup) cachedNamespace(name string) (map[string]interface{}, bool) {
+	if l.options.NamespaceTTL < 0 {
+		return nil, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.namespaces[name]
+	if !ok || l.now().Sub(entry.fetchedAt) >= l.options.NamespaceTTL {
+		return nil, false
+	}
+
+	l.namespaceHits.Add(1)
+	return entry.object, true
+}
+
+// storeNamespace: shares a fetched namespace with the following requests
+func (l *Lookup) storeNamespace(name string, object map[string]interface{}) {
+	if l.options.NamespaceTTL < 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.namespaces[name] = namespaceEntry{object: object, fetchedAt: l.now()}
+}
+
+// Loader: returns the Lua module loader bound to the session
+//
+//	local cluster = require("cluster")
+//	local ns, err = cluster.get_namespace("default")
+//	local cm, err = cluster.get("configmaps", "default", "settings")
+//
+// Missing objects are returned as nil, failures as nil and an error message
+func (s *Session) Loader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get_namespace": func(L *lua.LState) int {
+			return s.push(L, "namespaces", "", L.CheckString(1))
+		},
+		"get": func(L *lua.LState) int {
+			return s.push(L, L.CheckString(1), L.CheckString(2), L.CheckString(3))
+		},
+	})
+	L.Push(mod)
+	return 1
+}
+
+// push: looks an object up and pushes it (or nil and an error message) on the Lua stack
+func (s *Session) push(L *lua.LState, resource, namespace, name string) int {
+	object, err := s.Get(resource, namespace, name)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	if object == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	value, err := s.translator.ToLua(L, object)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to convert to Lua: %v", err)))
+		return 2
+	}
+
+	L.Push(value)
+	return 1
+}
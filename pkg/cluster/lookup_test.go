@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// countGets: counts the GET actions the fake clientset receives for a resource
+func countGets(clientset *fake.Clientset, resource string) *int {
+	count := 0
+	clientset.PrependReactor("get", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		count++
+		return false, nil, nil
+	})
+	return &count
+}
+
+func newTestClientset() *fake.Clientset {
+	return fake.NewSimpleClientset(
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "team-a"},
+			Data:       map[string]string{"tier": "gold"},
+		},
+	)
+}
+
+func TestSession_MemoizesWithinRequest(t *testing.T) {
+	clientset := newTestClientset()
+	gets := countGets(clientset, "configmaps")
+
+	lookup := NewLookup(clientset, log.New(os.Stdout, "[test] ", log.LstdFlags), Options{})
+	session := lookup.NewSession(context.Background())
+
+	for i := 0; i < 3; i++ {
+		object, err := session.Get("configmaps", "team-a", "settings")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		data := object["data"].(map[string]interface{})
+		if data["tier"] != "gold" {
+			t.Errorf("Expected ConfigMap data, got %v", object)
+		}
+	}
+
+	if *gets != 1 {
+		t.Errorf("Expected 1 GET within a request, got %d", *gets)
+	}
+
+	// A new request fetches ConfigMaps again
+	session.Close()
+	if _, err := lookup.NewSession(context.Background()).Get("configmaps", "team-a", "settings"); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if *gets != 2 {
+		t.Errorf("Expected ConfigMaps not to be shared across requests, got %d GETs", *gets)
+	}
+
+	stats := lookup.Stats()
+	if stats.Fetches != 2 || stats.RequestHits != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestSession_NamespaceCacheAcrossRequests(t *testing.T) {
+	clientset := newTestClientset()
+	gets := countGets(clientset, "namespaces")
+
+	now := time.Now()
+	lookup := NewLookup(clientset, log.New(os.Stdout, "[test] ", log.LstdFlags), Options{NamespaceTTL: time.Minute})
+	lookup.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		object, err := lookup.NewSession(context.Background()).Get("namespaces", "ignored", "team-a")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		labels := object["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+		if labels["team"] != "a" {
+			t.Errorf("Expected namespace labels, got %v", object)
+		}
+	}
+	if *gets != 1 {
+		t.Errorf("Expected 1 GET for namespaces within the TTL, got %d", *gets)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := lookup.NewSession(context.Background()).Get("namespaces", "", "team-a"); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if *gets != 2 {
+		t.Errorf("Expected namespace to be fetched again after the TTL, got %d GETs", *gets)
+	}
+
+	if stats := lookup.Stats(); stats.NamespaceHits != 2 || stats.Fetches != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// A negative TTL disables the cross-request cache
+	disabled := NewLookup(clientset, log.New(os.Stdout, "[test] ", log.LstdFlags), Options{NamespaceTTL: -1})
+	for i := 0; i < 2; i++ {
+		if _, err := disabled.NewSession(context.Background()).Get("namespaces", "", "team-a"); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+	if *gets != 4 {
+		t.Errorf("Expected every request to fetch namespaces when the cache is disabled, got %d GETs", *gets)
+	}
+}
+
+func TestSession_MissingAndFailedLookups(t *testing.T) {
+	clientset := newTestClientset()
+	clientset.PrependReactor("get", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+
+	lookup := NewLookup(clientset, log.New(os.Stdout, "[test] ", log.LstdFlags), Options{})
+	session := lookup.NewSession(context.Background())
+
+	object, err := session.Get("configmaps", "team-a", "missing")
+	if err != nil || object != nil {
+		t.Errorf("Expected missing object to be nil without error, got %v, %v", object, err)
+	}
+
+	if _, err := session.Get("services", "team-a", "web"); err == nil {
+		t.Error("Expected API errors to be returned")
+	}
+
+	if _, err := session.Get("secrets", "team-a", "token"); err == nil {
+		t.Error("Expected unsupported resources to be rejected")
+	}
+
+	if stats := lookup.Stats(); stats.Errors != 1 {
+		t.Errorf("Expected 1 error in stats, got %+v", stats)
+	}
+}
@@ -0,0 +1,362 @@
+package coverage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	"thechat/pkg/webhook"
+)
+
+// NamespaceNameLabel: label the API server sets on every namespace to its name
+const NamespaceNameLabel = "kubernetes.io/metadata.name"
+
+// clusterScopedKinds: well-known kinds without a namespace
+// Objects of other kinds without metadata.namespace are placed in Options.DefaultNamespace
+var clusterScopedKinds = map[string]bool{
+	"APIService":                     true,
+	"CSIDriver":                      true,
+	"CSINode":                        true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"CustomResourceDefinition":       true,
+	"IngressClass":                   true,
+	"MutatingWebhookConfiguration":   true,
+	"Namespace":                      true,
+	"Node":                           true,
+	"PersistentVolume":               true,
+	"PriorityClass":                  true,
+	"RuntimeClass":                   true,
+	"StorageClass":                   true,
+	"ValidatingWebhookConfiguration": true,
+}
+
+// Options: how objects are evaluated against a webhook configuration
+type Options struct {
+	// Operation: admission operation the objects are evaluated for, CREATE when empty
+	Operation admissionregistrationv1.OperationType
+	// DefaultNamespace: namespace of namespaced objects without metadata.namespace, "default" when empty
+	DefaultNamespace string
+	// NamespaceLabels: labels of known namespaces, used to evaluate namespaceSelector
+	// Namespace objects among the evaluated objects are added automatically
+	NamespaceLabels map[string]map[string]string
+	// Filters: server-side filters applied once the API server sends a request
+	Filters webhook.ServerFilters
+}
+
+// Result: coverage of one object by one webhook of the configuration
+type Result struct {
+	// Object: kind and namespace/name of the evaluated object
+	Object string `json:"object"`
+	// Webhook: name of the webhook entry in the configuration
+	Webhook string `json:"webhook"`
+	// Sent: whether the API server sends the object to the webhook
+	Sent bool `json:"sent"`
+	// SentReason: why the API server does not send the object, empty when it does
+	SentReason string `json:"sentReason,omitempty"`
+	// Processed: whether the server-side filters let scripts run for the object
+	Processed bool `json:"processed"`
+	// ProcessedReason: why the server skips the object, empty when it processes it
+	ProcessedReason string `json:"processedReason,omitempty"`
+}
+
+// Mismatch: reports whether the API server and the server-side filters disagree about the object
+func (r Result) Mismatch() bool {
+	return r.Sent != r.Processed
+}
+
+// Evaluate: reports, for every object and webhook, whether the API server sends the object
+// and whether the server-side filters then process it
+func Evaluate(config *admissionregistrationv1.MutatingWebhookConfiguration, objects []unstructured.Unstructured, options Options) ([]Result, error) {
+	if options.Operation == "" {
+		options.Operation = admissionregistrationv1.Create
+	}
+	if options.DefaultNamespace == "" {
+		options.DefaultNamespace = "default"
+	}
+
+	namespaceLabels := make(map[string]map[string]string, len(options.NamespaceLabels))
+	for name, nsLabels := range options.NamespaceLabels {
+		namespaceLabels[name] = nsLabels
+	}
+	for _, obj := range objects {
+		if obj.GetKind() == "Namespace" {
+			namespaceLabels[obj.GetName()] = obj.GetLabels()
+		}
+	}
+
+	var results []Result
+	for _, obj := range objects {
+		namespace := obj.GetNamespace()
+		if namespace == "" && !clusterScopedKinds[obj.GetKind()] {
+			namespace = options.DefaultNamespace
+		}
+
+		for _, wh := range config.Webhooks {
+			sent, sentReason, err := sentByAPIServer(wh, obj, namespace, namespaceLabels, options.Operation)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", wh.Name, err)
+			}
+			processed, processedReason := options.Filters.Processes(namespace, obj.GetKind())
+
+			results = append(results, Result{
+				Object:          objectName(obj, namespace),
+				Webhook:         wh.Name,
+				Sent:            sent,
+				SentReason:      sentReason,
+				Processed:       processed,
+				ProcessedReason: processedReason,
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// sentByAPIServer: emulates the API server matching of rules, namespaceSelector and objectSelector
+func sentByAPIServer(wh admissionregistrationv1.MutatingWebhook, obj unstructured.Unstructured, namespace string, namespaceLabels map[string]map[string]string, operation admissionregistrationv1.OperationType) (bool, string, error) {
+	gvk := obj.GroupVersionKind()
+	if !matchesRules(wh.Rules, gvk, namespace != "", operation) {
+		return false, fmt.Sprintf("no rule matches %s %s", operation, gvk.String()), nil
+	}
+
+	// Cluster-scoped objects other than namespaces always match the namespaceSelector
+	if wh.NamespaceSelector != nil && (namespace != "" || obj.GetKind() == "Namespace") {
+		selector, err := metav1.LabelSelectorAsSelector(wh.NamespaceSelector)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid namespaceSelector: %w", err)
+		}
+
+		name, nsLabels := namespace, namespaceLabels[namespace]
+		if obj.GetKind() == "Namespace" {
+			name, nsLabels = obj.GetName(), obj.GetLabels()
+		}
+		if !selector.Matches(withNameLabel(nsLabels, name)) {
+			return false, fmt.Sprintf("namespace %s does not match namespaceSelector %s", name, selector), nil
+		}
+	}
+
+	if wh.ObjectSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(wh.ObjectSelector)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid objectSelector: %w", err)
+		}
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			return false, fmt.Sprintf("object labels do not match objectSelector %s", selector), nil
+		}
+	}
+
+	return true, "", nil
+}
+
+// matchesRules: reports whether any rule matches the operation on the object group, version and resource
+func matchesRules(rules []admissionregistrationv1.RuleWithOperations, gvk schema.GroupVersionKind, namespaced bool, operation admissionregistrationv1.OperationType) bool {
+	resource, _ := meta.UnsafeGuessKindToResource(gvk)
+
+	for _, rule := range rules {
+		if !containsOperation(rule.Operations, operation) ||
+			!containsOrWildcard(rule.APIGroups, gvk.Group) ||
+			!containsOrWildcard(rule.APIVersions, gvk.Version) ||
+			!matchesResource(rule.Resources, resource.Resource) {
+			continue
+		}
+
+		if rule.Scope != nil {
+			switch *rule.Scope {
+			case admissionregistrationv1.NamespacedScope:
+				if !namespaced {
+					continue
+				}
+			case admissionregistrationv1.ClusterScope:
+				if namespaced {
+					continue
+				}
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// containsOperation: reports whether operations holds operation or the wildcard
+func containsOperation(operations []admissionregistrationv1.OperationType, operation admissionregistrationv1.OperationType) bool {
+	for _, op := range operations {
+		if op == admissionregistrationv1.OperationAll || op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// containsOrWildcard: reports whether values holds value or "*"
+func containsOrWildcard(values []string, value string) bool {
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesResource: reports whether resources matches the main resource (subresources never match an object)
+func matchesResource(resources []string, resource string) bool {
+	for _, r := range resources {
+		if r == "*" || r == "*/*" || r == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// withNameLabel: returns the namespace labels including the name label set by the API server
+func withNameLabel(nsLabels map[string]string, name string) labels.Set {
+	set := labels.Set{NamespaceNameLabel: name}
+	for k, v := range nsLabels {
+		set[k] = v
+	}
+	return set
+}
+
+// objectName: renders an object as Kind namespace/name
+func objectName(obj unstructured.Unstructured, namespace string) string {
+	if namespace == "" {
+		return fmt.Sprintf("%s %s", obj.GetKind(), obj.GetName())
+	}
+	return fmt.Sprintf("%s %s/%s", obj.GetKind(), namespace, obj.GetName())
+}
+
+// LoadWebhookConfiguration: reads a MutatingWebhookConfiguration from a YAML or JSON file
+func LoadWebhookConfiguration(path string) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook configuration %s: %w", path, err)
+	}
+
+	var config admissionregistrationv1.MutatingWebhookConfiguration
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook configuration %s: %w", path, err)
+	}
+	if config.Kind != "MutatingWebhookConfiguration" {
+		return nil, fmt.Errorf("%s holds a %q, expected a MutatingWebhookConfiguration", path, config.Kind)
+	}
+
+	return &config, nil
+}
+
+// LoadObjects: reads every object from the YAML and JSON files of a directory, or from a single file
+// Multi-document files and List kinds are expanded
+func LoadObjects(path string) ([]unstructured.Unstructured, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory %s: %w", path, err)
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+		sort.Strings(files)
+	}
+
+	var objects []unstructured.Unstructured
+	for _, file := range files {
+		fileObjects, err := decodeObjects(file)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, fileObjects...)
+	}
+
+	return objects, nil
+}
+
+// decodeObjects: decodes every document of a YAML or JSON file
+func decodeObjects(file string) ([]unstructured.Unstructured, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	var objects []unstructured.Unstructured
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		var obj unstructured.Unstructured
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed to decode %s: %w", file, err)
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		if obj.IsList() {
+			list, err := obj.ToList()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode list in %s: %w", file, err)
+			}
+			objects = append(objects, list.Items...)
+			continue
+		}
+
+		if obj.GetKind() == "" {
+			return nil, fmt.Errorf("object without kind in %s", file)
+		}
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+// FormatReport: renders results as a table, with mismatches flagged
+func FormatReport(w io.Writer, results []Result, onlyMismatches bool) {
+	for _, result := range results {
+		if onlyMismatches && !result.Mismatch() {
+			continue
+		}
+
+		flag := "  "
+		if result.Mismatch() {
+			flag = "!!"
+		}
+
+		var reasons []string
+		if result.SentReason != "" {
+			reasons = append(reasons, result.SentReason)
+		}
+		if result.ProcessedReason != "" {
+			reasons = append(reasons, result.ProcessedReason)
+		}
+
+		fmt.Fprintf(w, "%s %s\t%s\tsent=%v\tprocessed=%v\t%s\n",
+			flag, result.Object, result.Webhook, result.Sent, result.Processed, strings.Join(reasons, "; "))
+	}
+}
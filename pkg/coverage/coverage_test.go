@@ -0,0 +1,233 @@
+package coverage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"thechat/pkg/webhook"
+)
+
+// newObject: builds an unstructured object for coverage evaluation
+func newObject(apiVersion, kind, namespace, name string, objLabels map[string]string) unstructured.Unstructured {
+	obj := unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetLabels(objLabels)
+	return obj
+}
+
+// newConfig: builds a configuration with one webhook matching Pods and Deployments in enabled namespaces
+func newConfig() *admissionregistrationv1.MutatingWebhookConfiguration {
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name: "mutate.glua.maurice.fr",
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{"", "apps"},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods", "deployments"},
+						},
+					},
+				},
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"glua.maurice.fr/enabled": "true"},
+				},
+				ObjectSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "glua.maurice.fr/skip", Operator: metav1.LabelSelectorOpDoesNotExist},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	objects := []unstructured.Unstructured{
+		newObject("v1", "Namespace", "", "apps", map[string]string{"glua.maurice.fr/enabled": "true"}),
+		newObject("v1", "Namespace", "", "legacy", nil),
+		newObject("v1", "Namespace", "", "kube-system", map[string]string{"glua.maurice.fr/enabled": "true"}),
+		newObject("v1", "Pod", "apps", "web", nil),
+		newObject("v1", "Pod", "legacy", "old", nil),
+		newObject("v1", "Pod", "kube-system", "dns", nil),
+		newObject("apps/v1", "Deployment", "apps", "api", nil),
+		newObject("v1", "Pod", "apps", "opted-out", map[string]string{"glua.maurice.fr/skip": "true"}),
+		newObject("v1", "Service", "apps", "web", nil),
+		newObject("v1", "Pod", "", "unset-namespace", nil),
+	}
+
+	results, err := Evaluate(newConfig(), objects, Options{
+		NamespaceLabels: map[string]map[string]string{
+			"default": {"glua.maurice.fr/enabled": "true"},
+		},
+		Filters: webhook.ServerFilters{
+			SkipNamespaces: []string{"kube-system"},
+			OnlyKinds:      []string{"Pod"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Evaluate failed: %v", err)
+	}
+
+	byObject := make(map[string]Result)
+	for _, result := range results {
+		byObject[result.Object] = result
+	}
+
+	tests := []struct {
+		object    string
+		sent      bool
+		processed bool
+	}{
+		// Both layers agree
+		{object: "Pod apps/web", sent: true, processed: true},
+		{object: "Service apps/web", sent: false, processed: false},
+		// Excluded by namespaceSelector but not by the server filters
+		{object: "Pod legacy/old", sent: false, processed: true},
+		// Excluded by the server filters but not by namespaceSelector
+		{object: "Pod kube-system/dns", sent: true, processed: false},
+		// Kind sent by the API server but filtered by --only-kinds
+		{object: "Deployment apps/api", sent: true, processed: false},
+		// Excluded by objectSelector
+		{object: "Pod apps/opted-out", sent: false, processed: true},
+		// Namespaces match their own labels, cluster-scoped objects are not in rules here
+		{object: "Namespace apps", sent: false, processed: false},
+		// Objects without namespace land in the default namespace
+		{object: "Pod default/unset-namespace", sent: true, processed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.object, func(t *testing.T) {
+			result, ok := byObject[tt.object]
+			if !ok {
+				t.Fatalf("No result for %s in %v", tt.object, results)
+			}
+			if result.Sent != tt.sent || result.Processed != tt.processed {
+				t.Errorf("Expected sent=%v processed=%v, got %+v", tt.sent, tt.processed, result)
+			}
+			if result.Mismatch() != (tt.sent != tt.processed) {
+				t.Errorf("Expected mismatch=%v, got %+v", tt.sent != tt.processed, result)
+			}
+			if !result.Sent && result.SentReason == "" {
+				t.Errorf("Expected a reason for objects not sent, got %+v", result)
+			}
+			if !result.Processed && result.ProcessedReason == "" {
+				t.Errorf("Expected a reason for objects not processed, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestEvaluate_NamespaceNameLabelAndWildcards(t *testing.T) {
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name: "all",
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.OperationAll},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{"*"},
+							APIVersions: []string{"*"},
+							Resources:   []string{"*"},
+						},
+					},
+				},
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: NamespaceNameLabel, Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system"}},
+					},
+				},
+			},
+		},
+	}
+
+	objects := []unstructured.Unstructured{
+		newObject("v1", "ConfigMap", "kube-system", "coredns", nil),
+		newObject("v1", "ConfigMap", "team-a", "settings", nil),
+		newObject("rbac.authorization.k8s.io/v1", "ClusterRole", "", "reader", nil),
+	}
+
+	results, err := Evaluate(config, objects, Options{})
+	if err != nil {
+		t.Fatalf("Evaluate failed: %v", err)
+	}
+
+	expected := map[string]bool{
+		"ConfigMap kube-system/coredns": false,
+		"ConfigMap team-a/settings":     true,
+		"ClusterRole reader":            true,
+	}
+	for _, result := range results {
+		if result.Sent != expected[result.Object] {
+			t.Errorf("Expected %s sent=%v, got %+v", result.Object, expected[result.Object], result)
+		}
+	}
+}
+
+func TestLoadObjectsAndConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"namespaces.yaml": `apiVersion: v1
+kind: Namespace
+metadata:
+  name: apps
+  labels:
+    glua.maurice.fr/enabled: "true"
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Namespace
+  metadata:
+    name: legacy
+`,
+		"pod.json":   `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","namespace":"apps"}}`,
+		"notes.txt":  `ignored`,
+		"empty.yaml": "---\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	objects, err := LoadObjects(dir)
+	if err != nil {
+		t.Fatalf("LoadObjects failed: %v", err)
+	}
+	if len(objects) != 3 {
+		t.Fatalf("Expected 3 objects, got %d: %v", len(objects), objects)
+	}
+
+	configPath := filepath.Join("..", "..", "examples", "manifests", "05-mutating-webhook.yaml")
+	config, err := LoadWebhookConfiguration(configPath)
+	if err != nil {
+		t.Fatalf("LoadWebhookConfiguration failed: %v", err)
+	}
+
+	results, err := Evaluate(config, objects, Options{})
+	if err != nil {
+		t.Fatalf("Evaluate failed: %v", err)
+	}
+	for _, result := range results {
+		if result.Object == "Pod apps/web" && !result.Sent {
+			t.Errorf("Expected the pod in an enabled namespace to be sent, got %+v", result)
+		}
+	}
+
+	if _, err := LoadWebhookConfiguration(filepath.Join(dir, "pod.json")); err == nil {
+		t.Error("Expected error for a file that is not a MutatingWebhookConfiguration")
+	}
+}
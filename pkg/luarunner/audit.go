@@ -0,0 +1,65 @@
+package luarunner
+
+import (
+	"strings"
+
+	glualog "github.com/thomas-maurice/glua/pkg/modules/log"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// AuditModuleName: name scripts require the audit module by
+const AuditModuleName = "audit"
+
+// auditedLogLevels: functions of the log module whose messages are recorded for auditing
+var auditedLogLevels = []string{"debug", "info", "warn", "error"}
+
+// auditLoader: returns the audit module loader, recording messages into logs
+//
+//	local audit = require("audit")
+//	audit.log("added team label from namespace ", ns.metadata.name)
+//
+// Arguments are concatenated like warn()
+func (r *ScriptRunner) auditLoader(scriptName string, logs *[]string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"log": func(L *lua.LState) int {
+				parts := make([]string, 0, L.GetTop())
+				for i := 1; i <= L.GetTop(); i++ {
+					parts = append(parts, L.CheckString(i))
+				}
+				message := strings.Join(parts, "")
+				r.logger.Printf("Script %s audit: %s", scriptName, message)
+				*logs = append(*logs, message)
+				return 0
+			},
+		})
+		L.Push(mod)
+		return 1
+	}
+}
+
+// recordingLogLoader: returns a log module loader whose module-level functions also record
+// their message into logs, prefixed with the level
+func recordingLogLoader(logs *[]string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		glualog.Loader(L)
+		mod := L.CheckTable(-1)
+
+		for _, level := range auditedLogLevels {
+			original, ok := mod.RawGetString(level).(*lua.LFunction)
+			if !ok || original.GFunction == nil {
+				continue
+			}
+
+			level := level
+			mod.RawSetString(level, L.NewFunction(func(L *lua.LState) int {
+				if message, ok := L.Get(1).(lua.LString); ok {
+					*logs = append(*logs, level+": "+string(message))
+				}
+				return original.GFunction(L)
+			}))
+		}
+
+		return 1
+	}
+}
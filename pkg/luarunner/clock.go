@@ -0,0 +1,110 @@
+package luarunner
+
+import (
+	"math/rand"
+	gotime "time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Clock: source of the current time scripts see, see Options.Clock
+type Clock interface {
+	Now() gotime.Time
+}
+
+// FrozenClock: a clock stopped at an instant, so that scripts reading the time give the same
+// result on every run
+type FrozenClock gotime.Time
+
+// Now: implements Clock
+func (c FrozenClock) Now() gotime.Time {
+	return gotime.Time(c)
+}
+
+// clockedTimeLoader: wraps the loader of the time module so that time.now reads clock
+// time.now returns Unix seconds, like the function it replaces
+func clockedTimeLoader(loader lua.LGFunction, clock Clock) lua.LGFunction {
+	return func(L *lua.LState) int {
+		L.Push(L.NewFunction(loader))
+		L.Call(0, 1)
+		module := L.Get(-1)
+		if tbl, ok := module.(*lua.LTable); ok {
+			tbl.RawSetString("now", L.NewFunction(func(L *lua.LState) int {
+				L.Push(lua.LNumber(clock.Now().Unix()))
+				return 1
+			}))
+		}
+		return 1
+	}
+}
+
+// applyClock: makes os.time and os.date without a time argument read clock instead of the system time
+func applyClock(L *lua.LState, clock Clock) {
+	osLib, ok := L.GetGlobal(lua.OsLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	if osTime, ok := osLib.RawGetString("time").(*lua.LFunction); ok {
+		osLib.RawSetString("time", L.NewFunction(func(L *lua.LState) int {
+			if L.GetTop() > 0 && L.Get(1) != lua.LNil {
+				L.Push(osTime)
+				L.Push(L.Get(1))
+				L.Call(1, 1)
+				return 1
+			}
+			L.Push(lua.LNumber(clock.Now().Unix()))
+			return 1
+		}))
+	}
+
+	if osDate, ok := osLib.RawGetString("date").(*lua.LFunction); ok {
+		osLib.RawSetString("date", L.NewFunction(func(L *lua.LState) int {
+			format := L.OptString(1, "%c")
+			at := L.Get(2)
+			if at == lua.LNil {
+				at = lua.LNumber(clock.Now().Unix())
+			}
+			L.Push(osDate)
+			L.Push(lua.LString(format))
+			L.Push(at)
+			L.Call(2, 1)
+			return 1
+		}))
+	}
+}
+
+// applySeed: replaces math.random and math.randomseed with a generator of the state seeded with seed,
+// so that the numbers scripts draw are the same on every run
+// math.randomseed reseeds that generator, it never touches the one of the process
+func applySeed(L *lua.LState, seed int64) {
+	mathLib, ok := L.GetGlobal(lua.MathLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	generator := rand.New(rand.NewSource(seed))
+	mathLib.RawSetString("random", L.NewFunction(func(L *lua.LState) int {
+		switch L.GetTop() {
+		case 0:
+			L.Push(lua.LNumber(generator.Float64()))
+		case 1:
+			upper := L.CheckInt(1)
+			if upper < 1 {
+				L.ArgError(1, "interval is empty")
+			}
+			L.Push(lua.LNumber(generator.Intn(upper) + 1))
+		default:
+			lower, upper := L.CheckInt(1), L.CheckInt(2)
+			if upper < lower {
+				L.ArgError(2, "interval is empty")
+			}
+			L.Push(lua.LNumber(lower + generator.Intn(upper-lower+1)))
+		}
+		return 1
+	}))
+	mathLib.RawSetString("randomseed", L.NewFunction(func(L *lua.LState) int {
+		generator.Seed(L.CheckInt64(1))
+		return 0
+	}))
+}
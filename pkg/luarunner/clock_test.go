@@ -0,0 +1,105 @@
+package luarunner
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timestampLabel: returns the timestamp label the add-label example wrote into result
+func timestampLabel(t *testing.T, result []byte) string {
+	t.Helper()
+	var object struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(result, &object); err != nil {
+		t.Fatalf("Failed to decode result %s: %v", result, err)
+	}
+	return object.Metadata.Labels["glua.maurice.fr/timestamp"]
+}
+
+func TestFrozenClock_AddLabelExample(t *testing.T) {
+	script, err := os.ReadFile("../../examples/scripts/add-label.lua")
+	if err != nil {
+		t.Fatalf("Failed to read example: %v", err)
+	}
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	frozen := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	object := []byte(`{"metadata": {"name": "test"}}`)
+
+	runner := NewScriptRunnerWithOptions(logger, Options{Clock: FrozenClock(frozen)})
+	first, err := runner.RunScript("add-label", string(script), object)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	second, err := runner.RunScript("add-label", string(script), object)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	if string(first) != string(second) {
+		t.Errorf("Expected identical output across runs, got %s and %s", first, second)
+	}
+	expected := frozen.Local().Format("2006-01-02T15:04:05Z")
+	if got := timestampLabel(t, first); got != expected {
+		t.Errorf("Expected timestamp %s, got %s", expected, got)
+	}
+
+	// Without a clock, scripts see the system time
+	live, err := NewScriptRunner(logger).RunScript("add-label", string(script), object)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	if got := timestampLabel(t, live); got == expected {
+		t.Errorf("Expected the system time without a clock, got the frozen one %s", got)
+	}
+}
+
+func TestFrozenClock_TimeModuleAndOsTime(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	frozen := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	runner := NewScriptRunnerWithOptions(logger, Options{Clock: FrozenClock(frozen)})
+
+	script := `
+		object.now = require("time").now()
+		object.os_time = os.time()
+		object.explicit = os.time({year = 2020, month = 1, day = 1, hour = 0})
+		object.utc = os.date("!%Y-%m-%dT%H:%M:%SZ")
+	`
+	result, err := runner.RunScript("clock", script, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	for _, literal := range []string{`"now":981173106`, `"os_time":981173106`, `"utc":"2001-02-03T04:05:06Z"`} {
+		if !strings.Contains(string(result), literal) {
+			t.Errorf("Expected %s in result, got %s", literal, result)
+		}
+	}
+	if strings.Contains(string(result), `"explicit":981173106`) {
+		t.Errorf("Expected os.time with a table to convert it, got %s", result)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	script := `object.draws = {math.random(), math.random(100), math.random(5, 10)}`
+
+	run := func(seed int64) string {
+		result, err := NewScriptRunnerWithOptions(logger, Options{Seed: seed}).RunScript("random", script, []byte(`{}`))
+		if err != nil {
+			t.Fatalf("RunScript failed: %v", err)
+		}
+		return string(result)
+	}
+
+	if first, second := run(42), run(42); first != second {
+		t.Errorf("Expected the same draws with the same seed, got %s and %s", first, second)
+	}
+	if first, second := run(42), run(43); first == second {
+		t.Errorf("Expected different draws with different seeds, got %s twice", first)
+	}
+}
@@ -0,0 +1,111 @@
+package luarunner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// compatConstruct: syntax of a later Lua version, which gopher-lua, implementing Lua 5.1, fails to parse
+type compatConstruct struct {
+	// token: the construct as written
+	token string
+	// name: what the construct does
+	name string
+	// version: first Lua version supporting the construct
+	version string
+	// instead: how to write it in Lua 5.1
+	instead string
+}
+
+var (
+	floorDivision  = compatConstruct{"//", "floor division", "5.3", "use math.floor(a / b)"}
+	bitwiseAnd     = compatConstruct{"&", "bitwise and", "5.3", "it has no bitwise operators, use arithmetic"}
+	bitwiseOr      = compatConstruct{"|", "bitwise or", "5.3", "it has no bitwise operators, use arithmetic"}
+	bitwiseXor     = compatConstruct{"~", "bitwise xor or not", "5.3", "it has no bitwise operators, and inequality is written ~="}
+	leftShift      = compatConstruct{"<<", "left shift", "5.3", "use a * 2 ^ n"}
+	rightShift     = compatConstruct{">>", "right shift", "5.3", "use math.floor(a / 2 ^ n)"}
+	localAttribute = compatConstruct{"<const>", "local variable attribute", "5.4", "drop the attribute"}
+)
+
+// CompatError: a parse error caused by syntax of a later Lua version, pointing at the construct
+type CompatError struct {
+	// Line: line of the construct
+	Line int
+	// Column: column of the construct
+	Column    int
+	construct compatConstruct
+	err       *parse.Error
+}
+
+func (e *CompatError) Error() string {
+	return fmt.Sprintf("line %d (column %d): %s", e.Line, e.Column, e.Message())
+}
+
+// Message: the error without its position
+func (e *CompatError) Message() string {
+	return fmt.Sprintf("'%s' (%s) is Lua %s syntax, scripts run on Lua 5.1: %s",
+		e.construct.token, e.construct.name, e.construct.version, e.construct.instead)
+}
+
+func (e *CompatError) Unwrap() error {
+	return e.err
+}
+
+// withCompatHint: returns a CompatError for a parse error of content raised by syntax of a later
+// Lua version, err as is otherwise
+func withCompatHint(content string, err error) error {
+	var parseErr *parse.Error
+	if !errors.As(err, &parseErr) || parseErr.Pos.Line == parse.EOF {
+		return err
+	}
+	lines := strings.Split(content, "\n")
+	if parseErr.Pos.Line < 1 || parseErr.Pos.Line > len(lines) {
+		return err
+	}
+
+	// The parser stops on the construct, or on its second character for two character operators
+	line := lines[parseErr.Pos.Line-1]
+	at := parseErr.Pos.Column - 1
+	if at < 0 || at >= len(line) {
+		return err
+	}
+	previous := func(c byte) bool { return at > 0 && line[at-1] == c }
+	column := parseErr.Pos.Column
+
+	var construct compatConstruct
+	switch line[at] {
+	case '/':
+		if !previous('/') {
+			return err
+		}
+		construct, column = floorDivision, column-1
+	case '&':
+		construct = bitwiseAnd
+	case '|':
+		construct = bitwiseOr
+	case '~':
+		construct = bitwiseXor
+	case '<':
+		switch {
+		case previous('<'):
+			construct, column = leftShift, column-1
+		case strings.HasPrefix(line[at:], "<const>"), strings.HasPrefix(line[at:], "<close>"):
+			construct = localAttribute
+			construct.token = line[at : at+len("<const>")]
+		default:
+			return err
+		}
+	case '>':
+		if !previous('>') {
+			return err
+		}
+		construct, column = rightShift, column-1
+	default:
+		return err
+	}
+
+	return &CompatError{Line: parseErr.Pos.Line, Column: column, construct: construct, err: parseErr}
+}
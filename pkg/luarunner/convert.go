@@ -0,0 +1,148 @@
+package luarunner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DefaultMaxDepth: nesting depth of the object scripts may produce when Options.MaxDepth is zero,
+// far beyond what Kubernetes objects need
+const DefaultMaxDepth = 100
+
+// maxPathLength: longest path reported in a ConversionError, longer ones are elided in the middle
+const maxPathLength = 200
+
+// ConversionError: the object a script left cannot be converted back to JSON
+type ConversionError struct {
+	// Path: Lua path of the offending value, e.g. object.spec.replicas
+	Path string
+	// Problem: what is wrong with it
+	Problem string
+}
+
+// Error: implements error
+func (e *ConversionError) Error() string {
+	return fmt.Sprintf("script set %s to %s", e.Path, e.Problem)
+}
+
+// checkConvertible: returns a ConversionError when value holds what JSON cannot represent: a table
+// containing itself, a structure nested deeper than maxDepth, or a NaN or infinite number
+// Converting those would recurse forever, overflow the stack or fail with an obscure message
+// Tables referenced several times without forming a cycle are fine
+func checkConvertible(value lua.LValue, root string, maxDepth int) error {
+	return checkStructure(value, root, maxDepth, true)
+}
+
+// checkStructure: same as checkConvertible, only checking numbers when numbers is set
+func checkStructure(value lua.LValue, root string, maxDepth int, numbers bool) error {
+	var path []lua.LValue
+	problem := walkConvertible(value, maxDepth, numbers, make(map[*lua.LTable]bool), &path)
+	if problem == "" {
+		return nil
+	}
+	return &ConversionError{Path: luaPath(root, path), Problem: problem}
+}
+
+// walkConvertible: see checkStructure, depth is how many levels value may still nest and onPath holds
+// the tables being walked. On failure, path holds the keys leading to the value, innermost last
+func walkConvertible(value lua.LValue, depth int, numbers bool, onPath map[*lua.LTable]bool, path *[]lua.LValue) string {
+	switch v := value.(type) {
+	case lua.LNumber:
+		if f := float64(v); numbers && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			return "a NaN or infinite number, which JSON cannot represent"
+		}
+	case *lua.LTable:
+		if onPath[v] {
+			return "a table containing itself"
+		}
+		if depth < 0 {
+			return "a structure nested too deep"
+		}
+
+		onPath[v] = true
+		for key, child := v.Next(lua.LNil); key != lua.LNil; key, child = v.Next(key) {
+			if problem := walkConvertible(child, depth-1, numbers, onPath, path); problem != "" {
+				*path = append(*path, key)
+				return problem
+			}
+		}
+		delete(onPath, v)
+	}
+	return ""
+}
+
+// luaPath: renders keys, collected innermost first, as a Lua path below root
+func luaPath(root string, keys []lua.LValue) string {
+	var b strings.Builder
+	b.WriteString(root)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if s, ok := keys[i].(lua.LString); ok {
+			b.WriteString("." + string(s))
+		} else {
+			b.WriteString("[" + keys[i].String() + "]")
+		}
+	}
+
+	formatted := b.String()
+	if len(formatted) > maxPathLength {
+		formatted = formatted[:maxPathLength/2] + "..." + formatted[len(formatted)-maxPathLength/2:]
+	}
+	return formatted
+}
+
+// convertingFunctions: module functions converting a table argument to Go recursively, by module,
+// with the position of the argument. A table containing itself would overflow the stack of the
+// webhook, which is fatal to the whole process rather than to the script
+var convertingFunctions = map[string]map[string]int{
+	"json":     {"stringify": 1},
+	"yaml":     {"stringify": 1},
+	"spew":     {"dump": 1, "sdump": 1},
+	"template": {"render": 2, "render_file": 2},
+}
+
+// guardConversions: wraps the loader of a module so that its functions listed in convertingFunctions
+// raise an error on tables containing themselves or nested deeper than maxDepth instead of
+// recursing into them. Numbers are left to the functions, which report NaN and infinities themselves
+func guardConversions(module string, loader lua.LGFunction, maxDepth int) lua.LGFunction {
+	functions, ok := convertingFunctions[module]
+	if !ok {
+		return loader
+	}
+
+	return func(L *lua.LState) int {
+		n := loader(L)
+		mod, ok := L.Get(-1).(*lua.LTable)
+		if !ok {
+			return n
+		}
+
+		for name, argument := range functions {
+			original, ok := mod.RawGetString(name).(*lua.LFunction)
+			if !ok {
+				continue
+			}
+			qualified, argument := module+"."+name, argument
+			mod.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+				if err := checkStructure(L.Get(argument), "argument", maxDepth, false); err != nil {
+					var conversionErr *ConversionError
+					if errors.As(err, &conversionErr) {
+						L.RaiseError("%s: %s is %s", qualified, conversionErr.Path, conversionErr.Problem)
+					}
+				}
+
+				top := L.GetTop()
+				L.Push(original)
+				for i := 1; i <= top; i++ {
+					L.Push(L.Get(i))
+				}
+				L.Call(top, lua.MultRet)
+				return L.GetTop() - top
+			}))
+		}
+		return n
+	}
+}
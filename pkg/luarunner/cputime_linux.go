@@ -0,0 +1,25 @@
+//go:build linux
+
+package luarunner
+
+import (
+	gotime "time"
+
+	"golang.org/x/sys/unix"
+)
+
+// threadCPUTime: returns the CPU time consumed by the calling OS thread, false when it cannot be read
+// The caller must be locked to its thread for two readings to be comparable
+// Reads CLOCK_THREAD_CPUTIME_ID, falling back to the resource usage of the thread
+func threadCPUTime() (gotime.Duration, bool) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_THREAD_CPUTIME_ID, &ts); err == nil {
+		return gotime.Duration(ts.Nano()), true
+	}
+
+	var usage unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_THREAD, &usage); err == nil {
+		return gotime.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+	}
+	return 0, false
+}
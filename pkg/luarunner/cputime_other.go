@@ -0,0 +1,10 @@
+//go:build !linux
+
+package luarunner
+
+import gotime "time"
+
+// threadCPUTime: per-thread CPU clocks are only read on Linux, scripts report their wall time instead
+func threadCPUTime() (gotime.Duration, bool) {
+	return 0, false
+}
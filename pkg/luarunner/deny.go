@@ -0,0 +1,121 @@
+package luarunner
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Denial reasons of the deny helpers, translated into the status of the admission response by the webhook
+const (
+	// DenyForbidden: the object is not allowed by policy, deny_forbidden(message[, field])
+	DenyForbidden = "Forbidden"
+	// DenyInvalid: the object is malformed or fails validation, deny_invalid(message[, field])
+	DenyInvalid = "Invalid"
+	// DenyConflict: the object conflicts with the state of the cluster, deny_conflict(message[, field])
+	DenyConflict = "Conflict"
+)
+
+// denyHelpers: Lua function names of the deny helpers, and the reason each denies with
+var denyHelpers = map[string]string{
+	"deny_forbidden": DenyForbidden,
+	"deny_invalid":   DenyInvalid,
+	"deny_conflict":  DenyConflict,
+}
+
+// Denial: a script denied the request through one of the deny helpers
+// It is returned as the error of the script, and stops the chain
+type Denial struct {
+	// Reason: DenyForbidden, DenyInvalid or DenyConflict
+	Reason string
+	// Message: explanation given by the script
+	Message string
+	// Field: path of the offending field given by the script, such as spec.containers[0].image
+	// Empty when the denial is not about a single field
+	Field string
+	// Causes: field-level problems listed by the script, each reported as a cause of the denial
+	Causes []DenialCause
+}
+
+// DenialCause: a problem with one field of the object, like the causes of API validation errors
+type DenialCause struct {
+	// Type: cause type, such as FieldValueInvalid or FieldValueRequired, the reason of the denial when empty
+	Type string
+	// Message: explanation of the problem
+	Message string
+	// Field: path of the offending field, such as spec.containers[0].image
+	Field string
+}
+
+// Error: implements error
+func (d *Denial) Error() string {
+	return "denied (" + d.Reason + "): " + d.Message
+}
+
+// registerDenyHelpers: exposes deny_forbidden, deny_invalid and deny_conflict to scripts, called
+// either as deny_invalid(message[, field]) or as deny_invalid{message = ..., field = ..., causes = ...}
+// causes is an array of {message = ..., field = ..., type = ...} tables, one per offending field
+// Each records the denial into denial and stops the script
+func registerDenyHelpers(L *lua.LState, denial **Denial) {
+	for name, reason := range denyHelpers {
+		L.SetGlobal(name, L.NewFunction(func(L *lua.LState) int {
+			d := &Denial{Reason: reason}
+			if options, ok := L.Get(1).(*lua.LTable); ok {
+				message, ok := options.RawGetString("message").(lua.LString)
+				if !ok {
+					L.ArgError(1, "message must be a string")
+				}
+				d.Message = string(message)
+				switch field := options.RawGetString("field").(type) {
+				case lua.LString:
+					d.Field = string(field)
+				case *lua.LNilType:
+				default:
+					L.ArgError(1, "field must be a string")
+				}
+				d.Causes = checkCauses(L, options.RawGetString("causes"))
+			} else {
+				d.Message = L.CheckString(1)
+				d.Field = L.OptString(2, "")
+			}
+			*denial = d
+			L.RaiseError("%s", d.Error())
+			return 0
+		}))
+	}
+}
+
+// checkCauses: converts the causes option of a deny helper, raising an argument error when malformed
+func checkCauses(L *lua.LState, value lua.LValue) []DenialCause {
+	if value == lua.LNil {
+		return nil
+	}
+	list, ok := value.(*lua.LTable)
+	if !ok {
+		L.ArgError(1, "causes must be an array of tables")
+	}
+
+	causes := make([]DenialCause, 0, list.Len())
+	for i := 1; i <= list.Len(); i++ {
+		entry, ok := list.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			L.ArgError(1, fmt.Sprintf("cause %d must be a table", i))
+		}
+
+		var cause DenialCause
+		for key, target := range map[string]*string{"type": &cause.Type, "message": &cause.Message, "field": &cause.Field} {
+			switch value := entry.RawGetString(key).(type) {
+			case lua.LString:
+				*target = string(value)
+			case *lua.LNilType:
+			default:
+				L.ArgError(1, fmt.Sprintf("%s of cause %d must be a string", key, i))
+			}
+		}
+		if cause.Message == "" {
+			L.ArgError(1, fmt.Sprintf("cause %d has no message", i))
+		}
+		causes = append(causes, cause)
+	}
+	return causes
+}
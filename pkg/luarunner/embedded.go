@@ -0,0 +1,116 @@
+package luarunner
+
+import (
+	_ "embed"
+	"regexp"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// podspecLibrary: source of the k8s.podspec library
+//
+//go:embed lualib/k8s_podspec.lua
+var podspecLibrary string
+
+// policyLibrary: source of the k8s.policy library
+//
+//go:embed lualib/k8s_policy.lua
+var policyLibrary string
+
+// embeddedLibrary: a library written in Lua and shipped with the webhook
+type embeddedLibrary struct {
+	name   string
+	source string
+
+	once  sync.Once
+	proto *lua.FunctionProto
+	err   error
+}
+
+// embeddedLibraries: Lua libraries always available to scripts through require
+// They are plain Lua without host access, so neither the allowlist nor safe mode remove them:
+// scripts relying on them keep working whatever the sandbox settings
+var embeddedLibraries = []*embeddedLibrary{
+	{name: "k8s.podspec", source: podspecLibrary},
+	{name: "k8s.policy", source: policyLibrary},
+}
+
+// compile: returns the bytecode of the library, compiled once for all scripts
+func (l *embeddedLibrary) compile() (*lua.FunctionProto, error) {
+	l.once.Do(func() {
+		chunk, err := parse.Parse(strings.NewReader(l.source), l.name)
+		if err != nil {
+			l.err = err
+			return
+		}
+		l.proto, l.err = lua.Compile(chunk, l.name)
+	})
+	return l.proto, l.err
+}
+
+// loader: returns the module loader running the library in the state requiring it
+func (l *embeddedLibrary) loader() lua.LGFunction {
+	return func(L *lua.LState) int {
+		proto, err := l.compile()
+		if err != nil {
+			L.RaiseError("failed to compile %s: %v", l.name, err)
+		}
+		L.Push(L.NewFunctionFromProto(proto))
+		L.Call(0, 1)
+		return 1
+	}
+}
+
+// preloadEmbeddedLibraries: makes the embedded libraries available to require
+func preloadEmbeddedLibraries(L *lua.LState) []string {
+	names := make([]string, 0, len(embeddedLibraries))
+	for _, library := range embeddedLibraries {
+		L.PreloadModule(library.name, library.loader())
+		names = append(names, library.name)
+	}
+	return names
+}
+
+var (
+	// stubFunction: declaration of a function of the library table, module.name(arguments)
+	stubFunction = regexp.MustCompile(`^function (\w+\.\w+\([^)]*\))`)
+	// stubTable: declaration of the library table
+	stubTable = regexp.MustCompile(`^local \w+ = \{\}$`)
+)
+
+// stubs: returns the LuaLS definitions of the library, the annotated declarations of its source
+// Annotation comments (---) are kept with the function or table declaration following them,
+// function bodies are dropped
+func (l *embeddedLibrary) stubs() string {
+	var out, annotations strings.Builder
+	out.WriteString("---@meta " + l.name + "\n")
+
+	for _, line := range strings.Split(l.source, "\n") {
+		switch {
+		case strings.HasPrefix(line, "---"):
+			annotations.WriteString(line + "\n")
+			continue
+		case annotations.Len() > 0 && stubTable.MatchString(line):
+			out.WriteString("\n" + annotations.String() + line + "\n")
+		case annotations.Len() > 0 && stubFunction.MatchString(line):
+			out.WriteString("\n" + annotations.String() + "function " + stubFunction.FindStringSubmatch(line)[1] + " end\n")
+		case strings.HasPrefix(line, "return "):
+			out.WriteString("\n" + line + "\n")
+		}
+		annotations.Reset()
+	}
+	return out.String()
+}
+
+// EmbeddedLibraryStubs: LuaLS definitions of the embedded libraries, by module name
+// Each is a ---@meta file, IDEs resolve require of the module name to it
+func EmbeddedLibraryStubs() map[string]string {
+	stubs := make(map[string]string, len(embeddedLibraries))
+	for _, library := range embeddedLibraries {
+		stubs[library.name] = library.stubs()
+	}
+	return stubs
+}
@@ -0,0 +1,117 @@
+package luarunner
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runLuaTests: runs every global test_* function defined by the Lua file in its own state
+func runLuaTests(t *testing.T, path string) {
+	t.Helper()
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+
+	newState := func() *lua.LState {
+		L := lua.NewState()
+		preloadEmbeddedLibraries(L)
+		if err := L.DoString(string(source)); err != nil {
+			L.Close()
+			t.Fatalf("Failed to load %s: %v", path, err)
+		}
+		return L
+	}
+
+	L := newState()
+	var names []string
+	L.G.Global.ForEach(func(key, value lua.LValue) {
+		if name, ok := key.(lua.LString); ok && strings.HasPrefix(string(name), "test_") && value.Type() == lua.LTFunction {
+			names = append(names, string(name))
+		}
+	})
+	L.Close()
+	sort.Strings(names)
+	if len(names) == 0 {
+		t.Fatalf("No test functions in %s", path)
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			L := newState()
+			defer L.Close()
+			if err := L.CallByParam(lua.P{Fn: L.GetGlobal(name), NRet: 0, Protect: true}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPodspecLibrary(t *testing.T) {
+	runLuaTests(t, "testdata/k8s_podspec_test.lua")
+}
+
+func TestPolicyLibrary(t *testing.T) {
+	runLuaTests(t, "testdata/k8s_policy_test.lua")
+}
+
+func TestEmbeddedLibraryStubs(t *testing.T) {
+	stubs := EmbeddedLibraryStubs()
+	if len(stubs) != len(embeddedLibraries) {
+		t.Fatalf("Expected stubs for %d libraries, got %d", len(embeddedLibraries), len(stubs))
+	}
+
+	policy := stubs["k8s.policy"]
+	for _, expected := range []string{
+		"---@meta k8s.policy\n",
+		"---@class k8s.policy\nlocal policy = {}\n",
+		"---@return string|nil message\nfunction policy.require_labels(object, names) end\n",
+		"function policy.require_probes(pod, kinds) end\n",
+		"return policy\n",
+	} {
+		if !strings.Contains(policy, expected) {
+			t.Errorf("Expected the stubs to contain %q, got:\n%s", expected, policy)
+		}
+	}
+	// Only annotated declarations make it into the stubs, not the helpers or function bodies
+	for _, unexpected := range []string{"spec_of", "insert(problems"} {
+		if strings.Contains(policy, unexpected) {
+			t.Errorf("Expected the stubs not to contain %q, got:\n%s", unexpected, policy)
+		}
+	}
+
+	// Stubs are valid Lua
+	for name, stub := range stubs {
+		if issues := Lint(name, stub); len(issues) != 0 {
+			t.Errorf("Stubs of %s do not compile: %v", name, issues)
+		}
+	}
+}
+
+func TestEmbeddedLibraries_Sandbox(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	script := `
+		local podspec = require("k8s.podspec")
+		podspec.ensure_container(object, {name = "sidecar", image = "sidecar:1"})
+	`
+
+	for _, options := range []Options{
+		{Allowlist: []string{}},
+		{Allowlist: []string{"json"}, SafeMode: true},
+	} {
+		runner := NewScriptRunnerWithOptions(logger, options)
+		result, err := runner.RunScript("inject", script, []byte(`{"kind":"Pod","spec":{"containers":[{"name":"app"}]}}`))
+		if err != nil {
+			t.Fatalf("RunScript failed with %+v: %v", options, err)
+		}
+		if !strings.Contains(string(result), `"sidecar:1"`) {
+			t.Errorf("Expected the sidecar with %+v, got %s", options, result)
+		}
+	}
+}
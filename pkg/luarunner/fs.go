@@ -0,0 +1,186 @@
+package luarunner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// fsWriteFunctions: functions of the fs module changing the file system, refused by the rooted module
+var fsWriteFunctions = []string{"write_file", "mkdir", "mkdir_all", "remove", "remove_all"}
+
+// disabledFSLoader: the fs module when Options.DisableFS is set, failing require with an explanation
+// rather than the "module not found" scripts written against exec would otherwise get
+func disabledFSLoader(L *lua.LState) int {
+	L.RaiseError("the fs module is disabled in the webhook, scripts may only read files from a scripts data directory configured on it")
+	return 0
+}
+
+// rootedFS: the fs module confined to a directory, read-only, for Options.FSRoot
+// Paths are resolved inside the directory, "/config.yaml" and "config.yaml" are the same file.
+// Paths leaving it, through ".." or symbolic links, fail
+type rootedFS struct {
+	dir string
+}
+
+// loader: returns the rooted fs module, with the same functions as glua's fs module
+//
+//	local fs = require("fs")
+//	local content, err = fs.read_file("reference/registries.yaml")
+func (f rootedFS) loader(L *lua.LState) int {
+	functions := map[string]lua.LGFunction{
+		"read_file": f.readFile,
+		"exists":    f.exists,
+		"list":      f.list,
+		"stat":      f.stat,
+	}
+	for _, name := range fsWriteFunctions {
+		functions[name] = readOnlyFS(name)
+	}
+
+	L.Push(L.SetFuncs(L.NewTable(), functions))
+	return 1
+}
+
+// readOnlyFS: a write function of the fs module, returning an error instead of writing
+func readOnlyFS(name string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		L.Push(lua.LString(fmt.Sprintf("fs.%s is unavailable, the fs module is read-only in the webhook", name)))
+		return 1
+	}
+}
+
+// resolve: returns the path relative to the root a script path designates
+func (f rootedFS) resolve(path string) (string, error) {
+	relative := strings.TrimLeft(filepath.ToSlash(path), "/")
+	if relative == "" {
+		return ".", nil
+	}
+	if !filepath.IsLocal(relative) {
+		return "", fmt.Errorf("path %s escapes the scripts data directory", path)
+	}
+	return filepath.Clean(relative), nil
+}
+
+// open: resolves path and opens it within the root, the caller closes the returned root
+func (f rootedFS) open(path string) (*os.Root, *os.File, error) {
+	relative, err := f.resolve(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root, err := os.OpenRoot(f.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("scripts data directory unavailable: %w", err)
+	}
+	file, err := root.Open(relative)
+	if err != nil {
+		root.Close()
+		return nil, nil, err
+	}
+	return root, file, nil
+}
+
+// readFile: fs.read_file(path), returns the content, or nil and an error message
+func (f rootedFS) readFile(L *lua.LState) int {
+	root, file, err := f.open(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to read file: %v", err)))
+		return 2
+	}
+	defer root.Close()
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to read file: %v", err)))
+		return 2
+	}
+
+	L.Push(lua.LString(string(content)))
+	L.Push(lua.LNil)
+	return 2
+}
+
+// exists: fs.exists(path), false for paths outside the root, with the reason as second value
+func (f rootedFS) exists(L *lua.LState) int {
+	root, file, err := f.open(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LFalse)
+		if !os.IsNotExist(err) {
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		return 1
+	}
+	file.Close()
+	root.Close()
+
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// list: fs.list(path), returns the entry names of a directory, or nil and an error message
+func (f rootedFS) list(L *lua.LState) int {
+	root, file, err := f.open(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to list directory: %v", err)))
+		return 2
+	}
+	defer root.Close()
+	defer file.Close()
+
+	entries, err := file.ReadDir(-1)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to list directory: %v", err)))
+		return 2
+	}
+
+	tbl := L.NewTable()
+	for i, entry := range entries {
+		tbl.RawSetInt(i+1, lua.LString(entry.Name()))
+	}
+
+	L.Push(tbl)
+	L.Push(lua.LNil)
+	return 2
+}
+
+// stat: fs.stat(path), returns name, size, is_dir, mode and mod_time, or nil and an error message
+func (f rootedFS) stat(L *lua.LState) int {
+	path := L.CheckString(1)
+	root, file, err := f.open(path)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to stat: %v", err)))
+		return 2
+	}
+	defer root.Close()
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to stat: %v", err)))
+		return 2
+	}
+
+	tbl := L.NewTable()
+	tbl.RawSetString("name", lua.LString(filepath.Base(path)))
+	tbl.RawSetString("size", lua.LNumber(info.Size()))
+	tbl.RawSetString("is_dir", lua.LBool(info.IsDir()))
+	tbl.RawSetString("mode", lua.LNumber(info.Mode()))
+	tbl.RawSetString("mod_time", lua.LNumber(info.ModTime().Unix()))
+
+	L.Push(tbl)
+	L.Push(lua.LNil)
+	return 2
+}
@@ -0,0 +1,138 @@
+package luarunner
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fsDataDir: returns a data directory holding reference/registries.yaml, next to a secret file
+// outside of it, and a symbolic link from inside to the secret
+func fsDataDir(t *testing.T) (dir, secret string) {
+	t.Helper()
+
+	parent := t.TempDir()
+	dir = filepath.Join(parent, "data")
+	secret = filepath.Join(parent, "secret.txt")
+	if err := os.MkdirAll(filepath.Join(dir, "reference"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "reference", "registries.yaml"), []byte("allowed: [ghcr.io]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secret, []byte("s3cr3t"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	return dir, secret
+}
+
+// runFSScript: runs script with the options and returns the fields it set on object
+func runFSScript(t *testing.T, options Options, script string) map[string]interface{} {
+	t.Helper()
+
+	runner := NewScriptRunnerWithOptions(log.New(os.Stdout, "[test] ", log.LstdFlags), options)
+	result, err := runner.RunScript("fs", script, []byte(`{"kind":"ConfigMap"}`))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(result, &object); err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	return object
+}
+
+func TestFS_Rooted(t *testing.T) {
+	dir, _ := fsDataDir(t)
+
+	object := runFSScript(t, Options{FSRoot: dir}, `
+		local fs = require("fs")
+		object.relative = fs.read_file("reference/registries.yaml")
+		object.absolute = fs.read_file("/reference/registries.yaml")
+		object.exists = fs.exists("reference/registries.yaml")
+		object.missing = fs.exists("reference/none.yaml")
+		local entries = fs.list("/")
+		object.entries = table.concat(entries, ",")
+		object.is_dir = fs.stat("reference").is_dir
+
+		local _, err = fs.read_file("../../etc/passwd")
+		object.traversal = err
+		_, err = fs.read_file("reference/../../secret.txt")
+		object.nested_traversal = err
+		object.escape_exists = fs.exists("../secret.txt")
+		_, err = fs.list("..")
+		object.list_parent = err
+		_, err = fs.read_file("link.txt")
+		object.symlink = err
+
+		object.write = fs.write_file("reference/registries.yaml", "allowed: []")
+		object.remove = fs.remove("reference/registries.yaml")
+	`)
+
+	if object["relative"] != "allowed: [ghcr.io]\n" || object["absolute"] != object["relative"] {
+		t.Errorf("Expected files under the root to be readable, got %v and %v", object["relative"], object["absolute"])
+	}
+	if object["exists"] != true || object["missing"] != false || object["is_dir"] != true {
+		t.Errorf("Unexpected exists/stat results: %v", object)
+	}
+	if entries, _ := object["entries"].(string); !strings.Contains(entries, "reference") {
+		t.Errorf("Expected the root to be listed, got %v", object["entries"])
+	}
+
+	for _, field := range []string{"traversal", "nested_traversal", "list_parent"} {
+		if message, _ := object[field].(string); !strings.Contains(message, "escapes the scripts data directory") {
+			t.Errorf("Expected %s to fail with a clear message, got %v", field, object[field])
+		}
+	}
+	if object["escape_exists"] != false {
+		t.Errorf("Expected paths outside the root not to exist, got %v", object["escape_exists"])
+	}
+	if message, _ := object["symlink"].(string); message == "" || strings.Contains(message, "s3cr3t") {
+		t.Errorf("Expected the symbolic link leaving the root to fail, got %v", object["symlink"])
+	}
+
+	for _, field := range []string{"write", "remove"} {
+		if message, _ := object[field].(string); !strings.Contains(message, "read-only") {
+			t.Errorf("Expected %s to be refused, got %v", field, object[field])
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "reference", "registries.yaml")); string(content) != "allowed: [ghcr.io]\n" {
+		t.Errorf("Expected the file to be left alone, got %q", content)
+	}
+}
+
+func TestFS_Disabled(t *testing.T) {
+	object := runFSScript(t, Options{DisableFS: true, FSRoot: "/"}, `
+		local ok, err = pcall(require, "fs")
+		object.ok = ok
+		object.err = err
+	`)
+
+	if message, _ := object["err"].(string); object["ok"] != false || !strings.Contains(message, "fs module is disabled") {
+		t.Errorf("Expected require to fail with an explanation, got %v", object)
+	}
+}
+
+func TestFS_Unrestricted(t *testing.T) {
+	_, secret := fsDataDir(t)
+
+	object := runFSScript(t, Options{}, `
+		local fs = require("fs")
+		object.content = fs.read_file("`+secret+`")
+		object.write = fs.write_file("`+secret+`", "changed")
+	`)
+
+	if object["content"] != "s3cr3t" || object["write"] != nil {
+		t.Errorf("Expected the fs module to be unrestricted, got %v", object)
+	}
+	if content, _ := os.ReadFile(secret); string(content) != "changed" {
+		t.Errorf("Expected the file to be written, got %q", content)
+	}
+}
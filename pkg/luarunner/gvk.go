@@ -0,0 +1,42 @@
+package luarunner
+
+import (
+	"context"
+
+	lua "github.com/yuin/gopher-lua"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GVKGlobal: name of the global table holding the group, version and kind of the admission request
+const GVKGlobal = "gvk"
+
+// gvkKey: context key of the group, version and kind of the admission request
+type gvkKey struct{}
+
+// WithGVK: returns a context whose script chains expose gvk, the kind of the admission request, as
+// the gvk global. It is authoritative, unlike object.apiVersion and object.kind which some API
+// servers leave out of the objects they send
+func WithGVK(ctx context.Context, gvk schema.GroupVersionKind) context.Context {
+	return context.WithValue(ctx, gvkKey{}, gvk)
+}
+
+// gvkFrom: returns the group, version and kind attached to ctx by WithGVK, empty when there is none
+func gvkFrom(ctx context.Context) schema.GroupVersionKind {
+	gvk, _ := ctx.Value(gvkKey{}).(schema.GroupVersionKind)
+	return gvk
+}
+
+// setGVK: exposes gvk to scripts as the gvk global, gvk.group, gvk.version, gvk.kind and
+// gvk.api_version, empty strings when unknown so that scripts can compare them without nil checks
+func setGVK(L *lua.LState, gvk schema.GroupVersionKind) {
+	table := L.NewTable()
+	table.RawSetString("group", lua.LString(gvk.Group))
+	table.RawSetString("version", lua.LString(gvk.Version))
+	table.RawSetString("kind", lua.LString(gvk.Kind))
+	apiVersion, _ := gvk.ToAPIVersionAndKind()
+	if gvk.Version == "" {
+		apiVersion = ""
+	}
+	table.RawSetString("api_version", lua.LString(apiVersion))
+	L.SetGlobal(GVKGlobal, table)
+}
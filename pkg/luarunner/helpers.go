@@ -0,0 +1,271 @@
+package luarunner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// helpersLoader: loads the helpers module, nil-safe accessors for nested object fields
+//
+// Paths are dotted strings such as "metadata.labels.app" where all-digit segments index
+// arrays (1-based, like Lua) and "\." stands for a literal dot inside a key, so that
+// "metadata.labels.app\\.kubernetes\\.io/name" (as a Lua string literal) addresses the
+// "app.kubernetes.io/name" label. A table of segments, such as
+// {"metadata", "labels", "app.kubernetes.io/name"}, is accepted as well and never escaped
+func helpersLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":    helpersGet,
+		"set":    helpersSet,
+		"ensure": helpersEnsure,
+		"del":    helpersDel,
+
+		"sorted_pairs": helpersSortedPairs,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// helpersGet: get(object, path) returns the value at path, or nil when any part of it is missing
+func helpersGet(L *lua.LState) int {
+	segments := checkPath(L, 2)
+	L.Push(lookupPath(L.Get(1), segments))
+	return 1
+}
+
+// helpersSet: set(object, path, value) stores value at path, creating intermediate tables
+func helpersSet(L *lua.LState) int {
+	object := L.CheckTable(1)
+	segments := checkPath(L, 2)
+	value := L.Get(3)
+
+	parent := walkPath(L, "set", object, segments[:len(segments)-1])
+	parent.RawSet(segments[len(segments)-1], value)
+	return 0
+}
+
+// helpersEnsure: ensure(object, path) returns the table at path, creating it and its parents when missing
+func helpersEnsure(L *lua.LState) int {
+	object := L.CheckTable(1)
+	segments := checkPath(L, 2)
+
+	L.Push(walkPath(L, "ensure", object, segments))
+	return 1
+}
+
+// helpersDel: del(object, path) removes the value at path and returns it
+// Array elements are removed like table.remove, shifting down the following elements
+func helpersDel(L *lua.LState) int {
+	segments := checkPath(L, 2)
+
+	parent, ok := lookupPath(L.Get(1), segments[:len(segments)-1]).(*lua.LTable)
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	last := segments[len(segments)-1]
+	removed := parent.RawGet(last)
+
+	if index, isIndex := last.(lua.LNumber); isIndex && int(index) >= 1 && int(index) <= parent.Len() {
+		parent.Remove(int(index))
+	} else {
+		parent.RawSet(last, lua.LNil)
+	}
+
+	L.Push(removed)
+	return 1
+}
+
+// checkPath: reads the path argument at position n, raising an argument error when it is invalid
+func checkPath(L *lua.LState, n int) []lua.LValue {
+	switch path := L.Get(n).(type) {
+	case lua.LString:
+		segments, err := splitPath(string(path))
+		if err != nil {
+			L.ArgError(n, err.Error())
+		}
+		return segments
+	case *lua.LTable:
+		var segments []lua.LValue
+		for i := 1; i <= path.Len(); i++ {
+			switch segment := path.RawGetInt(i).(type) {
+			case lua.LString, lua.LNumber:
+				segments = append(segments, segment)
+			default:
+				L.ArgError(n, fmt.Sprintf("path segment %d must be a string or a number, got %s", i, segment.Type()))
+			}
+		}
+		if len(segments) == 0 {
+			L.ArgError(n, "path is empty")
+		}
+		return segments
+	default:
+		L.ArgError(n, fmt.Sprintf("path must be a string or a table, got %s", path.Type()))
+		return nil
+	}
+}
+
+// splitPath: splits a dotted path into keys, all-digit segments become array indices
+// A backslash escapes the next character, so "\." is a literal dot and "\\" a literal backslash
+func splitPath(path string) ([]lua.LValue, error) {
+	var segments []lua.LValue
+	var current strings.Builder
+	escaped := false
+	literal := false // current segment contains escaped characters, never an index
+
+	flush := func() error {
+		segment := current.String()
+		if segment == "" {
+			return fmt.Errorf("empty segment in path %q", path)
+		}
+		if index, err := strconv.Atoi(segment); err == nil && !literal && index >= 1 && isDigits(segment) {
+			segments = append(segments, lua.LNumber(index))
+		} else {
+			segments = append(segments, lua.LString(segment))
+		}
+		current.Reset()
+		literal = false
+		return nil
+	}
+
+	for _, r := range path {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+			literal = true
+		case r == '\\':
+			escaped = true
+		case r == '.':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("trailing escape in path %q", path)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
+
+// isDigits: reports whether s only holds ASCII digits
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPath: follows segments from value, returning nil as soon as a step is not a table
+func lookupPath(value lua.LValue, segments []lua.LValue) lua.LValue {
+	for _, segment := range segments {
+		tbl, ok := value.(*lua.LTable)
+		if !ok {
+			return lua.LNil
+		}
+		value = tbl.RawGet(segment)
+	}
+	return value
+}
+
+// walkPath: follows segments from object, creating missing tables, and returns the last table
+// Raises an error when a step holds a value that is not a table
+func walkPath(L *lua.LState, function string, object *lua.LTable, segments []lua.LValue) *lua.LTable {
+	current := object
+	for i, segment := range segments {
+		switch next := current.RawGet(segment).(type) {
+		case *lua.LTable:
+			current = next
+		case *lua.LNilType:
+			created := L.NewTable()
+			current.RawSet(segment, created)
+			current = created
+		default:
+			L.RaiseError("helpers.%s: %s is a %s, not a table", function, formatPath(segments[:i+1]), next.Type())
+		}
+	}
+	return current
+}
+
+// formatPath: renders segments back as a dotted path for error messages
+func formatPath(segments []lua.LValue) string {
+	parts := make([]string, len(segments))
+	for i, segment := range segments {
+		parts[i] = strings.ReplaceAll(segment.String(), ".", `\.`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// helpersSortedPairs: sorted_pairs(t) iterates over t like pairs, in sorted key order
+// Numeric keys come first in ascending order, then string keys in lexicographic order
+func helpersSortedPairs(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	L.Push(newKeysIterator(L, tbl, sortedKeys(tbl)))
+	L.Push(tbl)
+	L.Push(lua.LNil)
+	return 3
+}
+
+// newKeysIterator: returns an iterator function yielding the given keys of tbl and their values,
+// skipping keys whose value has been removed since
+func newKeysIterator(L *lua.LState, tbl *lua.LTable, keys []lua.LValue) *lua.LFunction {
+	i := 0
+	return L.NewFunction(func(L *lua.LState) int {
+		for i < len(keys) {
+			key := keys[i]
+			i++
+			if value := tbl.RawGet(key); value != lua.LNil {
+				L.Push(key)
+				L.Push(value)
+				return 2
+			}
+		}
+		L.Push(lua.LNil)
+		return 1
+	})
+}
+
+// sortedKeys: returns the keys of tbl, numbers first in ascending order, then strings, then the rest
+func sortedKeys(tbl *lua.LTable) []lua.LValue {
+	var keys []lua.LValue
+	tbl.ForEach(func(key, _ lua.LValue) {
+		keys = append(keys, key)
+	})
+
+	rank := func(v lua.LValue) int {
+		switch v.(type) {
+		case lua.LNumber:
+			return 0
+		case lua.LString:
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		ri, rj := rank(keys[i]), rank(keys[j])
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == 0 {
+			return keys[i].(lua.LNumber) < keys[j].(lua.LNumber)
+		}
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys
+}
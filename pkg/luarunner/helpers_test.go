@@ -0,0 +1,235 @@
+package luarunner
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runHelpersScript: runs script against input through a fresh runner and decodes the result
+func runHelpersScript(t *testing.T, script string, input map[string]interface{}) map[string]interface{} {
+	t.Helper()
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	inputJSON, err := json.Marshal(input)
+	if err != nil {
+		t.Fatalf("Failed to marshal input: %v", err)
+	}
+
+	result, err := NewScriptRunner(logger).RunScript("helpers", `local helpers = require("helpers")`+"\n"+script, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	var resultObj map[string]interface{}
+	if err := json.Unmarshal(result, &resultObj); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+	return resultObj
+}
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []lua.LValue
+		wantErr  bool
+	}{
+		{path: "metadata", expected: []lua.LValue{lua.LString("metadata")}},
+		{path: "metadata.labels.app", expected: []lua.LValue{lua.LString("metadata"), lua.LString("labels"), lua.LString("app")}},
+		{path: "spec.containers.1.image", expected: []lua.LValue{lua.LString("spec"), lua.LString("containers"), lua.LNumber(1), lua.LString("image")}},
+		{path: `metadata.labels.app\.kubernetes\.io/name`, expected: []lua.LValue{lua.LString("metadata"), lua.LString("labels"), lua.LString("app.kubernetes.io/name")}},
+		{path: `data.back\\slash`, expected: []lua.LValue{lua.LString("data"), lua.LString(`back\slash`)}},
+		{path: `ports.\80`, expected: []lua.LValue{lua.LString("ports"), lua.LString("80")}},
+		{path: "items.0", expected: []lua.LValue{lua.LString("items"), lua.LString("0")}},
+		{path: "", wantErr: true},
+		{path: "metadata..labels", wantErr: true},
+		{path: "metadata.", wantErr: true},
+		{path: `metadata\`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			segments, err := splitPath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for path %q, got %v", tt.path, segments)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitPath failed: %v", err)
+			}
+			if !reflect.DeepEqual(segments, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, segments)
+			}
+		})
+	}
+}
+
+func TestHelpers_Get(t *testing.T) {
+	input := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{
+				"app":                    "web",
+				"app.kubernetes.io/name": "frontend",
+			},
+		},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "nginx", "image": "nginx:1.25"},
+				map[string]interface{}{"name": "envoy", "image": "envoy:1.30"},
+			},
+		},
+	}
+
+	result := runHelpersScript(t, `
+		object.results = {
+			app = helpers.get(object, "metadata.labels.app"),
+			escaped = helpers.get(object, "metadata.labels.app\\.kubernetes\\.io/name"),
+			segments = helpers.get(object, {"metadata", "labels", "app.kubernetes.io/name"}),
+			second_image = helpers.get(object, "spec.containers.2.image"),
+			missing_intermediate = helpers.get(object, "metadata.annotations.owner") == nil,
+			out_of_range = helpers.get(object, "spec.containers.5.image") == nil,
+			through_scalar = helpers.get(object, "metadata.labels.app.name") == nil,
+			nil_object = helpers.get(nil, "metadata") == nil,
+		}
+	`, input)
+
+	expected := map[string]interface{}{
+		"app":                  "web",
+		"escaped":              "frontend",
+		"segments":             "frontend",
+		"second_image":         "envoy:1.30",
+		"missing_intermediate": true,
+		"out_of_range":         true,
+		"through_scalar":       true,
+		"nil_object":           true,
+	}
+	if !reflect.DeepEqual(result["results"], expected) {
+		t.Errorf("Expected %v, got %v", expected, result["results"])
+	}
+}
+
+func TestHelpers_SetAndEnsure(t *testing.T) {
+	input := map[string]interface{}{
+		"kind": "Pod",
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "nginx"},
+			},
+		},
+	}
+
+	result := runHelpersScript(t, `
+		helpers.set(object, "metadata.labels.app\\.kubernetes\\.io/name", "web")
+		helpers.set(object, "spec.containers.1.image", "nginx:1.25")
+
+		local annotations = helpers.ensure(object, "metadata.annotations")
+		annotations["owner"] = "platform"
+
+		-- ensure returns existing tables untouched
+		local labels = helpers.ensure(object, "metadata.labels")
+		labels["tier"] = "frontend"
+	`, input)
+
+	metadata := result["metadata"].(map[string]interface{})
+	labels := metadata["labels"].(map[string]interface{})
+	if labels["app.kubernetes.io/name"] != "web" || labels["tier"] != "frontend" {
+		t.Errorf("Expected labels to be set through missing intermediates, got %v", labels)
+	}
+
+	annotations := metadata["annotations"].(map[string]interface{})
+	if annotations["owner"] != "platform" {
+		t.Errorf("Expected ensure to return a usable table, got %v", annotations)
+	}
+
+	containers := result["spec"].(map[string]interface{})["containers"].([]interface{})
+	container := containers[0].(map[string]interface{})
+	if container["image"] != "nginx:1.25" || container["name"] != "nginx" {
+		t.Errorf("Expected image to be set on the first container, got %v", container)
+	}
+}
+
+func TestHelpers_Del(t *testing.T) {
+	input := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{"app": "web", "tier": "frontend"},
+		},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "a"},
+				map[string]interface{}{"name": "b"},
+				map[string]interface{}{"name": "c"},
+			},
+		},
+	}
+
+	result := runHelpersScript(t, `
+		object.removed = helpers.del(object, "metadata.labels.app")
+		helpers.del(object, "spec.containers.2")
+		object.missing = helpers.del(object, "metadata.annotations.owner") == nil
+	`, input)
+
+	if result["removed"] != "web" || result["missing"] != true {
+		t.Errorf("Expected del to return removed values, got removed=%v missing=%v", result["removed"], result["missing"])
+	}
+
+	labels := result["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if _, ok := labels["app"]; ok || labels["tier"] != "frontend" {
+		t.Errorf("Expected only the app label to be removed, got %v", labels)
+	}
+
+	containers := result["spec"].(map[string]interface{})["containers"].([]interface{})
+	if len(containers) != 2 || containers[1].(map[string]interface{})["name"] != "c" {
+		t.Errorf("Expected the second container to be removed and the array shifted, got %v", containers)
+	}
+}
+
+func TestHelpers_Errors(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	inputJSON := []byte(`{"metadata":{"name":"web"}}`)
+
+	tests := map[string]struct {
+		script   string
+		expected string
+	}{
+		"set through scalar":    {script: `helpers.set(object, "metadata.name.first", "x")`, expected: "metadata.name is a string"},
+		"ensure through scalar": {script: `helpers.ensure(object, "metadata.name")`, expected: "metadata.name is a string"},
+		"empty segment":         {script: `helpers.get(object, "metadata..name")`, expected: "empty segment"},
+		"invalid path type":     {script: `helpers.get(object, true)`, expected: "path must be a string or a table"},
+		"set on nil object":     {script: `helpers.set(nil, "metadata", {})`, expected: "table expected"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			runner := NewScriptRunner(logger)
+			_, err := runner.RunScript("helpers", `local helpers = require("helpers")`+"\n"+tt.script, inputJSON)
+			if err == nil {
+				t.Fatal("Expected script to fail")
+			}
+			if !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestHelpers_SortedPairs(t *testing.T) {
+	result := runHelpersScript(t, `
+		local t = {zeta = 1, alpha = 2, [3] = "c", [1] = "a", mid = 3}
+		local keys = {}
+		for k, v in helpers.sorted_pairs(t) do
+			table.insert(keys, tostring(k))
+		end
+		object.keys = table.concat(keys, ",")
+	`, map[string]interface{}{"kind": "Pod"})
+
+	if result["keys"] != "1,3,alpha,mid,zeta" {
+		t.Errorf("Expected numeric then string keys in order, got %v", result["keys"])
+	}
+}
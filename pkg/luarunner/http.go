@@ -0,0 +1,244 @@
+package luarunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	gotime "time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// HTTPPolicy: egress controls of the http module, the zero value allows everything
+// Requests breaking the policy raise a Lua error naming the URL, instead of returning an error
+type HTTPPolicy struct {
+	// AllowedHosts: globs (path.Match syntax, "*.example.com") of the hosts requests and their
+	// redirects may go to, without port, or domains starting with a dot (".example.com") allowing
+	// the domain and every host under it. Empty allows every host
+	AllowedHosts []string
+	// AllowedMethods: HTTP methods scripts may use, empty allows every method
+	AllowedMethods []string
+	// Timeout: longest a request may take, on top of the deadline of the script. Zero for no limit
+	Timeout gotime.Duration
+	// MaxResponseBytes: largest response body read, larger responses fail the request. Zero for no limit
+	MaxResponseBytes int64
+	// MaxCalls: requests the scripts of a chain, that is of an admission request, may make together
+	// Zero for no limit
+	MaxCalls int
+}
+
+// allowedMethod: reports whether the policy lets scripts use method
+func (p HTTPPolicy) allowedMethod(method string) bool {
+	if len(p.AllowedMethods) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHost: reports whether the policy lets requests go to host, a host name without port
+func (p HTTPPolicy) allowedHost(host string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range p.AllowedHosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedHostError: a request refused by allowlistTransport
+type blockedHostError struct {
+	host string
+}
+
+func (e *blockedHostError) Error() string {
+	return fmt.Sprintf("host %s is not allowed", e.host)
+}
+
+// allowlistTransport: refuses the requests to hosts the policy does not allow before they leave
+// the process, so that every request of the client, redirects included, stays within AllowedHosts
+type allowlistTransport struct {
+	policy HTTPPolicy
+	next   http.RoundTripper
+}
+
+func (t allowlistTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.policy.allowedHost(req.URL.Hostname()) {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, &blockedHostError{host: req.URL.Hostname()}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// httpCallsKey: context key of the number of requests made by the scripts of a chain
+type httpCallsKey struct{}
+
+// withHTTPCalls: returns a context counting the requests of the scripts running with it,
+// ctx itself when it already counts them
+func withHTTPCalls(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(httpCallsKey{}).(*atomic.Int64); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, httpCallsKey{}, new(atomic.Int64))
+}
+
+// loader: the http module, with the same API as glua's, enforcing the policy. Requests are bound
+// to the context of the script: they are cancelled with the admission request and cannot outlive it
+//
+//	local http = require("http")
+//	local resp, err = http.get("https://api.example.com/data", {["Authorization"] = "Bearer token"})
+func (p HTTPPolicy) loader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get": func(L *lua.LState) int {
+			return p.do(L, http.MethodGet, L.CheckString(1), "", L.OptTable(2, nil))
+		},
+		"post": func(L *lua.LState) int {
+			return p.do(L, http.MethodPost, L.CheckString(1), L.CheckString(2), L.OptTable(3, nil))
+		},
+		"put": func(L *lua.LState) int {
+			return p.do(L, http.MethodPut, L.CheckString(1), L.CheckString(2), L.OptTable(3, nil))
+		},
+		"delete": func(L *lua.LState) int {
+			return p.do(L, http.MethodDelete, L.CheckString(1), "", L.OptTable(2, nil))
+		},
+		"request": func(L *lua.LState) int {
+			return p.do(L, L.CheckString(1), L.CheckString(2), L.OptString(3, ""), L.OptTable(4, nil))
+		},
+	})
+	L.Push(mod)
+	return 1
+}
+
+// newHTTPClient: returns a client whose timeout is the time left before the deadline of ctx, if
+// any, and whose transport only reaches the allowed hosts of the policy
+func (p HTTPPolicy) newHTTPClient(ctx context.Context) *http.Client {
+	client := &http.Client{}
+	if deadline, ok := ctx.Deadline(); ok {
+		client.Timeout = gotime.Until(deadline)
+	}
+	if len(p.AllowedHosts) > 0 {
+		client.Transport = allowlistTransport{policy: p, next: http.DefaultTransport}
+	}
+	return client
+}
+
+// do: performs a request, pushing the response table, or nil and an error message
+// Requests breaking the policy raise an error
+func (p HTTPPolicy) do(L *lua.LState, method, rawURL, body string, headers *lua.LTable) int {
+	ctx := L.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if !p.allowedMethod(method) {
+		L.RaiseError("http request to %s blocked: method %s is not allowed", rawURL, method)
+	}
+	if target, err := url.Parse(rawURL); err == nil && !p.allowedHost(target.Hostname()) {
+		L.RaiseError("http request to %s blocked: host %s is not allowed", rawURL, target.Hostname())
+	}
+	if p.MaxCalls > 0 {
+		if calls, ok := ctx.Value(httpCallsKey{}).(*atomic.Int64); ok && calls.Add(1) > int64(p.MaxCalls) {
+			L.RaiseError("http request to %s blocked: the %d requests allowed per admission request are used up", rawURL, p.MaxCalls)
+		}
+	}
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bodyReader)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to create request: %v", err)))
+		return 2
+	}
+
+	if headers != nil {
+		headers.ForEach(func(key, value lua.LValue) {
+			if k, ok := key.(lua.LString); ok {
+				if v, ok := value.(lua.LString); ok {
+					req.Header.Set(string(k), string(v))
+				}
+			}
+		})
+	}
+
+	resp, err := p.newHTTPClient(ctx).Do(req)
+	var blocked *blockedHostError
+	if errors.As(err, &blocked) {
+		if blocked.host != req.URL.Hostname() {
+			L.RaiseError("http request to %s blocked: redirected to host %s which is not allowed", rawURL, blocked.host)
+		}
+		L.RaiseError("http request to %s blocked: %v", rawURL, blocked)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("request failed: %v", err)))
+		return 2
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var reader io.Reader = resp.Body
+	if p.MaxResponseBytes > 0 {
+		reader = io.LimitReader(resp.Body, p.MaxResponseBytes+1)
+	}
+	respBody, err := io.ReadAll(reader)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("failed to read response body: %v", err)))
+		return 2
+	}
+	if p.MaxResponseBytes > 0 && int64(len(respBody)) > p.MaxResponseBytes {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(fmt.Sprintf("response of %s exceeds %d bytes", rawURL, p.MaxResponseBytes)))
+		return 2
+	}
+
+	respTable := L.NewTable()
+	respTable.RawSetString("status", lua.LNumber(resp.StatusCode))
+	respTable.RawSetString("body", lua.LString(respBody))
+
+	headersTable := L.NewTable()
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headersTable.RawSetString(key, lua.LString(values[0]))
+		}
+	}
+	respTable.RawSetString("headers", headersTable)
+
+	L.Push(respTable)
+	L.Push(lua.LNil)
+	return 2
+}
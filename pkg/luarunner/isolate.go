@@ -0,0 +1,150 @@
+package luarunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	gotime "time"
+
+	lua "github.com/yuin/gopher-lua"
+	"go.opentelemetry.io/otel/trace"
+
+	"thechat/pkg/cluster"
+	"thechat/pkg/tracing"
+)
+
+// ErrScriptPanic: result of a script whose execution panicked, in gopher-lua, a module or the
+// conversion of the object. The panic is contained to the script, the chain goes on
+var ErrScriptPanic = errors.New("script panicked")
+
+// ErrScriptAbandoned: result of a script still running past its timeout, typically blocked in a
+// Go module the Lua context cannot interrupt. Its goroutine is left to finish on its own
+var ErrScriptAbandoned = errors.New("script did not stop after its timeout")
+
+// abandonGrace: time a script is given to stop by itself once its timeout is reached, before the
+// chain stops waiting for it
+const abandonGrace = 100 * gotime.Millisecond
+
+// scriptOutcome: what runScript returned, sent back by the goroutine running it
+type scriptOutcome struct {
+	result []byte
+	output scriptOutput
+	err    error
+}
+
+// runIsolated: runs runScript in its own goroutine, turning a panic into an error wrapping
+// ErrScriptPanic, and giving up on the script when it outlives its timeout
+// The script is traced as one span, its error recorded
+func (r *ScriptRunner) runIsolated(ctx context.Context, scriptName, scriptContent string, objectJSON, raw []byte, session *cluster.Session) ([]byte, scriptOutput, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "run script", trace.WithAttributes(tracing.AttrScript.String(scriptName)))
+	defer span.End()
+
+	started := gotime.Now()
+	result, output, err := r.waitIsolated(ctx, scriptName, scriptContent, objectJSON, raw, session)
+	span.SetAttributes(tracing.AttrDurationMs.Float64(float64(gotime.Since(started).Microseconds()) / 1000))
+	tracing.Fail(span, err)
+	return result, output, err
+}
+
+// waitIsolated: see runIsolated
+func (r *ScriptRunner) waitIsolated(ctx context.Context, scriptName, scriptContent string, objectJSON, raw []byte, session *cluster.Session) ([]byte, scriptOutput, error) {
+	done := make(chan scriptOutcome, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				r.logger.Printf("ERROR: Script %s panicked: %v\n%s", scriptName, p, debug.Stack())
+				done <- scriptOutcome{err: fmt.Errorf("%w: %v", ErrScriptPanic, p)}
+			}
+		}()
+		result, output, err := r.measureCPU(scriptName, func() ([]byte, scriptOutput, error) {
+			return r.runScript(ctx, scriptName, scriptContent, objectJSON, raw, session)
+		})
+		done <- scriptOutcome{result, output, err}
+	}()
+
+	deadline := ctx.Done()
+	if scriptTimeout := r.scriptTimeout(ctx, scriptName); scriptTimeout > 0 {
+		timeout, cancel := context.WithTimeout(ctx, scriptTimeout)
+		defer cancel()
+		deadline = timeout.Done()
+	}
+
+	select {
+	case outcome := <-done:
+		return outcome.result, outcome.output, outcome.err
+	case <-deadline:
+	}
+
+	// The Lua context stops the script at the same deadline, let it report it
+	select {
+	case outcome := <-done:
+		return outcome.result, outcome.output, outcome.err
+	case <-gotime.After(abandonGrace):
+		r.logger.Printf("ERROR: Script %s still running %s after its timeout, abandoning it", scriptName, abandonGrace)
+		return nil, scriptOutput{}, ErrScriptAbandoned
+	}
+}
+
+// measureCPU: runs run locked to its OS thread and records the CPU time the thread consumed into
+// the output, failed runs included. Falls back to the wall time of run, flagged as such, where the
+// thread CPU clock cannot be read or Options.DisableCPUTime is set
+func (r *ScriptRunner) measureCPU(scriptName string, run func() ([]byte, scriptOutput, error)) ([]byte, scriptOutput, error) {
+	var cpuStarted gotime.Duration
+	measured := false
+	if !r.options.DisableCPUTime {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		cpuStarted, measured = threadCPUTime()
+	}
+
+	started := gotime.Now()
+	result, output, err := run()
+	output.cpuTime, output.cpuWallClock = gotime.Since(started), true
+	if measured {
+		if cpuEnded, ok := threadCPUTime(); ok {
+			output.cpuTime, output.cpuWallClock = cpuEnded-cpuStarted, false
+		}
+	}
+
+	clock := "cpu"
+	if output.cpuWallClock {
+		clock = "wall"
+	}
+	r.logger.Printf("DEBUG: Script %s CPU time: %s (%s clock)", scriptName, output.cpuTime, clock)
+	return result, output, err
+}
+
+// interruptibleTimeLoader: wraps the loader of the time module so that time.sleep stops with an
+// error once the context of the script is done. The Lua context only stops the script between two
+// instructions, a sleeping script would keep its goroutine well past its timeout
+func interruptibleTimeLoader(loader lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		L.Push(L.NewFunction(loader))
+		L.Call(0, 1)
+		if module, ok := L.Get(-1).(*lua.LTable); ok {
+			module.RawSetString("sleep", L.NewFunction(interruptibleSleep))
+		}
+		return 1
+	}
+}
+
+// interruptibleSleep: time.sleep(seconds), returning early with an error when the context of the
+// script is done
+func interruptibleSleep(L *lua.LState) int {
+	seconds := L.CheckNumber(1)
+	timer := gotime.NewTimer(gotime.Duration(float64(seconds) * float64(gotime.Second)))
+	defer timer.Stop()
+
+	var done <-chan struct{}
+	if ctx := L.Context(); ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case <-timer.C:
+	case <-done:
+		L.RaiseError("time.sleep interrupted: %v", L.Context().Err())
+	}
+	return 0
+}
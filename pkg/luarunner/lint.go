@@ -0,0 +1,48 @@
+package luarunner
+
+import (
+	"errors"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// LintIssue: a problem found in a script without running it
+type LintIssue struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// Lint: checks that a script parses and compiles, returning the issues found
+// An issue at the end of the script is reported on its last line, syntax of a later Lua version
+// is reported as such rather than as a syntax error
+func Lint(file, content string) []LintIssue {
+	chunk, err := parse.Parse(strings.NewReader(content), file)
+	if err == nil {
+		_, err = lua.Compile(chunk, file)
+	}
+	if err == nil {
+		return nil
+	}
+
+	issue := LintIssue{File: file, Message: err.Error()}
+	var compatErr *CompatError
+	var parseErr *parse.Error
+	if errors.As(withCompatHint(content, err), &compatErr) {
+		issue.Line = compatErr.Line
+		issue.Message = compatErr.Message()
+	} else if errors.As(err, &parseErr) {
+		issue.Line = parseErr.Pos.Line
+		issue.Message = parseErr.Message
+		if parseErr.Token != "" && parseErr.Pos.Line != parse.EOF {
+			issue.Message += " near '" + parseErr.Token + "'"
+		}
+		if parseErr.Pos.Line == parse.EOF {
+			issue.Line = strings.Count(strings.TrimRight(content, "\n"), "\n") + 1
+		}
+	}
+
+	return []LintIssue{issue}
+}
@@ -0,0 +1,61 @@
+package luarunner
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	if issues := Lint("good.lua", "object.metadata.labels = {}\n"); len(issues) != 0 {
+		t.Fatalf("Expected no issues, got %v", issues)
+	}
+
+	issues := Lint("bad.lua", "local x = 1\nif x then\n  x = = 2\nend\n")
+	if len(issues) != 1 {
+		t.Fatalf("Expected one issue, got %v", issues)
+	}
+
+	data, err := json.Marshal(issues)
+	if err != nil {
+		t.Fatalf("Failed to encode issues: %v", err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode issues: %v", err)
+	}
+	if decoded[0]["file"] != "bad.lua" || decoded[0]["line"] != float64(3) || decoded[0]["message"] == "" {
+		t.Errorf("Unexpected issue: %s", data)
+	}
+}
+
+func TestLintUnterminatedBlock(t *testing.T) {
+	issues := Lint("eof.lua", "if true then\n  x = 1\n")
+	if len(issues) != 1 || issues[0].Line != 2 {
+		t.Fatalf("Expected one issue on the last line, got %v", issues)
+	}
+}
+
+func TestLintLuaCompat(t *testing.T) {
+	tests := []struct {
+		content string
+		line    int
+		message string
+	}{
+		{content: "local n = 7\nlocal half = n // 2\n", line: 2, message: "'//' (floor division) is Lua 5.3 syntax"},
+		{content: "local flags = 6 & 3\n", line: 1, message: "'&' (bitwise and) is Lua 5.3 syntax"},
+		{content: "local mask = 1 << 4\n", line: 1, message: "'<<' (left shift) is Lua 5.3 syntax"},
+		{content: "local x <const> = 1\n", line: 1, message: "'<const>' (local variable attribute) is Lua 5.4 syntax"},
+		{content: "if true then\n  x = = 2\nend\n", line: 2, message: "syntax error"},
+	}
+	for _, tt := range tests {
+		issues := Lint("compat.lua", tt.content)
+		if len(issues) != 1 {
+			t.Errorf("%q: expected one issue, got %v", tt.content, issues)
+			continue
+		}
+		if issues[0].Line != tt.line || !strings.Contains(issues[0].Message, tt.message) {
+			t.Errorf("%q: expected %q on line %d, got %v", tt.content, tt.message, tt.line, issues[0])
+		}
+	}
+}
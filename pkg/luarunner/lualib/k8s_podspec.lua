@@ -0,0 +1,113 @@
+-- k8s.podspec: idempotent pod spec edits, for sidecar injection and the like
+--
+-- Every function takes a Pod, a pod template, a workload holding one (Deployment, StatefulSet,
+-- DaemonSet, Job, ...) or a pod spec, and identifies containers, volumes, mounts and variables
+-- by name: calling them again on an object they already changed changes nothing
+
+-- Base functions are captured when the library loads, scripts reassigning them do not break it
+local error, ipairs, pairs, tostring, type = error, ipairs, pairs, tostring, type
+local insert = table.insert
+
+---@class k8s.podspec
+local podspec = {}
+
+-- spec_of: returns the pod spec of target, creating the spec of a Pod or pod template without one
+local function spec_of(target)
+  if type(target) ~= "table" then
+    error("k8s.podspec: expected a Pod, pod template, workload or pod spec, got " .. type(target), 3)
+  end
+  if target.containers ~= nil then
+    return target
+  end
+  if target.spec ~= nil and target.spec.template ~= nil then
+    target = target.spec.template
+  end
+  target.spec = target.spec or {}
+  return target.spec
+end
+
+-- find_by_name: returns the element of list named name and its index, nil when there is none
+local function find_by_name(list, name)
+  for i, item in ipairs(list) do
+    if item.name == name then
+      return item, i
+    end
+  end
+  return nil
+end
+
+-- ensure: appends item to the list field of owner unless an element with the same name exists
+-- Returns the element in the list and whether it was added
+local function ensure(owner, field, item, what)
+  if type(item) ~= "table" or type(item.name) ~= "string" or item.name == "" then
+    error("k8s.podspec: " .. what .. " must be a table with a name", 3)
+  end
+  owner[field] = owner[field] or {}
+  local existing = find_by_name(owner[field], item.name)
+  if existing ~= nil then
+    return existing, false
+  end
+  insert(owner[field], item)
+  return item, true
+end
+
+---Adds container unless one with its name exists
+---@param pod table
+---@param container table
+---@return table container the container of the pod
+---@return boolean added
+function podspec.ensure_container(pod, container)
+  return ensure(spec_of(pod), "containers", container, "container")
+end
+
+---Adds volume unless one with its name exists
+---@param pod table
+---@param volume table
+---@return table volume the volume of the pod
+---@return boolean added
+function podspec.ensure_volume(pod, volume)
+  return ensure(spec_of(pod), "volumes", volume, "volume")
+end
+
+---Adds mount to the named container, or to every container with "*", unless the container
+---already mounts a volume with its name
+---@param pod table
+---@param container_name string
+---@param mount table
+---@return integer added number of containers the mount was added to
+function podspec.ensure_volume_mount(pod, container_name, mount)
+  if type(container_name) ~= "string" then
+    error("k8s.podspec: container name must be a string, or \"*\" for every container", 2)
+  end
+  local added = 0
+  for _, container in ipairs(spec_of(pod).containers or {}) do
+    if container_name == "*" or container.name == container_name then
+      -- Each container gets its own copy, scripts may tweak them independently afterwards
+      local copy = {}
+      for k, v in pairs(mount) do
+        copy[k] = v
+      end
+      local _, was_added = ensure(container, "volumeMounts", copy, "volume mount")
+      if was_added then
+        added = added + 1
+      end
+    end
+  end
+  return added
+end
+
+---Adds the name=value variable unless the container already sets one named name, whose value
+---is then left alone
+---@param container table
+---@param name string
+---@param value any
+---@return boolean added
+function podspec.ensure_env(container, name, value)
+  if type(container) ~= "table" then
+    error("k8s.podspec: expected a container, got " .. type(container), 2)
+  end
+  local _, added = ensure(container, "env", {name = name, value = tostring(value)}, "environment variable")
+  return added
+end
+
+return podspec
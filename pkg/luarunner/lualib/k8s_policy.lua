@@ -0,0 +1,178 @@
+-- k8s.policy: reusable validations for admission policies
+--
+-- Every check returns true when the object passes, false and a message explaining why it does
+-- not otherwise, so scripts can combine checks and deny with the message themselves:
+--
+--   local ok, message = policy.require_labels(object, {"app", "env"})
+--   if not ok then deny_invalid(message) end
+--
+-- Pod checks accept a Pod, a pod template, a workload holding one or a pod spec
+
+-- Base functions are captured when the library loads, scripts reassigning them do not break it
+local error, ipairs, pairs, type = error, ipairs, pairs, type
+local concat, insert, sort = table.concat, table.insert, table.sort
+local find, sub = string.find, string.sub
+
+---@class k8s.policy
+local policy = {}
+
+-- spec_of: returns the pod spec of target, an empty one when it has none
+local function spec_of(target)
+  if type(target) ~= "table" then
+    error("k8s.policy: expected a Pod, pod template, workload or pod spec, got " .. type(target), 3)
+  end
+  if target.containers ~= nil then
+    return target
+  end
+  if target.spec ~= nil and target.spec.template ~= nil then
+    target = target.spec.template
+  end
+  return target.spec or {}
+end
+
+-- containers_of: returns the init containers then the containers of the pod spec
+local function containers_of(spec)
+  local all = {}
+  for _, container in ipairs(spec.initContainers or {}) do
+    insert(all, container)
+  end
+  for _, container in ipairs(spec.containers or {}) do
+    insert(all, container)
+  end
+  return all
+end
+
+-- result: turns the list of problems found by a check into its (ok, message) result
+local function result(problems)
+  if #problems == 0 then
+    return true, nil
+  end
+  return false, concat(problems, "; ")
+end
+
+-- image_tag: returns the tag of an image reference, nil when it has none
+-- The tag follows the last ":" after the last "/", registry ports are not tags
+local function image_tag(image)
+  local at = find(image, "@", 1, true)
+  if at ~= nil then
+    image = sub(image, 1, at - 1)
+  end
+  local last_slash, last_colon = 0, nil
+  for i = 1, #image do
+    local c = sub(image, i, i)
+    if c == "/" then
+      last_slash = i
+    elseif c == ":" then
+      last_colon = i
+    end
+  end
+  if last_colon == nil or last_colon < last_slash then
+    return nil
+  end
+  return sub(image, last_colon + 1)
+end
+
+---Checks that the object sets every label of names to a non empty value
+---@param object table
+---@param names string[]
+---@return boolean ok
+---@return string|nil message
+function policy.require_labels(object, names)
+  if type(object) ~= "table" then
+    error("k8s.policy: expected an object, got " .. type(object), 2)
+  end
+  local labels = (object.metadata or {}).labels or {}
+  local missing = {}
+  for _, name in ipairs(names) do
+    if labels[name] == nil or labels[name] == "" then
+      insert(missing, name)
+    end
+  end
+  if #missing == 0 then
+    return true, nil
+  end
+  return false, "missing required labels: " .. concat(missing, ", ")
+end
+
+---Checks that no container uses the latest tag, explicitly or by leaving the tag out
+---Images pinned by digest always pass
+---@param pod table
+---@return boolean ok
+---@return string|nil message
+function policy.forbid_latest_tag(pod)
+  local problems = {}
+  for _, container in ipairs(containers_of(spec_of(pod))) do
+    local image = container.image or ""
+    if not find(image, "@", 1, true) then
+      local tag = image_tag(image)
+      if tag == nil or tag == "latest" then
+        insert(problems, "container " .. container.name .. " uses the latest tag (" .. image .. ")")
+      end
+    end
+  end
+  return result(problems)
+end
+
+---Checks that every container sets the resources of kinds, {cpu = true, memory = true}
+---true requires both a request and a limit, "requests" or "limits" only that one
+---@param pod table
+---@param kinds table<string, boolean|"requests"|"limits">
+---@return boolean ok
+---@return string|nil message
+function policy.require_resources(pod, kinds)
+  local names = {}
+  for name, wanted in pairs(kinds) do
+    if wanted then
+      insert(names, name)
+    end
+  end
+  -- pairs has no order, messages must not change from one run to the next
+  sort(names)
+
+  local problems = {}
+  for _, container in ipairs(containers_of(spec_of(pod))) do
+    local resources = container.resources or {}
+    for _, name in ipairs(names) do
+      local wanted = kinds[name]
+      if (wanted == true or wanted == "requests") and (resources.requests or {})[name] == nil then
+        insert(problems, "container " .. container.name .. " has no " .. name .. " request")
+      end
+      if (wanted == true or wanted == "limits") and (resources.limits or {})[name] == nil then
+        insert(problems, "container " .. container.name .. " has no " .. name .. " limit")
+      end
+    end
+  end
+  return result(problems)
+end
+
+-- probeFields: fields of the probes require_probes knows about
+local probeFields = {
+  liveness = "livenessProbe",
+  readiness = "readinessProbe",
+  startup = "startupProbe",
+}
+
+---Checks that every container, init containers aside, defines the probes of kinds
+---@param pod table
+---@param kinds ("liveness"|"readiness"|"startup")[]
+---@return boolean ok
+---@return string|nil message
+function policy.require_probes(pod, kinds)
+  for _, kind in ipairs(kinds) do
+    if probeFields[kind] == nil then
+      error("k8s.policy: unknown probe " .. kind .. ", expected liveness, readiness or startup", 2)
+    end
+  end
+
+  local problems = {}
+  for _, container in ipairs(spec_of(pod).containers or {}) do
+    for _, kind in ipairs(kinds) do
+      if container[probeFields[kind]] == nil then
+        insert(problems, "container " .. container.name .. " has no " .. kind .. " probe")
+      end
+    end
+  end
+  return result(problems)
+end
+
+return policy
@@ -0,0 +1,63 @@
+package luarunner
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// MetadataChange: a label or annotation set on the object through add_label or add_annotation
+type MetadataChange struct {
+	// Field: "labels" or "annotations"
+	Field string
+	// Key, Value: the label or annotation set
+	Key   string
+	Value string
+}
+
+// registerMetadataHelpers: exposes add_label(object, key, value), add_annotation(object, key, value)
+// and once(object, annotation) to scripts, recording into changes the ones made on the object global
+// Changes recorded this way let the webhook build the patch without diffing the whole object
+func registerMetadataHelpers(L *lua.LState, changes *[]MetadataChange) {
+	for name, field := range map[string]string{"add_label": "labels", "add_annotation": "annotations"} {
+		L.SetGlobal(name, L.NewFunction(func(L *lua.LState) int {
+			setMetadata(L, L.CheckTable(1), field, L.CheckString(2), L.CheckString(3), changes)
+			return 0
+		}))
+	}
+
+	// once: returns false when the object carries the marker annotation, otherwise sets it to "true"
+	// and returns true, so that injections guarded by it happen a single time, UPDATEs included
+	L.SetGlobal("once", L.NewFunction(func(L *lua.LState) int {
+		object := L.CheckTable(1)
+		annotation := L.CheckString(2)
+
+		if metadata, ok := object.RawGetString("metadata").(*lua.LTable); ok {
+			if annotations, ok := metadata.RawGetString("annotations").(*lua.LTable); ok && annotations.RawGetString(annotation) != lua.LNil {
+				L.Push(lua.LFalse)
+				return 1
+			}
+		}
+		setMetadata(L, object, "annotations", annotation, "true", changes)
+		L.Push(lua.LTrue)
+		return 1
+	}))
+}
+
+// setMetadata: sets key to value in the labels or annotations of object, creating the maps it lacks
+func setMetadata(L *lua.LState, object *lua.LTable, field, key, value string, changes *[]MetadataChange) {
+	metadata, ok := object.RawGetString("metadata").(*lua.LTable)
+	if !ok {
+		metadata = L.NewTable()
+		object.RawSetString("metadata", metadata)
+	}
+	entries, ok := metadata.RawGetString(field).(*lua.LTable)
+	if !ok {
+		entries = L.NewTable()
+		metadata.RawSetString(field, entries)
+	}
+	entries.RawSetString(key, lua.LString(value))
+
+	// Tables other than the object, such as pod templates, go through the regular diff
+	if object == L.GetGlobal("object") {
+		*changes = append(*changes, MetadataChange{Field: field, Key: key, Value: value})
+	}
+}
@@ -0,0 +1,143 @@
+package luarunner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// orderField: metatable field holding the original key order of a table decoded from a JSON object
+const orderField = "__order"
+
+// keyOrder: key order of a JSON value, mirrored over its nested objects and arrays
+type keyOrder struct {
+	keys     []string
+	children map[string]*keyOrder
+	items    []*keyOrder
+}
+
+// decodeKeyOrder: records the order object keys appear in within a JSON document
+func decodeKeyOrder(data []byte) (*keyOrder, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decodeValueOrder(decoder)
+}
+
+// decodeValueOrder: records the key order of the next value of the decoder, nil for scalars
+func decodeValueOrder(decoder *json.Decoder) (*keyOrder, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return nil, nil
+	}
+
+	order := &keyOrder{}
+	switch delim {
+	case '{':
+		order.children = make(map[string]*keyOrder)
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := token.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected object key %v", token)
+			}
+			child, err := decodeValueOrder(decoder)
+			if err != nil {
+				return nil, err
+			}
+			order.keys = append(order.keys, key)
+			order.children[key] = child
+		}
+	case '[':
+		for decoder.More() {
+			child, err := decodeValueOrder(decoder)
+			if err != nil {
+				return nil, err
+			}
+			order.items = append(order.items, child)
+		}
+	}
+
+	// Consume the closing delimiter
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// attachKeyOrder: sets a metatable recording the original key order on every table decoded from a JSON object
+func attachKeyOrder(L *lua.LState, value lua.LValue, order *keyOrder) {
+	tbl, ok := value.(*lua.LTable)
+	if !ok || order == nil {
+		return
+	}
+
+	for i, item := range order.items {
+		attachKeyOrder(L, tbl.RawGetInt(i+1), item)
+	}
+
+	if order.children == nil {
+		return
+	}
+
+	keys := L.CreateTable(len(order.keys), 0)
+	for _, key := range order.keys {
+		keys.Append(lua.LString(key))
+		attachKeyOrder(L, tbl.RawGetString(key), order.children[key])
+	}
+
+	metatable := L.NewTable()
+	metatable.RawSetString(orderField, keys)
+	L.SetMetatable(tbl, metatable)
+}
+
+// registerOrderedPairs: replaces pairs with a version iterating over tables with a recorded key order
+// in that order, followed by keys added since in sorted order. Other tables iterate like next
+func registerOrderedPairs(L *lua.LState) {
+	L.SetGlobal("pairs", L.NewFunction(func(L *lua.LState) int {
+		tbl := L.CheckTable(1)
+
+		metatable, ok := L.GetMetatable(tbl).(*lua.LTable)
+		if !ok {
+			L.Push(L.GetGlobal("next"))
+			L.Push(tbl)
+			L.Push(lua.LNil)
+			return 3
+		}
+		recorded, ok := metatable.RawGetString(orderField).(*lua.LTable)
+		if !ok {
+			L.Push(L.GetGlobal("next"))
+			L.Push(tbl)
+			L.Push(lua.LNil)
+			return 3
+		}
+
+		keys := make([]lua.LValue, 0, recorded.Len())
+		seen := make(map[lua.LValue]bool, recorded.Len())
+		for i := 1; i <= recorded.Len(); i++ {
+			key := recorded.RawGetInt(i)
+			keys = append(keys, key)
+			seen[key] = true
+		}
+		for _, key := range sortedKeys(tbl) {
+			if !seen[key] {
+				keys = append(keys, key)
+			}
+		}
+
+		L.Push(newKeysIterator(L, tbl, keys))
+		L.Push(tbl)
+		L.Push(lua.LNil)
+		return 3
+	}))
+}
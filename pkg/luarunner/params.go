@@ -0,0 +1,119 @@
+package luarunner
+
+import (
+	"context"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ParamsGlobal: name of the read-only global table holding the parameters of a script chain
+const ParamsGlobal = "params"
+
+// readOnlyField: metatable field of read-only tables pointing at the table holding their content
+const readOnlyField = "__readonly"
+
+// paramsKey: context key of the parameters of a script chain
+type paramsKey struct{}
+
+// WithParams: returns a context whose script chains expose params to every script as the params global
+func WithParams(ctx context.Context, params map[string]interface{}) context.Context {
+	return context.WithValue(ctx, paramsKey{}, params)
+}
+
+// paramsFrom: returns the parameters attached to ctx by WithParams, nil when there are none
+func paramsFrom(ctx context.Context) map[string]interface{} {
+	params, _ := ctx.Value(paramsKey{}).(map[string]interface{})
+	return params
+}
+
+// setParams: exposes params to the script as the read-only params global, an empty table without params
+// Scripts can read, iterate with pairs and ipairs, and take the length of the tables, assigning
+// anything raises an error
+func (r *ScriptRunner) setParams(L *lua.LState, params map[string]interface{}) error {
+	value := lua.LValue(L.NewTable())
+	if params != nil {
+		converted, err := r.translator.ToLua(L, params)
+		if err != nil {
+			return fmt.Errorf("failed to convert params to Lua: %w", err)
+		}
+		value = converted
+	}
+
+	L.SetGlobal(ParamsGlobal, readOnly(L, value))
+	registerReadOnlyIteration(L)
+	return nil
+}
+
+// readOnly: returns a read-only proxy of a table, and of the tables it holds, other values as is
+func readOnly(L *lua.LState, value lua.LValue) lua.LValue {
+	tbl, ok := value.(*lua.LTable)
+	if !ok {
+		return value
+	}
+
+	content := L.NewTable()
+	tbl.ForEach(func(key, child lua.LValue) {
+		content.RawSet(key, readOnly(L, child))
+	})
+
+	metatable := L.NewTable()
+	metatable.RawSetString(readOnlyField, content)
+	metatable.RawSetString("__index", content)
+	metatable.RawSetString("__len", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(content.Len()))
+		return 1
+	}))
+	metatable.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("%s is read-only", ParamsGlobal)
+		return 0
+	}))
+	metatable.RawSetString("__metatable", lua.LFalse)
+
+	proxy := L.NewTable()
+	L.SetMetatable(proxy, metatable)
+	return proxy
+}
+
+// registerReadOnlyIteration: makes pairs and ipairs iterate over the content of read-only tables,
+// which the proxies themselves do not hold
+func registerReadOnlyIteration(L *lua.LState) {
+	for _, name := range []string{"pairs", "ipairs"} {
+		iterate, ok := L.GetGlobal(name).(*lua.LFunction)
+		if !ok {
+			continue
+		}
+		L.SetGlobal(name, L.NewFunction(func(L *lua.LState) int {
+			args := make([]lua.LValue, 0, L.GetTop())
+			for i := 1; i <= L.GetTop(); i++ {
+				args = append(args, L.Get(i))
+			}
+			if len(args) > 0 {
+				args[0] = readOnlyContent(args[0])
+			}
+
+			L.Push(iterate)
+			for _, arg := range args {
+				L.Push(arg)
+			}
+			L.Call(len(args), lua.MultRet)
+			return L.GetTop() - len(args)
+		}))
+	}
+}
+
+// readOnlyContent: returns the table holding the content of a read-only proxy, other values as is
+func readOnlyContent(value lua.LValue) lua.LValue {
+	tbl, ok := value.(*lua.LTable)
+	if !ok {
+		return value
+	}
+	metatable, ok := tbl.Metatable.(*lua.LTable)
+	if !ok {
+		return value
+	}
+	if content, ok := metatable.RawGetString(readOnlyField).(*lua.LTable); ok {
+		return content
+	}
+	return value
+}
@@ -0,0 +1,68 @@
+package luarunner
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	ctx := WithParams(context.Background(), map[string]interface{}{
+		"registry": "mirror.example.com",
+		"limits":   map[string]interface{}{"cpu": "500m"},
+		"zones":    []interface{}{"a", "b"},
+	})
+	scripts := map[string]string{
+		"read": `
+			local keys = {}
+			for key in pairs(params) do table.insert(keys, key) end
+			table.sort(keys)
+			local zones = {}
+			for _, zone in ipairs(params.zones) do table.insert(zones, zone) end
+			object.metadata.labels = {
+				registry = params.registry,
+				cpu = params.limits.cpu,
+				keys = table.concat(keys, ","),
+				zones = table.concat(zones, ",") .. ":" .. tostring(#params.zones),
+			}
+		`,
+		"write":        `params.registry = "evil.example.com"`,
+		"write-nested": `params.limits.cpu = "8"`,
+	}
+
+	result, results, err := runner.RunScriptsWithContext(ctx, scripts, []byte(`{"metadata": {}}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	for _, literal := range []string{`"registry":"mirror.example.com"`, `"cpu":"500m"`, `"keys":"limits,registry,zones"`, `"zones":"a,b:2"`} {
+		if !strings.Contains(string(result), literal) {
+			t.Errorf("Expected %s in result, got %s", literal, result)
+		}
+	}
+
+	for _, scriptResult := range results {
+		if strings.HasPrefix(scriptResult.Name, "write") {
+			if scriptResult.Err == nil || !strings.Contains(scriptResult.Err.Error(), "read-only") {
+				t.Errorf("Expected script %s to fail on the read-only params, got %v", scriptResult.Name, scriptResult.Err)
+			}
+		}
+	}
+}
+
+func TestParams_Empty(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	result, err := runner.RunScript("defaults", `object.registry = params.registry or "docker.io"`, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	if !strings.Contains(string(result), `"registry":"docker.io"`) {
+		t.Errorf("Expected the default registry without params, got %s", result)
+	}
+}
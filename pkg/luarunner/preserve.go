@@ -0,0 +1,113 @@
+package luarunner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// preserveUnchanged: returns result with the values scripts left untouched encoded exactly as in original
+//
+// Going through Lua loses information scripts never asked to change: numbers become float64
+// (large integers are rounded, 1.0 turns into 1), empty arrays come back as empty objects and
+// null values disappear, from objects and arrays alike. Wherever result still holds the value
+// Lua made of the original one, the original value is restored
+func preserveUnchanged(original, result []byte) ([]byte, error) {
+	before, err := decodePreservingNumbers(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode original object: %w", err)
+	}
+	after, err := decodePreservingNumbers(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode script result: %w", err)
+	}
+
+	return json.Marshal(restoreValue(before, after))
+}
+
+// decodePreservingNumbers: decodes JSON keeping numbers as their literal
+func decodePreservingNumbers(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// restoreValue: returns after, with the parts that equal the Lua conversion of before replaced by before
+func restoreValue(before, after interface{}) interface{} {
+	switch b := before.(type) {
+	case json.Number:
+		if a, ok := after.(json.Number); ok && sameNumber(b, a) {
+			return b
+		}
+
+	case map[string]interface{}:
+		switch a := after.(type) {
+		case map[string]interface{}:
+			for key, value := range a {
+				if original, ok := b[key]; ok {
+					a[key] = restoreValue(original, value)
+				}
+			}
+			// Null values never made it to Lua, scripts could not have removed them
+			for key, value := range b {
+				if _, ok := a[key]; !ok && value == nil {
+					a[key] = nil
+				}
+			}
+			return a
+		case []interface{}:
+			// Lua cannot tell an empty object from an empty array
+			if len(a) == 0 && len(b) == 0 {
+				return b
+			}
+		}
+
+	case []interface{}:
+		switch a := after.(type) {
+		case []interface{}:
+			// Null elements are dropped on the way to Lua, shifting the following ones down
+			if positions := nonNilPositions(b); len(a) != len(b) && len(a) == len(positions) {
+				restored := make([]interface{}, len(b))
+				for i, position := range positions {
+					restored[position] = restoreValue(b[position], a[i])
+				}
+				return restored
+			}
+			for i := range a {
+				if i < len(b) {
+					a[i] = restoreValue(b[i], a[i])
+				}
+			}
+			return a
+		case map[string]interface{}:
+			if len(a) == 0 && len(b) == 0 {
+				return b
+			}
+		}
+	}
+
+	return after
+}
+
+// sameNumber: reports whether after is what before becomes once converted to a Lua number
+func sameNumber(before, after json.Number) bool {
+	b, errB := before.Float64()
+	a, errA := after.Float64()
+	return errB == nil && errA == nil && a == b
+}
+
+// nonNilPositions: returns the indices of the values that are not null
+func nonNilPositions(values []interface{}) []int {
+	positions := make([]int, 0, len(values))
+	for i, value := range values {
+		if value != nil {
+			positions = append(positions, i)
+		}
+	}
+	return positions
+}
@@ -0,0 +1,77 @@
+package luarunner
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// quantityLoader: loads the quantity module, parsing Kubernetes resource quantities such as
+// "500m", "1Gi" or 2 as the API server does
+// Each function takes quantities as strings or numbers and returns nil and an error message
+// when one of them is not a valid quantity
+//
+//	quantity.parse(q): value of q in base units, e.g. 0.5 for "500m" and 1073741824 for "1Gi"
+//	quantity.compare(a, b): -1, 0 or 1 as a is less than, equal to or greater than b
+//	quantity.to_millis(q): value of q in thousandths of base units, rounded up, e.g. 1500 for "1.5"
+func quantityLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"parse":     quantityParse,
+		"compare":   quantityCompare,
+		"to_millis": quantityToMillis,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// checkQuantity: parses the quantity argument at index n
+func checkQuantity(L *lua.LState, n int) (resource.Quantity, error) {
+	switch value := L.Get(n).(type) {
+	case lua.LString:
+		return resource.ParseQuantity(string(value))
+	case lua.LNumber:
+		return resource.ParseQuantity(value.String())
+	default:
+		return resource.Quantity{}, fmt.Errorf("quantity must be a string or a number, got %s", value.Type())
+	}
+}
+
+// quantityParse: parse(q) returns the value of q in base units
+func quantityParse(L *lua.LState) int {
+	quantity, err := checkQuantity(L, 1)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNumber(quantity.AsApproximateFloat64()))
+	return 1
+}
+
+// quantityCompare: compare(a, b) returns -1, 0 or 1 as a is less than, equal to or greater than b
+func quantityCompare(L *lua.LState) int {
+	a, err := checkQuantity(L, 1)
+	if err == nil {
+		var b resource.Quantity
+		if b, err = checkQuantity(L, 2); err == nil {
+			L.Push(lua.LNumber(a.Cmp(b)))
+			return 1
+		}
+	}
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// quantityToMillis: to_millis(q) returns the value of q in thousandths of base units
+func quantityToMillis(L *lua.LState) int {
+	quantity, err := checkQuantity(L, 1)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNumber(quantity.MilliValue()))
+	return 1
+}
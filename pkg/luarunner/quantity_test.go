@@ -0,0 +1,55 @@
+package luarunner
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestQuantityModule(t *testing.T) {
+	script := `
+		local quantity = require("quantity")
+		local _, invalid = quantity.parse("lots")
+		local _, invalid_compare = quantity.compare("1", {})
+		object.results = {
+			greater = quantity.compare("1500m", "1"),
+			less = quantity.compare("1", "1500m"),
+			equal = quantity.compare("1Gi", "1024Mi"),
+			number = quantity.compare(2, "2000m"),
+			half = quantity.parse("500m"),
+			gibibyte = quantity.parse("1Gi"),
+			millis = quantity.to_millis("1.5"),
+			millis_cpu = quantity.to_millis("250m"),
+			invalid = invalid ~= nil,
+			invalid_compare = invalid_compare ~= nil,
+		}
+	`
+	output, err := NewScriptRunner(log.New(io.Discard, "", 0)).RunScript("quantity", script, []byte(`{"kind":"Pod"}`))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	var object struct {
+		Results map[string]interface{} `json:"results"`
+	}
+	if err := json.Unmarshal(output, &object); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+	expected := map[string]interface{}{
+		"greater":         float64(1),
+		"less":            float64(-1),
+		"equal":           float64(0),
+		"number":          float64(0),
+		"half":            0.5,
+		"gibibyte":        float64(1 << 30),
+		"millis":          float64(1500),
+		"millis_cpu":      float64(250),
+		"invalid":         true,
+		"invalid_compare": true,
+	}
+	if !reflect.DeepEqual(object.Results, expected) {
+		t.Errorf("Expected %v, got %v", expected, object.Results)
+	}
+}
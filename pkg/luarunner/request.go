@@ -0,0 +1,63 @@
+package luarunner
+
+import (
+	"context"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// RequestGlobal: name of the global table describing the admission request to scripts
+const RequestGlobal = "request"
+
+// requestOptionsKey: context key of the options of the admission request
+type requestOptionsKey struct{}
+
+// WithRequestOptions: returns a context whose script chains expose options, the decoded
+// CreateOptions, UpdateOptions or DeleteOptions of the admission request, as request.options
+func WithRequestOptions(ctx context.Context, options map[string]interface{}) context.Context {
+	return context.WithValue(ctx, requestOptionsKey{}, options)
+}
+
+// requestOptionsFrom: returns the options attached to ctx by WithRequestOptions, nil when there are none
+func requestOptionsFrom(ctx context.Context) map[string]interface{} {
+	options, _ := ctx.Value(requestOptionsKey{}).(map[string]interface{})
+	return options
+}
+
+// requestRawKey: context key of the object as received by the admission request
+type requestRawKey struct{}
+
+// WithRequestRaw: returns a context whose script chains expose raw as request.raw, rather than the
+// object they start from, for chains continuing one another on the same request
+func WithRequestRaw(ctx context.Context, raw []byte) context.Context {
+	return context.WithValue(ctx, requestRawKey{}, raw)
+}
+
+// requestRawFrom: returns the object attached to ctx by WithRequestRaw, nil when there is none
+func requestRawFrom(ctx context.Context) []byte {
+	raw, _ := ctx.Value(requestRawKey{}).([]byte)
+	return raw
+}
+
+// setRequest: exposes the request to scripts as the request global
+// request.raw holds the object exactly as received, before any script ran, so that scripts can
+// hash or sign it deterministically: the object global is a round-tripped copy of it
+// request.options holds the options of the operation, such as fieldManager, an empty table without any
+func (r *ScriptRunner) setRequest(L *lua.LState, raw []byte, options map[string]interface{}) error {
+	request := L.NewTable()
+	request.RawSetString("raw", lua.LString(raw))
+
+	value := lua.LValue(L.NewTable())
+	if options != nil {
+		converted, err := r.translator.ToLua(L, options)
+		if err != nil {
+			return fmt.Errorf("failed to convert request options to Lua: %w", err)
+		}
+		value = converted
+	}
+	request.RawSetString("options", value)
+
+	L.SetGlobal(RequestGlobal, request)
+	return nil
+}
@@ -1,16 +1,23 @@
 package luarunner
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	gotime "time"
 
 	"github.com/thomas-maurice/glua/pkg/glua"
 	"github.com/thomas-maurice/glua/pkg/modules/base64"
 	"github.com/thomas-maurice/glua/pkg/modules/fs"
 	"github.com/thomas-maurice/glua/pkg/modules/hash"
 	"github.com/thomas-maurice/glua/pkg/modules/hex"
-	"github.com/thomas-maurice/glua/pkg/modules/http"
 	gluajson "github.com/thomas-maurice/glua/pkg/modules/json"
 	glualog "github.com/thomas-maurice/glua/pkg/modules/log"
 	"github.com/thomas-maurice/glua/pkg/modules/spew"
@@ -18,75 +25,439 @@ import (
 	"github.com/thomas-maurice/glua/pkg/modules/time"
 	"github.com/thomas-maurice/glua/pkg/modules/yaml"
 	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"thechat/pkg/cluster"
 )
 
+// chunkName: name given to compiled scripts, matching what DoString reports in error messages
+const chunkName = "<string>"
+
+// ErrBudgetExhausted: result of the scripts of a chain skipped because too little time was left to run them
+var ErrBudgetExhausted = errors.New("latency budget exhausted")
+
+// Options: optional configuration for a ScriptRunner
+type Options struct {
+	// ExtraModules: additional Go modules preloaded alongside the built-in glua modules,
+	// available to scripts through require(name)
+	ExtraModules map[string]lua.LGFunction
+	// ExtraGlobals: additional globals, each evaluated once per script execution
+	ExtraGlobals map[string]func(L *lua.LState) lua.LValue
+	// Allowlist: names of the modules (built-in and extra) and extra globals scripts may use
+	// A nil allowlist allows everything. The object and warn globals are always available
+	Allowlist []string
+	// Cluster: read-only cluster access exposed as the cluster module, unavailable when nil
+	Cluster *cluster.Lookup
+	// PreserveKeyOrder: make pairs() iterate over tables of the object in the order their keys
+	// appear in the JSON document, so scripts building strings from them are reproducible
+	PreserveKeyOrder bool
+	// ScriptTimeout: maximum run time of a single script, zero for no limit
+	// Within a chain, a script only starts when the context deadline leaves it that much time
+	ScriptTimeout gotime.Duration
+	// Identity: where the webhook runs, exposed to scripts as the webhook global
+	Identity Identity
+	// MaxConversionTime: longest a script object may take to convert to or from Lua, the script
+	// fails with ErrConversionTimeout beyond it. Zero for no limit
+	MaxConversionTime gotime.Duration
+	// MaxDepth: deepest nesting of the object a script may leave, DefaultMaxDepth when zero
+	MaxDepth int
+	// SafeMode: never load the fs and http modules, and strip the base library functions
+	// reaching the host (dofile, loadfile, io, os.execute...), for untrusted script authors
+	SafeMode bool
+	// FSRoot: directory the fs module is confined to, read-only, scripts read files relative to it
+	// Empty leaves the fs module unrestricted
+	FSRoot string
+	// DisableFS: make require("fs") fail with an explanation, FSRoot is ignored
+	DisableFS bool
+	// HTTP: egress controls of the http module, the zero value allows everything
+	HTTP HTTPPolicy
+	// ContinueAfterDenial: keep running the chain after a script denied the request, so that
+	// every denial is reported. Only meaningful when the object the scripts leave is discarded
+	ContinueAfterDenial bool
+	// Clock: time scripts see through os.time, os.date and time.now, the system time when nil
+	// Set to a FrozenClock for reproducible runs, never in the webhook
+	Clock Clock
+	// Seed: seed of the generator behind math.random, so that runs draw the same numbers
+	// Zero leaves math.random as is
+	Seed int64
+	// DisableCPUTime: do not lock scripts to their OS thread to read its CPU clock, ScriptResult
+	// reports their wall time as CPU time instead
+	DisableCPUTime bool
+}
+
 // ScriptRunner: executes Lua scripts against Kubernetes objects with isolated VM instances
+//
+// A ScriptRunner is safe for concurrent use: every script runs in its own Lua state, the
+// compiled bytecode cache is guarded by a lock, and the options are never modified after
+// construction. Scripts of concurrent calls share nothing but the cluster lookup caches.
+// Extra modules and globals passed in Options must be safe for concurrent use as well
 type ScriptRunner struct {
-	logger       *log.Logger
-	translator   *glua.Translator
+	logger     *log.Logger
+	translator *glua.Translator
+	options    Options
+
+	registryMu   sync.Mutex
 	typeRegistry *glua.TypeRegistry
+
+	compiledMu sync.RWMutex
+	compiled   map[string]compiledScript
+
+	usageMu sync.Mutex
+	usage   map[string]*ScriptUsage
+}
+
+// compiledScript: bytecode of a script, along with the hash of the source it was compiled from
+type compiledScript struct {
+	hash  [sha256.Size]byte
+	proto *lua.FunctionProto
+}
+
+// ScriptResult: outcome of a single script execution within a chain
+type ScriptResult struct {
+	// Name: script identifier
+	Name string
+	// Warnings: messages emitted by the script through warn(), dropped when the script fails
+	Warnings []string
+	// Logs: messages logged by the script through the log or audit modules, dropped when the script fails
+	Logs []string
+	// Metadata: labels and annotations set on the object through add_label and add_annotation, in order
+	Metadata []MetadataChange
+	// Timings: time spent converting the object and running the script, zero when the script failed
+	Timings PhaseTimings
+	// Duration: wall time of the script, failed ones included, zero when it was skipped
+	Duration gotime.Duration
+	// CPUTime: CPU time the thread running the script consumed, conversions and failed scripts
+	// included, zero when it was skipped or abandoned. Wall time when CPUTimeWallClock is set
+	CPUTime gotime.Duration
+	// CPUTimeWallClock: CPUTime is the wall time of the script, the thread CPU clock being
+	// unavailable (outside Linux) or disabled through Options.DisableCPUTime
+	CPUTimeWallClock bool
+	// Usage: modules the script required and module functions it called, empty when the script failed
+	// for another reason than a denial
+	Usage Usage
+	// Hash: hex-encoded SHA-256 of the content the script ran with, set by the caller that loaded it
+	Hash string
+	// ResourceVersion: resourceVersion of the ConfigMap the script was loaded from, set by the
+	// caller that loaded it
+	ResourceVersion string
+	// Err: execution error, nil when the script succeeded, a *Denial when it denied the request
+	Err error
+}
+
+// ErrSummary: first line of Err, without the Lua traceback following it, empty when the script
+// succeeded
+func (r ScriptResult) ErrSummary() string {
+	if r.Err == nil {
+		return ""
+	}
+	message := r.Err.Error()
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		message = strings.TrimSpace(message[:i])
+	}
+	return message
 }
 
 // NewScriptRunner: creates a new Lua script runner with logging
 func NewScriptRunner(logger *log.Logger) *ScriptRunner {
+	return NewScriptRunnerWithOptions(logger, Options{})
+}
+
+// NewScriptRunnerWithOptions: creates a new Lua script runner with custom modules, globals and allowlist
+func NewScriptRunnerWithOptions(logger *log.Logger, options Options) *ScriptRunner {
 	registry := glua.NewTypeRegistry()
 
-	// Register common Kubernetes types for stub generation
+	// Register the type objects are decoded into for stub generation, once for all requests
 	// This enables LSP autocompletion and type checking in IDEs
 	logger.Printf("Initializing TypeRegistry for Kubernetes types")
+	if err := registry.Register(map[string]interface{}{}); err != nil {
+		logger.Printf("DEBUG: Could not register type for stub generation: %v", err)
+	}
 
 	return &ScriptRunner{
 		logger:       logger,
 		translator:   glua.NewTranslator(),
 		typeRegistry: registry,
+		options:      options,
+		compiled:     make(map[string]compiledScript),
+		usage:        make(map[string]*ScriptUsage),
+	}
+}
+
+// allowed: reports whether the allowlist lets scripts use the given module or global
+// Safe mode always denies the unsafe modules
+func (r *ScriptRunner) allowed(name string) bool {
+	if r.options.SafeMode && unsafeModules[name] {
+		return false
+	}
+	if r.options.Allowlist == nil {
+		return true
+	}
+
+	for _, allowed := range r.options.Allowlist {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// maxDepth: returns the deepest nesting of the object a script may leave
+func (r *ScriptRunner) maxDepth() int {
+	if r.options.MaxDepth > 0 {
+		return r.options.MaxDepth
+	}
+	return DefaultMaxDepth
+}
+
+// compile: returns the bytecode for a script, reusing the cached one when the content is unchanged
+func (r *ScriptRunner) compile(scriptName, scriptContent string) (*lua.FunctionProto, error) {
+	hash := sha256.Sum256([]byte(scriptContent))
+
+	r.compiledMu.RLock()
+	cached, exists := r.compiled[scriptName]
+	r.compiledMu.RUnlock()
+
+	if exists && cached.hash == hash {
+		return cached.proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(scriptContent), chunkName)
+	if err != nil {
+		return nil, withCompatHint(scriptContent, err)
+	}
+
+	proto, err := lua.Compile(chunk, chunkName)
+	if err != nil {
+		return nil, err
 	}
+
+	r.compiledMu.Lock()
+	r.compiled[scriptName] = compiledScript{hash: hash, proto: proto}
+	r.compiledMu.Unlock()
+
+	r.logger.Printf("Compiled script %s", scriptName)
+	return proto, nil
+}
+
+// EvictCompiled: drops the cached bytecode and the usage statistics of the scripts loaded from a
+// ConfigMap, whose content changed. Matches the namespace/name identifier as well as namespace/name#key ones
+func (r *ScriptRunner) EvictCompiled(namespace, name string) {
+	prefix := fmt.Sprintf("%s/%s", namespace, name)
+	matches := func(scriptName string) bool {
+		return scriptName == prefix || strings.HasPrefix(scriptName, prefix+"#")
+	}
+
+	r.compiledMu.Lock()
+	for scriptName := range r.compiled {
+		if matches(scriptName) {
+			delete(r.compiled, scriptName)
+			r.logger.Printf("Evicted compiled script %s", scriptName)
+		}
+	}
+	r.compiledMu.Unlock()
+
+	r.usageMu.Lock()
+	for scriptName := range r.usage {
+		if matches(scriptName) {
+			delete(r.usage, scriptName)
+		}
+	}
+	r.usageMu.Unlock()
+}
+
+// FlushCompiled: drops every cached bytecode and the usage statistics
+func (r *ScriptRunner) FlushCompiled() {
+	r.compiledMu.Lock()
+	r.compiled = make(map[string]compiledScript)
+	r.compiledMu.Unlock()
+
+	r.usageMu.Lock()
+	r.usage = make(map[string]*ScriptUsage)
+	r.usageMu.Unlock()
 }
 
 // RegisterType: registers a Kubernetes type with the TypeRegistry for stub generation
 // This is used to enable IDE support and type checking for Lua scripts
 func (r *ScriptRunner) RegisterType(obj interface{}) error {
 	r.logger.Printf("Registering type: %T", obj)
+
+	r.registryMu.Lock()
+	defer r.registryMu.Unlock()
 	return r.typeRegistry.Register(obj)
 }
 
+// GenerateTypeStubs: processes the registered types and returns their LuaLS stubs
+// Safe to call while other goroutines run scripts and register types
+func (r *ScriptRunner) GenerateTypeStubs() (string, error) {
+	r.registryMu.Lock()
+	defer r.registryMu.Unlock()
+
+	if err := r.typeRegistry.Process(); err != nil {
+		return "", err
+	}
+	return r.typeRegistry.GenerateStubs()
+}
+
 // GetTypeRegistry: returns the TypeRegistry for external use (e.g., stub generation)
+// The registry itself is not safe for concurrent use, do not call RegisterType while using it,
+// GenerateTypeStubs is the safe way to get stubs out of a runner in use
 func (r *ScriptRunner) GetTypeRegistry() *glua.TypeRegistry {
 	return r.typeRegistry
 }
 
-// loadModules: preloads ALL available glua modules into the Lua state
-// This includes: json, yaml, base64, hex, hash, http, log, spew, template, time, fs
+// builtinModules: glua modules available to scripts, in preload order
 // Note: k8sclient and kubernetes modules require rest.Config and are not loaded here
 // The webhook provides access to K8s resources through the object global variable
-func (r *ScriptRunner) loadModules(L *lua.LState) {
+var builtinModules = []struct {
+	name   string
+	loader lua.LGFunction
+}{
 	// Data encoding/decoding
-	L.PreloadModule("json", gluajson.Loader)
-	L.PreloadModule("yaml", yaml.Loader)
-	L.PreloadModule("base64", base64.Loader)
-	L.PreloadModule("hex", hex.Loader)
+	{"json", gluajson.Loader},
+	{"yaml", yaml.Loader},
+	{"base64", base64.Loader},
+	{"hex", hex.Loader},
 
 	// Cryptography and hashing
-	L.PreloadModule("hash", hash.Loader)
+	{"hash", hash.Loader},
 
 	// Network and HTTP
-	L.PreloadModule("http", http.Loader)
+	{"http", HTTPPolicy{}.loader},
 
 	// Utilities
-	L.PreloadModule("log", glualog.Loader)
-	L.PreloadModule("spew", spew.Loader)
-	L.PreloadModule("template", template.Loader)
-	L.PreloadModule("time", time.Loader)
+	{"helpers", helpersLoader},
+	{"quantity", quantityLoader},
+	{"log", glualog.Loader},
+	{"spew", spew.Loader},
+	{"template", template.Loader},
+	{"time", time.Loader},
 
 	// File system operations
-	L.PreloadModule("fs", fs.Loader)
+	{"fs", fs.Loader},
+}
+
+// loadModules: preloads the built-in glua modules and the extra modules permitted by the allowlist
+// Messages logged through the log and audit modules are recorded into logs, secretData enables k8s.secret
+func (r *ScriptRunner) loadModules(L *lua.LState, scriptName string, session *cluster.Session, logs *[]string, secretData bool) {
+	loaded := make([]string, 0, len(builtinModules)+len(r.options.ExtraModules))
+
+	for _, module := range builtinModules {
+		if r.allowed(module.name) {
+			loader := module.loader
+			switch {
+			case module.name == "log":
+				loader = recordingLogLoader(logs)
+			case module.name == "http":
+				loader = r.options.HTTP.loader
+			case module.name == "fs" && r.options.DisableFS:
+				loader = disabledFSLoader
+			case module.name == "fs" && r.options.FSRoot != "":
+				loader = rootedFS{dir: r.options.FSRoot}.loader
+			case module.name == "time":
+				loader = interruptibleTimeLoader(loader)
+				if r.options.Clock != nil {
+					loader = clockedTimeLoader(loader, r.options.Clock)
+				}
+			}
+			L.PreloadModule(module.name, guardConversions(module.name, loader, r.maxDepth()))
+			loaded = append(loaded, module.name)
+		}
+	}
+
+	if r.allowed(AuditModuleName) {
+		L.PreloadModule(AuditModuleName, r.auditLoader(scriptName, logs))
+		loaded = append(loaded, AuditModuleName)
+	}
+
+	extraNames := make([]string, 0, len(r.options.ExtraModules))
+	for name := range r.options.ExtraModules {
+		extraNames = append(extraNames, name)
+	}
+	sort.Strings(extraNames)
+
+	for _, name := range extraNames {
+		if r.allowed(name) {
+			L.PreloadModule(name, r.options.ExtraModules[name])
+			loaded = append(loaded, name)
+		}
+	}
+
+	loaded = append(loaded, preloadEmbeddedLibraries(L)...)
+	L.PreloadModule(SecretModuleName, secretLoader(secretData))
+	loaded = append(loaded, SecretModuleName)
+
+	if session != nil {
+		L.PreloadModule(cluster.ModuleName, session.Loader)
+		loaded = append(loaded, cluster.ModuleName)
+	}
+
+	r.logger.Printf("Loaded glua modules: %s", strings.Join(loaded, ", "))
+}
+
+// setExtraGlobals: evaluates the extra globals permitted by the allowlist into the Lua state
+func (r *ScriptRunner) setExtraGlobals(L *lua.LState) {
+	for name, global := range r.options.ExtraGlobals {
+		if r.allowed(name) {
+			L.SetGlobal(name, global(L))
+		}
+	}
+}
 
-	r.logger.Printf("Loaded glua modules: json, yaml, base64, hex, hash, http, log, spew, template, time, fs")
+// registerWarn: exposes warn(...) to scripts, collecting messages into warnings
+// Arguments are concatenated like Lua 5.4's warn
+func registerWarn(L *lua.LState, warnings *[]string) {
+	L.SetGlobal("warn", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, 0, L.GetTop())
+		for i := 1; i <= L.GetTop(); i++ {
+			parts = append(parts, L.CheckString(i))
+		}
+		*warnings = append(*warnings, strings.Join(parts, ""))
+		return 0
+	}))
 }
 
 // RunScript: executes a single Lua script against a Kubernetes object
 // Each invocation creates a fresh gopher-lua VM instance
 // Returns the modified object as JSON bytes and any error
 func (r *ScriptRunner) RunScript(scriptName, scriptContent string, objectJSON []byte) ([]byte, error) {
+	ctx := withHTTPCalls(context.Background())
+	session := r.newSession(ctx)
+	if session != nil {
+		defer session.Close()
+	}
+
+	result, _, err := r.runIsolated(ctx, scriptName, scriptContent, objectJSON, objectJSON, session)
+	if err != nil {
+		return nil, err
+	}
+	return r.preserve(objectJSON, result), nil
+}
+
+// newSession: starts the cluster lookups of a script chain, nil when scripts have no cluster access
+func (r *ScriptRunner) newSession(ctx context.Context) *cluster.Session {
+	if r.options.Cluster == nil || !r.allowed(cluster.ModuleName) {
+		return nil
+	}
+	return r.options.Cluster.NewSession(ctx)
+}
+
+// scriptOutput: messages a script emitted besides its mutations
+type scriptOutput struct {
+	warnings []string
+	logs     []string
+	metadata []MetadataChange
+	denial   *Denial
+	timings  PhaseTimings
+	usage    Usage
+
+	cpuTime      gotime.Duration
+	cpuWallClock bool
+}
+
+// runScript: executes a single Lua script and also returns the messages it emitted
+// raw is the object as received by the chain, objectJSON the object as left by the previous scripts
+// Cluster lookups go through session, shared by every script of a chain
+func (r *ScriptRunner) runScript(ctx context.Context, scriptName, scriptContent string, objectJSON, raw []byte, session *cluster.Session) ([]byte, scriptOutput, error) {
 	r.logger.Printf("Running script %s (length: %d bytes) against object (length: %d bytes)",
 		scriptName, len(scriptContent), len(objectJSON))
 
@@ -94,67 +465,162 @@ func (r *ScriptRunner) RunScript(scriptName, scriptContent string, objectJSON []
 	L := lua.NewState()
 	defer L.Close()
 
+	// Stop the script once its timeout or the caller deadline is reached
+	if timeout := r.scriptTimeout(ctx, scriptName); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	L.SetContext(ctx)
+
 	// Load glua modules
-	r.loadModules(L)
+	var output scriptOutput
+	r.loadModules(L, scriptName, session, &output.logs, secretDataAllowed(ctx))
 	r.logger.Printf("Loaded glua modules for script %s", scriptName)
 
+	// Record the modules the script requires, whether it succeeds or not
+	tracker := newUsageTracker()
+	tracker.instrument(L)
+	defer func() { r.recordUsage(scriptName, tracker.usage()) }()
+
 	// Parse the input JSON into a Go value
+	started := gotime.Now()
 	var obj interface{}
 	if err := json.Unmarshal(objectJSON, &obj); err != nil {
 		r.logger.Printf("ERROR: Failed to unmarshal JSON for script %s: %v", scriptName, err)
-		return nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
-	}
-
-	// Register the type for stub generation (best-effort, ignore errors)
-	// This helps build LSP type information for IDE support
-	if err := r.typeRegistry.Register(obj); err != nil {
-		r.logger.Printf("DEBUG: Could not register type for stub generation: %v", err)
+		return nil, scriptOutput{}, fmt.Errorf("failed to unmarshal JSON: %w", err)
 	}
 
 	// Convert Go object to Lua value using glua translator
 	luaValue, err := r.translator.ToLua(L, obj)
 	if err != nil {
 		r.logger.Printf("ERROR: Failed to convert object to Lua for script %s: %v", scriptName, err)
-		return nil, fmt.Errorf("failed to convert to Lua: %w", err)
+		return nil, scriptOutput{}, fmt.Errorf("failed to convert to Lua: %w", err)
+	}
+
+	if r.options.PreserveKeyOrder {
+		order, err := decodeKeyOrder(objectJSON)
+		if err != nil {
+			r.logger.Printf("ERROR: Failed to decode key order for script %s: %v", scriptName, err)
+			return nil, scriptOutput{}, fmt.Errorf("failed to decode key order: %w", err)
+		}
+		attachKeyOrder(L, luaValue, order)
+		registerOrderedPairs(L)
+	}
+
+	output.timings.ToLua = gotime.Since(started)
+	if err := r.checkConversionTime("to Lua", output.timings.ToLua); err != nil {
+		r.logger.Printf("ERROR: Script %s not run: %v", scriptName, err)
+		return nil, scriptOutput{}, err
 	}
 
 	L.SetGlobal("object", luaValue)
 	r.logger.Printf("Set global 'object' for script %s", scriptName)
 
+	if err := r.setRequest(L, raw, requestOptionsFrom(ctx)); err != nil {
+		r.logger.Printf("ERROR: Failed to set request for script %s: %v", scriptName, err)
+		return nil, scriptOutput{}, err
+	}
+	setIdentity(L, r.options.Identity)
+	setGVK(L, gvkFrom(ctx))
+	if err := r.setParams(L, paramsFrom(ctx)); err != nil {
+		r.logger.Printf("ERROR: Failed to set params for script %s: %v", scriptName, err)
+		return nil, scriptOutput{}, err
+	}
+
+	// Collect messages emitted through warn()
+	registerWarn(L, &output.warnings)
+	registerMetadataHelpers(L, &output.metadata)
+	registerDenyHelpers(L, &output.denial)
+
+	if r.options.Clock != nil {
+		applyClock(L, r.options.Clock)
+	}
+	if r.options.Seed != 0 {
+		applySeed(L, r.options.Seed)
+	}
+
+	r.setExtraGlobals(L)
+
+	if r.options.SafeMode {
+		applySafeMode(L)
+	}
+	tracker.instrumentBase(L)
+
+	// Compile the script, or reuse its cached bytecode
+	started = gotime.Now()
+	proto, err := r.compile(scriptName, scriptContent)
+	if err != nil {
+		r.logger.Printf("ERROR: Script %s compilation failed: %v", scriptName, err)
+		return nil, scriptOutput{}, fmt.Errorf("script execution failed: %w", err)
+	}
+
 	// Execute the script
 	r.logger.Printf("Executing Lua script %s", scriptName)
-	if err := L.DoString(scriptContent); err != nil {
+	L.Push(L.NewFunctionFromProto(proto))
+	err = L.PCall(0, lua.MultRet, nil)
+	// A denial stands even when the script caught the error stopping it with pcall
+	if output.denial != nil {
+		r.logger.Printf("Script %s denied the request: %v", scriptName, output.denial)
+		// Keep what the denial depended on, so that a denial resting on the clock is not cached
+		return nil, scriptOutput{usage: tracker.usage()}, output.denial
+	}
+	if err != nil {
 		r.logger.Printf("ERROR: Script %s execution failed: %v", scriptName, err)
-		return nil, fmt.Errorf("script execution failed: %w", err)
+		return nil, scriptOutput{}, fmt.Errorf("script execution failed: %w", err)
 	}
 
+	output.timings.Execute = gotime.Since(started)
+
 	// Retrieve the modified object
+	started = gotime.Now()
 	modifiedObj := L.GetGlobal("object")
 
-	// Convert back to Go value using glua translator
-	var goObj interface{}
-	if err := r.translator.FromLua(L, modifiedObj, &goObj); err != nil {
-		r.logger.Printf("ERROR: Failed to convert Lua value back to Go for script %s: %v", scriptName, err)
-		return nil, fmt.Errorf("failed to convert from Lua: %w", err)
+	// Cycles, runaway nesting and NaN or infinite numbers, e.g. from 0/0, have no JSON representation
+	if err := checkConvertible(modifiedObj, "object", r.maxDepth()); err != nil {
+		r.logger.Printf("ERROR: Script %s result cannot be converted: %v", scriptName, err)
+		return nil, scriptOutput{}, err
 	}
 
-	// Convert back to JSON
-	resultJSON, err := json.Marshal(goObj)
-	if err != nil {
-		r.logger.Printf("ERROR: Failed to marshal result for script %s: %v", scriptName, err)
-		return nil, fmt.Errorf("failed to marshal result: %w", err)
+	// Convert back to JSON using glua translator
+	// The translator goes through JSON internally, decoding into a RawMessage keeps its encoding
+	// instead of building a Go value only to marshal it again
+	var resultJSON json.RawMessage
+	if err := r.translator.FromLua(L, modifiedObj, &resultJSON); err != nil {
+		r.logger.Printf("ERROR: Failed to convert Lua value back to JSON for script %s: %v", scriptName, err)
+		return nil, scriptOutput{}, fmt.Errorf("failed to convert from Lua: %w", err)
+	}
+
+	output.timings.FromLua = gotime.Since(started)
+	if err := r.checkConversionTime("from Lua", output.timings.FromLua); err != nil {
+		r.logger.Printf("ERROR: Script %s result dropped: %v", scriptName, err)
+		return nil, scriptOutput{}, err
 	}
 
+	output.usage = tracker.usage()
+	r.logger.Printf("DEBUG: Script %s timings: %s", scriptName, output.timings)
 	r.logger.Printf("Script %s completed successfully, result length: %d bytes", scriptName, len(resultJSON))
-	return resultJSON, nil
+	return resultJSON, output, nil
 }
 
 // RunScriptsSequentially: executes multiple scripts in sequence, each with its own VM
-// Scripts are executed in alphabetical order
+// Scripts are executed in alphabetical order, each in its own goroutine so that a panic or a
+// script outliving its timeout only fails that script
 // If a script fails, it logs the error and continues with remaining scripts
 func (r *ScriptRunner) RunScriptsSequentially(scripts map[string]string, objectJSON []byte) ([]byte, error) {
-	r.logger.Printf("Running %d scripts sequentially against object", len(scripts))
+	result, _, err := r.RunScriptsWithResults(scripts, objectJSON)
+	return result, err
+}
 
+// RunScriptsWithResults: same as RunScriptsSequentially, also returning the outcome of each script
+// in execution order
+func (r *ScriptRunner) RunScriptsWithResults(scripts map[string]string, objectJSON []byte) ([]byte, []ScriptResult, error) {
+	return r.RunScriptsWithContext(context.Background(), scripts, objectJSON)
+}
+
+// RunScriptsWithContext: same as RunScriptsWithResults, with cluster lookups bound to ctx
+// Cluster lookups are memoized across the whole chain and forgotten once it completes
+func (r *ScriptRunner) RunScriptsWithContext(ctx context.Context, scripts map[string]string, objectJSON []byte) ([]byte, []ScriptResult, error) {
 	// Sort script names alphabetically
 	sortedNames := make([]string, 0, len(scripts))
 	for name := range scripts {
@@ -169,27 +635,122 @@ func (r *ScriptRunner) RunScriptsSequentially(scripts map[string]string, objectJ
 		}
 	}
 
+	return r.RunOrderedScriptsWithContext(ctx, sortedNames, scripts, objectJSON)
+}
+
+// RunOrderedScriptsWithContext: same as RunScriptsWithContext, running the scripts in the given order
+func (r *ScriptRunner) RunOrderedScriptsWithContext(ctx context.Context, order []string, scripts map[string]string, objectJSON []byte) ([]byte, []ScriptResult, error) {
+	return r.RunFilteredScriptsWithContext(ctx, order, scripts, objectJSON, nil)
+}
+
+// ScriptFilter: decides which changes of a script are kept
+// Receives the object before and after the script ran, returns the object the next script receives
+// and warnings about the changes dropped. An error fails the script
+type ScriptFilter func(scriptName string, before, after []byte) ([]byte, []string, error)
+
+// RunFilteredScriptsWithContext: same as RunOrderedScriptsWithContext, passing the result of every
+// script through filter, when not nil
+func (r *ScriptRunner) RunFilteredScriptsWithContext(ctx context.Context, order []string, scripts map[string]string, objectJSON []byte, filter ScriptFilter) ([]byte, []ScriptResult, error) {
+	r.logger.Printf("Running %d scripts sequentially against object", len(order))
+
+	// The http calls budget is shared by every script of the chain
+	ctx = withHTTPCalls(ctx)
+	session := r.newSession(ctx)
+	if session != nil {
+		defer session.Close()
+	}
+
 	currentJSON := objectJSON
+	raw := requestRawFrom(ctx)
+	if raw == nil {
+		raw = objectJSON
+	}
 	successCount := 0
 	failCount := 0
+	results := make([]ScriptResult, 0, len(order))
 
-	for _, name := range sortedNames {
-		scriptContent := scripts[name]
-		r.logger.Printf("Executing script %d/%d: %s", successCount+failCount+1, len(scripts), name)
+	for i, name := range order {
+		if !r.hasBudget(ctx) {
+			r.logger.Printf("WARNING: Latency budget exhausted, skipping %d remaining scripts", len(order)-i)
+			for _, skipped := range order[i:] {
+				results = append(results, ScriptResult{Name: skipped, Err: ErrBudgetExhausted})
+			}
+			break
+		}
 
-		result, err := r.RunScript(name, scriptContent, currentJSON)
+		scriptContent := scripts[name]
+		r.logger.Printf("Executing script %d/%d: %s", successCount+failCount+1, len(order), name)
+
+		started := gotime.Now()
+		result, output, err := r.runIsolated(ctx, name, scriptContent, currentJSON, raw, session)
+		duration := gotime.Since(started)
+		var denial *Denial
+		if errors.As(err, &denial) {
+			results = append(results, ScriptResult{Name: name, Duration: duration, CPUTime: output.cpuTime, CPUTimeWallClock: output.cpuWallClock, Usage: output.usage, Err: err})
+			failCount++
+			if r.options.ContinueAfterDenial {
+				r.logger.Printf("WARNING: Script %s denied the request, continuing to collect denials", name)
+				continue
+			}
+			r.logger.Printf("WARNING: Script %s denied the request, skipping %d remaining scripts", name, len(order)-i-1)
+			break
+		}
 		if err != nil {
 			r.logger.Printf("WARNING: Script %s failed (ignoring): %v", name, err)
+			results = append(results, ScriptResult{Name: name, Duration: duration, CPUTime: output.cpuTime, CPUTimeWallClock: output.cpuWallClock, Err: err})
 			failCount++
 			// Continue with remaining scripts using the current state
 			continue
 		}
 
+		if filter != nil {
+			var dropped []string
+			result, dropped, err = filter(name, currentJSON, r.preserve(currentJSON, result))
+			if err != nil {
+				r.logger.Printf("WARNING: Script %s result rejected (ignoring): %v", name, err)
+				results = append(results, ScriptResult{Name: name, Duration: duration, CPUTime: output.cpuTime, CPUTimeWallClock: output.cpuWallClock, Err: err})
+				failCount++
+				continue
+			}
+			output.warnings = append(output.warnings, dropped...)
+		}
+
 		currentJSON = result
+		results = append(results, ScriptResult{Name: name, Warnings: output.warnings, Logs: output.logs, Metadata: output.metadata, Timings: output.timings, Duration: duration, CPUTime: output.cpuTime, CPUTimeWallClock: output.cpuWallClock, Usage: output.usage})
 		successCount++
 		r.logger.Printf("Script %s succeeded, continuing to next script", name)
 	}
 
 	r.logger.Printf("Script execution complete: %d succeeded, %d failed", successCount, failCount)
-	return currentJSON, nil
+	return r.preserve(objectJSON, currentJSON), results, nil
+}
+
+// preserve: restores the values of the original object scripts did not change, see preserveUnchanged
+// Falls back to the script result when it cannot be compared with the original object
+func (r *ScriptRunner) preserve(original, result []byte) []byte {
+	if bytes.Equal(original, result) {
+		return result
+	}
+
+	preserved, err := preserveUnchanged(original, result)
+	if err != nil {
+		r.logger.Printf("WARNING: Failed to preserve unchanged fields: %v", err)
+		return result
+	}
+	return preserved
+}
+
+// hasBudget: reports whether the context leaves enough time to start another script,
+// that is at least ScriptTimeout before its deadline
+func (r *ScriptRunner) hasBudget(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+
+	return gotime.Until(deadline) >= r.options.ScriptTimeout
 }
@@ -1,11 +1,30 @@
 package luarunner
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"reflect"
+	goruntime "runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"thechat/pkg/cluster"
 )
 
 func TestRunScript_Success(t *testing.T) {
@@ -240,6 +259,226 @@ func TestRunScriptsSequentially_PartialFailure(t *testing.T) {
 	}
 }
 
+func TestRunScriptsWithResults_Warnings(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{
+		"a-warn": `
+			object.metadata = {labels = {sidecar = "injected"}}
+			warn("injected a sidecar ", "you did not ask for")
+		`,
+		"b-fail": `
+			warn("this warning is dropped")
+			error("boom")
+		`,
+	}
+
+	inputJSON, _ := json.Marshal(map[string]interface{}{"kind": "Pod"})
+
+	result, results, err := runner.RunScriptsWithResults(scripts, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+
+	if !strings.Contains(string(result), "injected") {
+		t.Errorf("Expected mutation to be kept alongside the warning, got %s", result)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	if results[0].Name != "a-warn" || len(results[0].Warnings) != 1 || results[0].Warnings[0] != "injected a sidecar you did not ask for" {
+		t.Errorf("Unexpected result for a-warn: %+v", results[0])
+	}
+
+	if results[1].Err == nil || len(results[1].Warnings) != 0 {
+		t.Errorf("Expected b-fail to fail without warnings, got %+v", results[1])
+	}
+}
+
+func TestRunScriptsWithResults_Logs(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{
+		"a-log": `
+			local log = require("log")
+			log.info("defaulting replicas", "replicas", 1)
+			require("audit").log("set ", "replicas")
+		`,
+		"b-fail": `
+			require("audit").log("this entry is dropped")
+			error("boom")
+		`,
+	}
+
+	_, results, err := runner.RunScriptsWithResults(scripts, []byte(`{"kind":"Deployment"}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+
+	expected := []string{"info: defaulting replicas", "set replicas"}
+	if fmt.Sprint(results[0].Logs) != fmt.Sprint(expected) {
+		t.Errorf("Expected logs %v, got %v", expected, results[0].Logs)
+	}
+	if results[1].Err == nil || len(results[1].Logs) != 0 {
+		t.Errorf("Expected b-fail to fail without logs, got %+v", results[1])
+	}
+}
+
+// unusualObject: object with fields a round-trip through Lua used to alter
+const unusualObject = `{
+	"apiVersion": "example.com/v1",
+	"kind": "Widget",
+	"metadata": {"name": "w", "labels": {"app": "w"}, "finalizers": []},
+	"spec": {
+		"bigInteger": 9007199254740993,
+		"float": 1.0,
+		"exponent": 1e3,
+		"emptyList": [],
+		"emptyObject": {},
+		"nothing": null,
+		"sparse": [1, null, 3, null],
+		"nested": [{"args": [], "env": {}}],
+		"unicode": "caf\u00e9 <tag> & \ud83d\ude00",
+		"x-unknown-field": {"deeply": {"nested": [true, false, 0]}}
+	}
+}`
+
+func TestRunScript_PreservesUnchangedFields(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	result, err := runner.RunScript("label", `object.metadata.labels.mutated = "true"`, []byte(unusualObject))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	for _, literal := range []string{
+		`"bigInteger":9007199254740993`,
+		`"float":1.0`,
+		`"exponent":1e3`,
+		`"emptyList":[]`,
+		`"emptyObject":{}`,
+		`"nothing":null`,
+		`"sparse":[1,null,3,null]`,
+		`"nested":[{"args":[],"env":{}}]`,
+		`"finalizers":[]`,
+		`"x-unknown-field":{"deeply":{"nested":[true,false,0]}}`,
+		`"mutated":"true"`,
+	} {
+		if !strings.Contains(string(result), literal) {
+			t.Errorf("Expected %s in result, got %s", literal, result)
+		}
+	}
+
+	// Apart from the label, the object is the same
+	var original, modified map[string]interface{}
+	if err := json.Unmarshal([]byte(unusualObject), &original); err != nil {
+		t.Fatalf("Failed to unmarshal original: %v", err)
+	}
+	if err := json.Unmarshal(result, &modified); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+	delete(modified["metadata"].(map[string]interface{})["labels"].(map[string]interface{}), "mutated")
+	if !reflect.DeepEqual(original, modified) {
+		t.Errorf("Expected every other field to survive, got %s", result)
+	}
+}
+
+func TestRunScript_IntentionalChangesWin(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	script := `
+		object.spec.float = 2.5
+		object.spec.emptyList = {"added"}
+		object.spec.sparse = nil
+		object.spec.nested[1].args = nil
+	`
+	result, err := runner.RunScript("change", script, []byte(unusualObject))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	for _, literal := range []string{`"float":2.5`, `"emptyList":["added"]`, `"nested":[{"env":{}}]`, `"bigInteger":9007199254740993`} {
+		if !strings.Contains(string(result), literal) {
+			t.Errorf("Expected %s in result, got %s", literal, result)
+		}
+	}
+	if strings.Contains(string(result), "sparse") {
+		t.Errorf("Expected the removed field to stay removed, got %s", result)
+	}
+}
+
+func TestRunScriptsWithResults_RequestRaw(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	// Both scripts see the object as received, whatever the first one changed
+	raw := `{"kind": "Pod", "metadata": {"name": "raw", "annotations": {}}, "spec": {"ratio": 1.0}}`
+	scripts := map[string]string{
+		"a-first":  `object.metadata.annotations.first = request.raw`,
+		"b-second": `object.metadata.annotations.second = request.raw`,
+	}
+
+	result, _, err := runner.RunScriptsWithResults(scripts, []byte(raw))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+
+	var object struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(result, &object); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+	for _, key := range []string{"first", "second"} {
+		if object.Metadata.Annotations[key] != raw {
+			t.Errorf("Expected request.raw to be the received bytes in %s, got %q", key, object.Metadata.Annotations[key])
+		}
+	}
+}
+
+func TestRunScript_CompiledCache(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	inputJSON, _ := json.Marshal(map[string]interface{}{"kind": "Pod"})
+
+	run := func(script string) string {
+		result, err := runner.RunScript("default/cached", script, inputJSON)
+		if err != nil {
+			t.Fatalf("RunScript failed: %v", err)
+		}
+		return string(result)
+	}
+
+	if got := run(`object.version = "v1"`); !strings.Contains(got, "v1") {
+		t.Errorf("Expected v1 output, got %s", got)
+	}
+
+	proto := runner.compiled["default/cached"].proto
+	run(`object.version = "v1"`)
+	if runner.compiled["default/cached"].proto != proto {
+		t.Error("Expected unchanged script to reuse its compiled bytecode")
+	}
+
+	// Changed content under the same name is recompiled
+	if got := run(`object.version = "v2"`); !strings.Contains(got, "v2") {
+		t.Errorf("Expected v2 output, got %s", got)
+	}
+
+	runner.EvictCompiled("default", "cached")
+	if _, exists := runner.compiled["default/cached"]; exists {
+		t.Error("Expected compiled script to be evicted")
+	}
+}
+
 func TestRunScriptsSequentially_EmptyScripts(t *testing.T) {
 	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
 	runner := NewScriptRunner(logger)
@@ -306,6 +545,437 @@ func TestRunScript_GluaModulesAvailable(t *testing.T) {
 	}
 }
 
+// ipamLoader: trivial custom module exposing ipam.lookup(name)
+func ipamLoader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"lookup": func(L *lua.LState) int {
+			L.Push(lua.LString("10.0.0.1/" + L.CheckString(1)))
+			return 1
+		},
+	})
+	L.Push(mod)
+	return 1
+}
+
+func TestNewScriptRunnerWithOptions_ExtraModulesAndGlobals(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	options := Options{
+		ExtraModules: map[string]lua.LGFunction{"ipam": ipamLoader},
+		ExtraGlobals: map[string]func(L *lua.LState) lua.LValue{
+			"cluster_name": func(L *lua.LState) lua.LValue { return lua.LString("prod-eu") },
+		},
+	}
+
+	script := `
+		local ipam = require("ipam")
+		object.ip = ipam.lookup("web")
+		object.cluster = cluster_name
+	`
+	inputJSON, _ := json.Marshal(map[string]interface{}{"kind": "Pod"})
+
+	runner := NewScriptRunnerWithOptions(logger, options)
+	result, err := runner.RunScript("custom", script, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	var resultObj map[string]interface{}
+	if err := json.Unmarshal(result, &resultObj); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+
+	if resultObj["ip"] != "10.0.0.1/web" || resultObj["cluster"] != "prod-eu" {
+		t.Errorf("Expected custom module and global to be usable, got %v", resultObj)
+	}
+
+	// Excluded from the allowlist, the module can no longer be required
+	options.Allowlist = []string{"json", "cluster_name"}
+	runner = NewScriptRunnerWithOptions(logger, options)
+	if _, err := runner.RunScript("custom", script, inputJSON); err == nil {
+		t.Error("Expected require of a module missing from the allowlist to fail")
+	}
+
+	// Built-in modules are subject to the allowlist as well
+	if _, err := runner.RunScript("builtin", `local http = require("http")`, inputJSON); err == nil {
+		t.Error("Expected require of a built-in module missing from the allowlist to fail")
+	}
+
+	// Globals missing from the allowlist are not set
+	options.Allowlist = []string{"ipam"}
+	runner = NewScriptRunnerWithOptions(logger, options)
+	result, err = runner.RunScript("custom", script, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	if strings.Contains(string(result), "prod-eu") {
+		t.Errorf("Expected global missing from the allowlist to be nil, got %s", result)
+	}
+}
+
+func TestRunScript_SafeMode(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	inputJSON := []byte(`{"kind":"Pod"}`)
+
+	script := `
+		object.dofile = dofile == nil
+		object.loadfile = loadfile == nil
+		object.io = io == nil
+		object.execute = os.execute == nil
+		object.getenv = os.getenv == nil
+		object.remove = os.remove == nil
+		object.clock = os.clock ~= nil
+		object.time = os.time ~= nil
+		object.fs = pcall(require, "fs") == false
+		object.http = pcall(require, "http") == false
+		object.cluster = pcall(require, "cluster") == false
+		object.io_require = pcall(require, "io") == false
+		object.json = pcall(require, "json")
+	`
+
+	lookup := cluster.NewLookup(fake.NewSimpleClientset(), logger, cluster.Options{})
+	runner := NewScriptRunnerWithOptions(logger, Options{SafeMode: true, Allowlist: []string{"fs", "http", "cluster", "json"}, Cluster: lookup})
+	result, err := runner.RunScript("safe", script, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	var resultObj map[string]interface{}
+	if err := json.Unmarshal(result, &resultObj); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+	for _, check := range []string{"dofile", "loadfile", "io", "execute", "getenv", "remove", "clock", "time", "fs", "http", "cluster", "io_require", "json"} {
+		if resultObj[check] != true {
+			t.Errorf("Safe mode check %s failed, got %s", check, result)
+		}
+	}
+
+	// Without safe mode, the base library is left untouched
+	runner = NewScriptRunnerWithOptions(logger, Options{})
+	result, err = runner.RunScript("unsafe", `object.dofile = dofile ~= nil; object.execute = os.execute ~= nil`, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	if !strings.Contains(string(result), `"dofile":true`) || !strings.Contains(string(result), `"execute":true`) {
+		t.Errorf("Expected base library functions outside safe mode, got %s", result)
+	}
+}
+
+func TestRunScriptsWithContext_ClusterLookupsMemoized(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "default"},
+			Data:       map[string]string{"tier": "gold"},
+		},
+	)
+
+	gets := 0
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	lookup := cluster.NewLookup(clientset, logger, cluster.Options{})
+	runner := NewScriptRunnerWithOptions(logger, Options{Cluster: lookup})
+
+	scripts := map[string]string{
+		"01-first": `
+			local cluster = require("cluster")
+			local cm = cluster.get("configmaps", "default", "settings")
+			object.first = cm.data.tier
+		`,
+		"02-second": `
+			local cluster = require("cluster")
+			local cm = cluster.get("configmaps", "default", "settings")
+			object.second = cm.data.tier
+			object.missing = cluster.get("configmaps", "default", "missing") == nil
+		`,
+	}
+	inputJSON, _ := json.Marshal(map[string]interface{}{"kind": "Pod"})
+
+	result, results, err := runner.RunScriptsWithContext(context.Background(), scripts, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("Script %s failed: %v", r.Name, r.Err)
+		}
+	}
+
+	var resultObj map[string]interface{}
+	if err := json.Unmarshal(result, &resultObj); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+	if resultObj["first"] != "gold" || resultObj["second"] != "gold" || resultObj["missing"] != true {
+		t.Errorf("Expected both scripts to read the ConfigMap, got %v", resultObj)
+	}
+
+	// One GET for settings, one for the missing ConfigMap
+	if gets != 2 {
+		t.Errorf("Expected the chain to fetch each ConfigMap once, got %d GETs", gets)
+	}
+
+	// The next request starts with an empty memo
+	if _, _, err := runner.RunScriptsWithContext(context.Background(), scripts, inputJSON); err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if gets != 4 {
+		t.Errorf("Expected lookups to be memoized per request only, got %d GETs", gets)
+	}
+
+	// Excluded from the allowlist, the module is unavailable
+	runner = NewScriptRunnerWithOptions(logger, Options{Cluster: lookup, Allowlist: []string{"json"}})
+	if _, err := runner.RunScript("blocked", `local cluster = require("cluster")`, inputJSON); err == nil {
+		t.Error("Expected require of the cluster module to fail when not allowed")
+	}
+}
+
+func TestRunScript_ReproducibleIteration(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	labels := make(map[string]interface{})
+	for _, key := range []string{"team", "app", "tier", "env", "version", "owner", "region", "zone", "cost-center", "release"} {
+		labels[key] = key + "-value"
+	}
+	inputJSON, _ := json.Marshal(map[string]interface{}{
+		"kind":     "Pod",
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+
+	tests := []struct {
+		name    string
+		options Options
+		script  string
+	}{
+		{
+			name: "sorted_pairs",
+			script: `
+				local helpers = require("helpers")
+				local keys = {}
+				for k, _ in helpers.sorted_pairs(object.metadata.labels) do
+					table.insert(keys, k)
+				end
+				object.keys = table.concat(keys, ",")
+			`,
+		},
+		{
+			name:    "pairs with preserved key order",
+			options: Options{PreserveKeyOrder: true},
+			script: `
+				local keys = {}
+				for k, _ in pairs(object.metadata.labels) do
+					table.insert(keys, k)
+				end
+				object.keys = table.concat(keys, ",")
+			`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var first string
+			for i := 0; i < 50; i++ {
+				runner := NewScriptRunnerWithOptions(logger, tt.options)
+				result, err := runner.RunScript("keys", tt.script, inputJSON)
+				if err != nil {
+					t.Fatalf("RunScript failed: %v", err)
+				}
+
+				var resultObj map[string]interface{}
+				if err := json.Unmarshal(result, &resultObj); err != nil {
+					t.Fatalf("Failed to unmarshal result: %v", err)
+				}
+
+				keys, _ := resultObj["keys"].(string)
+				if i == 0 {
+					first = keys
+					continue
+				}
+				if keys != first {
+					t.Fatalf("Run %d produced %q, expected %q", i, keys, first)
+				}
+			}
+
+			// encoding/json writes map keys sorted, so both orders are alphabetical here
+			if first != "app,cost-center,env,owner,region,release,team,tier,version,zone" {
+				t.Errorf("Unexpected key order %q", first)
+			}
+		})
+	}
+}
+
+func TestRunScript_PreserveKeyOrder(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{PreserveKeyOrder: true})
+
+	inputJSON := []byte(`{"kind":"Pod","metadata":{"annotations":{"zz":"1","aa":"2","mm":"3"}},` +
+		`"spec":{"containers":[{"name":"c","image":"i","args":[]}]}}`)
+
+	script := `
+		local annotations = object.metadata.annotations
+		annotations["bb"] = "4"
+		annotations["mm"] = nil
+
+		local keys = {}
+		for k, _ in pairs(annotations) do
+			table.insert(keys, k)
+		end
+		object.keys = table.concat(keys, ",")
+
+		local fields = {}
+		for k, _ in pairs(object.spec.containers[1]) do
+			table.insert(fields, k)
+		end
+		object.fields = table.concat(fields, ",")
+
+		-- tables created by the script keep the default behavior
+		local count = 0
+		for _ in pairs({x = 1, y = 2}) do
+			count = count + 1
+		end
+		object.count = count
+	`
+
+	result, err := runner.RunScript("order", script, inputJSON)
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	var resultObj map[string]interface{}
+	if err := json.Unmarshal(result, &resultObj); err != nil {
+		t.Fatalf("Failed to unmarshal result: %v", err)
+	}
+
+	if resultObj["keys"] != "zz,aa,bb" {
+		t.Errorf("Expected document order then added keys, got %v", resultObj["keys"])
+	}
+	if resultObj["fields"] != "name,image,args" {
+		t.Errorf("Expected document order inside arrays, got %v", resultObj["fields"])
+	}
+	if resultObj["count"] != float64(2) {
+		t.Errorf("Expected plain tables to iterate normally, got %v", resultObj["count"])
+	}
+}
+
+// slowScript: busy-loops for the given number of seconds, then sets object[field]
+func slowScript(seconds float64, field string) string {
+	return fmt.Sprintf(`
+		local start = os.clock()
+		while os.clock() - start < %f do end
+		object[%q] = true
+	`, seconds, field)
+}
+
+func TestRunScriptsWithContext_ScriptTimeout(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{ScriptTimeout: 100 * time.Millisecond})
+
+	scripts := map[string]string{
+		"01-forever": `while true do end`,
+		"02-fast":    `object.fast = true`,
+	}
+
+	start := time.Now()
+	result, results, err := runner.RunScriptsWithContext(context.Background(), scripts, []byte(`{"kind":"Pod"}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the endless script to be stopped by its timeout, took %s", elapsed)
+	}
+
+	if results[0].Err == nil {
+		t.Error("Expected the endless script to fail")
+	}
+	if results[1].Err != nil || !strings.Contains(string(result), `"fast":true`) {
+		t.Errorf("Expected the following script to run, got %s (%v)", result, results[1].Err)
+	}
+}
+
+func TestRunScriptsWithContext_BudgetExhausted(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{ScriptTimeout: 300 * time.Millisecond})
+
+	scripts := map[string]string{
+		"01-slow":  slowScript(0.15, "first"),
+		"02-slow":  slowScript(0.15, "second"),
+		"03-slow":  slowScript(0.15, "third"),
+		"04-quick": `object.fourth = true`,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	result, results, err := runner.RunScriptsWithContext(ctx, scripts, []byte(`{"kind":"Pod"}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected the chain to finish within the budget, took %s", elapsed)
+	}
+
+	if len(results) != 4 {
+		t.Fatalf("Expected a result for every script, got %d", len(results))
+	}
+	for i, r := range results {
+		skipped := errors.Is(r.Err, ErrBudgetExhausted)
+		if skipped != (i >= 2) {
+			t.Errorf("Script %s: expected skipped=%v, got %v", r.Name, i >= 2, r.Err)
+		}
+	}
+
+	if !strings.Contains(string(result), `"first":true`) || !strings.Contains(string(result), `"second":true`) ||
+		strings.Contains(string(result), "third") || strings.Contains(string(result), "fourth") {
+		t.Errorf("Expected only the mutations of the scripts that ran, got %s", result)
+	}
+}
+
+func TestRunScript_Concurrent(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	runner := NewScriptRunner(logger)
+
+	script := `
+		local helpers = require("helpers")
+		local json = require("json")
+		require("log").info("labelling " .. object.metadata.name)
+		helpers.ensure(object, "metadata.labels").copy = json.stringify({name = object.metadata.name})
+		warn("labelled")
+	`
+
+	const calls = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("pod-%d", i)
+			input := []byte(fmt.Sprintf(`{"kind":"Pod","metadata":{"name":%q}}`, name))
+			result, err := runner.RunScript("concurrent", script, input)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !strings.Contains(string(result), name) {
+				errs <- fmt.Errorf("result of %s holds another object: %s", name, result)
+			}
+			if err := runner.RegisterType(map[string]interface{}{}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
 func TestNewScriptRunner(t *testing.T) {
 	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
 	runner := NewScriptRunner(logger)
@@ -318,3 +988,508 @@ func TestNewScriptRunner(t *testing.T) {
 		t.Error("Expected logger to be set")
 	}
 }
+
+func TestRunScript_NonFiniteNumber(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	tests := map[string]string{
+		`object.x = 0/0`:                     "object.x",
+		`object.spec = {replicas = 1/0}`:     "object.spec.replicas",
+		`object.spec = {ports = {80, -1/0}}`: "object.spec.ports[2]",
+	}
+	for script, path := range tests {
+		_, err := runner.RunScript("nan", script, []byte(`{}`))
+		if err == nil || !strings.Contains(err.Error(), "script set "+path+" to a NaN or infinite number") {
+			t.Errorf("Expected %q to fail on %s, got %v", script, path, err)
+		}
+	}
+}
+
+func TestRunScript_CyclicTable(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	_, err := runner.RunScript("cycle", `object.spec = {}; object.spec.self = object.spec`, []byte(`{}`))
+	var conversionErr *ConversionError
+	if !errors.As(err, &conversionErr) {
+		t.Fatalf("Expected a ConversionError, got %v", err)
+	}
+	if conversionErr.Path != "object.spec.self" || !strings.Contains(err.Error(), "table containing itself") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The same table referenced twice is not a cycle
+	result, err := runner.RunScript("shared", `local labels = {app = "x"}; object.a = labels; object.b = labels`, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("Expected shared tables to be allowed, got %v", err)
+	}
+	if !strings.Contains(string(result), `"b":{"app":"x"}`) {
+		t.Errorf("Unexpected result: %s", result)
+	}
+}
+
+func TestRunScript_MaxDepth(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{MaxDepth: 20})
+
+	nest := func(levels int) string {
+		return fmt.Sprintf(`local t = object; for i = 1, %d do t.a = {}; t = t.a end`, levels)
+	}
+
+	if _, err := runner.RunScript("deep", nest(20), []byte(`{}`)); err != nil {
+		t.Errorf("Expected 20 levels to be allowed, got %v", err)
+	}
+
+	_, err := runner.RunScript("too-deep", nest(21), []byte(`{}`))
+	var conversionErr *ConversionError
+	if !errors.As(err, &conversionErr) || !strings.Contains(err.Error(), "nested too deep") {
+		t.Fatalf("Expected a nesting ConversionError, got %v", err)
+	}
+	if !strings.HasPrefix(conversionErr.Path, "object.a.a.a") {
+		t.Errorf("Unexpected path %q", conversionErr.Path)
+	}
+
+	// The default limit stops runaway nesting without overflowing the stack
+	_, err = NewScriptRunner(logger).RunScript("runaway", nest(10000), []byte(`{}`))
+	if !errors.As(err, &conversionErr) || len(conversionErr.Path) > maxPathLength+3 {
+		t.Errorf("Expected a short nesting ConversionError, got %v", err)
+	}
+}
+
+func TestRunScript_CyclicModuleArguments(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{MaxDepth: 20})
+
+	script := `
+		local json = require("json")
+		local yaml = require("yaml")
+		local template = require("template")
+
+		local cyclic = {name = "x"}
+		cyclic.self = cyclic
+		local deep = {}
+		local t = deep
+		for i = 1, 50 do t.a = {}; t = t.a end
+
+		local _, err
+		_, err = pcall(json.stringify, cyclic)
+		object.json = err
+		_, err = pcall(yaml.stringify, {spec = cyclic})
+		object.yaml = err
+		_, err = pcall(template.render, "{{.name}}", cyclic)
+		object.template = err
+		_, err = pcall(json.stringify, deep)
+		object.deep = err
+
+		object.plain = json.stringify({name = "x", list = {1, 2}})
+		local encoded, nan_err = json.stringify({n = 0/0})
+		object.nan = encoded == nil and nan_err ~= nil
+	`
+	result, err := runner.RunScript("modules", script, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(result, &object); err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	for field, expected := range map[string]string{
+		"json":     "json.stringify: argument.self is a table containing itself",
+		"yaml":     "yaml.stringify: argument.spec.self is a table containing itself",
+		"template": "template.render: argument.self is a table containing itself",
+		"deep":     "json.stringify: argument.a.a.a",
+	} {
+		if message, _ := object[field].(string); !strings.Contains(message, expected) {
+			t.Errorf("Expected %s to fail with %q, got %v", field, expected, object[field])
+		}
+	}
+	if !strings.Contains(object["deep"].(string), "nested too deep") {
+		t.Errorf("Expected the depth limit to apply, got %v", object["deep"])
+	}
+	if object["plain"] != `{"list":[1,2],"name":"x"}` || object["nan"] != true {
+		t.Errorf("Expected other conversions to be unchanged, got %v and %v", object["plain"], object["nan"])
+	}
+}
+
+func TestRunScript_WebhookIdentity(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunnerWithOptions(logger, Options{
+		Identity: Identity{Namespace: "glua-system", PodName: "glua-webhook-0"},
+	})
+
+	script := `
+if object.metadata.namespace == webhook.namespace then
+	object.metadata.labels = {own = "true"}
+end
+object.metadata.annotations = {pod = webhook.pod_name}
+`
+	result, err := runner.RunScript("identity", script, []byte(`{"metadata":{"namespace":"glua-system"}}`))
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	if !strings.Contains(string(result), `"own":"true"`) || !strings.Contains(string(result), `"pod":"glua-webhook-0"`) {
+		t.Errorf("Expected the webhook identity to be exposed, got %s", result)
+	}
+
+	// Unknown identity fields are empty strings
+	result, err = NewScriptRunner(logger).RunScript("unknown", `object.ns = webhook.namespace`, []byte(`{}`))
+	if err != nil || string(result) != `{"ns":""}` {
+		t.Errorf("Expected an empty namespace, got %s (%v)", result, err)
+	}
+}
+
+func TestRunScriptsWithContext_GVK(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	script := `object.seen = gvk.api_version .. " " .. gvk.kind .. " " .. gvk.group .. " " .. gvk.version`
+	ctx := WithGVK(context.Background(), schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"})
+	result, _, err := runner.RunScriptsWithContext(ctx, map[string]string{"gvk": script}, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if string(result) != `{"seen":"apps/v1 Deployment apps v1"}` {
+		t.Errorf("Expected the kind of the request to be exposed, got %s", result)
+	}
+
+	// Without a kind, the fields are empty strings
+	result, err = runner.RunScript("unknown", `object.kind = gvk.api_version .. gvk.kind`, []byte(`{}`))
+	if err != nil || string(result) != `{"kind":""}` {
+		t.Errorf("Expected an empty kind, got %s (%v)", result, err)
+	}
+}
+
+func TestRunScript_LuaCompat(t *testing.T) {
+	runner := NewScriptRunner(log.New(io.Discard, "", 0))
+
+	_, err := runner.RunScript("compat", "object.replicas = object.replicas // 2", []byte(`{"replicas":4}`))
+	var compatErr *CompatError
+	if !errors.As(err, &compatErr) {
+		t.Fatalf("Expected a Lua compatibility error, got %v", err)
+	}
+	if compatErr.Line != 1 || compatErr.Column != 35 || !strings.Contains(err.Error(), "use math.floor(a / b)") {
+		t.Errorf("Expected the error to point at the floor division, got %v", err)
+	}
+}
+
+func TestRunScriptsWithResults_Deny(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{
+		"a-label": `object.metadata = {labels = {a = "b"}}`,
+		"b-deny":  `pcall(deny_conflict, "name already taken")`,
+		"c-after": `object.metadata.labels.c = "d"`,
+	}
+
+	_, results, err := runner.RunScriptsWithResults(scripts, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected the chain to stop at the denial, got %+v", results)
+	}
+
+	var denial *Denial
+	if !errors.As(results[1].Err, &denial) {
+		t.Fatalf("Expected a Denial, got %v", results[1].Err)
+	}
+	if denial.Reason != DenyConflict || denial.Message != "name already taken" {
+		t.Errorf("Unexpected denial: %+v", denial)
+	}
+}
+
+func TestRunScriptsWithResults_DenyCauses(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	runner := NewScriptRunnerWithOptions(logger, Options{ContinueAfterDenial: true})
+
+	scripts := map[string]string{
+		"a-causes": `deny_invalid{message = "invalid containers", causes = {
+			{message = "image must be pinned", field = "spec.containers[0].image"},
+			{message = "name is required", field = "spec.containers[1].name", type = "FieldValueRequired"},
+		}}`,
+		"b-not-a-list":  `deny_invalid{message = "x", causes = "nope"}`,
+		"c-no-message":  `deny_invalid{message = "x", causes = {{field = "spec"}}}`,
+		"d-bad-message": `deny_invalid{message = "x", causes = {{message = 1}}}`,
+	}
+
+	_, results, err := runner.RunScriptsWithResults(scripts, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected every script to run, got %+v", results)
+	}
+
+	want := Denial{Reason: DenyInvalid, Message: "invalid containers", Causes: []DenialCause{
+		{Message: "image must be pinned", Field: "spec.containers[0].image"},
+		{Type: "FieldValueRequired", Message: "name is required", Field: "spec.containers[1].name"},
+	}}
+	var denial *Denial
+	if !errors.As(results[0].Err, &denial) || !reflect.DeepEqual(*denial, want) {
+		t.Errorf("Expected denial %+v, got %v", want, results[0].Err)
+	}
+	for _, result := range results[1:] {
+		if errors.As(result.Err, new(*Denial)) || result.Err == nil {
+			t.Errorf("%s: expected malformed causes to fail the script, got %v", result.Name, result.Err)
+		}
+	}
+}
+
+func TestRunScriptsWithResults_DenyField(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	runner := NewScriptRunnerWithOptions(logger, Options{ContinueAfterDenial: true})
+
+	scripts := map[string]string{
+		"a-positional": `deny_invalid("image must be pinned", "spec.containers[0].image")`,
+		"b-table":      `deny_forbidden{message = "host network", field = "spec.hostNetwork"}`,
+		"c-plain":      `deny_conflict("taken")`,
+		"d-bad-field":  `deny_invalid{message = "x", field = 1}`,
+	}
+
+	_, results, err := runner.RunScriptsWithResults(scripts, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected every script to run, got %+v", results)
+	}
+
+	expected := []Denial{
+		{Reason: DenyInvalid, Message: "image must be pinned", Field: "spec.containers[0].image"},
+		{Reason: DenyForbidden, Message: "host network", Field: "spec.hostNetwork"},
+		{Reason: DenyConflict, Message: "taken"},
+	}
+	for i, want := range expected {
+		var denial *Denial
+		if !errors.As(results[i].Err, &denial) || !reflect.DeepEqual(*denial, want) {
+			t.Errorf("%s: expected denial %+v, got %v", results[i].Name, want, results[i].Err)
+		}
+	}
+	if errors.As(results[3].Err, new(*Denial)) || !strings.Contains(results[3].Err.Error(), "field must be a string") {
+		t.Errorf("Expected a non-string field to fail the script, got %v", results[3].Err)
+	}
+}
+
+// bigObject: an object with the given number of entries, each a nested table
+func bigObject(entries int) []byte {
+	items := make([]interface{}, 0, entries)
+	for i := 0; i < entries; i++ {
+		items = append(items, map[string]interface{}{
+			"name":   fmt.Sprintf("item-%d", i),
+			"values": []interface{}{i, i * 2, i * 3},
+			"labels": map[string]interface{}{"tier": fmt.Sprintf("tier-%d", i%7)},
+		})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"kind": "Big", "spec": map[string]interface{}{"items": items}})
+	return data
+}
+
+func TestRunScriptsWithContext_Timings(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{"label": `object.metadata = {labels = {seen = tostring(#object.spec.items)}}`}
+	_, results, err := runner.RunScriptsWithContext(context.Background(), scripts, bigObject(5000))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Err != nil {
+		t.Fatalf("Expected the script to succeed, got %+v", results)
+	}
+
+	timings := results[0].Timings
+	if timings.ToLua <= 0 || timings.Execute <= 0 || timings.FromLua <= 0 {
+		t.Errorf("Expected non-zero timings for every phase, got %s", timings)
+	}
+}
+
+func TestRunScriptsWithContext_CPUTime(t *testing.T) {
+	if goruntime.GOOS != "linux" {
+		t.Skip("thread CPU time is only measured on Linux")
+	}
+	logger := log.New(io.Discard, "", 0)
+	options := Options{
+		ExtraModules: map[string]lua.LGFunction{"sleeper": func(L *lua.LState) int {
+			L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{"sleep": func(L *lua.LState) int {
+				time.Sleep(time.Duration(L.CheckInt(1)) * time.Millisecond)
+				return 0
+			}}))
+			return 1
+		}},
+	}
+	runner := NewScriptRunnerWithOptions(logger, options)
+
+	run := func(script string) ScriptResult {
+		t.Helper()
+		_, results, err := runner.RunScriptsWithContext(context.Background(), map[string]string{"script": script}, []byte(`{}`))
+		if err != nil {
+			t.Fatalf("RunScriptsWithContext failed: %v", err)
+		}
+		if len(results) != 1 || results[0].Err != nil {
+			t.Fatalf("Expected the script to succeed, got %+v", results)
+		}
+		if results[0].CPUTimeWallClock {
+			t.Fatalf("Expected the thread CPU clock to be read on Linux")
+		}
+		return results[0]
+	}
+
+	// A busy loop keeps its thread on CPU the whole time
+	busy := run(`local x = 0 for i = 1, 5000000 do x = x + i end object.sum = x`)
+	if busy.CPUTime < busy.Duration/2 {
+		t.Errorf("Expected the CPU time of a busy loop to be close to its wall time %s, got %s", busy.Duration, busy.CPUTime)
+	}
+
+	// A sleeping script hardly uses any
+	sleeping := run(`require("sleeper").sleep(200) object.slept = true`)
+	if sleeping.Duration < 200*time.Millisecond || sleeping.CPUTime > sleeping.Duration/10 {
+		t.Errorf("Expected the CPU time of a sleeping script to be far below its wall time %s, got %s", sleeping.Duration, sleeping.CPUTime)
+	}
+
+	// Disabled, the wall time is reported instead
+	runner = NewScriptRunnerWithOptions(logger, Options{DisableCPUTime: true})
+	_, results, err := runner.RunScriptsWithContext(context.Background(), map[string]string{"script": `object.touched = true`}, []byte(`{}`))
+	if err != nil || len(results) != 1 {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if !results[0].CPUTimeWallClock || results[0].CPUTime <= 0 {
+		t.Errorf("Expected the wall time to be reported as CPU time, got %s (wall clock %v)", results[0].CPUTime, results[0].CPUTimeWallClock)
+	}
+}
+
+func TestRunScript_MaxConversionTime(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	runner := NewScriptRunnerWithOptions(logger, Options{MaxConversionTime: time.Nanosecond})
+
+	_, err := runner.RunScript("big", `object.touched = true`, bigObject(5000))
+	if !errors.Is(err, ErrConversionTimeout) || !strings.Contains(err.Error(), "converting the object to Lua took") {
+		t.Errorf("Expected the conversion cap to stop the script, got %v", err)
+	}
+
+	// Small objects within the cap are unaffected
+	runner = NewScriptRunnerWithOptions(logger, Options{MaxConversionTime: time.Minute})
+	if _, err := runner.RunScript("small", `object.touched = true`, []byte(`{}`)); err != nil {
+		t.Errorf("Expected the script to run, got %v", err)
+	}
+}
+
+func TestRunScriptsWithResults_PanicIsolation(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// Globals are created before each script runs, outside of the Lua VM: the second one panics
+	var created atomic.Int32
+	runner := NewScriptRunnerWithOptions(logger, Options{
+		ExtraGlobals: map[string]func(L *lua.LState) lua.LValue{
+			"crash": func(L *lua.LState) lua.LValue {
+				if created.Add(1) == 2 {
+					var labels map[string]string
+					labels["boom"] = "true"
+				}
+				return L.NewFunction(func(L *lua.LState) int {
+					panic("module failure")
+				})
+			},
+		},
+	})
+
+	scripts := map[string]string{
+		"a-label":  `object.metadata = {labels = {a = "b"}}`,
+		"b-setup":  `object.metadata.labels.b = "c"`,
+		"c-module": `crash()`,
+		"d-label":  `object.metadata.labels.d = "e"`,
+	}
+
+	result, results, err := runner.RunScriptsWithResults(scripts, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected the chain to go on after the panics, got %+v", results)
+	}
+	if !errors.Is(results[1].Err, ErrScriptPanic) || !strings.Contains(results[1].Err.Error(), "nil map") {
+		t.Errorf("Expected b-setup to fail with ErrScriptPanic, got %v", results[1].Err)
+	}
+	if results[2].Err == nil || !strings.Contains(results[2].Err.Error(), "module failure") {
+		t.Errorf("Expected c-module to fail with the panic of the module, got %v", results[2].Err)
+	}
+	if results[0].Err != nil || results[3].Err != nil {
+		t.Errorf("Expected the other scripts to succeed, got %+v", results)
+	}
+	if string(result) != `{"metadata":{"labels":{"a":"b","d":"e"}}}` {
+		t.Errorf("Unexpected result %s", result)
+	}
+}
+
+func TestRunScriptsWithResults_TimedOutScriptStops(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	runner := NewScriptRunnerWithOptions(logger, Options{ScriptTimeout: 50 * time.Millisecond})
+
+	scripts := map[string]string{
+		"a-sleep": `local time = require("time") time.sleep(3600)`,
+		"b-loop":  `while true do end`,
+	}
+
+	before := goruntime.NumGoroutine()
+	started := time.Now()
+	_, results, err := runner.RunScriptsWithResults(scripts, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected the scripts to stop at their timeout, the chain took %s", elapsed)
+	}
+
+	// A script reporting its own error was not abandoned: its goroutine returned
+	for _, result := range results {
+		if result.Err == nil || errors.Is(result.Err, ErrScriptAbandoned) {
+			t.Errorf("Expected %s to stop with an error at its timeout, got %v", result.Name, result.Err)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); goruntime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := goruntime.NumGoroutine(); count > before {
+		t.Errorf("Expected the goroutines of the timed out scripts to exit, %d left of %d", count, before)
+	}
+}
+
+func TestRunScriptsWithResults_AbandonedScript(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	release := make(chan struct{})
+	defer close(release)
+
+	runner := NewScriptRunnerWithOptions(logger, Options{
+		ScriptTimeout: 50 * time.Millisecond,
+		ExtraGlobals: map[string]func(L *lua.LState) lua.LValue{
+			"block": func(L *lua.LState) lua.LValue {
+				return L.NewFunction(func(L *lua.LState) int {
+					<-release
+					return 0
+				})
+			},
+		},
+	})
+
+	scripts := map[string]string{
+		"a-block": `block()`,
+		"b-label": `object.metadata = {labels = {b = "c"}}`,
+	}
+
+	started := time.Now()
+	result, results, err := runner.RunScriptsWithResults(scripts, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected the blocked script to be abandoned, the chain took %s", elapsed)
+	}
+	if len(results) != 2 || !errors.Is(results[0].Err, ErrScriptAbandoned) || results[1].Err != nil {
+		t.Fatalf("Expected a-block to be abandoned and b-label to run, got %+v", results)
+	}
+	if string(result) != `{"metadata":{"labels":{"b":"c"}}}` {
+		t.Errorf("Unexpected result %s", result)
+	}
+}
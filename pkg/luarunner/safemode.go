@@ -0,0 +1,55 @@
+package luarunner
+
+import (
+	lua "github.com/yuin/gopher-lua"
+
+	"thechat/pkg/cluster"
+)
+
+// unsafeModules: modules never preloaded in safe mode, whatever the allowlist says
+// cluster reads live objects through the webhook credentials, like http it reaches out of the sandbox
+var unsafeModules = map[string]bool{
+	"fs":               true,
+	"http":             true,
+	cluster.ModuleName: true,
+}
+
+// unsafeGlobals: base library functions removed in safe mode, they read and run files from disk
+var unsafeGlobals = []string{"dofile", "loadfile"}
+
+// unsafeLibFunctions: functions removed from the standard libraries in safe mode
+// os keeps clock, date, difftime and time, scripts rely on them for timestamps
+var unsafeLibFunctions = map[string][]string{
+	lua.OsLibName: {"execute", "exit", "getenv", "remove", "rename", "setenv", "setlocale", "tmpname"},
+}
+
+// unsafeLibs: standard libraries removed entirely in safe mode
+var unsafeLibs = []string{lua.IoLibName}
+
+// applySafeMode: strips the globals giving scripts access to the host from the Lua state
+// Lua files can no longer be required from disk either, preloaded modules still load
+func applySafeMode(L *lua.LState) {
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	for lib, functions := range unsafeLibFunctions {
+		if tbl, ok := L.GetGlobal(lib).(*lua.LTable); ok {
+			for _, name := range functions {
+				tbl.RawSetString(name, lua.LNil)
+			}
+		}
+	}
+
+	loaded, _ := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable)
+	for _, lib := range unsafeLibs {
+		L.SetGlobal(lib, lua.LNil)
+		if loaded != nil {
+			loaded.RawSetString(lib, lua.LNil)
+		}
+	}
+
+	if pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable); ok {
+		pkg.RawSetString("path", lua.LString(""))
+	}
+}
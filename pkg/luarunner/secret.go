@@ -0,0 +1,100 @@
+package luarunner
+
+import (
+	"context"
+	"encoding/base64"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SecretModuleName: name of the module reading and writing the data of Secret-like objects in plaintext
+const SecretModuleName = "k8s.secret"
+
+// secretDataKey: context key of the secret data opt-in of a script chain
+type secretDataKey struct{}
+
+// WithSecretData: returns a context whose script chains may read and write Secret data in plaintext
+// through the k8s.secret module, which fails otherwise: Secret data stays opaque by default
+func WithSecretData(ctx context.Context) context.Context {
+	return context.WithValue(ctx, secretDataKey{}, true)
+}
+
+// secretDataAllowed: reports whether ctx carries the opt-in of WithSecretData
+func secretDataAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(secretDataKey{}).(bool)
+	return allowed
+}
+
+// secretLoader: returns the loader of the k8s.secret module
+// secret.get(object, key) returns the plaintext of data[key], else stringData[key], nil when neither holds it
+// secret.set(object, key, plaintext) writes data[key] base64-encoded and removes stringData[key], so that
+// patches only ever touch data. Both raise an error when secret data is not allowed for the request
+func secretLoader(allowed bool) lua.LGFunction {
+	return func(L *lua.LState) int {
+		guard := func(fn lua.LGFunction) lua.LGFunction {
+			return func(L *lua.LState) int {
+				if !allowed {
+					L.RaiseError("%s: secret data is redacted for this request (see --allow-secret-data)", SecretModuleName)
+				}
+				return fn(L)
+			}
+		}
+
+		L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"get": guard(secretGet),
+			"set": guard(secretSet),
+		}))
+		return 1
+	}
+}
+
+// secretGet: implements secret.get(object, key)
+func secretGet(L *lua.LState) int {
+	object := L.CheckTable(1)
+	key := L.CheckString(2)
+
+	if data, ok := object.RawGetString("data").(*lua.LTable); ok {
+		if encoded, ok := data.RawGetString(key).(lua.LString); ok {
+			decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+			if err != nil {
+				L.RaiseError("%s: data[%q] is not valid base64: %v", SecretModuleName, key, err)
+			}
+			L.Push(lua.LString(decoded))
+			return 1
+		}
+	}
+
+	if stringData, ok := object.RawGetString("stringData").(*lua.LTable); ok {
+		if value, ok := stringData.RawGetString(key).(lua.LString); ok {
+			L.Push(value)
+			return 1
+		}
+	}
+
+	L.Push(lua.LNil)
+	return 1
+}
+
+// secretSet: implements secret.set(object, key, plaintext)
+func secretSet(L *lua.LState) int {
+	object := L.CheckTable(1)
+	key := L.CheckString(2)
+	plaintext := L.CheckString(3)
+
+	data, ok := object.RawGetString("data").(*lua.LTable)
+	if !ok {
+		data = L.NewTable()
+		object.RawSetString("data", data)
+	}
+	data.RawSetString(key, lua.LString(base64.StdEncoding.EncodeToString([]byte(plaintext))))
+
+	// The API server merges stringData over data, a stale entry would override the value written
+	if stringData, ok := object.RawGetString("stringData").(*lua.LTable); ok {
+		stringData.RawSetString(key, lua.LNil)
+		// An empty table could convert back to an array, which the API server rejects
+		if next, _ := stringData.Next(lua.LNil); next == lua.LNil {
+			object.RawSetString("stringData", lua.LNil)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package luarunner
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// secretFixture: a Secret holding a key in data and another in stringData
+const secretFixture = `{
+	"apiVersion": "v1",
+	"kind": "Secret",
+	"metadata": {"name": "db", "namespace": "default"},
+	"data": {"password": "czNjcjN0"},
+	"stringData": {"username": "admin"}
+}`
+
+func TestSecretModule(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{
+		"derive": `
+			local secret = require("k8s.secret")
+			assert(secret.get(object, "password") == "s3cr3t", "password")
+			assert(secret.get(object, "username") == "admin", "username")
+			assert(secret.get(object, "missing") == nil, "missing")
+			secret.set(object, "dsn", secret.get(object, "username") .. ":" .. secret.get(object, "password") .. "@db")
+			secret.set(object, "username", "root")
+		`,
+	}
+
+	result, results, err := runner.RunScriptsWithContext(WithSecretData(context.Background()), scripts, []byte(secretFixture))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if results[0].Err != nil {
+		t.Fatalf("Script failed: %v", results[0].Err)
+	}
+
+	var secret struct {
+		Data       map[string][]byte `json:"data"`
+		StringData map[string]string `json:"stringData"`
+	}
+	if err := json.Unmarshal(result, &secret); err != nil {
+		t.Fatalf("Failed to decode result %s: %v", result, err)
+	}
+	if string(secret.Data["dsn"]) != "admin:s3cr3t@db" || string(secret.Data["username"]) != "root" || string(secret.Data["password"]) != "s3cr3t" {
+		t.Errorf("Unexpected data: %v", secret.Data)
+	}
+	// Writes go to data only, the stringData entry they replace is removed
+	if strings.Contains(string(result), "stringData") {
+		t.Errorf("Expected stringData to be removed, got %s", result)
+	}
+}
+
+func TestSecretModule_Redacted(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{
+		"get": `require("k8s.secret").get(object, "password")`,
+		"set": `require("k8s.secret").set(object, "password", "changed")`,
+	}
+
+	result, results, err := runner.RunScriptsWithContext(context.Background(), scripts, []byte(secretFixture))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	for _, scriptResult := range results {
+		if scriptResult.Err == nil || !strings.Contains(scriptResult.Err.Error(), "redacted") {
+			t.Errorf("Expected script %s to fail on redacted secret data, got %v", scriptResult.Name, scriptResult.Err)
+		}
+	}
+	if !strings.Contains(string(result), "czNjcjN0") {
+		t.Errorf("Expected the Secret to be left unchanged, got %s", result)
+	}
+}
+
+func TestSecretModule_InvalidBase64(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	runner := NewScriptRunner(logger)
+
+	scripts := map[string]string{"get": `require("k8s.secret").get(object, "password")`}
+	_, results, err := runner.RunScriptsWithContext(WithSecretData(context.Background()), scripts,
+		[]byte(`{"kind": "Secret", "data": {"password": "czNjcjN0="}}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithContext failed: %v", err)
+	}
+	if results[0].Err == nil || !strings.Contains(results[0].Err.Error(), "not valid base64") {
+		t.Errorf("Expected invalid base64 to fail the script, got %v", results[0].Err)
+	}
+}
@@ -0,0 +1,141 @@
+package luarunner
+
+import (
+	"context"
+	"fmt"
+)
+
+// selfTestObject: object the self-test scripts run against
+const selfTestObject = `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"selftest","namespace":"default","labels":{"app":"selftest"}}}`
+
+// selfTestScripts: script exercising each module, run when the configuration enables the module
+// The http script only reaches out when a URL is given, as params.url
+var selfTestScripts = map[string]string{
+	"json": `
+		local json = require("json")
+		local encoded = json.stringify({name = "glua"})
+		assert(json.parse(encoded).name == "glua", "json round trip failed")`,
+	"yaml": `
+		local yaml = require("yaml")
+		local encoded = yaml.stringify({name = "glua"})
+		assert(yaml.parse(encoded).name == "glua", "yaml round trip failed")`,
+	"base64": `
+		local base64 = require("base64")
+		assert(base64.decode(base64.encode("glua")) == "glua", "base64 round trip failed")`,
+	"hex": `
+		local hex = require("hex")
+		assert(type(hex) == "table" and next(hex) ~= nil, "hex module is empty")`,
+	"hash": `
+		local hash = require("hash")
+		assert(string.lower(hash.sha256("abc")) == "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", "unexpected sha256")`,
+	"http": `
+		local http = require("http")
+		if params.url then
+			local response, err = http.get(params.url)
+			assert(response, "GET " .. params.url .. " failed: " .. tostring(err))
+		else
+			assert(type(http.get) == "function", "http.get is missing")
+		end`,
+	"helpers": `
+		local helpers = require("helpers")
+		assert(helpers.get(object, "metadata.labels.app") == "selftest", "helpers.get failed")
+		helpers.set(object, "metadata.annotations.checked", "true")
+		assert(object.metadata.annotations.checked == "true", "helpers.set failed")`,
+	"quantity": `
+		local quantity = require("quantity")
+		assert(quantity.compare("1500m", "1") == 1, "quantity.compare failed")`,
+	"log": `
+		require("log").info("self-test")`,
+	"spew": `
+		local spew = require("spew")
+		assert(type(spew.dump) == "function", "spew.dump is missing")`,
+	"template": `
+		local template = require("template")
+		assert(template.render("Hello, {{.name}}!", {name = "glua"}) == "Hello, glua!", "template rendering failed")`,
+	"time": `
+		local time = require("time")
+		assert(time.now() ~= nil, "time.now returned nil")`,
+	"fs": `
+		local fs = require("fs")
+		assert(fs.exists("/"), "the root of the fs module does not exist")`,
+	AuditModuleName: `
+		require("audit").log("self-test")`,
+	"k8s.podspec": `
+		local podspec = require("k8s.podspec")
+		assert(type(podspec) == "table", "k8s.podspec did not load")`,
+	"k8s.policy": `
+		local policy = require("k8s.policy")
+		assert(policy.require_labels(object, {"app"}), "k8s.policy.require_labels failed")`,
+	SecretModuleName: `
+		local secret = require("k8s.secret")
+		assert(type(secret.get) == "function", "k8s.secret did not load")`,
+}
+
+// SelfTestResult: outcome of the self-test of a module
+type SelfTestResult struct {
+	// Module: name of the module, as required by scripts
+	Module string `json:"module"`
+	// Enabled: whether the configuration lets scripts use the module
+	Enabled bool `json:"enabled"`
+	// Passed: whether the module behaved as configured, working when enabled and failing to load otherwise
+	Passed bool `json:"passed"`
+	// Error: why the module did not behave as configured
+	Error string `json:"error,omitempty"`
+}
+
+// SelfTestModules: names of the modules SelfTest exercises, in order
+// The cluster module needs an API server and is left out
+func SelfTestModules() []string {
+	names := make([]string, 0, len(builtinModules)+len(embeddedLibraries)+2)
+	for _, module := range builtinModules {
+		names = append(names, module.name)
+	}
+	names = append(names, AuditModuleName)
+	for _, library := range embeddedLibraries {
+		names = append(names, library.name)
+	}
+	return append(names, SecretModuleName)
+}
+
+// moduleEnabled: reports whether the options let scripts load a module
+func (r *ScriptRunner) moduleEnabled(name string) bool {
+	for _, library := range embeddedLibraries {
+		if library.name == name {
+			return true
+		}
+	}
+	if name == SecretModuleName {
+		return true
+	}
+	if name == "fs" && r.options.DisableFS {
+		return false
+	}
+	return r.allowed(name)
+}
+
+// SelfTest: runs a script exercising each module with the options of the runner, and reports
+// whether each behaves as configured. Enabled modules pass when their script succeeds, disabled
+// ones when requiring them fails. httpURL, when not empty, is fetched through the http module
+func (r *ScriptRunner) SelfTest(ctx context.Context, httpURL string) []SelfTestResult {
+	if httpURL != "" {
+		ctx = WithParams(ctx, map[string]interface{}{"url": httpURL})
+	}
+
+	var results []SelfTestResult
+	for _, name := range SelfTestModules() {
+		result := SelfTestResult{Module: name, Enabled: r.moduleEnabled(name)}
+
+		script := selfTestScripts[name]
+		if !result.Enabled {
+			script = fmt.Sprintf("local ok = pcall(require, %q)\nassert(not ok, %q)", name, "module loads although it is disabled")
+		}
+
+		_, _, err := r.runIsolated(withHTTPCalls(ctx), "selftest/"+name, script, []byte(selfTestObject), []byte(selfTestObject), nil)
+		result.Passed = err == nil
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
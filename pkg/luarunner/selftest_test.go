@@ -0,0 +1,61 @@
+package luarunner
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	tests := []struct {
+		name     string
+		options  Options
+		disabled map[string]bool
+		failed   map[string]bool
+	}{
+		{name: "defaults"},
+		{
+			name:     "safe mode",
+			options:  Options{SafeMode: true, Allowlist: []string{"json", "fs", "http"}},
+			disabled: map[string]bool{"yaml": true, "base64": true, "hex": true, "hash": true, "http": true, "helpers": true, "quantity": true, "log": true, "spew": true, "template": true, "time": true, "fs": true, AuditModuleName: true},
+		},
+		{
+			name:     "fs disabled",
+			options:  Options{DisableFS: true},
+			disabled: map[string]bool{"fs": true},
+		},
+		{
+			name:    "http host not allowed",
+			options: Options{HTTP: HTTPPolicy{AllowedHosts: []string{"*.example.com"}}},
+			failed:  map[string]bool{"http": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := NewScriptRunnerWithOptions(logger, tt.options)
+			results := runner.SelfTest(context.Background(), server.URL)
+			if len(results) != len(SelfTestModules()) {
+				t.Fatalf("Expected %d results, got %d", len(SelfTestModules()), len(results))
+			}
+
+			for _, result := range results {
+				if result.Enabled == tt.disabled[result.Module] {
+					t.Errorf("Expected module %s enabled: %v, got %v", result.Module, !tt.disabled[result.Module], result.Enabled)
+				}
+				if result.Passed == tt.failed[result.Module] {
+					t.Errorf("Expected module %s to pass: %v, got %+v", result.Module, !tt.failed[result.Module], result)
+				}
+			}
+		})
+	}
+}
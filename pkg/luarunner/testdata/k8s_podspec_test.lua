@@ -0,0 +1,98 @@
+-- Tests of the k8s.podspec library, every global test_* function is run in a fresh state
+local podspec = require("k8s.podspec")
+
+local function assert_eq(actual, expected, what)
+  if actual ~= expected then
+    error(what .. ": expected " .. tostring(expected) .. ", got " .. tostring(actual), 2)
+  end
+end
+
+function test_ensure_container_pod()
+  local pod = {kind = "Pod", spec = {containers = {{name = "app", image = "app:1"}}}}
+  local sidecar, added = podspec.ensure_container(pod, {name = "sidecar", image = "sidecar:1"})
+  assert_eq(added, true, "added")
+  assert_eq(sidecar.image, "sidecar:1", "image")
+  assert_eq(#pod.spec.containers, 2, "containers")
+  assert_eq(pod.spec.containers[2].name, "sidecar", "second container")
+end
+
+function test_ensure_container_idempotent()
+  local pod = {kind = "Pod", spec = {containers = {{name = "sidecar", image = "sidecar:0"}}}}
+  local sidecar, added = podspec.ensure_container(pod, {name = "sidecar", image = "sidecar:1"})
+  assert_eq(added, false, "added")
+  assert_eq(sidecar.image, "sidecar:0", "existing container left alone")
+  assert_eq(#pod.spec.containers, 1, "containers")
+end
+
+function test_ensure_container_without_spec()
+  local pod = {kind = "Pod"}
+  podspec.ensure_container(pod, {name = "sidecar"})
+  assert_eq(#pod.spec.containers, 1, "containers")
+end
+
+function test_ensure_container_workload()
+  local deployment = {kind = "Deployment", spec = {template = {spec = {containers = {{name = "app"}}}}}}
+  podspec.ensure_container(deployment, {name = "sidecar"})
+  assert_eq(#deployment.spec.template.spec.containers, 2, "template containers")
+end
+
+function test_ensure_container_requires_name()
+  local ok, err = pcall(podspec.ensure_container, {spec = {}}, {image = "sidecar:1"})
+  assert_eq(ok, false, "ok")
+  assert_eq(string.find(err, "must be a table with a name", 1, true) ~= nil, true, "error mentions the name")
+end
+
+function test_ensure_volume()
+  local pod = {kind = "Pod", spec = {containers = {}}}
+  local _, added = podspec.ensure_volume(pod, {name = "varlog", hostPath = {path = "/var/log"}})
+  assert_eq(added, true, "first call")
+  _, added = podspec.ensure_volume(pod, {name = "varlog", emptyDir = {}})
+  assert_eq(added, false, "second call")
+  assert_eq(#pod.spec.volumes, 1, "volumes")
+  assert_eq(pod.spec.volumes[1].hostPath.path, "/var/log", "existing volume left alone")
+end
+
+function test_ensure_volume_mount_named()
+  local pod = {spec = {containers = {{name = "app"}, {name = "sidecar"}}}}
+  local mount = {name = "varlog", mountPath = "/var/log"}
+  assert_eq(podspec.ensure_volume_mount(pod, "sidecar", mount), 1, "first call")
+  assert_eq(podspec.ensure_volume_mount(pod, "sidecar", mount), 0, "second call")
+  assert_eq(pod.spec.containers[1].volumeMounts, nil, "other container")
+  assert_eq(#pod.spec.containers[2].volumeMounts, 1, "mounts")
+end
+
+function test_ensure_volume_mount_all()
+  local pod = {spec = {containers = {{name = "app", volumeMounts = {{name = "varlog", mountPath = "/logs"}}}, {name = "sidecar"}}}}
+  assert_eq(podspec.ensure_volume_mount(pod, "*", {name = "varlog", mountPath = "/var/log"}), 1, "added")
+  assert_eq(pod.spec.containers[1].volumeMounts[1].mountPath, "/logs", "existing mount left alone")
+  assert_eq(pod.spec.containers[2].volumeMounts[1].mountPath, "/var/log", "new mount")
+
+  -- Mounts are copied, changing one does not change the others
+  local pod2 = {spec = {containers = {{name = "a"}, {name = "b"}}}}
+  podspec.ensure_volume_mount(pod2, "*", {name = "data", mountPath = "/data"})
+  pod2.spec.containers[1].volumeMounts[1].readOnly = true
+  assert_eq(pod2.spec.containers[2].volumeMounts[1].readOnly, nil, "copied mount")
+end
+
+function test_ensure_volume_mount_unknown_container()
+  local pod = {spec = {containers = {{name = "app"}}}}
+  assert_eq(podspec.ensure_volume_mount(pod, "missing", {name = "varlog", mountPath = "/var/log"}), 0, "added")
+end
+
+function test_ensure_env()
+  local container = {name = "app", env = {{name = "LOG_LEVEL", value = "debug"}}}
+  assert_eq(podspec.ensure_env(container, "LOG_LEVEL", "info"), false, "existing variable")
+  assert_eq(container.env[1].value, "debug", "existing value left alone")
+  assert_eq(podspec.ensure_env(container, "REPLICAS", 3), true, "new variable")
+  assert_eq(container.env[2].value, "3", "values are strings")
+  assert_eq(podspec.ensure_env(container, "REPLICAS", 3), false, "second call")
+  assert_eq(#container.env, 2, "env")
+end
+
+function test_reassigned_globals()
+  ipairs = nil
+  table.insert = nil
+  local pod = {spec = {containers = {}}}
+  podspec.ensure_container(pod, {name = "sidecar"})
+  assert_eq(#pod.spec.containers, 1, "containers")
+end
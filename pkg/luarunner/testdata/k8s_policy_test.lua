@@ -0,0 +1,120 @@
+-- Tests of the k8s.policy library, every global test_* function is run in a fresh state
+local policy = require("k8s.policy")
+
+local function assert_eq(actual, expected, what)
+  if actual ~= expected then
+    error(what .. ": expected " .. tostring(expected) .. ", got " .. tostring(actual), 2)
+  end
+end
+
+local function pod(containers)
+  return {kind = "Pod", metadata = {name = "web"}, spec = {containers = containers}}
+end
+
+function test_require_labels_pass()
+  local ok, message = policy.require_labels({metadata = {labels = {app = "web", env = "prod"}}}, {"app", "env"})
+  assert_eq(ok, true, "ok")
+  assert_eq(message, nil, "message")
+end
+
+function test_require_labels_missing()
+  local ok, message = policy.require_labels({metadata = {labels = {app = "web", env = ""}}}, {"app", "env", "team"})
+  assert_eq(ok, false, "ok")
+  assert_eq(message, "missing required labels: env, team", "message")
+end
+
+function test_require_labels_no_metadata()
+  local ok, message = policy.require_labels({kind = "Pod"}, {"app"})
+  assert_eq(ok, false, "ok")
+  assert_eq(message, "missing required labels: app", "message")
+end
+
+function test_forbid_latest_tag_pass()
+  local ok = policy.forbid_latest_tag(pod({
+    {name = "app", image = "registry:5000/team/app:1.2.3"},
+    {name = "proxy", image = "envoy@sha256:0123abcd"},
+  }))
+  assert_eq(ok, true, "ok")
+end
+
+function test_forbid_latest_tag_fail()
+  local p = pod({
+    {name = "app", image = "nginx:latest"},
+    {name = "proxy", image = "registry:5000/envoy"},
+  })
+  p.spec.initContainers = {{name = "init", image = "busybox:1.36"}}
+  local ok, message = policy.forbid_latest_tag(p)
+  assert_eq(ok, false, "ok")
+  assert_eq(message, "container app uses the latest tag (nginx:latest); container proxy uses the latest tag (registry:5000/envoy)", "message")
+end
+
+function test_forbid_latest_tag_init_container()
+  local p = pod({{name = "app", image = "app:1"}})
+  p.spec.initContainers = {{name = "init", image = "busybox"}}
+  local ok, message = policy.forbid_latest_tag(p)
+  assert_eq(ok, false, "ok")
+  assert_eq(message, "container init uses the latest tag (busybox)", "message")
+end
+
+function test_forbid_latest_tag_workload()
+  local deployment = {kind = "Deployment", spec = {template = {spec = {containers = {{name = "app", image = "app:latest"}}}}}}
+  assert_eq(policy.forbid_latest_tag(deployment), false, "ok")
+end
+
+function test_require_resources_pass()
+  local ok = policy.require_resources(pod({
+    {name = "app", resources = {requests = {cpu = "100m", memory = "64Mi"}, limits = {cpu = "1", memory = "128Mi"}}},
+  }), {cpu = true, memory = true})
+  assert_eq(ok, true, "ok")
+end
+
+function test_require_resources_fail()
+  local ok, message = policy.require_resources(pod({
+    {name = "app", resources = {requests = {cpu = "100m", memory = "64Mi"}, limits = {cpu = "1"}}},
+    {name = "sidecar"},
+  }), {cpu = true, memory = true})
+  assert_eq(ok, false, "ok")
+  assert_eq(message, "container app has no memory limit; container sidecar has no cpu request; container sidecar has no cpu limit; container sidecar has no memory request; container sidecar has no memory limit", "message")
+end
+
+function test_require_resources_requests_only()
+  local p = pod({{name = "app", resources = {requests = {memory = "64Mi"}}}})
+  assert_eq(policy.require_resources(p, {memory = "requests", cpu = false}), true, "requests only")
+  local ok, message = policy.require_resources(p, {memory = "limits"})
+  assert_eq(ok, false, "limits only")
+  assert_eq(message, "container app has no memory limit", "message")
+end
+
+function test_require_probes_pass()
+  local p = pod({{name = "app", livenessProbe = {httpGet = {path = "/healthz", port = 8080}}, readinessProbe = {tcpSocket = {port = 8080}}}})
+  p.spec.initContainers = {{name = "init"}}
+  assert_eq(policy.require_probes(p, {"liveness", "readiness"}), true, "ok")
+end
+
+function test_require_probes_fail()
+  local ok, message = policy.require_probes(pod({{name = "app", livenessProbe = {exec = {command = {"true"}}}}}), {"liveness", "readiness"})
+  assert_eq(ok, false, "ok")
+  assert_eq(message, "container app has no readiness probe", "message")
+end
+
+function test_require_probes_unknown()
+  local ok, err = pcall(policy.require_probes, pod({}), {"health"})
+  assert_eq(ok, false, "ok")
+  assert_eq(string.find(err, "unknown probe health", 1, true) ~= nil, true, "error mentions the probe")
+end
+
+function test_compose()
+  local p = pod({{name = "app", image = "app:latest"}})
+  p.metadata.labels = {app = "web"}
+  local problems = {}
+  for _, check in ipairs({
+    {policy.require_labels(p, {"app"})},
+    {policy.forbid_latest_tag(p)},
+    {policy.require_probes(p, {"readiness"})},
+  }) do
+    if not check[1] then
+      table.insert(problems, check[2])
+    end
+  end
+  assert_eq(table.concat(problems, "; "), "container app uses the latest tag (app:latest); container app has no readiness probe", "problems")
+end
@@ -0,0 +1,24 @@
+package luarunner
+
+import (
+	"context"
+	gotime "time"
+)
+
+// scriptTimeoutsKey: context key of the timeouts of the scripts of a chain that have their own
+type scriptTimeoutsKey struct{}
+
+// WithScriptTimeouts: returns a context whose script chains stop each script named in timeouts after
+// its own timeout instead of Options.ScriptTimeout
+func WithScriptTimeouts(ctx context.Context, timeouts map[string]gotime.Duration) context.Context {
+	return context.WithValue(ctx, scriptTimeoutsKey{}, timeouts)
+}
+
+// scriptTimeout: returns the maximum run time of the script, zero for no limit
+func (r *ScriptRunner) scriptTimeout(ctx context.Context, scriptName string) gotime.Duration {
+	timeouts, _ := ctx.Value(scriptTimeoutsKey{}).(map[string]gotime.Duration)
+	if timeout, ok := timeouts[scriptName]; ok && timeout > 0 {
+		return timeout
+	}
+	return r.options.ScriptTimeout
+}
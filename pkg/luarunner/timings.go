@@ -0,0 +1,37 @@
+package luarunner
+
+import (
+	"errors"
+	"fmt"
+	gotime "time"
+)
+
+// ErrConversionTimeout: result of a script whose object took longer than Options.MaxConversionTime
+// to convert to or from Lua, the script did not run or its result was dropped
+var ErrConversionTimeout = errors.New("object conversion took too long")
+
+// PhaseTimings: time a script spent in each phase of its execution
+type PhaseTimings struct {
+	// ToLua: decoding the object and converting it to Lua
+	ToLua gotime.Duration
+	// Execute: compiling, or fetching the bytecode, and running the script
+	Execute gotime.Duration
+	// FromLua: checking the object left by the script and converting it back to JSON
+	FromLua gotime.Duration
+}
+
+// String: formats the timings for logs
+func (t PhaseTimings) String() string {
+	return fmt.Sprintf("to_lua=%s execute=%s from_lua=%s", t.ToLua, t.Execute, t.FromLua)
+}
+
+// checkConversionTime: returns an error wrapping ErrConversionTimeout when a conversion phase took
+// longer than Options.MaxConversionTime
+// Conversions cannot be interrupted, the cap stops gigantic objects before the next phase starts
+func (r *ScriptRunner) checkConversionTime(phase string, elapsed gotime.Duration) error {
+	if r.options.MaxConversionTime <= 0 || elapsed <= r.options.MaxConversionTime {
+		return nil
+	}
+	return fmt.Errorf("%w: converting the object %s took %s, more than %s",
+		ErrConversionTimeout, phase, elapsed, r.options.MaxConversionTime)
+}
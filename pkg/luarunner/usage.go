@@ -0,0 +1,198 @@
+package luarunner
+
+import (
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Usage: modules a script required during an execution, and the functions of them it called
+type Usage struct {
+	// Modules: modules the script required, sorted
+	Modules []string `json:"modules"`
+	// Functions: functions of the module tables the script called, as "module.function", along
+	// with the base library functions of recordedBaseFunctions, as "os.date", sorted
+	Functions []string `json:"functions"`
+}
+
+// Uses: reports whether the script required the given module
+func (u Usage) Uses(module string) bool {
+	index := sort.SearchStrings(u.Modules, module)
+	return index < len(u.Modules) && u.Modules[index] == module
+}
+
+// Calls: reports whether the script called the given function, as "module.function"
+func (u Usage) Calls(function string) bool {
+	index := sort.SearchStrings(u.Functions, function)
+	return index < len(u.Functions) && u.Functions[index] == function
+}
+
+// recordedBaseFunctions: functions of the base libraries recorded along with the module
+// functions, by library. Their results depend on the time or on randomness rather than on the
+// object, which callers caching the results of scripts need to know
+var recordedBaseFunctions = map[string][]string{
+	lua.OsLibName:   {"clock", "date", "time"},
+	lua.MathLibName: {"random"},
+}
+
+// ScriptUsage: modules and module functions a script used across its executions
+type ScriptUsage struct {
+	// Name: script identifier
+	Name string `json:"name"`
+	// Executions: executions recorded since the script was last compiled
+	Executions int `json:"executions"`
+	// Modules: executions requiring each module
+	Modules map[string]int `json:"modules"`
+	// Functions: executions calling each module function, as "module.function"
+	Functions map[string]int `json:"functions"`
+}
+
+// usageTracker: records the modules required and the module functions called within a Lua state
+// A Lua state runs on a single goroutine, the tracker needs no lock
+type usageTracker struct {
+	modules   map[string]bool
+	functions map[string]bool
+}
+
+// newUsageTracker: creates a tracker recording nothing yet
+func newUsageTracker() *usageTracker {
+	return &usageTracker{modules: make(map[string]bool), functions: make(map[string]bool)}
+}
+
+// instrument: wraps the loaders of package.preload, so that requiring a module records it and the
+// Go functions of the table it returns record their calls. Lua functions of the table are not
+// wrapped, recording them would cost a Lua call each
+func (u *usageTracker) instrument(L *lua.LState) {
+	preload, ok := L.GetField(L.GetGlobal(lua.LoadLibName), "preload").(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	loaders := make(map[string]*lua.LFunction)
+	preload.ForEach(func(key, value lua.LValue) {
+		if loader, ok := value.(*lua.LFunction); ok && key.Type() == lua.LTString {
+			loaders[key.String()] = loader
+		}
+	})
+	for name, loader := range loaders {
+		preload.RawSetString(name, L.NewFunction(u.loader(name, loader)))
+	}
+}
+
+// loader: returns a module loader recording the module, then running loader
+func (u *usageTracker) loader(name string, loader *lua.LFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		u.modules[name] = true
+
+		L.Push(loader)
+		L.Push(L.Get(1))
+		L.Call(1, 1)
+		if module, ok := L.Get(-1).(*lua.LTable); ok {
+			u.wrapFunctions(name, module)
+		}
+		return 1
+	}
+}
+
+// instrumentBase: wraps the functions of recordedBaseFunctions so that their calls are recorded
+// It runs once the base libraries are final, clock, seed and safe mode applied
+func (u *usageTracker) instrumentBase(L *lua.LState) {
+	for library, names := range recordedBaseFunctions {
+		table, ok := L.GetGlobal(library).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		functions := make(map[string]*lua.LFunction, len(names))
+		for _, name := range names {
+			if fn, ok := table.RawGetString(name).(*lua.LFunction); ok && fn.IsG {
+				functions[name] = fn
+			}
+		}
+		u.wrap(library, table, functions)
+	}
+}
+
+// wrapFunctions: replaces the Go functions of a module table with ones recording their calls
+func (u *usageTracker) wrapFunctions(module string, table *lua.LTable) {
+	functions := make(map[string]*lua.LFunction)
+	table.ForEach(func(key, value lua.LValue) {
+		if fn, ok := value.(*lua.LFunction); ok && fn.IsG && key.Type() == lua.LTString {
+			functions[key.String()] = fn
+		}
+	})
+	u.wrap(module, table, functions)
+}
+
+// wrap: replaces functions, found in table under their name, with ones recording their calls
+// The wrappers share the upvalues of the functions they wrap, which still find them
+func (u *usageTracker) wrap(module string, table *lua.LTable, functions map[string]*lua.LFunction) {
+	for name, fn := range functions {
+		qualified, wrapped := module+"."+name, fn.GFunction
+		table.RawSetString(name, &lua.LFunction{
+			IsG: true,
+			Env: fn.Env,
+			GFunction: func(L *lua.LState) int {
+				u.functions[qualified] = true
+				return wrapped(L)
+			},
+			Upvalues: fn.Upvalues,
+		})
+	}
+}
+
+// usage: returns what the tracker recorded
+func (u *usageTracker) usage() Usage {
+	usage := Usage{Modules: []string{}, Functions: []string{}}
+	for module := range u.modules {
+		usage.Modules = append(usage.Modules, module)
+	}
+	for function := range u.functions {
+		usage.Functions = append(usage.Functions, function)
+	}
+	sort.Strings(usage.Modules)
+	sort.Strings(usage.Functions)
+	return usage
+}
+
+// recordUsage: adds the usage of an execution of a script to its statistics
+func (r *ScriptRunner) recordUsage(scriptName string, usage Usage) {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+
+	stats, ok := r.usage[scriptName]
+	if !ok {
+		stats = &ScriptUsage{Name: scriptName, Modules: make(map[string]int), Functions: make(map[string]int)}
+		r.usage[scriptName] = stats
+	}
+	stats.Executions++
+	for _, module := range usage.Modules {
+		stats.Modules[module]++
+	}
+	for _, function := range usage.Functions {
+		stats.Functions[function]++
+	}
+}
+
+// Usage: returns the modules and module functions every script used since it was last compiled,
+// sorted by script name
+func (r *ScriptRunner) Usage() []ScriptUsage {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+
+	usage := make([]ScriptUsage, 0, len(r.usage))
+	for _, stats := range r.usage {
+		copied := *stats
+		copied.Modules = make(map[string]int, len(stats.Modules))
+		for module, count := range stats.Modules {
+			copied.Modules[module] = count
+		}
+		copied.Functions = make(map[string]int, len(stats.Functions))
+		for function, count := range stats.Functions {
+			copied.Functions[function] = count
+		}
+		usage = append(usage, copied)
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Name < usage[j].Name })
+	return usage
+}
@@ -0,0 +1,81 @@
+package luarunner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRunScriptsWithResults_Usage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"team": "platform"}`))
+	}))
+	defer server.Close()
+
+	runner := NewScriptRunner(log.New(io.Discard, "", 0))
+	scripts := map[string]string{
+		"default/enrich": fmt.Sprintf(`
+			local json = require("json")
+			local http = require("http")
+			local resp = http.get(%q)
+			local data = json.parse(resp.body)
+			object.metadata = {labels = {team = data.team}}
+		`, server.URL),
+		"default/plain": `object.metadata = {labels = {plain = "true"}}`,
+	}
+
+	_, results, err := runner.RunScriptsWithResults(scripts, []byte(`{"kind": "Pod"}`))
+	if err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Err != nil || results[1].Err != nil {
+		t.Fatalf("Expected both scripts to succeed, got %+v", results)
+	}
+
+	expected := Usage{Modules: []string{"http", "json"}, Functions: []string{"http.get", "json.parse"}}
+	if !reflect.DeepEqual(results[0].Usage, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, results[0].Usage)
+	}
+	if !results[0].Usage.Uses("http") || results[0].Usage.Uses("fs") {
+		t.Errorf("Expected Uses to report http only, got %+v", results[0].Usage)
+	}
+	if empty := (Usage{Modules: []string{}, Functions: []string{}}); !reflect.DeepEqual(results[1].Usage, empty) {
+		t.Errorf("Expected a script requiring nothing to use nothing, got %+v", results[1].Usage)
+	}
+
+	// Base library functions reading the time or drawing random numbers are recorded as well
+	_, results, err = NewScriptRunner(log.New(io.Discard, "", 0)).RunScriptsWithResults(map[string]string{
+		"default/stamp": `object.metadata = {labels = {at = os.date("%Y"), n = tostring(math.random(10)), len = tostring(string.len("x"))}}`,
+	}, []byte(`{"kind": "Pod"}`))
+	if err != nil || results[0].Err != nil {
+		t.Fatalf("Expected default/stamp to succeed, got %v %+v", err, results)
+	}
+	if expected := []string{"math.random", "os.date"}; !reflect.DeepEqual(results[0].Usage.Functions, expected) {
+		t.Errorf("Expected the calls of %v to be recorded, got %+v", expected, results[0].Usage)
+	}
+	if !results[0].Usage.Calls("os.date") || results[0].Usage.Calls("os.time") || len(results[0].Usage.Modules) != 0 {
+		t.Errorf("Expected Calls to report os.date only, got %+v", results[0].Usage)
+	}
+
+	// Statistics add up across executions, until the ConfigMap of the script changes
+	if _, _, err := runner.RunScriptsWithResults(scripts, []byte(`{"kind": "Pod"}`)); err != nil {
+		t.Fatalf("RunScriptsWithResults failed: %v", err)
+	}
+	usage := runner.Usage()
+	if len(usage) != 2 || usage[0].Name != "default/enrich" || usage[0].Executions != 2 ||
+		usage[0].Modules["http"] != 2 || usage[0].Functions["json.parse"] != 2 {
+		t.Fatalf("Unexpected usage statistics %+v", usage)
+	}
+	if usage[1].Executions != 2 || len(usage[1].Modules) != 0 {
+		t.Errorf("Unexpected usage statistics for default/plain %+v", usage[1])
+	}
+
+	runner.EvictCompiled("default", "enrich")
+	if usage := runner.Usage(); len(usage) != 1 || usage[0].Name != "default/plain" {
+		t.Errorf("Expected the statistics of the evicted script to be dropped, got %+v", usage)
+	}
+}
@@ -0,0 +1,301 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// Namespace: prefix shared by every glua-webhook metric
+	Namespace = "glua_webhook"
+
+	// ActiveWindow: how long after its last execution a script still counts in ScriptsActive
+	ActiveWindow = 10 * time.Minute
+
+	// ResultSuccess: script execution outcome, the script ran and its changes were kept
+	ResultSuccess = "success"
+	// ResultError: script execution outcome, the script failed and its changes were dropped
+	ResultError = "error"
+	// ResultSkipped: script execution outcome, the script did not run for lack of latency budget
+	ResultSkipped = "skipped"
+	// ResultDenied: script execution outcome, the script denied the request
+	ResultDenied = "denied"
+
+	// ClockCPU: clock of ScriptCPUDuration, the CPU time of the thread running the script
+	ClockCPU = "cpu"
+	// ClockWall: clock of ScriptCPUDuration, the wall time of the script, where the thread CPU clock is unavailable
+	ClockWall = "wall"
+)
+
+// PhaseBuckets: buckets of the script phase histograms, from 100µs to about 3s
+var PhaseBuckets = prometheus.ExponentialBuckets(0.0001, 2, 16)
+
+var (
+	// StaleScriptsServed: scripts served from a stale cache entry because the API server could not be reached
+	StaleScriptsServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "stale_scripts_served_total",
+		Help:      "Number of times a script was served from a stale cache entry because its ConfigMap could not be fetched.",
+	}, []string{"script"})
+
+	// SkippedScripts: script references skipped in best-effort mode because they could not be loaded
+	SkippedScripts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "skipped_scripts_total",
+		Help:      "Number of script references skipped in best-effort mode because their ConfigMap could not be loaded.",
+	}, []string{"script", "reason"})
+
+	// BudgetExhausted: admission requests finalized early because the latency budget ran out
+	BudgetExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "budget_exhausted_total",
+		Help:      "Number of admission requests whose remaining scripts were skipped because the latency budget was exhausted.",
+	}, []string{"webhook"})
+
+	// ScriptExecutions: script executions by ConfigMap and outcome
+	// Labelled by ConfigMap rather than script key or content so that cardinality stays bounded by
+	// the number of script ConfigMaps
+	ScriptExecutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "script_executions_total",
+		Help:      "Number of script executions, by webhook, script ConfigMap (namespace/name) and result (success, error, skipped or denied).",
+	}, []string{"webhook", "configmap", "result"})
+
+	// ScriptContentChanged: last time the content of a script ConfigMap was seen changing
+	ScriptContentChanged = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "script_content_changed_timestamp_seconds",
+		Help:      "Unix time at which the webhook last loaded a script ConfigMap (namespace/name) whose content differed from the previous load.",
+	}, []string{"configmap"})
+
+	// PreFiltered: admission requests allowed as-is because a pre-filter matched their object
+	PreFiltered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "pre_filtered_total",
+		Help:      "Number of admission requests allowed without running any script because a pre-filter matched their object, by webhook and pre-filter expression.",
+	}, []string{"webhook", "filter"})
+
+	// MatchConditionSkipped: admission requests allowed as-is because they did not meet a match condition
+	MatchConditionSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "match_condition_skipped_total",
+		Help:      "Number of admission requests allowed without running any script because they did not meet a match condition, by webhook and condition name.",
+	}, []string{"webhook", "condition"})
+
+	// ConsistencyConflicts: mutated objects a validating pass of the same scripts would deny
+	ConsistencyConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "consistency_conflicts_total",
+		Help:      "Number of objects patched by the mutating webhook that the same scripts would deny once mutated, by denying script ConfigMap (namespace/name).",
+	}, []string{"configmap"})
+
+	// ResponseCacheHits: admission requests answered from the response cache
+	ResponseCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "response_cache_hits_total",
+		Help:      "Number of admission requests answered with the cached response of an identical request, without running any script, by webhook.",
+	}, []string{"webhook"})
+
+	// ShedRequests: admission requests shed because too many were in flight
+	ShedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "shed_requests_total",
+		Help:      "Number of admission requests answered without running any script because too many requests were in flight, by webhook.",
+	}, []string{"webhook"})
+
+	// ShadowDivergence: admission requests the shadow scripts would have answered differently
+	ShadowDivergence = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "shadow_divergence_total",
+		Help:      "Number of admission requests the shadow scripts would have answered differently from the primary scripts, by webhook.",
+	}, []string{"webhook"})
+
+	// PatchGeneratorDivergence: patches of the diff generator not yielding what the scripts made of the object
+	PatchGeneratorDivergence = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "patch_generator_divergence_total",
+		Help:      "Number of mutated objects the patch of the diff generator would not turn into what the scripts made of them, by webhook.",
+	}, []string{"webhook"})
+
+	// AuditSinkFailures: patches that never made it to the audit sink
+	AuditSinkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "audit_sink_failures_total",
+		Help:      "Number of patches that could not be shipped to the audit sink, by reason (dropped when its queue was full, error when it failed to accept them).",
+	}, []string{"reason"})
+
+	// TemplateAnnotationMissing: workloads carrying the scripts annotation on their metadata but not on their pod template
+	TemplateAnnotationMissing = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "template_annotation_missing_total",
+		Help:      "Number of workloads admitted with the scripts annotation on their metadata but not on their pod template, by webhook and kind.",
+	}, []string{"webhook", "kind"})
+
+	// ConversionToLuaDuration: time scripts spent decoding the object and converting it to Lua
+	ConversionToLuaDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "conversion_to_lua_duration_seconds",
+		Help:      "Time spent decoding the object and converting it to Lua before running a script, by webhook.",
+		Buckets:   PhaseBuckets,
+	}, []string{"webhook"})
+
+	// ScriptExecuteDuration: time scripts spent running, conversions excluded
+	ScriptExecuteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "script_execute_duration_seconds",
+		Help:      "Time spent running a script, object conversions excluded, by webhook.",
+		Buckets:   PhaseBuckets,
+	}, []string{"webhook"})
+
+	// ConversionFromLuaDuration: time scripts spent converting the object they left back to JSON
+	ConversionFromLuaDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "conversion_from_lua_duration_seconds",
+		Help:      "Time spent checking the object left by a script and converting it back to JSON, by webhook.",
+		Buckets:   PhaseBuckets,
+	}, []string{"webhook"})
+
+	// ScriptCPUDuration: CPU time the threads running scripts consumed, or their wall time where
+	// the thread CPU clock is unavailable, told apart by the clock label
+	ScriptCPUDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "script_cpu_seconds",
+		Help:      "CPU time consumed running a script, conversions and failed scripts included, by webhook and clock (cpu, or wall where the thread CPU clock is unavailable).",
+		Buckets:   PhaseBuckets,
+	}, []string{"webhook", "clock"})
+
+	// ScriptsActive: number of distinct script ConfigMaps executed within ActiveWindow
+	ScriptsActive = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "scripts_active",
+		Help:      "Number of distinct script ConfigMaps executed in the last 10 minutes.",
+	}, func() float64 { return float64(active.count()) })
+)
+
+// Metric: description of an exported metric, see Catalog
+type Metric struct {
+	// Name: full metric name, as scraped
+	Name string
+	// Type: counter, gauge or histogram
+	Type string
+	// Labels: label names, in order
+	Labels []string
+	// Help: help text of the metric
+	Help string
+}
+
+// Catalog: every metric exported by the webhook
+// Error ratio of a script ConfigMap, e.g. to alert above 5% over 10 minutes:
+//
+//	sum by (configmap) (rate(glua_webhook_script_executions_total{result="error"}[10m]))
+//	  / sum by (configmap) (rate(glua_webhook_script_executions_total[10m]))
+var Catalog = []Metric{
+	{Name: Namespace + "_stale_scripts_served_total", Type: "counter", Labels: []string{"script"},
+		Help: "Number of times a script was served from a stale cache entry because its ConfigMap could not be fetched."},
+	{Name: Namespace + "_skipped_scripts_total", Type: "counter", Labels: []string{"script", "reason"},
+		Help: "Number of script references skipped in best-effort mode because their ConfigMap could not be loaded."},
+	{Name: Namespace + "_budget_exhausted_total", Type: "counter", Labels: []string{"webhook"},
+		Help: "Number of admission requests whose remaining scripts were skipped because the latency budget was exhausted."},
+	{Name: Namespace + "_script_executions_total", Type: "counter", Labels: []string{"webhook", "configmap", "result"},
+		Help: "Number of script executions, by webhook, script ConfigMap (namespace/name) and result (success, error, skipped or denied)."},
+	{Name: Namespace + "_script_content_changed_timestamp_seconds", Type: "gauge", Labels: []string{"configmap"},
+		Help: "Unix time at which the webhook last loaded a script ConfigMap (namespace/name) whose content differed from the previous load."},
+	{Name: Namespace + "_pre_filtered_total", Type: "counter", Labels: []string{"webhook", "filter"},
+		Help: "Number of admission requests allowed without running any script because a pre-filter matched their object, by webhook and pre-filter expression."},
+	{Name: Namespace + "_match_condition_skipped_total", Type: "counter", Labels: []string{"webhook", "condition"},
+		Help: "Number of admission requests allowed without running any script because they did not meet a match condition, by webhook and condition name."},
+	{Name: Namespace + "_consistency_conflicts_total", Type: "counter", Labels: []string{"configmap"},
+		Help: "Number of objects patched by the mutating webhook that the same scripts would deny once mutated, by denying script ConfigMap (namespace/name)."},
+	{Name: Namespace + "_response_cache_hits_total", Type: "counter", Labels: []string{"webhook"},
+		Help: "Number of admission requests answered with the cached response of an identical request, without running any script, by webhook."},
+	{Name: Namespace + "_shed_requests_total", Type: "counter", Labels: []string{"webhook"},
+		Help: "Number of admission requests answered without running any script because too many requests were in flight, by webhook."},
+	{Name: Namespace + "_shadow_divergence_total", Type: "counter", Labels: []string{"webhook"},
+		Help: "Number of admission requests the shadow scripts would have answered differently from the primary scripts, by webhook."},
+	{Name: Namespace + "_patch_generator_divergence_total", Type: "counter", Labels: []string{"webhook"},
+		Help: "Number of mutated objects the patch of the diff generator would not turn into what the scripts made of them, by webhook."},
+	{Name: Namespace + "_audit_sink_failures_total", Type: "counter", Labels: []string{"reason"},
+		Help: "Number of patches that could not be shipped to the audit sink, by reason (dropped when its queue was full, error when it failed to accept them)."},
+	{Name: Namespace + "_template_annotation_missing_total", Type: "counter", Labels: []string{"webhook", "kind"},
+		Help: "Number of workloads admitted with the scripts annotation on their metadata but not on their pod template, by webhook and kind."},
+	{Name: Namespace + "_scripts_active", Type: "gauge", Labels: []string{},
+		Help: "Number of distinct script ConfigMaps executed in the last 10 minutes."},
+	{Name: Namespace + "_conversion_to_lua_duration_seconds", Type: "histogram", Labels: []string{"webhook"},
+		Help: "Time spent decoding the object and converting it to Lua before running a script, by webhook."},
+	{Name: Namespace + "_script_execute_duration_seconds", Type: "histogram", Labels: []string{"webhook"},
+		Help: "Time spent running a script, object conversions excluded, by webhook."},
+	{Name: Namespace + "_conversion_from_lua_duration_seconds", Type: "histogram", Labels: []string{"webhook"},
+		Help: "Time spent checking the object left by a script and converting it back to JSON, by webhook."},
+	{Name: Namespace + "_script_cpu_seconds", Type: "histogram", Labels: []string{"webhook", "clock"},
+		Help: "CPU time consumed running a script, conversions and failed scripts included, by webhook and clock (cpu, or wall where the thread CPU clock is unavailable)."},
+}
+
+func init() {
+	prometheus.MustRegister(
+		StaleScriptsServed,
+		SkippedScripts,
+		BudgetExhausted,
+		ScriptExecutions,
+		ScriptContentChanged,
+		PreFiltered,
+		MatchConditionSkipped,
+		ConsistencyConflicts,
+		ResponseCacheHits,
+		ShedRequests,
+		ShadowDivergence,
+		PatchGeneratorDivergence,
+		AuditSinkFailures,
+		TemplateAnnotationMissing,
+		ScriptsActive,
+		ConversionToLuaDuration,
+		ScriptExecuteDuration,
+		ConversionFromLuaDuration,
+		ScriptCPUDuration,
+	)
+}
+
+// Handler: returns the HTTP handler exposing all registered metrics in Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveScriptExecution: counts an execution of a script of configMap, and marks it active
+func ObserveScriptExecution(webhook, configMap, result string) {
+	ScriptExecutions.WithLabelValues(webhook, configMap, result).Inc()
+	active.observe(configMap)
+}
+
+// active: script ConfigMaps executed recently, backing ScriptsActive
+var active = &activeSet{seen: make(map[string]time.Time), now: time.Now}
+
+// activeSet: last execution time of each script ConfigMap
+type activeSet struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	now  func() time.Time
+}
+
+// observe: records an execution of configMap
+func (s *activeSet) observe(configMap string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seen[configMap] = s.now()
+}
+
+// count: forgets the ConfigMaps not executed within ActiveWindow and returns how many remain
+func (s *activeSet) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for configMap, seen := range s.seen {
+		if s.now().Sub(seen) > ActiveWindow {
+			delete(s.seen, configMap)
+		}
+	}
+	return len(s.seen)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCatalog(t *testing.T) {
+	collectors := []prometheus.Collector{
+		StaleScriptsServed,
+		SkippedScripts,
+		BudgetExhausted,
+		ScriptExecutions,
+		ScriptContentChanged,
+		PreFiltered,
+		MatchConditionSkipped,
+		ConsistencyConflicts,
+		ResponseCacheHits,
+		ShedRequests,
+		ShadowDivergence,
+		PatchGeneratorDivergence,
+		AuditSinkFailures,
+		TemplateAnnotationMissing,
+		ScriptsActive,
+		ConversionToLuaDuration,
+		ScriptExecuteDuration,
+		ConversionFromLuaDuration,
+		ScriptCPUDuration,
+	}
+	if len(collectors) != len(Catalog) {
+		t.Fatalf("Expected %d metrics in the catalog, got %d", len(collectors), len(Catalog))
+	}
+
+	for i, collector := range collectors {
+		descs := make(chan *prometheus.Desc, 1)
+		collector.Describe(descs)
+		desc := <-descs
+
+		expected := prometheus.NewDesc(Catalog[i].Name, Catalog[i].Help, Catalog[i].Labels, nil)
+		if desc.String() != expected.String() {
+			t.Errorf("Catalog entry %d does not match its metric:\n got %s\nwant %s", i, expected, desc)
+		}
+	}
+}
+
+func TestActiveSet(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	set := &activeSet{seen: make(map[string]time.Time), now: func() time.Time { return now }}
+
+	set.observe("default/a")
+	set.observe("default/b")
+	set.observe("default/a")
+	if count := set.count(); count != 2 {
+		t.Errorf("Expected 2 active ConfigMaps, got %d", count)
+	}
+
+	now = now.Add(ActiveWindow / 2)
+	set.observe("default/b")
+	now = now.Add(ActiveWindow/2 + time.Second)
+	if count := set.count(); count != 1 {
+		t.Errorf("Expected default/a to expire, got %d active ConfigMaps", count)
+	}
+}
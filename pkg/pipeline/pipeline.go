@@ -0,0 +1,248 @@
+// Package pipeline runs a chain of scripts described by a pipeline file locally, each step with its
+// own priority, timeout, failure policy and params, to simulate the chain of the webhook without
+// a cluster
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+// Failure policies of a step
+const (
+	// FailurePolicyIgnore: the chain carries on with the object as left by the previous steps, as
+	// the webhook does with failing scripts
+	FailurePolicyIgnore = "ignore"
+	// FailurePolicyAbortChain: the remaining steps are skipped
+	FailurePolicyAbortChain = "abort-chain"
+)
+
+// ErrAborted: error of the steps skipped after a step failed under FailurePolicyAbortChain
+var ErrAborted = errors.New("skipped: a previous step failed and aborted the chain")
+
+// Pipeline: an ordered chain of scripts, as described by a pipeline file
+type Pipeline struct {
+	// Params: params global of every step, overridden key by key by the params of each step
+	Params map[string]interface{} `json:"params,omitempty"`
+	// Steps: scripts of the chain, run by ascending priority then in the order of the file
+	Steps []Step `json:"steps"`
+}
+
+// Step: a script of a pipeline
+type Step struct {
+	// Name: name of the step in the report, the name of its script when empty
+	Name string `json:"name,omitempty"`
+	// Script: path of the Lua script, relative to the pipeline file
+	Script string `json:"script,omitempty"`
+	// ConfigMap: path of the manifest of the ConfigMap holding the script, relative to the
+	// pipeline file, exclusive with Script
+	ConfigMap string `json:"configMap,omitempty"`
+	// Key: key of the ConfigMap holding the script, scriptloader.DefaultScriptKey when empty
+	Key string `json:"key,omitempty"`
+	// Priority: steps of lower priority run first, steps of equal priority in the order of the file
+	Priority int `json:"priority,omitempty"`
+	// Timeout: maximum run time of the script, unlimited when zero
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// FailurePolicy: FailurePolicyIgnore or FailurePolicyAbortChain, FailurePolicyIgnore when empty
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+	// Params: params of the step, overriding the params of the pipeline
+	Params map[string]interface{} `json:"params,omitempty"`
+
+	// scriptName and content: the script, as loaded by Load
+	scriptName string
+	content    string
+}
+
+// StepResult: outcome of a step
+type StepResult struct {
+	// Step: name of the step
+	Step string
+	// Result: outcome of the script of the step, as the webhook records it
+	Result luarunner.ScriptResult
+	// FailurePolicy: failure policy of the step
+	FailurePolicy string
+}
+
+// Load: reads a pipeline file and the scripts of its steps, ordered by priority
+func Load(path string) (*Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline %s: %w", path, err)
+	}
+	var pipeline Pipeline
+	if err := yaml.UnmarshalStrict(data, &pipeline); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline %s: %w", path, err)
+	}
+	if len(pipeline.Steps) == 0 {
+		return nil, fmt.Errorf("pipeline %s has no steps", path)
+	}
+
+	dir := filepath.Dir(path)
+	names := make(map[string]bool, len(pipeline.Steps))
+	for i := range pipeline.Steps {
+		step := &pipeline.Steps[i]
+		if err := step.load(dir); err != nil {
+			return nil, fmt.Errorf("step %d of pipeline %s: %w", i+1, path, err)
+		}
+		if names[step.scriptName] {
+			return nil, fmt.Errorf("step %d of pipeline %s: script %s is already a step", i+1, path, step.scriptName)
+		}
+		names[step.scriptName] = true
+	}
+	sort.SliceStable(pipeline.Steps, func(i, j int) bool {
+		return pipeline.Steps[i].Priority < pipeline.Steps[j].Priority
+	})
+	return &pipeline, nil
+}
+
+// load: checks the step and reads its script, from a file or a ConfigMap manifest under dir
+func (s *Step) load(dir string) error {
+	switch s.FailurePolicy {
+	case "":
+		s.FailurePolicy = FailurePolicyIgnore
+	case FailurePolicyIgnore, FailurePolicyAbortChain:
+	default:
+		return fmt.Errorf("invalid failure policy %q (expected %s or %s)", s.FailurePolicy, FailurePolicyIgnore, FailurePolicyAbortChain)
+	}
+	if s.Timeout.Duration < 0 {
+		return fmt.Errorf("invalid timeout %s", s.Timeout.Duration)
+	}
+
+	switch {
+	case s.Script != "" && s.ConfigMap != "":
+		return fmt.Errorf("script and configMap are mutually exclusive")
+	case s.Script != "":
+		content, err := os.ReadFile(filepath.Join(dir, s.Script))
+		if err != nil {
+			return fmt.Errorf("failed to read script: %w", err)
+		}
+		s.scriptName, s.content = s.Script, string(content)
+	case s.ConfigMap != "":
+		data, err := os.ReadFile(filepath.Join(dir, s.ConfigMap))
+		if err != nil {
+			return fmt.Errorf("failed to read ConfigMap: %w", err)
+		}
+		var configMap corev1.ConfigMap
+		if err := yaml.Unmarshal(data, &configMap); err != nil {
+			return fmt.Errorf("failed to parse ConfigMap %s: %w", s.ConfigMap, err)
+		}
+		key := s.Key
+		if key == "" {
+			key = scriptloader.DefaultScriptKey
+		}
+		content, ok := configMap.Data[key]
+		if !ok {
+			return fmt.Errorf("ConfigMap %s does not contain '%s' key", s.ConfigMap, key)
+		}
+		namespace := configMap.Namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		s.scriptName, s.content = scriptloader.ScriptName(namespace, configMap.Name, key), content
+	default:
+		return fmt.Errorf("one of script and configMap is required")
+	}
+
+	if s.Name == "" {
+		s.Name = s.scriptName
+	}
+	return nil
+}
+
+// params: returns the params of the step, those of the pipeline overridden by its own
+func (s *Step) params(base map[string]interface{}) map[string]interface{} {
+	if base == nil && s.Params == nil {
+		return nil
+	}
+	params := make(map[string]interface{}, len(base)+len(s.Params))
+	for key, value := range base {
+		params[key] = value
+	}
+	for key, value := range s.Params {
+		params[key] = value
+	}
+	return params
+}
+
+// Run: runs the steps against object in order, each through the ordered execution of the script
+// runner with options, its timeout and its params, and returns the object left by the chain
+// Like the webhook, a failing step is ignored and a denial ends the chain, a failing step under
+// FailurePolicyAbortChain ends it as well, the remaining steps being reported with ErrAborted.
+// Every step sees the object as received as request.raw
+func (p *Pipeline) Run(ctx context.Context, logger *log.Logger, options luarunner.Options, object []byte) ([]byte, []StepResult, error) {
+	ctx = luarunner.WithRequestRaw(ctx, object)
+
+	current := object
+	results := make([]StepResult, 0, len(p.Steps))
+	for i, step := range p.Steps {
+		stepOptions := options
+		stepOptions.ScriptTimeout = step.Timeout.Duration
+		runner := luarunner.NewScriptRunnerWithOptions(logger, stepOptions)
+
+		stepCtx := ctx
+		if params := step.params(p.Params); params != nil {
+			stepCtx = luarunner.WithParams(ctx, params)
+		}
+		output, scriptResults, err := runner.RunOrderedScriptsWithContext(stepCtx, []string{step.scriptName}, map[string]string{step.scriptName: step.content}, current)
+		if err != nil {
+			return nil, results, fmt.Errorf("step %s: %w", step.Name, err)
+		}
+		current = output
+
+		result := StepResult{Step: step.Name, Result: scriptResults[0], FailurePolicy: step.FailurePolicy}
+		results = append(results, result)
+		if result.Result.Err == nil {
+			continue
+		}
+		var denial *luarunner.Denial
+		if errors.As(result.Result.Err, &denial) || step.FailurePolicy == FailurePolicyAbortChain {
+			for _, skipped := range p.Steps[i+1:] {
+				results = append(results, StepResult{
+					Step:          skipped.Name,
+					Result:        luarunner.ScriptResult{Name: skipped.scriptName, Err: ErrAborted},
+					FailurePolicy: skipped.FailurePolicy,
+				})
+			}
+			break
+		}
+	}
+	return current, results, nil
+}
+
+// WriteReport: writes a line per step, ok, failed or skipped with the reason, along with its
+// duration and failure policy. Errors are cut to their first line, without the Lua traceback
+func WriteReport(w io.Writer, results []StepResult) error {
+	var b strings.Builder
+	for i, result := range results {
+		status := "ok"
+		switch {
+		case errors.Is(result.Result.Err, ErrAborted):
+			status = "skipped"
+		case result.Result.Err != nil:
+			status = "failed"
+		}
+		fmt.Fprintf(&b, "%d/%d %-7s %s (%s, %s)", i+1, len(results), status, result.Step,
+			result.Result.Duration.Round(time.Microsecond), result.FailurePolicy)
+		if result.Result.Err != nil && status != "skipped" {
+			fmt.Fprintf(&b, ": %s", result.Result.ErrSummary())
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
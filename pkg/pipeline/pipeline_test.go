@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"thechat/pkg/luarunner"
+)
+
+// writePipeline: writes a pipeline file and the scripts it references to a temporary directory,
+// returning the path of the pipeline file
+func writePipeline(t *testing.T, pipeline string, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	path := filepath.Join(dir, "pipeline.yaml")
+	if err := os.WriteFile(path, []byte(pipeline), 0o600); err != nil {
+		t.Fatalf("Failed to write pipeline: %v", err)
+	}
+	return path
+}
+
+func TestRun_FailurePolicies(t *testing.T) {
+	files := map[string]string{
+		"labels.lua": `object.metadata.labels = {team = params.team}`,
+		"broken.lua": `error("no quota given")`,
+		"sidecar.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: sidecar
+  namespace: platform
+data:
+  inject.lua: |
+    object.metadata.annotations = {sidecar = params.image}
+`,
+	}
+	object := []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test"}}`)
+
+	tests := []struct {
+		policy    string
+		annotated bool
+		lastErr   error
+	}{
+		{policy: FailurePolicyIgnore, annotated: true},
+		{policy: FailurePolicyAbortChain, lastErr: ErrAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			path := writePipeline(t, `
+params:
+  team: platform
+  image: nginx
+steps:
+- configMap: sidecar.yaml
+  key: inject.lua
+  priority: 20
+  timeout: 500ms
+  params:
+    image: envoy
+- name: quota
+  script: broken.lua
+  priority: 10
+  failurePolicy: `+tt.policy+`
+- script: labels.lua
+`, files)
+
+			pipeline, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			// Steps run by ascending priority
+			var names []string
+			for _, step := range pipeline.Steps {
+				names = append(names, step.Name)
+			}
+			if strings.Join(names, ",") != "labels.lua,quota,platform/sidecar#inject.lua" {
+				t.Fatalf("Unexpected step order %v", names)
+			}
+			if pipeline.Steps[2].Timeout.Duration != 500*time.Millisecond {
+				t.Errorf("Expected the timeout of the step to be loaded, got %s", pipeline.Steps[2].Timeout.Duration)
+			}
+
+			output, results, err := pipeline.Run(context.Background(), log.New(io.Discard, "", 0), luarunner.Options{}, object)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if len(results) != 3 {
+				t.Fatalf("Expected a result per step, got %d", len(results))
+			}
+			if results[0].Result.Err != nil || results[1].Result.Err == nil {
+				t.Errorf("Expected the first step to succeed and the second to fail, got %v and %v", results[0].Result.Err, results[1].Result.Err)
+			}
+			if !strings.Contains(string(output), `"team":"platform"`) {
+				t.Errorf("Expected the label of the first step, got %s", output)
+			}
+
+			annotated := strings.Contains(string(output), `"sidecar":"envoy"`)
+			if annotated != tt.annotated {
+				t.Errorf("Expected annotated=%v with the %s policy, got %s", tt.annotated, tt.policy, output)
+			}
+			if !errors.Is(results[2].Result.Err, tt.lastErr) {
+				t.Errorf("Expected the last step to end with %v, got %v", tt.lastErr, results[2].Result.Err)
+			}
+
+			var report bytes.Buffer
+			if err := WriteReport(&report, results); err != nil {
+				t.Fatalf("WriteReport failed: %v", err)
+			}
+			lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+			if len(lines) != 3 || !strings.HasPrefix(lines[1], "2/3 failed  quota (") || !strings.Contains(lines[1], "no quota given") {
+				t.Errorf("Expected a report line per step, got %q", report.String())
+			}
+			status := "ok     "
+			if tt.policy == FailurePolicyAbortChain {
+				status = "skipped"
+			}
+			if !strings.HasPrefix(lines[2], "3/3 "+status+" platform/sidecar#inject.lua") {
+				t.Errorf("Expected the last step to be reported %s, got %q", status, lines[2])
+			}
+		})
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	files := map[string]string{"labels.lua": `object.labels = {}`}
+	tests := []struct {
+		pipeline string
+		message  string
+	}{
+		{pipeline: "steps: []", message: "has no steps"},
+		{pipeline: "steps:\n- script: labels.lua\n  failurePolicy: retry", message: "invalid failure policy"},
+		{pipeline: "steps:\n- script: labels.lua\n  configMap: cm.yaml", message: "mutually exclusive"},
+		{pipeline: "steps:\n- priority: 1", message: "one of script and configMap is required"},
+		{pipeline: "steps:\n- script: labels.lua\n- script: labels.lua", message: "already a step"},
+		{pipeline: "steps:\n- script: labels.lua\n  retries: 3", message: "failed to parse pipeline"},
+	}
+	for _, tt := range tests {
+		_, err := Load(writePipeline(t, tt.pipeline, files))
+		if err == nil || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%q: expected an error containing %q, got %v", tt.pipeline, tt.message, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package render runs the scripts of the mutating webhook over a bundle of manifests, offline, to
+// review what the webhook would do to them before they reach a cluster
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+
+	"thechat/pkg/webhook"
+)
+
+// Options: how manifests are rendered
+type Options struct {
+	// HandlerOptions: options of the mutating webhook the manifests go through, as configured on the server
+	HandlerOptions webhook.HandlerOptions
+	// DefaultNamespace: namespace of the ConfigMaps without metadata.namespace, "default" when empty
+	DefaultNamespace string
+	// Logger: logger of the webhook handler, logs are discarded when nil
+	Logger *log.Logger
+}
+
+// Result: what the mutating webhook did to an object of the bundle
+type Result struct {
+	// Object: kind and namespace/name of the object
+	Object string `json:"object"`
+	// Allowed: whether the webhook allowed the object
+	Allowed bool `json:"allowed"`
+	// Message: why the webhook denied the object
+	Message string `json:"message,omitempty"`
+	// Warnings: admission warnings returned for the object
+	Warnings []string `json:"warnings,omitempty"`
+	// Patch: JSON patch of the response, empty when the scripts left the object alone
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Error: why the object could not be rendered
+	Error string `json:"error,omitempty"`
+	// Rendered: the object as the API server would store it, the object as given when it could not
+	// be rendered or was denied
+	Rendered map[string]interface{} `json:"-"`
+}
+
+// Mutated: reports whether the webhook changed the object
+func (r Result) Mutated() bool {
+	return r.Error == "" && len(r.Patch) > 0
+}
+
+// Failed: reports whether the object was denied or could not be rendered
+func (r Result) Failed() bool {
+	return r.Error != "" || !r.Allowed
+}
+
+// Render: sends each object of manifests to a mutating webhook handler as a CREATE request, and
+// applies the patches of the responses. The handler loads its scripts and params from the
+// ConfigMaps of manifests and scripts, the objects of scripts are not rendered
+// An object failing to render is reported in its result, the others are rendered regardless
+func Render(ctx context.Context, manifests, scripts []unstructured.Unstructured, options Options) ([]Result, error) {
+	namespace := options.DefaultNamespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	var configMaps []runtime.Object
+	for _, object := range append(append([]unstructured.Unstructured{}, scripts...), manifests...) {
+		if object.GetAPIVersion() != "v1" || object.GetKind() != "ConfigMap" {
+			continue
+		}
+		var configMap corev1.ConfigMap
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &configMap); err != nil {
+			return nil, fmt.Errorf("failed to decode ConfigMap %s: %w", object.GetName(), err)
+		}
+		if configMap.Namespace == "" {
+			configMap.Namespace = namespace
+		}
+		configMaps = append(configMaps, &configMap)
+	}
+
+	logger := options.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	handler := webhook.NewWebhookHandlerWithOptions(fake.NewSimpleClientset(configMaps...), logger, "mutating", options.HandlerOptions)
+
+	results := make([]Result, 0, len(manifests))
+	for _, object := range manifests {
+		results = append(results, renderObject(ctx, handler, object))
+	}
+	return results, nil
+}
+
+// renderObject: runs an object through handler
+func renderObject(ctx context.Context, handler *webhook.WebhookHandler, object unstructured.Unstructured) Result {
+	result := Result{Object: objectName(object), Rendered: object.Object}
+
+	raw, err := json.Marshal(object.Object)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to encode object: %v", err)
+		return result
+	}
+
+	gvk := object.GroupVersionKind()
+	response := handler.Review(ctx, &admissionv1.AdmissionRequest{
+		UID:       types.UID("render-" + strings.ToLower(gvk.Kind) + "-" + object.GetName()),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Namespace: object.GetNamespace(),
+		Name:      object.GetName(),
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	result.Allowed = response.Allowed
+	result.Warnings = response.Warnings
+	if !response.Allowed {
+		if response.Result != nil {
+			result.Message = response.Result.Message
+		}
+		return result
+	}
+	if len(response.Patch) == 0 {
+		return result
+	}
+
+	patch, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to decode patch: %v", err)
+		return result
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to apply patch: %v", err)
+		return result
+	}
+	var rendered map[string]interface{}
+	if err := json.Unmarshal(patched, &rendered); err != nil {
+		result.Error = fmt.Sprintf("failed to decode patched object: %v", err)
+		return result
+	}
+	result.Patch = response.Patch
+	result.Rendered = rendered
+	return result
+}
+
+// objectName: returns the kind and namespace/name of an object
+func objectName(object unstructured.Unstructured) string {
+	if object.GetNamespace() == "" {
+		return object.GetKind() + " " + object.GetName()
+	}
+	return object.GetKind() + " " + object.GetNamespace() + "/" + object.GetName()
+}
+
+// WriteManifests: writes the rendered objects as a multi-document YAML stream
+func WriteManifests(w io.Writer, results []Result) error {
+	for i, result := range results {
+		document, err := yaml.Marshal(result.Rendered)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", result.Object, err)
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteReport: writes a Markdown report of the objects the webhook mutated, denied or failed to
+// render, with the changes made to each, suitable for a pull request comment
+func WriteReport(w io.Writer, results []Result) error {
+	var mutated, failed int
+	for _, result := range results {
+		switch {
+		case result.Failed():
+			failed++
+		case result.Mutated():
+			mutated++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## glua-webhook render\n\n%d objects: %d mutated, %d denied or failed, %d unchanged\n",
+		len(results), mutated, failed, len(results)-mutated-failed)
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			fmt.Fprintf(&b, "\n### %s (error)\n\n%s\n", result.Object, result.Error)
+		case !result.Allowed:
+			fmt.Fprintf(&b, "\n### %s (denied)\n\n%s\n", result.Object, result.Message)
+		case result.Mutated():
+			lines, err := patchLines(result.Patch)
+			if err != nil {
+				return fmt.Errorf("failed to format the changes of %s: %w", result.Object, err)
+			}
+			fmt.Fprintf(&b, "\n### %s (mutated)\n\n```diff\n%s```\n", result.Object, lines)
+		default:
+			continue
+		}
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(&b, "\n> warning: %s\n", warning)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// patchLines: formats the operations of a JSON patch as diff lines, + for additions, - for
+// removals and ~ for replacements
+func patchLines(patch []byte) (string, error) {
+	var operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, operation := range operations {
+		switch operation.Op {
+		case "add":
+			fmt.Fprintf(&b, "+ %s: %s\n", operation.Path, operation.Value)
+		case "remove":
+			fmt.Fprintf(&b, "- %s\n", operation.Path)
+		default:
+			fmt.Fprintf(&b, "~ %s: %s\n", operation.Path, operation.Value)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,158 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"thechat/pkg/coverage"
+)
+
+// bundle: a kustomize-style directory, the scripts ConfigMap next to the objects annotated with them
+var bundle = map[string]string{
+	"kustomization.yaml": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  - scripts.yaml
+  - web.yaml
+`,
+	"scripts.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: policies
+  namespace: default
+data:
+  label.lua: |
+    add_label(object, "team", "platform")
+  no-latest.lua: |
+    if object.kind == "Pod" and object.spec.containers[1].image:match(":latest$") then
+      deny_invalid("latest images are not allowed", "spec.containers[0].image")
+    end
+`,
+	"web.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: default
+  annotations:
+    glua.maurice.fr/scripts: default/policies#label.lua
+spec:
+  ports:
+    - port: 80
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  namespace: default
+  annotations:
+    glua.maurice.fr/scripts: default/policies#no-latest.lua
+spec:
+  containers:
+    - name: web
+      image: nginx:latest
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: plain
+  namespace: default
+spec:
+  containers:
+    - name: web
+      image: nginx:1.27
+`,
+}
+
+func renderBundle(t *testing.T) []Result {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range bundle {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	manifests, err := coverage.LoadObjects(dir)
+	if err != nil {
+		t.Fatalf("LoadObjects failed: %v", err)
+	}
+
+	results, err := Render(context.Background(), manifests, nil, Options{})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	return results
+}
+
+func TestRender(t *testing.T) {
+	results := renderBundle(t)
+
+	byObject := make(map[string]Result, len(results))
+	for _, result := range results {
+		byObject[result.Object] = result
+	}
+	if len(byObject) != 5 {
+		t.Fatalf("Expected 5 rendered objects, got %+v", results)
+	}
+
+	service := byObject["Service default/web"]
+	if !service.Mutated() || service.Failed() {
+		t.Errorf("Expected the Service to be mutated, got %+v", service)
+	}
+	pod := byObject["Pod default/web"]
+	if !pod.Failed() || !strings.Contains(pod.Message, "latest images are not allowed") {
+		t.Errorf("Expected the Pod to be denied, got %+v", pod)
+	}
+	for _, unchanged := range []string{"Pod default/plain", "ConfigMap default/policies", "Kustomization "} {
+		if result := byObject[unchanged]; result.Mutated() || result.Failed() {
+			t.Errorf("Expected %s to be left alone, got %+v", unchanged, result)
+		}
+	}
+}
+
+func TestWriteManifests(t *testing.T) {
+	var output bytes.Buffer
+	if err := WriteManifests(&output, renderBundle(t)); err != nil {
+		t.Fatalf("WriteManifests failed: %v", err)
+	}
+
+	documents := strings.Split(output.String(), "---\n")
+	if len(documents) != 5 {
+		t.Fatalf("Expected 5 documents, got %d:\n%s", len(documents), output.String())
+	}
+	var service string
+	for _, document := range documents {
+		if strings.Contains(document, "kind: Service") {
+			service = document
+		}
+	}
+	if !strings.Contains(service, "team: platform") {
+		t.Errorf("Expected the Service to be rendered with its label, got:\n%s", service)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	var output bytes.Buffer
+	if err := WriteReport(&output, renderBundle(t)); err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+
+	report := output.String()
+	for _, expected := range []string{
+		"5 objects: 1 mutated, 1 denied or failed, 3 unchanged",
+		"### Service default/web (mutated)",
+		`+ /metadata/labels: {"team":"platform"}`,
+		"### Pod default/web (denied)",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected the report to contain %q, got:\n%s", expected, report)
+		}
+	}
+	if strings.Contains(report, "default/plain") {
+		t.Errorf("Expected unchanged objects to be left out of the report, got:\n%s", report)
+	}
+}
@@ -0,0 +1,94 @@
+package scriptloader
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ParseError: an entry of a scripts annotation that is not a valid reference
+type ParseError struct {
+	// Entry: entry as written in the annotation
+	Entry string `json:"entry"`
+	// Reason: why the entry is not a valid reference
+	Reason string `json:"reason"`
+}
+
+// Error: implements error
+func (e ParseError) Error() string {
+	return fmt.Sprintf("invalid script reference %q: %s", e.Entry, e.Reason)
+}
+
+// ParseAnnotationErrors: same as ParseAnnotation, also returning an error for every malformed entry
+// instead of dropping it silently. ConfigMap references must name a valid namespace and ConfigMap,
+// references of other schemes must use one of schemes, the ones of the registered sources
+func ParseAnnotationErrors(annotation string, schemes ...string) ([]ScriptRef, []ParseError) {
+	var refs []ScriptRef
+	var errs []ParseError
+	seen := make(map[ScriptRef]bool)
+
+	for _, entry := range strings.Split(annotation, ",") {
+		// Empty entries, such as the one after a trailing comma, are harmless
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		ref, reason := checkRef(entry)
+		if reason == "" && ref.Scheme != "" && !contains(schemes, ref.Scheme) {
+			reason = fmt.Sprintf("unknown script source %q", ref.Scheme)
+			if ref.Namespace == "" {
+				reason += ", use namespace/name to reference a ConfigMap"
+			}
+		}
+		if reason != "" {
+			errs = append(errs, ParseError{Entry: entry, Reason: reason})
+			continue
+		}
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs, errs
+}
+
+// checkRef: parses an entry of a scripts annotation, returning why it is malformed when it is
+// The scheme of references to other sources than ConfigMaps is left to the loader to check
+func checkRef(entry string) (ScriptRef, string) {
+	ref, reason := splitRef(entry)
+	if reason != "" || ref.Scheme != "" {
+		return ref, reason
+	}
+
+	switch {
+	case ref.Namespace == "":
+		return ScriptRef{}, "empty namespace"
+	case ref.Name == "":
+		return ScriptRef{}, "empty ConfigMap name"
+	}
+	if errs := validation.IsDNS1123Label(ref.Namespace); len(errs) > 0 {
+		return ScriptRef{}, fmt.Sprintf("invalid namespace %q: %s", ref.Namespace, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsDNS1123Subdomain(ref.Name); len(errs) > 0 {
+		return ScriptRef{}, fmt.Sprintf("invalid ConfigMap name %q: %s", ref.Name, strings.Join(errs, "; "))
+	}
+	if ref.Key != "" {
+		if errs := validation.IsConfigMapKey(ref.Key); len(errs) > 0 {
+			return ScriptRef{}, fmt.Sprintf("invalid key %q: %s", ref.Key, strings.Join(errs, "; "))
+		}
+	}
+	return ref, ""
+}
+
+// contains: reports whether values holds value
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
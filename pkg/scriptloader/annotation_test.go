@@ -0,0 +1,86 @@
+package scriptloader
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAnnotationErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		schemes    []string
+		refs       []ScriptRef
+		errors     map[string]string // entry -> start of the reason
+	}{
+		{
+			name:       "colon instead of slash",
+			annotation: "default:my-script",
+			errors:     map[string]string{"default:my-script": `unknown script source "default", use namespace/name`},
+		},
+		{
+			name:       "uppercase namespace and name",
+			annotation: "Default/My-Script, default/My-Script",
+			errors: map[string]string{
+				"Default/My-Script": `invalid namespace "Default"`,
+				"default/My-Script": `invalid ConfigMap name "My-Script"`,
+			},
+		},
+		{
+			name:       "empty namespace",
+			annotation: "/my-script,default/labels",
+			refs:       []ScriptRef{{Namespace: "default", Name: "labels"}},
+			errors:     map[string]string{"/my-script": "empty namespace"},
+		},
+		{
+			name:       "trailing comma",
+			annotation: "default/labels,default/sidecar,",
+			refs:       []ScriptRef{{Namespace: "default", Name: "labels"}, {Namespace: "default", Name: "sidecar"}},
+		},
+		{
+			name:       "malformed entries",
+			annotation: "default/labels#, a/b/c, default/",
+			errors: map[string]string{
+				"default/labels#": "empty key after #",
+				"a/b/c":           "expected namespace/name",
+				"default/":        "empty ConfigMap name",
+			},
+		},
+		{
+			name:       "invalid key",
+			annotation: "default/labels#my script.lua",
+			errors:     map[string]string{"default/labels#my script.lua": `invalid key "my script.lua"`},
+		},
+		{
+			name:       "registered scheme",
+			annotation: "builtin:defaults,oci:team/policy",
+			schemes:    []string{"builtin"},
+			refs:       []ScriptRef{{Scheme: "builtin", Name: "defaults"}},
+			errors:     map[string]string{"oci:team/policy": `unknown script source "oci"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs, errs := ParseAnnotationErrors(tt.annotation, tt.schemes...)
+			if !reflect.DeepEqual(refs, tt.refs) {
+				t.Errorf("Expected references %v, got %v", tt.refs, refs)
+			}
+
+			if len(errs) != len(tt.errors) {
+				t.Fatalf("Expected %d errors, got %v", len(tt.errors), errs)
+			}
+			for _, err := range errs {
+				reason, ok := tt.errors[err.Entry]
+				if !ok {
+					t.Errorf("Unexpected error %v", err)
+					continue
+				}
+				if !strings.HasPrefix(err.Reason, reason) {
+					t.Errorf("Expected the reason for %q to start with %q, got %q", err.Entry, reason, err.Reason)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package scriptloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultScriptsKey: ConfigMap key holding the default scripts configuration
+const DefaultScriptsKey = "defaults.yaml"
+
+// DefaultScriptsConfig: configuration file mapping GroupVersionKinds to scripts
+//
+// Example:
+//
+//	defaults:
+//	  - group: apps
+//	    version: v1
+//	    kind: Deployment
+//	    scripts:
+//	      - platform/standard-deployment-policy
+type DefaultScriptsConfig struct {
+	Defaults []GVKScripts `json:"defaults"`
+}
+
+// GVKScripts: scripts run against every object of a GroupVersionKind
+// The core group is the empty string, an empty version matches every version
+type GVKScripts struct {
+	Group   string   `json:"group"`
+	Version string   `json:"version"`
+	Kind    string   `json:"kind"`
+	Scripts []string `json:"scripts"`
+}
+
+// DefaultScripts: resolved GroupVersionKind -> scripts mapping consulted for every request
+type DefaultScripts struct {
+	entries []defaultEntry
+}
+
+// defaultEntry: parsed GVKScripts entry
+type defaultEntry struct {
+	group   string
+	version string
+	kind    string
+	refs    []ScriptRef
+}
+
+// ParseDefaultScripts: parses a YAML or JSON default scripts configuration
+func ParseDefaultScripts(data []byte) (*DefaultScripts, error) {
+	var config DefaultScriptsConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse default scripts configuration: %w", err)
+	}
+
+	defaults := &DefaultScripts{}
+	for i, entry := range config.Defaults {
+		if entry.Kind == "" {
+			return nil, fmt.Errorf("default scripts entry %d has no kind", i)
+		}
+
+		var refs []ScriptRef
+		for _, script := range entry.Scripts {
+			ref, ok := parseRef(script)
+			if !ok {
+				return nil, fmt.Errorf("invalid script reference %q for kind %s (expected namespace/name)", script, entry.Kind)
+			}
+			refs = append(refs, ref)
+		}
+
+		defaults.entries = append(defaults.entries, defaultEntry{
+			group:   entry.Group,
+			version: entry.Version,
+			kind:    entry.Kind,
+			refs:    refs,
+		})
+	}
+
+	return defaults, nil
+}
+
+// LoadDefaultScriptsFile: reads the default scripts configuration from a file
+func LoadDefaultScriptsFile(path string) (*DefaultScripts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read default scripts file %s: %w", path, err)
+	}
+	return ParseDefaultScripts(data)
+}
+
+// LoadDefaultScriptsConfigMap: reads the default scripts configuration from the DefaultScriptsKey of a ConfigMap
+func LoadDefaultScriptsConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*DefaultScripts, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ConfigMap %s/%s: %w", namespace, name, err)
+	}
+
+	data, ok := cm.Data[DefaultScriptsKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s does not contain '%s' key", namespace, name, DefaultScriptsKey)
+	}
+
+	return ParseDefaultScripts([]byte(data))
+}
+
+// ScriptsFor: returns the script references configured for a GroupVersionKind, in configuration order
+func (d *DefaultScripts) ScriptsFor(gvk metav1.GroupVersionKind) []ScriptRef {
+	if d == nil {
+		return nil
+	}
+
+	var refs []ScriptRef
+	for _, entry := range d.entries {
+		if entry.group != gvk.Group || entry.kind != gvk.Kind {
+			continue
+		}
+		if entry.version != "" && entry.version != gvk.Version {
+			continue
+		}
+		refs = append(refs, entry.refs...)
+	}
+
+	return refs
+}
@@ -0,0 +1,173 @@
+package scriptloader
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testDefaultsConfig = `
+defaults:
+  - group: apps
+    version: v1
+    kind: Deployment
+    scripts:
+      - platform/standard-deployment-policy
+      - platform/labels#deployment.lua
+  - group: apps
+    kind: Deployment
+    scripts:
+      - platform/any-version
+  - kind: Pod
+    version: v1
+    scripts:
+      - platform/pod-defaults
+`
+
+func TestParseDefaultScripts_ScriptsFor(t *testing.T) {
+	defaults, err := ParseDefaultScripts([]byte(testDefaultsConfig))
+	if err != nil {
+		t.Fatalf("ParseDefaultScripts failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		gvk      metav1.GroupVersionKind
+		expected []string
+	}{
+		{
+			name:     "exact match and version wildcard",
+			gvk:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			expected: []string{"platform/standard-deployment-policy", "platform/labels#deployment.lua", "platform/any-version"},
+		},
+		{
+			name:     "other version only matches wildcard",
+			gvk:      metav1.GroupVersionKind{Group: "apps", Version: "v1beta2", Kind: "Deployment"},
+			expected: []string{"platform/any-version"},
+		},
+		{
+			name:     "core group",
+			gvk:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			expected: []string{"platform/pod-defaults"},
+		},
+		{
+			name: "group must match",
+			gvk:  metav1.GroupVersionKind{Group: "extensions", Version: "v1", Kind: "Deployment"},
+		},
+		{
+			name: "unmapped kind",
+			gvk:  metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refs := defaults.ScriptsFor(tt.gvk)
+			if len(refs) != len(tt.expected) {
+				t.Fatalf("Expected %d scripts, got %v", len(tt.expected), refs)
+			}
+			for i, ref := range refs {
+				if ref.String() != tt.expected[i] {
+					t.Errorf("Expected script %d to be %s, got %s", i, tt.expected[i], ref)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDefaultScripts_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"missing kind":  "defaults:\n  - group: apps\n    scripts: [platform/a]\n",
+		"invalid ref":   "defaults:\n  - kind: Pod\n    scripts: [not-a-ref]\n",
+		"unknown field": "defaults:\n  - kind: Pod\n    script: [platform/a]\n",
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseDefaultScripts([]byte(config)); err == nil {
+				t.Error("Expected error for invalid configuration")
+			}
+		})
+	}
+}
+
+func TestDefaultScripts_Nil(t *testing.T) {
+	var defaults *DefaultScripts
+	if refs := defaults.ScriptsFor(metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}); refs != nil {
+		t.Errorf("Expected no scripts from nil defaults, got %v", refs)
+	}
+}
+
+func TestLoadDefaultScriptsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defaults.yaml")
+	if err := os.WriteFile(path, []byte(testDefaultsConfig), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	defaults, err := LoadDefaultScriptsFile(path)
+	if err != nil {
+		t.Fatalf("LoadDefaultScriptsFile failed: %v", err)
+	}
+	if refs := defaults.ScriptsFor(metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}); len(refs) != 1 {
+		t.Errorf("Expected 1 script for Pods, got %v", refs)
+	}
+
+	if _, err := LoadDefaultScriptsFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestLoadDefaultScriptsConfigMap(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "glua-defaults", Namespace: "glua-system"},
+			Data:       map[string]string{DefaultScriptsKey: testDefaultsConfig},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "empty", Namespace: "glua-system"},
+		},
+	)
+
+	defaults, err := LoadDefaultScriptsConfigMap(context.Background(), clientset, "glua-system", "glua-defaults")
+	if err != nil {
+		t.Fatalf("LoadDefaultScriptsConfigMap failed: %v", err)
+	}
+	if refs := defaults.ScriptsFor(metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}); len(refs) != 3 {
+		t.Errorf("Expected 3 scripts for Deployments, got %v", refs)
+	}
+
+	if _, err := LoadDefaultScriptsConfigMap(context.Background(), clientset, "glua-system", "empty"); err == nil {
+		t.Error("Expected error for ConfigMap without the defaults key")
+	}
+	if _, err := LoadDefaultScriptsConfigMap(context.Background(), clientset, "glua-system", "missing"); err == nil {
+		t.Error("Expected error for missing ConfigMap")
+	}
+}
+
+func TestLoadScripts(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: "platform"},
+			Data:       map[string]string{"script.lua": `object.policy = true`},
+		},
+	)
+
+	loader := NewScriptLoader(clientset, log.New(os.Stdout, "[test] ", log.LstdFlags))
+	scripts, err := loader.LoadScripts(context.Background(), []ScriptRef{{Namespace: "platform", Name: "policy"}})
+	if err != nil {
+		t.Fatalf("LoadScripts failed: %v", err)
+	}
+	if scripts["platform/policy"] != `object.policy = true` {
+		t.Errorf("Expected platform/policy to be loaded, got %v", scripts)
+	}
+
+	if _, err := loader.LoadScripts(context.Background(), []ScriptRef{{Namespace: "platform", Name: "missing"}}); err == nil {
+		t.Error("Expected error for missing ConfigMap")
+	}
+}
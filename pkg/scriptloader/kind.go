@@ -0,0 +1,27 @@
+package scriptloader
+
+import (
+	"context"
+	"strings"
+)
+
+// kindKey: context key of the kind of the object scripts are loaded for
+type kindKey struct{}
+
+// WithKind: returns a context loading scripts for objects of kind, whose key (see KindKey) is tried
+// first for references without an explicit #key when Options.KindKeys is set
+func WithKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, kindKey{}, kind)
+}
+
+// kindFrom: returns the kind of the object scripts are loaded for, lowercased, empty when ctx has none
+func kindFrom(ctx context.Context) string {
+	kind, _ := ctx.Value(kindKey{}).(string)
+	return strings.ToLower(kind)
+}
+
+// KindKey: returns the ConfigMap key holding the script of a kind, its lowercased name with the
+// .lua extension, such as pod.lua for Pods
+func KindKey(kind string) string {
+	return strings.ToLower(kind) + ".lua"
+}
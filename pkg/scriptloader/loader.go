@@ -1,13 +1,28 @@
 package scriptloader
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+
+	"thechat/pkg/metrics"
+	"thechat/pkg/tracing"
 )
 
 const (
@@ -16,95 +31,769 @@ const (
 	// AnnotationScripts: annotation key for specifying ConfigMap scripts
 	// Format: "namespace/configmap-name,namespace/configmap-name2"
 	AnnotationScripts = AnnotationPrefix + "/scripts"
+	// AnnotationScriptsCreate: scripts only run for CREATE requests, same format as AnnotationScripts
+	AnnotationScriptsCreate = AnnotationScripts + "-create"
+	// AnnotationScriptsUpdate: scripts only run for UPDATE requests, same format as AnnotationScripts
+	AnnotationScriptsUpdate = AnnotationScripts + "-update"
+	// AnnotationScriptsDelete: scripts only run for DELETE requests, same format as AnnotationScripts
+	AnnotationScriptsDelete = AnnotationScripts + "-delete"
+
+	// LabelScript: ConfigMap label ("true") marking ConfigMaps holding scripts, whose scripts the
+	// webhook checks when the ConfigMap itself is admitted
+	LabelScript = AnnotationPrefix + "/script"
+
+	// DefaultScriptKey: ConfigMap key holding the script when nothing else is specified
+	DefaultScriptKey = "script.lua"
+
+	// CompressedSuffix: key suffix marking gzip-compressed, base64-encoded script content
+	CompressedSuffix = ".gz"
+	// MaxDecompressedSize: upper bound on the size of a decompressed script
+	MaxDecompressedSize = 16 << 20
 )
 
+// DefaultKeySearchOrder: ConfigMap keys tried in order when a reference has no explicit #key
+var DefaultKeySearchOrder = []string{DefaultScriptKey, "main.lua", "init.lua"}
+
+// ScriptRef: reference to a script in the scripts annotation
+// Format: "namespace/name" or "namespace/name#key" to select a specific ConfigMap key, prefixed with
+// "scheme:" for scripts of other sources than ConfigMaps ("scheme:name" when they have no namespace)
+type ScriptRef struct {
+	// Scheme: source of the script, empty for ConfigMaps
+	Scheme    string
+	Namespace string
+	Name      string
+	// Key: explicit ConfigMap key, empty when the key search order applies
+	Key string
+}
+
+// String: returns the reference as written in the annotation
+func (r ScriptRef) String() string {
+	ref := r.Name
+	if r.Namespace != "" {
+		ref = r.Namespace + "/" + ref
+	}
+	if r.Scheme != "" {
+		ref = r.Scheme + ":" + ref
+	}
+	if r.Key != "" {
+		ref += "#" + r.Key
+	}
+	return ref
+}
+
+// ScriptName: returns the identifier of a script loaded from the given ConfigMap key
+// Scripts loaded from the default key keep the plain namespace/name identifier
+func ScriptName(namespace, name, key string) string {
+	if key == DefaultScriptKey {
+		return fmt.Sprintf("%s/%s", namespace, name)
+	}
+	return fmt.Sprintf("%s/%s#%s", namespace, name, key)
+}
+
+// Options: tunables for the ScriptLoader
+type Options struct {
+	// CacheTTL: how long a loaded script is served from memory before the ConfigMap is fetched again
+	// Zero disables caching, every request fetches the ConfigMap
+	CacheTTL time.Duration
+	// MaxStaleness: how long after its last successful load a script may still be served
+	// when the API server cannot be reached. Zero disables stale serving
+	MaxStaleness time.Duration
+	// KeySearchOrder: ConfigMap keys tried in order for references without an explicit #key
+	// Defaults to DefaultKeySearchOrder
+	KeySearchOrder []string
+	// KindKeys: try the key named after the kind of the object (see KindKey and WithKind) before
+	// the key search order, so that one ConfigMap holds a script per kind, such as pod.lua and
+	// deployment.lua, falling back to script.lua for the other kinds
+	KindKeys bool
+	// BestEffort: skip references whose ConfigMap cannot be loaded instead of failing the whole load
+	BestEffort bool
+	// RejectDuplicates: fail the load of annotations referencing a script several times, instead of
+	// only loading it once, at its first occurrence
+	RejectDuplicates bool
+	// Sources: script sources by the scheme of the references they resolve, "configmap" replaces
+	// the built-in ConfigMap source, used for references without a scheme
+	Sources map[string]ScriptSource
+}
+
+// SourceConfigMap: source of scripts loaded from ConfigMaps, and scheme of references to them
+const SourceConfigMap = "configmap"
+
+// cacheEntry: last successfully loaded scripts for a script reference
+type cacheEntry struct {
+	ref      string
+	kind     string
+	source   string
+	scripts  []loadedScript
+	scope    []string
+	loadedAt time.Time
+	// served: loads are served from the entry until it expires, false for entries recording the
+	// last resolution of a source that is resolved on every load
+	served bool
+}
+
+// loadedScript: script loaded from one ConfigMap key
+type loadedScript struct {
+	key             string
+	name            string
+	content         string
+	hash            string
+	resourceVersion string
+	priority        *int
+	timeout         time.Duration
+	failurePolicy   string
+}
+
+// paramsEntry: last successfully loaded params ConfigMap, decoded
+type paramsEntry struct {
+	params   map[string]interface{}
+	loadedAt time.Time
+}
+
+// CachedScript: metadata about a script held in the loader cache, content is never exposed
+type CachedScript struct {
+	// Ref: reference as written in the scripts annotation
+	Ref string `json:"ref"`
+	// Kind: kind of the objects the reference was resolved for, lowercased, with Options.KindKeys set
+	Kind string `json:"kind,omitempty"`
+	// Name: script identifier used in logs and ordering
+	Name string `json:"name"`
+	// Key: ConfigMap key the script was loaded from
+	Key string `json:"key"`
+	// Source: scheme of the source the script was loaded from, such as SourceConfigMap
+	Source string `json:"source"`
+	// Priority: number prefixing the ConfigMap key of the script, which orders the keys of its
+	// ConfigMap, nil when the key is not numbered
+	Priority *int `json:"priority,omitempty"`
+	// Timeout: maximum run time of the script set by AnnotationTimeout, empty for the timeout of the server
+	Timeout string `json:"timeout,omitempty"`
+	// FailurePolicy: what a failure of the script does to the request, FailurePolicyIgnore or FailurePolicyFail
+	FailurePolicy string `json:"failurePolicy"`
+	// Hash: hex-encoded SHA-256 of the script content
+	Hash string `json:"sha256"`
+	// ResourceVersion: resourceVersion of the ConfigMap the content was read from
+	ResourceVersion string `json:"resourceVersion"`
+	// Size: script content length in bytes
+	Size int `json:"size"`
+	// LoadedAt: time of the last successful load
+	LoadedAt time.Time `json:"loadedAt"`
+	// ExpiresAt: time after which the ConfigMap is fetched again, nil when caching is disabled or
+	// the source is resolved on every load
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
 // ScriptLoader: loads Lua scripts from Kubernetes ConfigMaps
 type ScriptLoader struct {
 	clientset kubernetes.Interface
 	logger    *log.Logger
+	options   Options
+
+	mu      sync.RWMutex
+	cache   map[string]cacheEntry
+	params  map[string]paramsEntry    // params ConfigMap namespace/name -> decoded keys
+	after   map[string][]string       // ConfigMap namespace/name -> ConfigMaps it runs after
+	hashes  map[string]string         // script reference -> hash of the content last fetched
+	samples map[string]float64        // ConfigMap namespace/name -> percentage of objects its scripts run for
+	ranks   map[string]map[string]int // ConfigMap namespace/name -> position of each script among its numbered keys
+	hooks   []func(namespace, name string)
+	now     func() time.Time
 }
 
 // NewScriptLoader: creates a new script loader with K8s client
 func NewScriptLoader(clientset kubernetes.Interface, logger *log.Logger) *ScriptLoader {
+	return NewScriptLoaderWithOptions(clientset, logger, Options{})
+}
+
+// NewScriptLoaderWithOptions: creates a new script loader with caching and stale-serving options
+func NewScriptLoaderWithOptions(clientset kubernetes.Interface, logger *log.Logger, options Options) *ScriptLoader {
+	if len(options.KeySearchOrder) == 0 {
+		options.KeySearchOrder = DefaultKeySearchOrder
+	}
+
 	return &ScriptLoader{
 		clientset: clientset,
 		logger:    logger,
+		options:   options,
+		cache:     make(map[string]cacheEntry),
+		params:    make(map[string]paramsEntry),
+		after:     make(map[string][]string),
+		hashes:    make(map[string]string),
+		samples:   make(map[string]float64),
+		ranks:     make(map[string]map[string]int),
+		now:       time.Now,
 	}
 }
 
 // LoadScriptsFromAnnotations: loads Lua scripts from ConfigMaps specified in object annotations
-// Annotation format: glua.maurice.fr/scripts: "namespace/configmap1,namespace/configmap2"
-// Each ConfigMap should contain a single Lua script in a key named "script.lua"
+// Annotation format: glua.maurice.fr/scripts: "namespace/configmap1,namespace/configmap2#key.lua"
+// Without an explicit #key, the keys of the search order are tried in turn, then a lone .lua key
 // Returns a map of scriptName -> scriptContent
 func (l *ScriptLoader) LoadScriptsFromAnnotations(ctx context.Context, annotations map[string]string) (map[string]string, error) {
+	set, err := l.loadAnnotations(ctx, annotations, AnnotationScripts)
+	return set.Scripts, err
+}
+
+// LoadScriptsForOperation: same as LoadScriptsFromAnnotations, merged with the scripts of the
+// annotation scoped to the admission operation (CREATE, UPDATE or DELETE)
+func (l *ScriptLoader) LoadScriptsForOperation(ctx context.Context, annotations map[string]string, operation string) (map[string]string, error) {
+	set, err := l.LoadScriptSetForOperation(ctx, annotations, operation)
+	return set.Scripts, err
+}
+
+// LoadScriptSetForOperation: same as LoadScriptsForOperation, along with the scope of every script
+func (l *ScriptLoader) LoadScriptSetForOperation(ctx context.Context, annotations map[string]string, operation string) (ScriptSet, error) {
+	keys := []string{AnnotationScripts}
+	if annotation := OperationAnnotation(operation); annotation != "" {
+		keys = append(keys, annotation)
+	}
+	return l.loadAnnotations(ctx, annotations, keys...)
+}
+
+// OperationAnnotation: returns the scripts annotation scoped to an admission operation,
+// empty for operations without one
+func OperationAnnotation(operation string) string {
+	switch strings.ToUpper(operation) {
+	case "CREATE":
+		return AnnotationScriptsCreate
+	case "UPDATE":
+		return AnnotationScriptsUpdate
+	case "DELETE":
+		return AnnotationScriptsDelete
+	default:
+		return ""
+	}
+}
+
+// loadAnnotations: loads the scripts referenced by the given annotations, in order, within a span
+func (l *ScriptLoader) loadAnnotations(ctx context.Context, annotations map[string]string, keys ...string) (ScriptSet, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "load scripts")
+	defer span.End()
+
+	set, err := l.loadAnnotationScripts(ctx, annotations, keys...)
+	span.SetAttributes(tracing.AttrScripts.Int(len(set.Scripts)))
+	tracing.Fail(span, err)
+	return set, err
+}
+
+// loadAnnotationScripts: loads the scripts referenced by the given annotations, in order
+// The set holds no scripts, nil, when none of the annotations is present
+func (l *ScriptLoader) loadAnnotationScripts(ctx context.Context, annotations map[string]string, keys ...string) (ScriptSet, error) {
+	var set ScriptSet
 	if annotations == nil {
 		l.logger.Printf("No annotations found on object")
-		return nil, nil
+		return set, nil
 	}
 
-	scriptsAnnotation, exists := annotations[AnnotationScripts]
-	if !exists {
-		l.logger.Printf("No %s annotation found", AnnotationScripts)
-		return nil, nil
+	seen := make(map[ScriptRef]string) // reference -> annotation it first appeared in
+	for _, key := range keys {
+		scriptsAnnotation, exists := annotations[key]
+		if !exists {
+			l.logger.Printf("No %s annotation found", key)
+			continue
+		}
+
+		l.logger.Printf("Found %s annotation: %s", key, scriptsAnnotation)
+		if set.Scripts == nil {
+			set = ScriptSet{Scripts: make(map[string]string), Scopes: make(map[string][]string)}
+		}
+
+		// Parse the annotation: "namespace/configmap1,namespace/configmap2"
+		for _, ref := range strings.Split(scriptsAnnotation, ",") {
+			ref = strings.TrimSpace(ref)
+			if ref == "" {
+				continue
+			}
+
+			// Parse namespace/name[#key], malformed entries are reported by the handler
+			scriptRef, reason := checkRef(ref)
+			if reason != "" {
+				l.logger.Printf("WARNING: Skipping %v in %s", ParseError{Entry: ref, Reason: reason}, key)
+				continue
+			}
+
+			// A script referenced twice would otherwise run once, silently
+			if first, duplicate := seen[scriptRef]; duplicate {
+				if l.options.RejectDuplicates {
+					return ScriptSet{}, fmt.Errorf("script %s is referenced more than once (in %s and %s)", scriptRef, first, key)
+				}
+				l.logger.Printf("WARNING: Ignoring duplicate reference to script %s in %s, already referenced in %s", scriptRef, key, first)
+				continue
+			}
+			seen[scriptRef] = key
+
+			if err := l.loadInto(ctx, scriptRef, &set); err != nil {
+				return ScriptSet{}, err
+			}
+		}
 	}
 
-	l.logger.Printf("Found scripts annotation: %s", scriptsAnnotation)
+	if set.Scripts == nil {
+		return set, nil
+	}
 
-	// Parse the annotation: "namespace/configmap1,namespace/configmap2"
-	configMapRefs := strings.Split(scriptsAnnotation, ",")
-	scripts := make(map[string]string)
+	l.logger.Printf("Successfully loaded %d scripts from ConfigMaps", len(set.Scripts))
+	return set, nil
+}
 
-	for _, ref := range configMapRefs {
-		ref = strings.TrimSpace(ref)
-		if ref == "" {
+// LoadScripts: loads the scripts of already parsed references
+// Returns a map of scriptName -> scriptContent
+func (l *ScriptLoader) LoadScripts(ctx context.Context, refs []ScriptRef) (map[string]string, error) {
+	set, err := l.LoadScriptSet(ctx, refs)
+	return set.Scripts, err
+}
+
+// LoadScriptSet: same as LoadScripts, along with the scope of every script
+func (l *ScriptLoader) LoadScriptSet(ctx context.Context, refs []ScriptRef) (ScriptSet, error) {
+	set := ScriptSet{Scripts: make(map[string]string), Scopes: make(map[string][]string)}
+	for _, ref := range refs {
+		if err := l.loadInto(ctx, ref, &set); err != nil {
+			return ScriptSet{}, err
+		}
+	}
+	return set, nil
+}
+
+// loadInto: loads the scripts a reference resolves to, through the source of its scheme, and
+// adds them to set under their name
+func (l *ScriptLoader) loadInto(ctx context.Context, ref ScriptRef, set *ScriptSet) error {
+	l.logger.Printf("Loading script %s", ref)
+
+	source, err := l.source(ref.Scheme)
+	var resolved []Script
+	if err == nil {
+		resolved, err = source.Resolve(ctx, ref)
+	}
+	if err != nil {
+		if !l.options.BestEffort {
+			return err
+		}
+
+		reason := "error"
+		if apierrors.IsNotFound(err) {
+			reason = "not_found"
+		}
+		l.logger.Printf("WARNING: Skipping script %s in best-effort mode: %v", ref, err)
+		metrics.SkippedScripts.WithLabelValues(ref.String(), reason).Inc()
+		return nil
+	}
+
+	for _, script := range resolved {
+		if script.Content == "" {
 			continue
 		}
+		set.add(script)
+		l.logger.Printf("Loaded script %s (length: %d bytes)", script.Name, len(script.Content))
+	}
+	l.recordResolved(ref, resolved)
+	return nil
+}
 
-		// Parse namespace/name
-		parts := strings.Split(ref, "/")
-		if len(parts) != 2 {
-			l.logger.Printf("WARNING: Invalid ConfigMap reference format: %s (expected namespace/name)", ref)
+// recordResolved: keeps the scripts a registered source resolved a reference to, for CachedScripts
+// The built-in ConfigMap source records its scripts in the cache it serves them from
+func (l *ScriptLoader) recordResolved(ref ScriptRef, resolved []Script) {
+	scheme := ref.Scheme
+	if scheme == "" {
+		scheme = SourceConfigMap
+	}
+	if _, registered := l.options.Sources[scheme]; !registered {
+		return
+	}
+	if l.options.CacheTTL <= 0 && l.options.MaxStaleness <= 0 {
+		return
+	}
+
+	scripts := make([]loadedScript, 0, len(resolved))
+	for _, script := range resolved {
+		if script.Content == "" {
 			continue
 		}
+		failurePolicy := script.FailurePolicy
+		if failurePolicy == "" {
+			failurePolicy = FailurePolicyIgnore
+		}
+		scripts = append(scripts, loadedScript{
+			name:            script.Name,
+			content:         script.Content,
+			hash:            contentHash(script.Content),
+			resourceVersion: script.ResourceVersion,
+			timeout:         script.Timeout,
+			failurePolicy:   failurePolicy,
+		})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// @ never starts a reference, these entries cannot collide with the ones of the ConfigMap source
+	key := "@" + ref.String()
+	if len(scripts) == 0 {
+		delete(l.cache, key)
+		return
+	}
+	l.cache[key] = cacheEntry{
+		ref:      ref.String(),
+		source:   scheme,
+		scripts:  scripts,
+		loadedAt: l.now(),
+	}
+}
+
+// loadScript: returns the scripts and scope a reference resolves to, going through the cache
+// No script with a nil error means the ConfigMap holds no usable script
+// When the API server is unreachable, the last successfully loaded content is served
+// for up to MaxStaleness after it was loaded
+// With kind keys, references without an explicit #key are cached per kind, as "namespace/name#@kind"
+func (l *ScriptLoader) loadScript(ctx context.Context, ref ScriptRef) ([]loadedScript, []string, error) {
+	namespace, name := ref.Namespace, ref.Name
+	cacheKey := ref.String()
+	var kind string
+	if l.options.KindKeys && ref.Key == "" {
+		kind = kindFrom(ctx)
+	}
+	if kind != "" {
+		// @ never appears in ConfigMap keys, this cannot collide with an explicit #key
+		cacheKey += "#@" + kind
+	}
 
-		namespace := strings.TrimSpace(parts[0])
-		name := strings.TrimSpace(parts[1])
+	l.mu.RLock()
+	entry, cached := l.cache[cacheKey]
+	l.mu.RUnlock()
 
-		l.logger.Printf("Loading script from ConfigMap %s/%s", namespace, name)
+	if cached && l.options.CacheTTL > 0 && l.now().Sub(entry.loadedAt) < l.options.CacheTTL {
+		l.logger.Printf("Using cached script %s (loaded %s ago)",
+			scriptNames(entry.scripts), l.now().Sub(entry.loadedAt))
+		return entry.scripts, entry.scope, nil
+	}
 
-		// Fetch the ConfigMap
-		cm, err := l.clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
-		if err != nil {
-			l.logger.Printf("ERROR: Failed to fetch ConfigMap %s/%s: %v", namespace, name, err)
-			return nil, fmt.Errorf("failed to fetch ConfigMap %s/%s: %w", namespace, name, err)
+	// Fetch the ConfigMap
+	cm, err := l.clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if cached && l.options.MaxStaleness > 0 && isTransientError(err) {
+			age := l.now().Sub(entry.loadedAt)
+			if age <= l.options.MaxStaleness {
+				l.logger.Printf("WARNING: Failed to fetch ConfigMap %s/%s (%v), serving stale script %s loaded %s ago",
+					namespace, name, err, scriptNames(entry.scripts), age)
+				for _, script := range entry.scripts {
+					metrics.StaleScriptsServed.WithLabelValues(script.name).Inc()
+				}
+				return entry.scripts, entry.scope, nil
+			}
+			l.logger.Printf("ERROR: Stale copy of script %s is %s old, exceeding max staleness of %s",
+				cacheKey, age, l.options.MaxStaleness)
 		}
 
-		// Extract the script from the ConfigMap
-		// Look for "script.lua" key
-		scriptContent, exists := cm.Data["script.lua"]
-		if !exists {
-			l.logger.Printf("WARNING: ConfigMap %s/%s does not contain 'script.lua' key", namespace, name)
-			continue
+		if apierrors.IsNotFound(err) {
+			l.evict(cacheKey)
+		}
+
+		l.logger.Printf("ERROR: Failed to fetch ConfigMap %s/%s: %v", namespace, name, err)
+		return nil, nil, fmt.Errorf("failed to fetch ConfigMap %s/%s: %w", namespace, name, err)
+	}
+
+	l.recordAfter(namespace, name, cm.Annotations)
+	scope := l.parseScope(namespace, name, cm.Annotations)
+	timeout, failurePolicy := l.parseScriptOptions(namespace, name, cm.Annotations)
+	l.recordSample(namespace, name, cm.Annotations)
+
+	// Extract the scripts from the ConfigMap
+	keys, ok := l.resolveKeys(ref, kind, cm.Data)
+	if !ok {
+		l.evict(cacheKey)
+		return nil, nil, nil
+	}
+
+	names := []string{ScriptName(namespace, name, keys[0])}
+	if ref.Key == "" {
+		names = l.keyNames(namespace, name, keys)
+		var ranked []string
+		if len(keys) > 1 {
+			ranked = names
 		}
+		l.recordRanks(namespace, name, ranked)
+	}
 
+	var scripts []loadedScript
+	for i, key := range keys {
+		scriptContent, err := DecodeScript(key, cm.Data[key])
+		if err != nil {
+			l.logger.Printf("ERROR: Failed to decompress '%s' of ConfigMap %s/%s: %v", key, namespace, name, err)
+			l.evict(cacheKey)
+			return nil, nil, fmt.Errorf("failed to decompress '%s' of ConfigMap %s/%s: %w", key, namespace, name, err)
+		}
 		if scriptContent == "" {
-			l.logger.Printf("WARNING: ConfigMap %s/%s has empty 'script.lua' content", namespace, name)
+			l.logger.Printf("WARNING: ConfigMap %s/%s has empty '%s' content", namespace, name, key)
 			continue
 		}
 
-		// Use namespace/name as the script identifier
-		scriptName := fmt.Sprintf("%s/%s", namespace, name)
-		scripts[scriptName] = scriptContent
-		l.logger.Printf("Loaded script %s (length: %d bytes)", scriptName, len(scriptContent))
+		hashKey := cacheKey
+		if len(keys) > 1 {
+			hashKey = ScriptRef{Namespace: namespace, Name: name, Key: key}.String()
+		}
+		var priority *int
+		if number, _, ok := numberedKey(key); ok {
+			priority = &number
+		}
+		scripts = append(scripts, loadedScript{
+			key:             key,
+			name:            names[i],
+			content:         scriptContent,
+			hash:            l.recordHash(hashKey, names[i], scriptContent, cm.ResourceVersion),
+			resourceVersion: cm.ResourceVersion,
+			priority:        priority,
+			timeout:         timeout,
+			failurePolicy:   failurePolicy,
+		})
+	}
+	if len(scripts) == 0 {
+		l.evict(cacheKey)
+		return nil, nil, nil
+	}
+
+	l.logger.Printf("Resolved ConfigMap %s to keys %v", ref, keys)
+
+	if l.options.CacheTTL > 0 || l.options.MaxStaleness > 0 {
+		l.mu.Lock()
+		l.cache[cacheKey] = cacheEntry{
+			ref:      ref.String(),
+			kind:     kind,
+			source:   SourceConfigMap,
+			scripts:  scripts,
+			scope:    scope,
+			loadedAt: l.now(),
+			served:   true,
+		}
+		l.mu.Unlock()
+	}
+
+	return scripts, scope, nil
+}
+
+// scriptNames: renders the names of loaded scripts for logs
+func scriptNames(scripts []loadedScript) string {
+	names := make([]string, len(scripts))
+	for i, script := range scripts {
+		names[i] = script.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// resolveKeys: picks the ConfigMap keys holding the scripts of a reference
+// An explicit #key wins, then the key of kind when not empty, then the first key of the search
+// order present in the ConfigMap (plain, then with the .gz suffix), then the only .lua or
+// .lua.gz key if there is exactly one.
+// Several .lua keys of which at least one is numbered, e.g. "10-labels.lua", are all loaded, in
+// the order of their numbers (see orderedKeys)
+func (l *ScriptLoader) resolveKeys(ref ScriptRef, kind string, data map[string]string) ([]string, bool) {
+	if ref.Key != "" {
+		if _, exists := data[ref.Key]; !exists {
+			l.logger.Printf("WARNING: ConfigMap %s/%s does not contain '%s' key", ref.Namespace, ref.Name, ref.Key)
+			return nil, false
+		}
+		return []string{ref.Key}, true
+	}
+
+	searchOrder := l.options.KeySearchOrder
+	if kind != "" {
+		searchOrder = append([]string{KindKey(kind)}, searchOrder...)
+	}
+	for _, key := range searchOrder {
+		if _, exists := data[key]; exists {
+			return []string{key}, true
+		}
+		if _, exists := data[key+CompressedSuffix]; exists {
+			return []string{key + CompressedSuffix}, true
+		}
+	}
+
+	if keys, ok := orderedKeys(data); ok {
+		return keys, true
 	}
 
-	l.logger.Printf("Successfully loaded %d scripts from ConfigMaps", len(scripts))
-	return scripts, nil
+	var luaKeys []string
+	for key := range data {
+		if IsScriptKey(key) {
+			luaKeys = append(luaKeys, key)
+		}
+	}
+
+	switch len(luaKeys) {
+	case 0:
+		l.logger.Printf("WARNING: ConfigMap %s/%s does not contain any of the keys %v nor any .lua key",
+			ref.Namespace, ref.Name, l.options.KeySearchOrder)
+		return nil, false
+	case 1:
+		return luaKeys, true
+	default:
+		sort.Strings(luaKeys)
+		l.logger.Printf("WARNING: ConfigMap %s/%s has multiple .lua keys %v, none of %v nor any numbered one, use namespace/name#key to pick one",
+			ref.Namespace, ref.Name, luaKeys, l.options.KeySearchOrder)
+		return nil, false
+	}
 }
 
-// ParseAnnotation: helper to parse the scripts annotation into namespace/name pairs
-func ParseAnnotation(annotation string) []struct{ Namespace, Name string } {
-	var result []struct{ Namespace, Name string }
+// CachedScripts: returns metadata about every cached script, sorted by reference
+func (l *ScriptLoader) CachedScripts() []CachedScript {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	scripts := make([]CachedScript, 0, len(l.cache))
+	for _, entry := range l.cache {
+		for _, script := range entry.scripts {
+			cached := CachedScript{
+				Ref:             entry.ref,
+				Kind:            entry.kind,
+				Name:            script.name,
+				Key:             script.key,
+				Source:          entry.source,
+				Priority:        script.priority,
+				FailurePolicy:   script.failurePolicy,
+				Hash:            script.hash,
+				ResourceVersion: script.resourceVersion,
+				Size:            len(script.content),
+				LoadedAt:        entry.loadedAt,
+			}
+			if script.timeout > 0 {
+				cached.Timeout = script.timeout.String()
+			}
+			if entry.served && l.options.CacheTTL > 0 {
+				expiresAt := entry.loadedAt.Add(l.options.CacheTTL)
+				cached.ExpiresAt = &expiresAt
+			}
+			scripts = append(scripts, cached)
+		}
+	}
+
+	sort.Slice(scripts, func(i, j int) bool {
+		if scripts[i].Ref != scripts[j].Ref {
+			return scripts[i].Ref < scripts[j].Ref
+		}
+		if scripts[i].Kind != scripts[j].Kind {
+			return scripts[i].Kind < scripts[j].Kind
+		}
+		return scripts[i].Name < scripts[j].Name
+	})
+	return scripts
+}
+
+// Flush: drops every cached script, the next load of each reference fetches its ConfigMap again
+func (l *ScriptLoader) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.logger.Printf("Flushing script cache (%d entries)", len(l.cache))
+	l.cache = make(map[string]cacheEntry)
+	l.params = make(map[string]paramsEntry)
+	l.after = make(map[string][]string)
+	l.samples = make(map[string]float64)
+	l.ranks = make(map[string]map[string]int)
+}
+
+// IsScriptKey: reports whether a ConfigMap key holds a script, plain (.lua) or compressed (.lua.gz)
+func IsScriptKey(key string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(key, CompressedSuffix), ".lua")
+}
+
+// DecodeScript: returns the script stored under a ConfigMap key, decompressed for .gz keys
+func DecodeScript(key, content string) (string, error) {
+	if !strings.HasSuffix(key, CompressedSuffix) || content == "" {
+		return content, nil
+	}
+	return decompress(content)
+}
+
+// decompress: base64-decodes then gunzips script content stored under a .gz key
+func decompress(content string) (string, error) {
+	compressed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %w", err)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", fmt.Errorf("invalid gzip: %w", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, MaxDecompressedSize+1))
+	if err != nil {
+		return "", fmt.Errorf("invalid gzip: %w", err)
+	}
+	if len(decompressed) > MaxDecompressedSize {
+		return "", fmt.Errorf("decompressed script exceeds %d bytes", MaxDecompressedSize)
+	}
+
+	return string(decompressed), nil
+}
+
+// contentHash: returns the hex-encoded SHA-256 of a script
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// shortHash: returns the first 12 characters of a hex-encoded hash, enough to tell contents apart in logs
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// recordHash: remembers the hash of the content fetched for a script reference, and records the time
+// in metrics.ScriptContentChanged when it differs from the previously fetched one, logging both
+// hashes along with the resourceVersion of the ConfigMap holding the new content. Returns the hash
+func (l *ScriptLoader) recordHash(cacheKey, scriptName, content, resourceVersion string) string {
+	hash := contentHash(content)
+
+	l.mu.Lock()
+	previous, seen := l.hashes[cacheKey]
+	l.hashes[cacheKey] = hash
+	l.mu.Unlock()
+
+	if seen && previous != hash {
+		l.logger.Printf("Content of script %s changed: sha256 %s -> %s (ConfigMap resourceVersion %s)",
+			scriptName, shortHash(previous), shortHash(hash), resourceVersion)
+		metrics.ScriptContentChanged.WithLabelValues(ConfigMapOf(scriptName)).Set(float64(l.now().Unix()))
+	}
+	return hash
+}
+
+// evict: drops a script reference from the cache
+func (l *ScriptLoader) evict(scriptName string) {
+	l.mu.Lock()
+	delete(l.cache, scriptName)
+	l.mu.Unlock()
+}
+
+// isTransientError: reports whether a ConfigMap fetch error is likely caused by the
+// API server being temporarily unreachable, as opposed to the ConfigMap being absent or forbidden
+func isTransientError(err error) bool {
+	if apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsUnexpectedServerError(err) {
+		return true
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// ParseAnnotation: helper to parse the scripts annotation into script references
+// References appearing several times are kept at their first occurrence only
+func ParseAnnotation(annotation string) []ScriptRef {
+	refs, _ := ParseAnnotationDuplicates(annotation)
+	return refs
+}
+
+// ParseAnnotationDuplicates: same as ParseAnnotation, also returning the references dropped because
+// they appeared earlier in the annotation, for tooling to flag them
+func ParseAnnotationDuplicates(annotation string) (result, duplicates []ScriptRef) {
+	seen := make(map[ScriptRef]bool)
 
 	refs := strings.Split(annotation, ",")
 	for _, ref := range refs {
@@ -113,16 +802,82 @@ func ParseAnnotation(annotation string) []struct{ Namespace, Name string } {
 			continue
 		}
 
-		parts := strings.Split(ref, "/")
-		if len(parts) != 2 {
+		scriptRef, ok := parseRef(ref)
+		if !ok {
 			continue
 		}
 
-		result = append(result, struct{ Namespace, Name string }{
-			Namespace: strings.TrimSpace(parts[0]),
-			Name:      strings.TrimSpace(parts[1]),
-		})
+		if seen[scriptRef] {
+			duplicates = append(duplicates, scriptRef)
+			continue
+		}
+		seen[scriptRef] = true
+		result = append(result, scriptRef)
+	}
+
+	return result, duplicates
+}
+
+// parseRef: parses a single "[scheme:]namespace/name[#key]" reference
+// The configmap scheme is dropped, "configmap:namespace/name" and "namespace/name" are the same reference
+func parseRef(ref string) (ScriptRef, bool) {
+	parsed, reason := splitRef(ref)
+	return parsed, reason == ""
+}
+
+// splitRef: same as parseRef, returning why the reference is malformed instead of a boolean
+func splitRef(ref string) (ScriptRef, string) {
+	var scheme, key string
+	if idx := strings.Index(ref, "#"); idx >= 0 {
+		key = strings.TrimSpace(ref[idx+1:])
+		ref = ref[:idx]
+		if key == "" {
+			return ScriptRef{}, "empty key after #"
+		}
+	}
+
+	if idx := strings.Index(ref, ":"); idx >= 0 {
+		scheme = strings.TrimSpace(ref[:idx])
+		ref = ref[idx+1:]
+		if !isScheme(scheme) {
+			return ScriptRef{}, fmt.Sprintf("invalid source %q before ':', expected lowercase letters and digits", scheme)
+		}
+		if scheme == SourceConfigMap {
+			scheme = ""
+		}
+	}
+
+	parts := strings.Split(ref, "/")
+	switch {
+	case len(parts) == 1 && scheme != "":
+		// Sources other than ConfigMaps may name scripts without a namespace
+		parts = []string{"", parts[0]}
+	case len(parts) != 2:
+		return ScriptRef{}, "expected namespace/name"
+	}
+
+	parsed := ScriptRef{
+		Scheme:    scheme,
+		Namespace: strings.TrimSpace(parts[0]),
+		Name:      strings.TrimSpace(parts[1]),
+		Key:       key,
+	}
+	if scheme != "" && parsed.Name == "" {
+		return ScriptRef{}, "empty name"
 	}
+	return parsed, ""
+}
 
-	return result
+// isScheme: reports whether s is a valid reference scheme, lowercase letters and digits
+// starting with a letter
+func isScheme(s string) bool {
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
 }
@@ -1,15 +1,28 @@
 package scriptloader
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"io"
 	"log"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"thechat/pkg/metrics"
 )
 
 func TestLoadScriptsFromAnnotations_Success(t *testing.T) {
@@ -109,6 +122,218 @@ func TestLoadScriptsFromAnnotations_ConfigMapNotFound(t *testing.T) {
 	}
 }
 
+func TestLoadScriptsFromAnnotations_BestEffort(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("first")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "last", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("last")`},
+		},
+	)
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() == "forbidden" {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "forbidden", nil)
+		}
+		return false, nil, nil
+	})
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	annotations := map[string]string{
+		AnnotationScripts: "default/first,default/missing,default/forbidden,default/last",
+	}
+
+	// Strict mode fails the whole load
+	if _, err := NewScriptLoader(clientset, logger).LoadScriptsFromAnnotations(context.Background(), annotations); err == nil {
+		t.Fatal("Expected error in strict mode")
+	}
+
+	missingBefore := testutil.ToFloat64(metrics.SkippedScripts.WithLabelValues("default/missing", "not_found"))
+	forbiddenBefore := testutil.ToFloat64(metrics.SkippedScripts.WithLabelValues("default/forbidden", "error"))
+
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{BestEffort: true})
+	scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations)
+	if err != nil {
+		t.Fatalf("Expected no error in best-effort mode, got %v", err)
+	}
+
+	if len(scripts) != 2 || scripts["default/first"] == "" || scripts["default/last"] == "" {
+		t.Errorf("Expected the valid scripts to be loaded, got %v", scripts)
+	}
+
+	if got := testutil.ToFloat64(metrics.SkippedScripts.WithLabelValues("default/missing", "not_found")); got != missingBefore+1 {
+		t.Errorf("Expected the missing ConfigMap to be counted once, got %v", got-missingBefore)
+	}
+	if got := testutil.ToFloat64(metrics.SkippedScripts.WithLabelValues("default/forbidden", "error")); got != forbiddenBefore+1 {
+		t.Errorf("Expected the forbidden ConfigMap to be counted once, got %v", got-forbiddenBefore)
+	}
+}
+
+// gzipBase64: compresses content the way scripts are stored under .gz keys
+func gzipBase64(t testing.TB, content string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatalf("Failed to gzip content: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to gzip content: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestLoadScriptsFromAnnotations_Compressed(t *testing.T) {
+	script := `object.metadata.labels = {compressed = "true"}`
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "searched", Namespace: "default"},
+			Data:       map[string]string{"script.lua.gz": gzipBase64(t, script)},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "explicit", Namespace: "default"},
+			Data:       map[string]string{"policy.lua.gz": gzipBase64(t, script), "README": "docs"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "lone", Namespace: "default"},
+			Data:       map[string]string{"policy.lua.gz": gzipBase64(t, script)},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "plain-wins", Namespace: "default"},
+			Data:       map[string]string{"script.lua": "plain", "script.lua.gz": gzipBase64(t, script)},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "bad-base64", Namespace: "default"},
+			Data:       map[string]string{"script.lua.gz": "not base64!"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "bad-gzip", Namespace: "default"},
+			Data:       map[string]string{"script.lua.gz": base64.StdEncoding.EncodeToString([]byte(script))},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+
+	tests := []struct {
+		ref      string
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{ref: "default/searched", name: "default/searched#script.lua.gz", expected: script},
+		{ref: "default/explicit#policy.lua.gz", name: "default/explicit#policy.lua.gz", expected: script},
+		{ref: "default/lone", name: "default/lone#policy.lua.gz", expected: script},
+		{ref: "default/plain-wins", name: "default/plain-wins", expected: "plain"},
+		{ref: "default/bad-base64", wantErr: true},
+		{ref: "default/bad-gzip", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+				AnnotationScripts: tt.ref,
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got %v", scripts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+			}
+			if scripts[tt.name] != tt.expected {
+				t.Errorf("Expected %s to hold %q, got %v", tt.name, tt.expected, scripts)
+			}
+		})
+	}
+}
+
+func TestDecompress_SizeLimit(t *testing.T) {
+	if _, err := decompress(gzipBase64(t, strings.Repeat("-", MaxDecompressedSize+1))); err == nil {
+		t.Error("Expected error for content exceeding the decompressed size limit")
+	}
+
+	content, err := decompress(gzipBase64(t, strings.Repeat("-", 1024)))
+	if err != nil || len(content) != 1024 {
+		t.Errorf("Expected 1024 bytes, got %d (%v)", len(content), err)
+	}
+}
+
+func TestLoadScriptsForOperation(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "always", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("always")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "create-only", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("create")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "delete-only", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("delete")`},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+
+	annotations := map[string]string{
+		AnnotationScripts:       "default/always",
+		AnnotationScriptsCreate: "default/create-only",
+		AnnotationScriptsDelete: "default/delete-only, default/always",
+	}
+
+	tests := []struct {
+		operation string
+		expected  []string
+	}{
+		{operation: "CREATE", expected: []string{"default/always", "default/create-only"}},
+		{operation: "UPDATE", expected: []string{"default/always"}},
+		{operation: "DELETE", expected: []string{"default/always", "default/delete-only"}},
+		{operation: "CONNECT", expected: []string{"default/always"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.operation, func(t *testing.T) {
+			scripts, err := loader.LoadScriptsForOperation(context.Background(), annotations, tt.operation)
+			if err != nil {
+				t.Fatalf("LoadScriptsForOperation failed: %v", err)
+			}
+			if len(scripts) != len(tt.expected) {
+				t.Fatalf("Expected scripts %v, got %v", tt.expected, scripts)
+			}
+			for _, name := range tt.expected {
+				if _, ok := scripts[name]; !ok {
+					t.Errorf("Expected script %s to be loaded, got %v", name, scripts)
+				}
+			}
+		})
+	}
+
+	// Operation-scoped annotations work without the un-suffixed one
+	scripts, err := loader.LoadScriptsForOperation(context.Background(), map[string]string{
+		AnnotationScriptsCreate: "default/create-only",
+	}, "CREATE")
+	if err != nil || len(scripts) != 1 {
+		t.Errorf("Expected only the create script, got %v (%v)", scripts, err)
+	}
+
+	// The un-suffixed loader ignores operation-scoped annotations
+	scripts, err = loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScriptsCreate: "default/create-only",
+	})
+	if err != nil || scripts != nil {
+		t.Errorf("Expected no scripts, got %v (%v)", scripts, err)
+	}
+}
+
 func TestLoadScriptsFromAnnotations_MissingScriptKey(t *testing.T) {
 	// ConfigMap without script.lua key
 	clientset := fake.NewSimpleClientset(
@@ -141,6 +366,174 @@ func TestLoadScriptsFromAnnotations_MissingScriptKey(t *testing.T) {
 	}
 }
 
+func TestLoadScriptsFromAnnotations_KeyResolution(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           map[string]string
+		ref            string
+		searchOrder    []string
+		expectedName   string
+		expectedScript string
+	}{
+		{
+			name:           "default script.lua key",
+			data:           map[string]string{"script.lua": "default", "main.lua": "main"},
+			ref:            "default/cm",
+			expectedName:   "default/cm",
+			expectedScript: "default",
+		},
+		{
+			name:           "falls back to main.lua",
+			data:           map[string]string{"main.lua": "main", "init.lua": "init"},
+			ref:            "default/cm",
+			expectedName:   "default/cm#main.lua",
+			expectedScript: "main",
+		},
+		{
+			name:           "falls back to init.lua",
+			data:           map[string]string{"init.lua": "init", "README.md": "docs"},
+			ref:            "default/cm",
+			expectedName:   "default/cm#init.lua",
+			expectedScript: "init",
+		},
+		{
+			name:           "single lua key regardless of name",
+			data:           map[string]string{"policy.lua": "policy", "config.yaml": "a: b"},
+			ref:            "default/cm",
+			expectedName:   "default/cm#policy.lua",
+			expectedScript: "policy",
+		},
+		{
+			name:           "explicit key",
+			data:           map[string]string{"script.lua": "default", "other.lua": "other"},
+			ref:            "default/cm#other.lua",
+			expectedName:   "default/cm#other.lua",
+			expectedScript: "other",
+		},
+		{
+			name:           "custom search order",
+			data:           map[string]string{"script.lua": "default", "policy.lua": "policy"},
+			ref:            "default/cm",
+			searchOrder:    []string{"policy.lua"},
+			expectedName:   "default/cm#policy.lua",
+			expectedScript: "policy",
+		},
+		{
+			name: "ambiguous multiple lua keys",
+			data: map[string]string{"a.lua": "a", "b.lua": "b"},
+			ref:  "default/cm",
+		},
+		{
+			name: "missing explicit key",
+			data: map[string]string{"script.lua": "default"},
+			ref:  "default/cm#missing.lua",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "cm",
+						Namespace: "default",
+					},
+					Data: tt.data,
+				},
+			)
+
+			logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+			loader := NewScriptLoaderWithOptions(clientset, logger, Options{KeySearchOrder: tt.searchOrder})
+
+			scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+				AnnotationScripts: tt.ref,
+			})
+			if err != nil {
+				t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+			}
+
+			if tt.expectedName == "" {
+				if len(scripts) != 0 {
+					t.Errorf("Expected no script to be resolved, got %v", scripts)
+				}
+				return
+			}
+
+			if len(scripts) != 1 {
+				t.Fatalf("Expected 1 script, got %d", len(scripts))
+			}
+
+			if scripts[tt.expectedName] != tt.expectedScript {
+				t.Errorf("Expected %s to hold %q, got %v", tt.expectedName, tt.expectedScript, scripts)
+			}
+		})
+	}
+}
+
+func TestLoadScriptsFromAnnotations_KindKeys(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "default"},
+			Data: map[string]string{
+				"script.lua":     "generic",
+				"pod.lua":        "pod",
+				"deployment.lua": "deployment",
+			},
+		},
+	)
+	logger := log.New(io.Discard, "", 0)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{KindKeys: true, CacheTTL: time.Minute})
+	annotations := map[string]string{AnnotationScripts: "default/shared"}
+
+	// A Pod picks pod.lua
+	scripts, err := loader.LoadScriptsFromAnnotations(WithKind(context.Background(), "Pod"), annotations)
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+	if len(scripts) != 1 || scripts["default/shared#pod.lua"] != "pod" {
+		t.Errorf("Expected the Pod to get pod.lua, got %v", scripts)
+	}
+
+	// A Service has no key of its own and falls back to script.lua, despite the cached Pod entry
+	scripts, err = loader.LoadScriptsFromAnnotations(WithKind(context.Background(), "Service"), annotations)
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+	if len(scripts) != 1 || scripts["default/shared"] != "generic" {
+		t.Errorf("Expected the Service to fall back to script.lua, got %v", scripts)
+	}
+
+	// Explicit keys win over the kind
+	scripts, err = loader.LoadScriptsFromAnnotations(WithKind(context.Background(), "Pod"), map[string]string{AnnotationScripts: "default/shared#deployment.lua"})
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+	if len(scripts) != 1 || scripts["default/shared#deployment.lua"] != "deployment" {
+		t.Errorf("Expected the explicit key to be loaded, got %v", scripts)
+	}
+
+	// Both kinds are cached apart
+	var kinds []string
+	for _, cached := range loader.CachedScripts() {
+		if cached.Ref == "default/shared" {
+			kinds = append(kinds, cached.Kind+"="+cached.Key)
+		}
+	}
+	if !reflect.DeepEqual(kinds, []string{"pod=pod.lua", "service=script.lua"}) {
+		t.Errorf("Expected a cache entry per kind, got %v", kinds)
+	}
+
+	// Without the option, the kind is ignored
+	loader = NewScriptLoaderWithOptions(clientset, logger, Options{})
+	scripts, err = loader.LoadScriptsFromAnnotations(WithKind(context.Background(), "Pod"), annotations)
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+	if len(scripts) != 1 || scripts["default/shared"] != "generic" {
+		t.Errorf("Expected script.lua without kind keys, got %v", scripts)
+	}
+}
+
 func TestLoadScriptsFromAnnotations_EmptyScript(t *testing.T) {
 	// ConfigMap with empty script
 	clientset := fake.NewSimpleClientset(
@@ -234,6 +627,130 @@ func TestLoadScriptsFromAnnotations_MultipleScriptsWithSpaces(t *testing.T) {
 	}
 }
 
+func TestLoadScriptsFromAnnotations_CacheTTL(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "cached",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `print("cached")`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{CacheTTL: time.Minute})
+	now := time.Now()
+	loader.now = func() time.Time { return now }
+
+	annotations := map[string]string{
+		AnnotationScripts: "default/cached",
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations); err != nil {
+			t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+		}
+	}
+
+	if got := len(clientset.Actions()); got != 1 {
+		t.Errorf("Expected 1 ConfigMap fetch within the TTL, got %d", got)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations); err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	if got := len(clientset.Actions()); got != 2 {
+		t.Errorf("Expected the ConfigMap to be fetched again after the TTL, got %d fetches", got)
+	}
+}
+
+func TestLoadScriptsFromAnnotations_StaleFallback(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "stale",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `print("stale")`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{MaxStaleness: 5 * time.Minute})
+	now := time.Now()
+	loader.now = func() time.Time { return now }
+
+	annotations := map[string]string{
+		AnnotationScripts: "default/stale",
+	}
+
+	// Prime the cache
+	if _, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations); err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	// The API server becomes unreachable
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("apiserver unavailable")
+	})
+
+	now = now.Add(4 * time.Minute)
+	scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations)
+	if err != nil {
+		t.Fatalf("Expected stale script to be served, got error: %v", err)
+	}
+
+	if scripts["default/stale"] != `print("stale")` {
+		t.Errorf("Expected stale script content, got %q", scripts["default/stale"])
+	}
+
+	// Past max staleness we fall back to failing
+	now = now.Add(2 * time.Minute)
+	if _, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations); err == nil {
+		t.Error("Expected error once the stale copy exceeds max staleness, got nil")
+	}
+}
+
+func TestLoadScriptsFromAnnotations_StaleFallbackIgnoresPermanentErrors(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "forbidden",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `print("forbidden")`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{MaxStaleness: time.Hour})
+
+	annotations := map[string]string{
+		AnnotationScripts: "default/forbidden",
+	}
+
+	if _, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations); err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "forbidden", nil)
+	})
+
+	if _, err := loader.LoadScriptsFromAnnotations(context.Background(), annotations); err == nil {
+		t.Error("Expected forbidden error not to be masked by the stale cache")
+	}
+}
+
 func TestParseAnnotation(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -270,6 +787,16 @@ func TestParseAnnotation(t *testing.T) {
 			annotation: "invalid",
 			expected:   0,
 		},
+		{
+			name:       "explicit key",
+			annotation: "default/script1#main.lua",
+			expected:   1,
+		},
+		{
+			name:       "empty explicit key",
+			annotation: "default/script1#",
+			expected:   0,
+		},
 		{
 			name:       "mixed valid and invalid",
 			annotation: "default/script1,invalid,kube-system/script2",
@@ -302,6 +829,67 @@ func TestParseAnnotation_Values(t *testing.T) {
 	if result[1].Namespace != "kube-system" || result[1].Name != "script2" {
 		t.Errorf("Expected kube-system/script2, got %s/%s", result[1].Namespace, result[1].Name)
 	}
+
+	result = ParseAnnotation("default/script1#policy.lua")
+	if len(result) != 1 || result[0].Name != "script1" || result[0].Key != "policy.lua" {
+		t.Errorf("Expected default/script1 with key policy.lua, got %+v", result)
+	}
+}
+
+func TestParseAnnotationDuplicates(t *testing.T) {
+	refs, duplicates := ParseAnnotationDuplicates("default/b, default/a,default/b,default/a#main.lua,default/a")
+
+	var names []string
+	for _, ref := range refs {
+		names = append(names, ref.String())
+	}
+	if strings.Join(names, ",") != "default/b,default/a,default/a#main.lua" {
+		t.Errorf("Expected first occurrences in order, got %v", names)
+	}
+	if len(duplicates) != 2 || duplicates[0].String() != "default/b" || duplicates[1].String() != "default/a" {
+		t.Errorf("Expected default/b and default/a reported as duplicates, got %v", duplicates)
+	}
+}
+
+func TestLoadScriptsFromAnnotations_Duplicates(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("a")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("b")`},
+		},
+	)
+	annotations := map[string]string{
+		AnnotationScripts:       "default/a,default/a,default/b",
+		AnnotationScriptsCreate: "default/b",
+	}
+
+	var logs bytes.Buffer
+	loader := NewScriptLoader(clientset, log.New(&logs, "", 0))
+	scripts, err := loader.LoadScriptsForOperation(context.Background(), annotations, "CREATE")
+	if err != nil {
+		t.Fatalf("LoadScriptsForOperation failed: %v", err)
+	}
+	if len(scripts) != 2 {
+		t.Errorf("Expected each script loaded once, got %v", scripts)
+	}
+	for _, expected := range []string{
+		"duplicate reference to script default/a in " + AnnotationScripts,
+		"duplicate reference to script default/b in " + AnnotationScriptsCreate + ", already referenced in " + AnnotationScripts,
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("Expected a warning containing %q, got:\n%s", expected, logs.String())
+		}
+	}
+
+	strict := NewScriptLoaderWithOptions(clientset, log.New(io.Discard, "", 0), Options{RejectDuplicates: true})
+	if _, err := strict.LoadScriptsForOperation(context.Background(), annotations, "CREATE"); err == nil ||
+		!strings.Contains(err.Error(), "script default/a is referenced more than once") {
+		t.Errorf("Expected the duplicate to be rejected, got %v", err)
+	}
 }
 
 func TestNewScriptLoader(t *testing.T) {
@@ -360,3 +948,35 @@ func BenchmarkLoadScriptsFromAnnotations(b *testing.B) {
 		_, _ = loader.LoadScriptsFromAnnotations(context.Background(), annotations)
 	}
 }
+
+func TestLoadScripts_ContentChangedMetric(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "changing", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `print("v1")`},
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+	loader.now = func() time.Time { return time.Unix(1700000000, 0) }
+	refs := []ScriptRef{{Namespace: "default", Name: "changing"}}
+	gauge := metrics.ScriptContentChanged.WithLabelValues("default/changing")
+
+	for i := 0; i < 2; i++ {
+		if _, err := loader.LoadScripts(context.Background(), refs); err != nil {
+			t.Fatalf("LoadScripts failed: %v", err)
+		}
+	}
+	if value := testutil.ToFloat64(gauge); value != 0 {
+		t.Errorf("Expected no change recorded for unchanged content, got %v", value)
+	}
+
+	cm, _ := clientset.CoreV1().ConfigMaps("default").Get(context.Background(), "changing", metav1.GetOptions{})
+	cm.Data["script.lua"] = `print("v2")`
+	_, _ = clientset.CoreV1().ConfigMaps("default").Update(context.Background(), cm, metav1.UpdateOptions{})
+
+	if _, err := loader.LoadScripts(context.Background(), refs); err != nil {
+		t.Fatalf("LoadScripts failed: %v", err)
+	}
+	if value := testutil.ToFloat64(gauge); value != 1700000000 {
+		t.Errorf("Expected the change time to be recorded, got %v", value)
+	}
+}
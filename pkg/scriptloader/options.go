@@ -0,0 +1,52 @@
+package scriptloader
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// AnnotationTimeout: ConfigMap annotation setting the maximum run time of its scripts, as a
+	// duration such as "500ms", in place of the script timeout of the server
+	AnnotationTimeout = AnnotationPrefix + "/timeout"
+	// AnnotationFailurePolicy: ConfigMap annotation telling what a failure of its scripts does to the
+	// request, FailurePolicyIgnore or FailurePolicyFail
+	AnnotationFailurePolicy = AnnotationPrefix + "/failure-policy"
+)
+
+const (
+	// FailurePolicyIgnore: a failing script is skipped, the request goes on with the other scripts
+	FailurePolicyIgnore = "ignore"
+	// FailurePolicyFail: a failing script denies the request
+	FailurePolicyFail = "fail"
+)
+
+// parseScriptOptions: returns the timeout and failure policy of the scripts of a ConfigMap, zero and
+// FailurePolicyIgnore when unset
+// Invalid values are ignored with a warning
+func (l *ScriptLoader) parseScriptOptions(namespace, name string, annotations map[string]string) (time.Duration, string) {
+	configMap := fmt.Sprintf("%s/%s", namespace, name)
+
+	var timeout time.Duration
+	if value, ok := annotations[AnnotationTimeout]; ok {
+		parsed, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || parsed <= 0 {
+			l.logger.Printf("WARNING: Invalid %s value %q on ConfigMap %s (expected a positive duration), ignoring it", AnnotationTimeout, value, configMap)
+		} else {
+			timeout = parsed
+		}
+	}
+
+	policy := FailurePolicyIgnore
+	if value, ok := annotations[AnnotationFailurePolicy]; ok {
+		switch strings.TrimSpace(value) {
+		case FailurePolicyIgnore, FailurePolicyFail:
+			policy = strings.TrimSpace(value)
+		default:
+			l.logger.Printf("WARNING: Invalid %s value %q on ConfigMap %s (expected %s or %s), ignoring it",
+				AnnotationFailurePolicy, value, configMap, FailurePolicyIgnore, FailurePolicyFail)
+		}
+	}
+	return timeout, policy
+}
@@ -0,0 +1,88 @@
+package scriptloader
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseScriptOptions(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(fake.NewSimpleClientset(), logger)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		timeout     time.Duration
+		policy      string
+	}{
+		{name: "unset", policy: FailurePolicyIgnore},
+		{name: "set", annotations: map[string]string{AnnotationTimeout: "250ms", AnnotationFailurePolicy: "fail"}, timeout: 250 * time.Millisecond, policy: FailurePolicyFail},
+		{name: "invalid", annotations: map[string]string{AnnotationTimeout: "-1s", AnnotationFailurePolicy: "Sometimes"}, policy: FailurePolicyIgnore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout, policy := loader.parseScriptOptions("default", "script", tt.annotations)
+			if timeout != tt.timeout || policy != tt.policy {
+				t.Errorf("Expected %s and %q, got %s and %q", tt.timeout, tt.policy, timeout, policy)
+			}
+		})
+	}
+}
+
+func TestCachedScripts_Options(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "chain",
+			Namespace: "default",
+			Annotations: map[string]string{
+				AnnotationTimeout:       "2s",
+				AnnotationFailurePolicy: FailurePolicyFail,
+			},
+		},
+		Data: map[string]string{"10-labels.lua": "-- labels", "check.lua": "-- check"},
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{
+		CacheTTL: time.Minute,
+		Sources: map[string]ScriptSource{
+			"builtin": StaticSource{Scheme: "builtin", Scripts: map[string]string{"podspec": "-- podspec"}},
+		},
+	})
+
+	set, err := loader.LoadScriptSetForOperation(context.Background(), map[string]string{
+		AnnotationScripts: "default/chain,builtin:podspec",
+	}, "CREATE")
+	if err != nil {
+		t.Fatalf("LoadScriptSetForOperation failed: %v", err)
+	}
+	if set.Timeouts["default/chain#labels.lua"] != 2*time.Second || set.FailurePolicy("default/chain#check.lua") != FailurePolicyFail {
+		t.Errorf("Expected the options of the ConfigMap in the set, got %v and %v", set.Timeouts, set.FailurePolicies)
+	}
+	if set.FailurePolicy("builtin:podspec") != FailurePolicyIgnore {
+		t.Errorf("Expected the static script to be ignored on failure, got %q", set.FailurePolicy("builtin:podspec"))
+	}
+
+	cached := loader.CachedScripts()
+	if len(cached) != 3 {
+		t.Fatalf("Expected 3 cached scripts, got %+v", cached)
+	}
+
+	// Sorted by reference: the static script first, resolved on every load
+	static, check, labels := cached[0], cached[1], cached[2]
+	if static.Source != "builtin" || static.ExpiresAt != nil || static.Priority != nil || static.FailurePolicy != FailurePolicyIgnore {
+		t.Errorf("Unexpected static script: %+v", static)
+	}
+	if check.Source != SourceConfigMap || check.Priority != nil || check.Timeout != "2s" || check.FailurePolicy != FailurePolicyFail || check.ExpiresAt == nil {
+		t.Errorf("Unexpected check script: %+v", check)
+	}
+	if labels.Priority == nil || *labels.Priority != 10 || labels.Timeout != "2s" || labels.FailurePolicy != FailurePolicyFail {
+		t.Errorf("Unexpected labels script: %+v", labels)
+	}
+}
@@ -0,0 +1,201 @@
+package scriptloader
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AnnotationAfter: ConfigMap annotation listing the ConfigMaps whose scripts must run before its own
+// Format: "namespace/configmap-name,namespace/configmap-name2"
+const AnnotationAfter = AnnotationPrefix + "/after"
+
+// ErrDependencyCycle: returned when the after annotations of the scripts of a chain form a cycle
+var ErrDependencyCycle = errors.New("dependency cycle between scripts")
+
+// recordAfter: remembers the ConfigMaps a ConfigMap must run after, as last fetched
+func (l *ScriptLoader) recordAfter(namespace, name string, annotations map[string]string) {
+	configMap := fmt.Sprintf("%s/%s", namespace, name)
+
+	var after []string
+	for _, dependency := range strings.Split(annotations[AnnotationAfter], ",") {
+		dependency = strings.TrimSpace(dependency)
+		if dependency == "" {
+			continue
+		}
+		ref, ok := parseRef(dependency)
+		if !ok || ref.Scheme != "" || ref.Key != "" {
+			l.logger.Printf("WARNING: Invalid %s entry %q on ConfigMap %s (expected namespace/name)", AnnotationAfter, dependency, configMap)
+			continue
+		}
+		after = append(after, ref.String())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(after) == 0 {
+		delete(l.after, configMap)
+		return
+	}
+	l.after[configMap] = after
+}
+
+// OrderScripts: returns the names of scripts in execution order
+// Scripts run in alphabetical order, the scripts of a ConfigMap with numbered keys in the order of
+// their numbers, except that the scripts of a ConfigMap run after the scripts
+// of every ConfigMap listed in its AnnotationAfter annotation. ConfigMaps listed there but absent
+// from the chain are ignored. A cycle is reported as ErrDependencyCycle
+func (l *ScriptLoader) OrderScripts(scripts map[string]string) ([]string, error) {
+	names := make([]string, 0, len(scripts))
+	for name := range scripts {
+		names = append(names, name)
+	}
+
+	l.mu.RLock()
+	after := make(map[string][]string, len(names))
+	ranks := make(map[string]int)
+	for _, name := range names {
+		if dependencies, ok := l.after[ConfigMapOf(name)]; ok {
+			after[ConfigMapOf(name)] = dependencies
+		}
+		if rank, ok := l.ranks[ConfigMapOf(name)][name]; ok {
+			ranks[name] = rank
+		}
+	}
+	l.mu.RUnlock()
+
+	return orderScripts(names, after, ranks)
+}
+
+// ConfigMapOf: returns the namespace/name of the ConfigMap a script name was loaded from
+func ConfigMapOf(scriptName string) string {
+	configMap, _, _ := strings.Cut(scriptName, "#")
+	return configMap
+}
+
+// orderScripts: topologically sorts names given, for each ConfigMap, the ConfigMaps it runs after,
+// and the rank of the scripts loaded from numbered keys among those of their ConfigMap
+// Among the scripts ready to run, the first one (see sortScripts) always goes next
+func orderScripts(names []string, after map[string][]string, ranks map[string]int) ([]string, error) {
+	sortScripts(names, ranks)
+
+	byConfigMap := make(map[string][]string)
+	for _, name := range names {
+		byConfigMap[ConfigMapOf(name)] = append(byConfigMap[ConfigMapOf(name)], name)
+	}
+
+	// Edges go from a script to the scripts that must wait for it
+	pending := make(map[string]int, len(names))
+	next := make(map[string][]string)
+	for _, name := range names {
+		for _, dependency := range after[ConfigMapOf(name)] {
+			for _, before := range byConfigMap[dependency] {
+				if before == name {
+					continue
+				}
+				next[before] = append(next[before], name)
+				pending[name]++
+			}
+		}
+	}
+
+	var ready []string
+	for _, name := range names {
+		if pending[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	order := make([]string, 0, len(names))
+	for len(ready) > 0 {
+		sortScripts(ready, ranks)
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+
+		for _, waiting := range next[name] {
+			pending[waiting]--
+			if pending[waiting] == 0 {
+				ready = append(ready, waiting)
+			}
+		}
+	}
+
+	if len(order) < len(names) {
+		return nil, fmt.Errorf("%w: %s", ErrDependencyCycle, findCycle(names, pending, after, byConfigMap))
+	}
+
+	return order, nil
+}
+
+// sortScripts: sorts script names by ConfigMap, then by rank within a ConfigMap, ranked scripts
+// first, then alphabetically
+func sortScripts(names []string, ranks map[string]int) {
+	sort.Slice(names, func(i, j int) bool {
+		configMapI, configMapJ := ConfigMapOf(names[i]), ConfigMapOf(names[j])
+		if configMapI != configMapJ {
+			return configMapI < configMapJ
+		}
+
+		rankI, rankedI := ranks[names[i]]
+		rankJ, rankedJ := ranks[names[j]]
+		if rankedI != rankedJ {
+			return rankedI
+		}
+		if rankedI && rankI != rankJ {
+			return rankI < rankJ
+		}
+		return names[i] < names[j]
+	})
+}
+
+// findCycle: renders one cycle among the ConfigMaps of the scripts left pending, as "a -> b -> a"
+func findCycle(names []string, pending map[string]int, after map[string][]string, byConfigMap map[string][]string) string {
+	var start string
+	for _, name := range names {
+		if pending[name] > 0 {
+			start = ConfigMapOf(name)
+			break
+		}
+	}
+
+	// Follow "runs after" edges between stuck ConfigMaps until one repeats
+	path := []string{start}
+	seen := map[string]int{start: 0}
+	current := start
+	for {
+		var following string
+		for _, dependency := range after[current] {
+			if dependency == current {
+				continue
+			}
+			for _, name := range byConfigMap[dependency] {
+				if pending[name] > 0 {
+					following = dependency
+					break
+				}
+			}
+			if following != "" {
+				break
+			}
+		}
+		if following == "" {
+			return strings.Join(path, " -> ")
+		}
+
+		if index, ok := seen[following]; ok {
+			cycle := append(path[index:], following)
+			// Report edges in execution order: each ConfigMap runs after the next one
+			for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+				cycle[i], cycle[j] = cycle[j], cycle[i]
+			}
+			return strings.Join(cycle, " -> ")
+		}
+
+		seen[following] = len(path)
+		path = append(path, following)
+		current = following
+	}
+}
@@ -0,0 +1,111 @@
+package scriptloader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// scriptConfigMap: ConfigMap holding a script, running after the given ConfigMaps
+func scriptConfigMap(namespace, name, after string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       map[string]string{DefaultScriptKey: "-- " + name},
+	}
+	if after != "" {
+		cm.Annotations = map[string]string{AnnotationAfter: after}
+	}
+	return cm
+}
+
+func TestOrderScripts_DAG(t *testing.T) {
+	// inject-sidecar needs the defaults and the labels, labels needs the defaults
+	clientset := fake.NewSimpleClientset(
+		scriptConfigMap("platform", "apply-defaults", ""),
+		scriptConfigMap("platform", "inject-sidecar", "platform/labels, platform/apply-defaults"),
+		scriptConfigMap("platform", "labels", "platform/apply-defaults,platform/not-in-chain"),
+		scriptConfigMap("team", "audit", ""),
+		scriptConfigMap("team", "zz-first", ""),
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+
+	scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScripts: "platform/inject-sidecar,platform/labels,team/zz-first,platform/apply-defaults,team/audit",
+	})
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	order, err := loader.OrderScripts(scripts)
+	if err != nil {
+		t.Fatalf("OrderScripts failed: %v", err)
+	}
+
+	expected := []string{
+		"platform/apply-defaults",
+		"platform/labels",
+		"platform/inject-sidecar",
+		"team/audit",
+		"team/zz-first",
+	}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected order %v, got %v", expected, order)
+	}
+}
+
+func TestOrderScripts_KeysOfTheSameConfigMap(t *testing.T) {
+	order, err := orderScripts(
+		[]string{"b/second#main.lua", "b/second#extra.lua", "a/first"},
+		map[string][]string{"a/first": {"b/second"}},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("orderScripts failed: %v", err)
+	}
+
+	expected := []string{"b/second#extra.lua", "b/second#main.lua", "a/first"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected every script of a ConfigMap to run before its dependents, got %v", order)
+	}
+}
+
+func TestOrderScripts_Cycle(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		scriptConfigMap("default", "a", "default/c"),
+		scriptConfigMap("default", "b", "default/a"),
+		scriptConfigMap("default", "c", "default/b"),
+		scriptConfigMap("default", "d", "default/a"),
+		scriptConfigMap("default", "independent", ""),
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+
+	scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScripts: "default/a,default/b,default/c,default/d,default/independent",
+	})
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	_, err = loader.OrderScripts(scripts)
+	if !errors.Is(err, ErrDependencyCycle) {
+		t.Fatalf("Expected a dependency cycle error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "default/a -> default/b -> default/c -> default/a") {
+		t.Errorf("Expected the error to spell out the cycle, got %v", err)
+	}
+
+	// A ConfigMap running after itself is not a cycle
+	if _, err := orderScripts([]string{"default/self"}, map[string][]string{"default/self": {"default/self"}}, nil); err != nil {
+		t.Errorf("Expected self references to be ignored, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package scriptloader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// AnnotationParams: object annotation naming the ConfigMap whose keys are exposed to the scripts
+// as the params global. Format: "namespace/configmap"
+const AnnotationParams = AnnotationPrefix + "/params"
+
+// ParseParamsRef: parses a "namespace/configmap" params reference, keys cannot be selected
+func ParseParamsRef(value string) (ScriptRef, bool) {
+	ref, ok := parseRef(strings.TrimSpace(value))
+	if !ok || ref.Scheme != "" || ref.Key != "" || ref.Namespace == "" || ref.Name == "" {
+		return ScriptRef{}, false
+	}
+	return ref, true
+}
+
+// DecodeParams: decodes every key of a params ConfigMap, YAML and JSON values into the value
+// they hold, anything else, including empty values and values only holding a comment, as a string
+func DecodeParams(data map[string]string) map[string]interface{} {
+	params := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		var decoded interface{}
+		if err := yaml.Unmarshal([]byte(value), &decoded); err != nil || decoded == nil {
+			params[key] = value
+			continue
+		}
+		params[key] = decoded
+	}
+	return params
+}
+
+// LoadParams: returns the decoded keys of a params ConfigMap, going through the cache like scripts
+// In best-effort mode, a ConfigMap that cannot be loaded yields nil params instead of an error
+func (l *ScriptLoader) LoadParams(ctx context.Context, ref ScriptRef) (map[string]interface{}, error) {
+	params, err := l.loadParams(ctx, ref)
+	if err != nil {
+		if !l.options.BestEffort {
+			return nil, err
+		}
+		l.logger.Printf("WARNING: Skipping params %s in best-effort mode: %v", ref, err)
+		return nil, nil
+	}
+	return params, nil
+}
+
+// loadParams: fetches and decodes a params ConfigMap, serving it from the cache while fresh,
+// or stale for up to MaxStaleness when the API server is unreachable
+func (l *ScriptLoader) loadParams(ctx context.Context, ref ScriptRef) (map[string]interface{}, error) {
+	cacheKey := ref.String()
+
+	l.mu.RLock()
+	entry, cached := l.params[cacheKey]
+	l.mu.RUnlock()
+
+	if cached && l.options.CacheTTL > 0 && l.now().Sub(entry.loadedAt) < l.options.CacheTTL {
+		l.logger.Printf("Using cached params %s (loaded %s ago)", cacheKey, l.now().Sub(entry.loadedAt))
+		return entry.params, nil
+	}
+
+	cm, err := l.clientset.CoreV1().ConfigMaps(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		if cached && l.options.MaxStaleness > 0 && isTransientError(err) {
+			age := l.now().Sub(entry.loadedAt)
+			if age <= l.options.MaxStaleness {
+				l.logger.Printf("WARNING: Failed to fetch ConfigMap %s (%v), serving stale params loaded %s ago", cacheKey, err, age)
+				return entry.params, nil
+			}
+			l.logger.Printf("ERROR: Stale copy of params %s is %s old, exceeding max staleness of %s",
+				cacheKey, age, l.options.MaxStaleness)
+		}
+
+		if apierrors.IsNotFound(err) {
+			l.mu.Lock()
+			delete(l.params, cacheKey)
+			l.mu.Unlock()
+		}
+
+		l.logger.Printf("ERROR: Failed to fetch params ConfigMap %s: %v", cacheKey, err)
+		return nil, fmt.Errorf("failed to fetch params ConfigMap %s: %w", cacheKey, err)
+	}
+
+	params := DecodeParams(cm.Data)
+	l.logger.Printf("Loaded %d params from ConfigMap %s", len(params), cacheKey)
+
+	if l.options.CacheTTL > 0 || l.options.MaxStaleness > 0 {
+		l.mu.Lock()
+		l.params[cacheKey] = paramsEntry{params: params, loadedAt: l.now()}
+		l.mu.Unlock()
+	}
+
+	return params, nil
+}
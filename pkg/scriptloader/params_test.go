@@ -0,0 +1,83 @@
+package scriptloader
+
+import (
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDecodeParams(t *testing.T) {
+	params := DecodeParams(map[string]string{
+		"registry": "mirror.example.com:5000",
+		"replicas": "3",
+		"enabled":  "true",
+		"limits":   "cpu: 500m\nmemory: 128Mi\n",
+		"zones":    `["a", "b"]`,
+		"color":    "#ff0000",
+		"empty":    "",
+		"invalid":  "key: [unterminated",
+	})
+
+	expected := map[string]interface{}{
+		"registry": "mirror.example.com:5000",
+		"replicas": float64(3),
+		"enabled":  true,
+		"limits":   map[string]interface{}{"cpu": "500m", "memory": "128Mi"},
+		"zones":    []interface{}{"a", "b"},
+		"color":    "#ff0000",
+		"empty":    "",
+		"invalid":  "key: [unterminated",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Expected %v, got %v", expected, params)
+	}
+}
+
+func TestParseParamsRef(t *testing.T) {
+	if ref, ok := ParseParamsRef(" default/params "); !ok || ref.Namespace != "default" || ref.Name != "params" {
+		t.Errorf("Expected default/params to parse, got %v %v", ref, ok)
+	}
+	for _, value := range []string{"params", "default/params#key", "/params", "a/b/c"} {
+		if _, ok := ParseParamsRef(value); ok {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestLoadParams(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "params", Namespace: "default"},
+		Data:       map[string]string{"registry": "mirror.example.com"},
+	})
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{CacheTTL: time.Minute})
+	ref := ScriptRef{Namespace: "default", Name: "params"}
+
+	params, err := loader.LoadParams(context.Background(), ref)
+	if err != nil || params["registry"] != "mirror.example.com" {
+		t.Fatalf("Expected the registry param, got %v %v", params, err)
+	}
+
+	// Served from the cache until the ConfigMap is invalidated
+	_ = clientset.CoreV1().ConfigMaps("default").Delete(context.Background(), "params", metav1.DeleteOptions{})
+	if params, err := loader.LoadParams(context.Background(), ref); err != nil || params["registry"] != "mirror.example.com" {
+		t.Errorf("Expected the cached params, got %v %v", params, err)
+	}
+
+	loader.InvalidateConfigMap("default", "params")
+	if _, err := loader.LoadParams(context.Background(), ref); err == nil {
+		t.Error("Expected an error once the deleted ConfigMap is invalidated")
+	}
+
+	bestEffort := NewScriptLoaderWithOptions(clientset, logger, Options{BestEffort: true})
+	if params, err := bestEffort.LoadParams(context.Background(), ref); err != nil || params != nil {
+		t.Errorf("Expected no params and no error in best-effort mode, got %v %v", params, err)
+	}
+}
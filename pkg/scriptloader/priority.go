@@ -0,0 +1,108 @@
+package scriptloader
+
+import (
+	"fmt"
+	"sort"
+)
+
+// numberedKey: splits a ConfigMap key of the form "<number>-<name>", e.g. "10-labels.lua", into its
+// number and name. Keys without a numeric prefix, or whose name is not a script key, are not numbered
+func numberedKey(key string) (int, string, bool) {
+	digits := 0
+	for digits < len(key) && key[digits] >= '0' && key[digits] <= '9' {
+		digits++
+	}
+	if digits == 0 || digits > 9 || digits+1 >= len(key) || key[digits] != '-' {
+		return 0, "", false
+	}
+
+	name := key[digits+1:]
+	if !IsScriptKey(name) {
+		return 0, "", false
+	}
+
+	number := 0
+	for _, digit := range key[:digits] {
+		number = number*10 + int(digit-'0')
+	}
+	return number, name, true
+}
+
+// orderedKeys: returns the script keys of a ConfigMap in execution order when at least one of them is
+// numbered: numbered keys first, by number, then the others alphabetically
+func orderedKeys(data map[string]string) ([]string, bool) {
+	var keys []string
+	numbered := false
+	for key := range data {
+		if !IsScriptKey(key) {
+			continue
+		}
+		keys = append(keys, key)
+		if _, _, ok := numberedKey(key); ok {
+			numbered = true
+		}
+	}
+	if !numbered {
+		return nil, false
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		numberI, _, numberedI := numberedKey(keys[i])
+		numberJ, _, numberedJ := numberedKey(keys[j])
+		if numberedI != numberedJ {
+			return numberedI
+		}
+		if numberedI && numberI != numberJ {
+			return numberI < numberJ
+		}
+		return keys[i] < keys[j]
+	})
+	return keys, true
+}
+
+// keyNames: returns the script name of each of the ordered keys of a ConfigMap, numbered keys being
+// named without their prefix so that renumbering them keeps their name. A key whose name without
+// prefix is already taken keeps its prefix
+func (l *ScriptLoader) keyNames(namespace, name string, keys []string) []string {
+	names := make([]string, len(keys))
+	taken := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if _, _, ok := numberedKey(key); !ok {
+			taken[key] = true
+		}
+	}
+
+	for i, key := range keys {
+		if _, stripped, ok := numberedKey(key); ok {
+			if !taken[stripped] {
+				taken[stripped] = true
+				key = stripped
+			} else {
+				l.logger.Printf("WARNING: ConfigMap %s/%s has several keys named '%s' once their prefix is stripped, keeping '%s' as is",
+					namespace, name, stripped, key)
+			}
+		}
+		names[i] = ScriptName(namespace, name, key)
+	}
+	return names
+}
+
+// recordRanks: remembers the position of each script among the ordered keys of a ConfigMap, as last
+// fetched, nil names forgetting them
+func (l *ScriptLoader) recordRanks(namespace, name string, names []string) {
+	configMap := fmt.Sprintf("%s/%s", namespace, name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(names) == 0 {
+		delete(l.ranks, configMap)
+		return
+	}
+
+	ranks := make(map[string]int, len(names))
+	for rank, scriptName := range names {
+		ranks[scriptName] = rank
+	}
+	l.ranks[configMap] = ranks
+}
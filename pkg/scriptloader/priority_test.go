@@ -0,0 +1,104 @@
+package scriptloader
+
+import (
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNumberedKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		number   int
+		name     string
+		numbered bool
+	}{
+		{key: "10-labels.lua", number: 10, name: "labels.lua", numbered: true},
+		{key: "007-bond.lua.gz", number: 7, name: "bond.lua.gz", numbered: true},
+		{key: "labels.lua"},
+		{key: "10-labels.yaml"},
+		{key: "10-"},
+		{key: "-labels.lua"},
+		{key: "10labels.lua"},
+		{key: "v1-labels.lua"},
+	}
+
+	for _, tt := range tests {
+		number, name, numbered := numberedKey(tt.key)
+		if number != tt.number || name != tt.name || numbered != tt.numbered {
+			t.Errorf("numberedKey(%q) = %d, %q, %v, expected %d, %q, %v",
+				tt.key, number, name, numbered, tt.number, tt.name, tt.numbered)
+		}
+	}
+}
+
+func TestLoadScripts_NumberedKeys(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "policies", Namespace: "default"},
+			Data: map[string]string{
+				"20-annotate.lua": "-- annotate",
+				"3-defaults.lua":  "-- defaults",
+				"10-labels.lua":   "-- labels",
+				"audit.lua":       "-- audit",
+				"10-audit.lua":    "-- numbered audit",
+				"README.md":       "docs",
+			},
+		},
+		scriptConfigMap("default", "other", ""),
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+
+	scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScripts: "default/policies,default/other",
+	})
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"default/policies#defaults.lua": "-- defaults",
+		"default/policies#10-audit.lua": "-- numbered audit",
+		"default/policies#labels.lua":   "-- labels",
+		"default/policies#annotate.lua": "-- annotate",
+		"default/policies#audit.lua":    "-- audit",
+		"default/other":                 "-- other",
+	}
+	if !reflect.DeepEqual(scripts, expected) {
+		t.Fatalf("Expected every script key to load, prefixes stripped, got %v", scripts)
+	}
+
+	order, err := loader.OrderScripts(scripts)
+	if err != nil {
+		t.Fatalf("OrderScripts failed: %v", err)
+	}
+	expectedOrder := []string{
+		"default/other",
+		"default/policies#defaults.lua",
+		"default/policies#10-audit.lua",
+		"default/policies#labels.lua",
+		"default/policies#annotate.lua",
+		"default/policies#audit.lua",
+	}
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Errorf("Expected numbered keys to run by number, unnumbered ones last, got %v", order)
+	}
+
+	// An explicit key still selects a single script, under its full key
+	scripts, err = loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScripts: "default/policies#10-labels.lua",
+	})
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+	if !reflect.DeepEqual(scripts, map[string]string{"default/policies#10-labels.lua": "-- labels"}) {
+		t.Errorf("Expected the explicit key alone, got %v", scripts)
+	}
+}
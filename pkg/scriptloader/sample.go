@@ -0,0 +1,43 @@
+package scriptloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AnnotationSample: ConfigMap annotation restricting its scripts to a percentage of the admitted
+// objects, e.g. "10" for about one in ten, to roll a new script out gradually
+const AnnotationSample = AnnotationPrefix + "/sample"
+
+// recordSample: remembers the sample percentage of a ConfigMap, as last fetched
+// Values that are not a percentage between 0 and 100 are ignored with a warning
+func (l *ScriptLoader) recordSample(namespace, name string, annotations map[string]string) {
+	configMap := fmt.Sprintf("%s/%s", namespace, name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	value, ok := annotations[AnnotationSample]
+	if !ok {
+		delete(l.samples, configMap)
+		return
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		l.logger.Printf("WARNING: Invalid %s value %q on ConfigMap %s (expected a percentage between 0 and 100), ignoring it", AnnotationSample, value, configMap)
+		delete(l.samples, configMap)
+		return
+	}
+	l.samples[configMap] = percent
+}
+
+// Sample: returns the percentage of objects the script runs for, and whether it is sampled at all
+func (l *ScriptLoader) Sample(scriptName string) (float64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	percent, ok := l.samples[ConfigMapOf(scriptName)]
+	return percent, ok
+}
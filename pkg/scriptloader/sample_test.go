@@ -0,0 +1,49 @@
+package scriptloader
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSample(t *testing.T) {
+	sampled := func(name, sample string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default",
+				Annotations: map[string]string{AnnotationSample: sample}},
+			Data: map[string]string{DefaultScriptKey: "-- " + name},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		sampled("canary", "10"),
+		sampled("percent", "12.5%"),
+		sampled("invalid", "150"),
+		scriptConfigMap("default", "everyone", ""),
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+
+	if _, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScripts: "default/canary,default/percent,default/invalid,default/everyone",
+	}); err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	if percent, ok := loader.Sample("default/canary"); !ok || percent != 10 {
+		t.Errorf("Expected a 10%% sample, got %v %v", percent, ok)
+	}
+	if percent, ok := loader.Sample("default/percent"); !ok || percent != 12.5 {
+		t.Errorf("Expected a 12.5%% sample, got %v %v", percent, ok)
+	}
+	if _, ok := loader.Sample("default/invalid"); ok {
+		t.Error("Expected an out of range sample to be ignored")
+	}
+	if _, ok := loader.Sample("default/everyone"); ok {
+		t.Error("Expected no sample without the annotation")
+	}
+}
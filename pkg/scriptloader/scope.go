@@ -0,0 +1,124 @@
+package scriptloader
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AnnotationScope: ConfigMap annotation listing the parts of objects its scripts may change
+// Format: comma-separated JSON pointers, e.g. "/metadata/labels,/metadata/annotations"
+// Changes made outside them are dropped
+const AnnotationScope = AnnotationPrefix + "/scope"
+
+// parseScope: returns the scope of a ConfigMap, nil when its scripts may change anything
+// An annotation without any valid pointer yields an empty scope: the scripts may not change anything
+func (l *ScriptLoader) parseScope(namespace, name string, annotations map[string]string) []string {
+	value, ok := annotations[AnnotationScope]
+	if !ok {
+		return nil
+	}
+
+	scope := []string{}
+	for _, pointer := range strings.Split(value, ",") {
+		pointer = strings.TrimSpace(pointer)
+		if pointer == "" {
+			continue
+		}
+		if !strings.HasPrefix(pointer, "/") {
+			l.logger.Printf("WARNING: Invalid %s entry %q on ConfigMap %s (expected a JSON pointer)",
+				AnnotationScope, pointer, fmt.Sprintf("%s/%s", namespace, name))
+			continue
+		}
+		scope = append(scope, pointer)
+	}
+	return scope
+}
+
+// ScriptSet: scripts loaded for a request, with the scope of each
+// Scopes are loaded along with the content, flushing the loader cache in between cannot lose them
+type ScriptSet struct {
+	// Scripts: script content by name
+	Scripts map[string]string
+	// Scopes: JSON pointers each script of Scripts may change, nil for scripts that may change anything
+	Scopes map[string][]string
+	// Versions: version of the content of each script of Scripts, as loaded
+	Versions map[string]ScriptVersion
+	// Timeouts: maximum run time of the scripts of Scripts that have their own, see AnnotationTimeout
+	Timeouts map[string]time.Duration
+	// FailurePolicies: failure policy of each script of Scripts, see AnnotationFailurePolicy
+	FailurePolicies map[string]string
+}
+
+// ScriptVersion: identifies the content a script was loaded with, to tell which version of a
+// script made a decision
+type ScriptVersion struct {
+	// Hash: hex-encoded SHA-256 of the script content
+	Hash string `json:"sha256"`
+	// ResourceVersion: resourceVersion of the ConfigMap the content was read from, empty for
+	// scripts of other sources
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// add: adds a resolved script to the set, replacing the one of the same name
+func (s *ScriptSet) add(script Script) {
+	if s.Scripts == nil {
+		s.Scripts = make(map[string]string)
+		s.Scopes = make(map[string][]string)
+	}
+	if s.Versions == nil {
+		s.Versions = make(map[string]ScriptVersion)
+	}
+	s.Scripts[script.Name] = script.Content
+	s.Scopes[script.Name] = script.Scope
+	s.Versions[script.Name] = ScriptVersion{Hash: contentHash(script.Content), ResourceVersion: script.ResourceVersion}
+	if s.Timeouts == nil {
+		s.Timeouts = make(map[string]time.Duration)
+	}
+	if s.FailurePolicies == nil {
+		s.FailurePolicies = make(map[string]string)
+	}
+	delete(s.Timeouts, script.Name)
+	if script.Timeout > 0 {
+		s.Timeouts[script.Name] = script.Timeout
+	}
+	policy := script.FailurePolicy
+	if policy == "" {
+		policy = FailurePolicyIgnore
+	}
+	s.FailurePolicies[script.Name] = policy
+}
+
+// Merge: adds the scripts of other to the set, replacing those of the same name
+func (s *ScriptSet) Merge(other ScriptSet) {
+	for name, content := range other.Scripts {
+		s.add(Script{
+			Name:            name,
+			Content:         content,
+			Scope:           other.Scopes[name],
+			ResourceVersion: other.Versions[name].ResourceVersion,
+			Timeout:         other.Timeouts[name],
+			FailurePolicy:   other.FailurePolicies[name],
+		})
+	}
+}
+
+// Version: returns the version of the content a script of the set was loaded with
+func (s ScriptSet) Version(scriptName string) ScriptVersion {
+	return s.Versions[scriptName]
+}
+
+// FailurePolicy: returns the failure policy of a script of the set, FailurePolicyIgnore when unknown
+func (s ScriptSet) FailurePolicy(scriptName string) string {
+	if policy, ok := s.FailurePolicies[scriptName]; ok {
+		return policy
+	}
+	return FailurePolicyIgnore
+}
+
+// Scope: returns the JSON pointers a script of the set may change, nil when it may change anything,
+// and whether its scope is known, which it is for every script the set holds
+func (s ScriptSet) Scope(scriptName string) ([]string, bool) {
+	scope, ok := s.Scopes[scriptName]
+	return scope, ok
+}
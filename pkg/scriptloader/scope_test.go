@@ -0,0 +1,80 @@
+package scriptloader
+
+import (
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestScope(t *testing.T) {
+	scoped := func(name, scope string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default",
+				Annotations: map[string]string{AnnotationScope: scope}},
+			Data: map[string]string{DefaultScriptKey: "-- " + name},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		scoped("labels", "/metadata/labels, /metadata/annotations"),
+		scoped("invalid", "metadata.labels"),
+		scriptConfigMap("default", "unscoped", ""),
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(clientset, logger)
+
+	set, err := loader.LoadScriptSetForOperation(context.Background(), map[string]string{
+		AnnotationScripts: "default/labels,default/invalid,default/unscoped",
+	}, "CREATE")
+	if err != nil {
+		t.Fatalf("LoadScriptSetForOperation failed: %v", err)
+	}
+
+	// Scopes come with the loaded scripts, flushing the cache does not lose them
+	loader.Flush()
+
+	if scope, _ := set.Scope("default/labels"); !reflect.DeepEqual(scope, []string{"/metadata/labels", "/metadata/annotations"}) {
+		t.Errorf("Unexpected scope %v", scope)
+	}
+	if scope, _ := set.Scope("default/invalid"); scope == nil || len(scope) != 0 {
+		t.Errorf("Expected an empty scope for an annotation without valid pointers, got %#v", scope)
+	}
+	if scope, known := set.Scope("default/unscoped"); scope != nil || !known {
+		t.Errorf("Expected a known, unrestricted scope, got %v (known: %v)", scope, known)
+	}
+	if _, known := set.Scope("default/absent"); known {
+		t.Error("Expected the scope of a script outside the set to be unknown")
+	}
+}
+
+func TestScope_CachedAndSourceScripts(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "labels", Namespace: "default",
+			Annotations: map[string]string{AnnotationScope: "/metadata/labels"}},
+		Data: map[string]string{DefaultScriptKey: "-- labels"},
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{
+		CacheTTL: time.Hour,
+		Sources:  map[string]ScriptSource{"static": StaticSource{Scheme: "static", Scripts: map[string]string{"policy": "-- policy"}}},
+	})
+
+	for i := 0; i < 2; i++ {
+		set, err := loader.LoadScriptSet(context.Background(), []ScriptRef{{Namespace: "default", Name: "labels"}, {Scheme: "static", Name: "policy"}})
+		if err != nil {
+			t.Fatalf("LoadScriptSet failed: %v", err)
+		}
+		if scope, _ := set.Scope("default/labels"); !reflect.DeepEqual(scope, []string{"/metadata/labels"}) {
+			t.Errorf("Load %d: unexpected scope %v", i, scope)
+		}
+		if scope, known := set.Scope("static:policy"); scope != nil || !known {
+			t.Errorf("Load %d: expected a known, unrestricted scope for the source script, got %v (known: %v)", i, scope, known)
+		}
+	}
+}
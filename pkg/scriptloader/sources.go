@@ -0,0 +1,112 @@
+package scriptloader
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Script: a script a source resolved a reference to
+type Script struct {
+	// Name: script identifier used in logs, ordering and results, unique across sources
+	Name string
+	// Content: Lua source of the script
+	Content string
+	// Scope: JSON pointers the script may change, nil when it may change anything (see AnnotationScope)
+	Scope []string
+	// ResourceVersion: version of the object the content was read from, such as the resourceVersion
+	// of its ConfigMap, empty when the source has none
+	ResourceVersion string
+	// Timeout: maximum run time of the script, zero for the script timeout of the server
+	Timeout time.Duration
+	// FailurePolicy: what a failure of the script does to the request, FailurePolicyIgnore when empty
+	FailurePolicy string
+}
+
+// ScriptSource: resolves script references of a scheme to scripts
+// Integrators register their own sources through Options.Sources
+type ScriptSource interface {
+	// Resolve: returns the scripts a reference resolves to, none when it holds no usable script
+	// Errors fail the load, unless the loader is in best-effort mode
+	Resolve(ctx context.Context, ref ScriptRef) ([]Script, error)
+}
+
+// configMapSource: the built-in source loading scripts from ConfigMap keys, through the loader cache
+type configMapSource struct {
+	loader *ScriptLoader
+}
+
+// Resolve: implements ScriptSource
+func (s configMapSource) Resolve(ctx context.Context, ref ScriptRef) ([]Script, error) {
+	loaded, scope, err := s.loader.loadScript(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make([]Script, 0, len(loaded))
+	for _, script := range loaded {
+		scripts = append(scripts, Script{
+			Name:            script.name,
+			Content:         script.content,
+			Scope:           scope,
+			ResourceVersion: script.resourceVersion,
+			Timeout:         script.timeout,
+			FailurePolicy:   script.failurePolicy,
+		})
+	}
+	return scripts, nil
+}
+
+// StaticSource: a source serving scripts held in memory, by name, for scripts shipped with the
+// program embedding the webhook. The name of a reference is "namespace/name", or "name" alone
+// when the reference has no namespace
+type StaticSource struct {
+	// Scheme: scheme the source is registered under, prefixed to the name of its scripts
+	Scheme string
+	// Scripts: script content by name
+	Scripts map[string]string
+}
+
+// Resolve: implements ScriptSource
+func (s StaticSource) Resolve(ctx context.Context, ref ScriptRef) ([]Script, error) {
+	name := ref.Name
+	if ref.Namespace != "" {
+		name = ref.Namespace + "/" + name
+	}
+
+	content, ok := s.Scripts[name]
+	if !ok {
+		return nil, fmt.Errorf("no %s script named %s", s.Scheme, name)
+	}
+	return []Script{{Name: s.Scheme + ":" + name, Content: content}}, nil
+}
+
+// source: returns the source references of the given scheme are resolved by
+func (l *ScriptLoader) source(scheme string) (ScriptSource, error) {
+	if scheme == "" {
+		scheme = SourceConfigMap
+	}
+	if source, ok := l.options.Sources[scheme]; ok {
+		return source, nil
+	}
+	if scheme == SourceConfigMap {
+		return configMapSource{loader: l}, nil
+	}
+
+	schemes := append([]string{SourceConfigMap}, l.Schemes()...)
+	sort.Strings(schemes)
+	return nil, fmt.Errorf("no script source for scheme %q (available: %v)", scheme, schemes)
+}
+
+// Schemes: returns the schemes of the sources registered beyond the ConfigMap one, sorted
+func (l *ScriptLoader) Schemes() []string {
+	var schemes []string
+	for registered := range l.options.Sources {
+		if registered != SourceConfigMap {
+			schemes = append(schemes, registered)
+		}
+	}
+	sort.Strings(schemes)
+	return schemes
+}
@@ -0,0 +1,142 @@
+package scriptloader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// recordingSource: returns one script per reference and records the references it resolved
+type recordingSource struct {
+	refs []ScriptRef
+	err  error
+}
+
+func (s *recordingSource) Resolve(ctx context.Context, ref ScriptRef) ([]Script, error) {
+	s.refs = append(s.refs, ref)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []Script{{Name: ref.String(), Content: "-- " + ref.Name}}, nil
+}
+
+func TestParseRef_Schemes(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected ScriptRef
+		ok       bool
+	}{
+		{ref: "default/script", expected: ScriptRef{Namespace: "default", Name: "script"}, ok: true},
+		{ref: "configmap:default/script#main.lua", expected: ScriptRef{Namespace: "default", Name: "script", Key: "main.lua"}, ok: true},
+		{ref: "secret:default/script", expected: ScriptRef{Scheme: "secret", Namespace: "default", Name: "script"}, ok: true},
+		{ref: "builtin:podspec", expected: ScriptRef{Scheme: "builtin", Name: "podspec"}, ok: true},
+		{ref: "configmap:script", ok: false},
+		{ref: "builtin:", ok: false},
+		{ref: "Bad Scheme:default/script", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			ref, ok := parseRef(tt.ref)
+			if ok != tt.ok {
+				t.Fatalf("Expected ok=%v, got %v (%+v)", tt.ok, ok, ref)
+			}
+			if ok && ref != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, ref)
+			}
+		})
+	}
+
+	// Parsing what String returns gives back the reference
+	for _, ref := range []ScriptRef{{Scheme: "builtin", Name: "podspec"}, {Scheme: "oci", Namespace: "team", Name: "policy", Key: "main.lua"}} {
+		if parsed, ok := parseRef(ref.String()); !ok || parsed != ref {
+			t.Errorf("Expected %s to round-trip, got %+v", ref, parsed)
+		}
+	}
+}
+
+func TestLoadScripts_Sources(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "labels", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `object.labels = true`},
+	})
+	custom := &recordingSource{}
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{Sources: map[string]ScriptSource{
+		"custom":  custom,
+		"builtin": StaticSource{Scheme: "builtin", Scripts: map[string]string{"defaults": `object.defaults = true`}},
+	}})
+
+	scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScripts: "default/labels, builtin:defaults, custom:team/policy#main.lua, configmap:default/labels",
+	})
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"default/labels":              `object.labels = true`,
+		"builtin:defaults":            `object.defaults = true`,
+		"custom:team/policy#main.lua": "-- policy",
+	}
+	if len(scripts) != len(expected) {
+		t.Fatalf("Expected %d scripts, got %v", len(expected), scripts)
+	}
+	for name, content := range expected {
+		if scripts[name] != content {
+			t.Errorf("Expected %s to be %q, got %q", name, content, scripts[name])
+		}
+	}
+	if len(custom.refs) != 1 || custom.refs[0] != (ScriptRef{Scheme: "custom", Namespace: "team", Name: "policy", Key: "main.lua"}) {
+		t.Errorf("Expected the custom source to resolve team/policy#main.lua once, got %+v", custom.refs)
+	}
+}
+
+func TestLoadScripts_UnknownScheme(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoader(fake.NewSimpleClientset(), logger)
+
+	_, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{AnnotationScripts: "oci:team/policy"})
+	if err == nil || !strings.Contains(err.Error(), `no script source for scheme "oci"`) {
+		t.Fatalf("Expected an unknown scheme error, got %v", err)
+	}
+
+	// Best-effort mode skips them like any other reference failing to load
+	loader = NewScriptLoaderWithOptions(fake.NewSimpleClientset(), logger, Options{BestEffort: true})
+	scripts, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{AnnotationScripts: "oci:team/policy"})
+	if err != nil || len(scripts) != 0 {
+		t.Errorf("Expected the reference to be skipped, got %v, %v", scripts, err)
+	}
+}
+
+func TestLoadScripts_SourceError(t *testing.T) {
+	failing := &recordingSource{err: errors.New("registry unreachable")}
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(fake.NewSimpleClientset(), logger, Options{Sources: map[string]ScriptSource{"oci": failing}})
+
+	_, err := loader.LoadScripts(context.Background(), []ScriptRef{{Scheme: "oci", Name: "policy"}})
+	if err == nil || !strings.Contains(err.Error(), "registry unreachable") {
+		t.Fatalf("Expected the source error, got %v", err)
+	}
+}
+
+func TestLoadScripts_ReplaceConfigMapSource(t *testing.T) {
+	replacement := &recordingSource{}
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(fake.NewSimpleClientset(), logger, Options{Sources: map[string]ScriptSource{SourceConfigMap: replacement}})
+
+	scripts, err := loader.LoadScripts(context.Background(), ParseAnnotation("default/labels"))
+	if err != nil {
+		t.Fatalf("LoadScripts failed: %v", err)
+	}
+	if scripts["default/labels"] != "-- labels" || len(replacement.refs) != 1 {
+		t.Errorf("Expected references without a scheme to go to the replacement source, got %v", scripts)
+	}
+}
@@ -0,0 +1,83 @@
+package scriptloader
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// AddInvalidationHook: registers a function called whenever the scripts of a ConfigMap are invalidated
+// Used to drop state derived from script content, such as compiled bytecode
+func (l *ScriptLoader) AddInvalidationHook(hook func(namespace, name string)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.hooks = append(l.hooks, hook)
+}
+
+// InvalidateConfigMap: drops every cached script loaded from a ConfigMap, whatever its key,
+// as well as its cached params, and notifies the invalidation hooks
+func (l *ScriptLoader) InvalidateConfigMap(namespace, name string) {
+	prefix := fmt.Sprintf("%s/%s", namespace, name)
+
+	l.mu.Lock()
+	for ref := range l.cache {
+		if ref == prefix || strings.HasPrefix(ref, prefix+"#") {
+			delete(l.cache, ref)
+		}
+	}
+	delete(l.params, prefix)
+	hooks := append([]func(namespace, name string){}, l.hooks...)
+	l.mu.Unlock()
+
+	l.logger.Printf("Invalidated cached scripts of ConfigMap %s", prefix)
+	for _, hook := range hooks {
+		hook(namespace, name)
+	}
+}
+
+// WatchConfigMaps: starts a ConfigMap informer invalidating cached scripts as soon as their
+// ConfigMap is updated or deleted, so edits take effect without waiting for the cache TTL
+// Blocks until the informer has synced, the watch stops when ctx is cancelled
+func (l *ScriptLoader) WatchConfigMaps(ctx context.Context, resync time.Duration) error {
+	factory := informers.NewSharedInformerFactory(l.clientset, resync)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldCM, okOld := oldObj.(*corev1.ConfigMap)
+			newCM, okNew := newObj.(*corev1.ConfigMap)
+			if !okOld || !okNew || oldCM.ResourceVersion == newCM.ResourceVersion {
+				// Periodic resync, nothing changed
+				return
+			}
+			l.InvalidateConfigMap(newCM.Namespace, newCM.Name)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				l.InvalidateConfigMap(cm.Namespace, cm.Name)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register ConfigMap event handler: %w", err)
+	}
+
+	l.logger.Printf("INFO: Starting ConfigMap informer for script cache invalidation")
+	factory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync ConfigMap informer")
+	}
+
+	l.logger.Printf("ConfigMap informer synced")
+	return nil
+}
@@ -0,0 +1,105 @@
+package scriptloader
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestInvalidateConfigMap(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "multi", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("a")`, "other.lua": `print("b")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "multi-other", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `print("c")`},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{CacheTTL: time.Hour})
+
+	var invalidated []string
+	loader.AddInvalidationHook(func(namespace, name string) {
+		invalidated = append(invalidated, namespace+"/"+name)
+	})
+
+	_, err := loader.LoadScriptsFromAnnotations(context.Background(), map[string]string{
+		AnnotationScripts: "default/multi,default/multi#other.lua,default/multi-other",
+	})
+	if err != nil {
+		t.Fatalf("LoadScriptsFromAnnotations failed: %v", err)
+	}
+
+	if got := len(loader.CachedScripts()); got != 3 {
+		t.Fatalf("Expected 3 cached scripts, got %d", got)
+	}
+
+	loader.InvalidateConfigMap("default", "multi")
+
+	cached := loader.CachedScripts()
+	if len(cached) != 1 || cached[0].Ref != "default/multi-other" {
+		t.Errorf("Expected only default/multi-other to remain cached, got %+v", cached)
+	}
+
+	if len(invalidated) != 1 || invalidated[0] != "default/multi" {
+		t.Errorf("Expected the hook to be called for default/multi, got %v", invalidated)
+	}
+}
+
+func TestWatchConfigMaps_InvalidatesOnUpdateAndDelete(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "watched", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string]string{"script.lua": `print("v1")`},
+	}
+	clientset := fake.NewSimpleClientset(cm)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := NewScriptLoaderWithOptions(clientset, logger, Options{CacheTTL: time.Hour})
+
+	invalidated := make(chan string, 10)
+	loader.AddInvalidationHook(func(namespace, name string) {
+		invalidated <- namespace + "/" + name
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := loader.WatchConfigMaps(ctx, 0); err != nil {
+		t.Fatalf("WatchConfigMaps failed: %v", err)
+	}
+
+	updated := cm.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Data["script.lua"] = `print("v2")`
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+
+	select {
+	case name := <-invalidated:
+		if name != "default/watched" {
+			t.Errorf("Expected default/watched to be invalidated, got %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for invalidation on update")
+	}
+
+	if err := clientset.CoreV1().ConfigMaps("default").Delete(ctx, "watched", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete ConfigMap: %v", err)
+	}
+
+	select {
+	case <-invalidated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for invalidation on delete")
+	}
+}
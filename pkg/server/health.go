@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HealthzHandler: liveness probe, always succeeds while the server is running
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// ReadyzHandler: readiness probe of the webhook, always succeeds while the server is running
+// The API server is not checked, see Config.ReadyzSkipAPIServer
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ready"))
+}
+
+// APIServerReadyzHandler: readiness probe succeeding while the API server answers, the one of Run
+// Asks for the server version, which requires no RBAC permission
+func APIServerReadyzHandler(clientset kubernetes.Interface) http.HandlerFunc {
+	return APIServerReadyzHandlerWithLogger(clientset, log.New(io.Discard, "", 0))
+}
+
+// APIServerReadyzHandlerWithLogger: same as APIServerReadyzHandler, logging failed checks
+// Rejected credentials, such as an expired token, are reported apart from an unreachable API server
+func APIServerReadyzHandlerWithLogger(clientset kubernetes.Interface, logger *log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := clientset.Discovery().ServerVersion(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			switch {
+			case apierrors.IsUnauthorized(err):
+				logger.Printf("ERROR: Readiness check failed, the API server rejected the credentials: %v", err)
+				_, _ = fmt.Fprintf(w, "not ready: authentication failed: %v", err)
+			case apierrors.IsForbidden(err):
+				logger.Printf("ERROR: Readiness check failed, the API server denied access: %v", err)
+				_, _ = fmt.Fprintf(w, "not ready: authorization failed: %v", err)
+			default:
+				logger.Printf("WARNING: Readiness check failed, the API server cannot be reached: %v", err)
+				_, _ = fmt.Fprintf(w, "not ready: %v", err)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ready"))
+	}
+}
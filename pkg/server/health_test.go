@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ReadyzHandler(recorder, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "ready" {
+		t.Errorf("Expected body 'ready', got %q", body)
+	}
+}
+
+func TestAPIServerReadyzHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int
+		expectedBody string
+		expectedLog  string
+	}{
+		{
+			name:         "ready",
+			expectedCode: http.StatusOK,
+			expectedBody: "ready",
+		},
+		{
+			name:         "expired credentials",
+			err:          apierrors.NewUnauthorized("token has expired"),
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: "not ready: authentication failed: token has expired",
+			expectedLog:  "ERROR: Readiness check failed, the API server rejected the credentials",
+		},
+		{
+			name:         "forbidden",
+			err:          apierrors.NewForbidden(schema.GroupResource{Resource: "version"}, "", errors.New("denied")),
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: "not ready: authorization failed",
+			expectedLog:  "ERROR: Readiness check failed, the API server denied access",
+		},
+		{
+			name:         "unreachable",
+			err:          errors.New("connection refused"),
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: "not ready: connection refused",
+			expectedLog:  "WARNING: Readiness check failed, the API server cannot be reached",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if tt.err != nil {
+				clientset.PrependReactor("get", "version", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.err
+				})
+			}
+
+			var logs bytes.Buffer
+			recorder := httptest.NewRecorder()
+			APIServerReadyzHandlerWithLogger(clientset, log.New(&logs, "", 0))(recorder, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+
+			if recorder.Code != tt.expectedCode {
+				t.Errorf("Expected status %d, got %d", tt.expectedCode, recorder.Code)
+			}
+			if !strings.HasPrefix(recorder.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body starting with %q, got %q", tt.expectedBody, recorder.Body.String())
+			}
+			if !strings.Contains(logs.String(), tt.expectedLog) {
+				t.Errorf("Expected log %q, got %q", tt.expectedLog, logs.String())
+			}
+		})
+	}
+}
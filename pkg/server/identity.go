@@ -0,0 +1,37 @@
+package server
+
+import (
+	"os"
+	"strings"
+
+	"thechat/pkg/luarunner"
+)
+
+const (
+	// EnvPodNamespace: environment variable holding the namespace of the webhook pod, set through the downward API
+	EnvPodNamespace = "POD_NAMESPACE"
+	// EnvPodName: environment variable holding the name of the webhook pod, set through the downward API
+	EnvPodName = "POD_NAME"
+)
+
+// serviceAccountNamespaceFile: namespace of the mounted ServiceAccount, the pod namespace when the
+// downward API does not provide it
+var serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// DetectIdentity: returns where the webhook runs, read from the downward API environment
+// variables, falling back on the ServiceAccount namespace and the hostname
+func DetectIdentity() luarunner.Identity {
+	identity := luarunner.Identity{
+		Namespace: os.Getenv(EnvPodNamespace),
+		PodName:   os.Getenv(EnvPodName),
+	}
+	if identity.Namespace == "" {
+		if namespace, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+			identity.Namespace = strings.TrimSpace(string(namespace))
+		}
+	}
+	if identity.PodName == "" {
+		identity.PodName, _ = os.Hostname()
+	}
+	return identity
+}
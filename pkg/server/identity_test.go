@@ -0,0 +1,32 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectIdentity(t *testing.T) {
+	namespaceFile := filepath.Join(t.TempDir(), "namespace")
+	if err := os.WriteFile(namespaceFile, []byte("from-service-account\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	previous := serviceAccountNamespaceFile
+	serviceAccountNamespaceFile = namespaceFile
+	defer func() { serviceAccountNamespaceFile = previous }()
+
+	t.Setenv(EnvPodNamespace, "glua-system")
+	t.Setenv(EnvPodName, "glua-webhook-0")
+	identity := DetectIdentity()
+	if identity.Namespace != "glua-system" || identity.PodName != "glua-webhook-0" {
+		t.Errorf("Expected the downward API identity, got %+v", identity)
+	}
+
+	t.Setenv(EnvPodNamespace, "")
+	t.Setenv(EnvPodName, "")
+	identity = DetectIdentity()
+	hostname, _ := os.Hostname()
+	if identity.Namespace != "from-service-account" || identity.PodName != hostname {
+		t.Errorf("Expected the ServiceAccount namespace and hostname, got %+v", identity)
+	}
+}
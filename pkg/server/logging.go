@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// levelPrefixes: prefixes of the log lines of the components, and the level each stands for
+var levelPrefixes = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"ERROR:", slog.LevelError},
+	{"WARNING:", slog.LevelWarn},
+	{"INFO:", slog.LevelInfo},
+	{"DEBUG:", slog.LevelDebug},
+}
+
+// LevelLogger: returns a log.Logger turning each line into a record of logger, at the level its
+// ERROR:, WARNING:, INFO: or DEBUG: prefix names. The step-by-step lines without prefix are Debug
+// records, so that at Info level a request only shows up through its summary, warnings and errors,
+// while the INFO: lines of the server lifecycle (configuration, listen address, shutdown) remain
+func LevelLogger(logger *slog.Logger) *log.Logger {
+	return log.New(levelWriter{logger: logger}, "", 0)
+}
+
+// levelWriter: writes log lines to logger
+type levelWriter struct {
+	logger *slog.Logger
+}
+
+// Write: implements io.Writer, log.Logger writes a line per call
+func (w levelWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	level := slog.LevelDebug
+	for _, candidate := range levelPrefixes {
+		if strings.HasPrefix(message, candidate.prefix) {
+			level = candidate.level
+			message = strings.TrimSpace(strings.TrimPrefix(message, candidate.prefix))
+			break
+		}
+	}
+	w.logger.Log(context.Background(), level, message)
+	return len(p), nil
+}
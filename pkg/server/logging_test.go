@@ -0,0 +1,38 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevelLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger := LevelLogger(slog.New(slog.NewJSONHandler(&output, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	logger.Printf("INFO: Starting HTTPS server on 127.0.0.1:8443")
+	logger.Printf("Executing script 1/1: default/label")
+	logger.Printf("DEBUG: Skipping default/pod: pre-filter matched")
+	logger.Printf("WARNING: Script default/label failed (ignoring): boom")
+	logger.Printf("ERROR: Failed to load scripts")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected the lifecycle line, the warning and the error only, got %q", output.String())
+	}
+	for i, expected := range []struct{ level, msg string }{
+		{"INFO", "Starting HTTPS server on 127.0.0.1:8443"},
+		{"WARN", "Script default/label failed (ignoring): boom"},
+		{"ERROR", "Failed to load scripts"},
+	} {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("Failed to decode record %q: %v", lines[i], err)
+		}
+		if record["level"] != expected.level || record["msg"] != expected.msg {
+			t.Errorf("Expected %s record %q, got %v", expected.level, expected.msg, record)
+		}
+	}
+}
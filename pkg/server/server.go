@@ -0,0 +1,420 @@
+// Package server: the complete glua-webhook server, for binaries embedding it
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"thechat/pkg/cluster"
+	"thechat/pkg/luarunner"
+	"thechat/pkg/metrics"
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/webhook"
+)
+
+const (
+	// HealthzPath: liveness probe endpoint
+	HealthzPath = "/healthz"
+	// ReadyzPath: readiness probe endpoint
+	ReadyzPath = "/readyz"
+	// MetricsPath: Prometheus metrics endpoint
+	MetricsPath = "/metrics"
+
+	// DefaultShutdownTimeout: how long in-flight requests may take to complete once Run is cancelled
+	DefaultShutdownTimeout = 30 * time.Second
+	// DrainLogInterval: how often the admission requests still in flight are logged while shutting down
+	DrainLogInterval = time.Second
+	// WatchResync: resync period of the ConfigMap informer
+	WatchResync = 10 * time.Minute
+)
+
+// Config: everything Run needs to serve admission requests
+type Config struct {
+	// Port: HTTPS port, ignored when Listener is set
+	Port int
+	// Listener: accepts the connections of the server instead of listening on Port
+	Listener net.Listener
+	// CertFile, KeyFile: TLS certificate and key, ignored when TLSConfig holds certificates
+	CertFile string
+	KeyFile  string
+	// TLSConfig: TLS configuration of the server, a TLS 1.2 minimum one is used when nil
+	TLSConfig *tls.Config
+
+	// Clientset: Kubernetes client, built from Kubeconfig (or the in-cluster configuration) when nil
+	Clientset kubernetes.Interface
+	// Kubeconfig: path to a kubeconfig file, empty for the in-cluster configuration
+	Kubeconfig string
+	// TokenFile: bearer token file replacing the credentials of the kubeconfig, such as a projected
+	// ServiceAccount token. client-go reads it again periodically, rotated tokens are picked up
+	TokenFile string
+
+	// MutatingPath, ValidatingPath: paths the webhook endpoints are served on
+	MutatingPath   string
+	ValidatingPath string
+	// EnableMutating, EnableValidation: endpoints served, at least one is required
+	EnableMutating   bool
+	EnableValidation bool
+	// EnableDebug: serve the debug endpoints that modify server state
+	EnableDebug bool
+	// ReadyzSkipAPIServer: answer /readyz ready without checking the API server, so that a webhook
+	// serving stale cached scripts (see scriptloader.Options.MaxStaleness) stays reachable while
+	// it is down. Rejected credentials are then only reported by failing script fetches
+	ReadyzSkipAPIServer bool
+
+	// HandlerOptions: options of both webhook handlers
+	// The script loader and cluster lookup are created and shared when not set
+	HandlerOptions webhook.HandlerOptions
+	// ClusterOptions: options of the cluster lookup created when HandlerOptions has none
+	ClusterOptions cluster.Options
+	// WatchConfigMaps: invalidate cached scripts as soon as their ConfigMap changes
+	WatchConfigMaps bool
+	// DefaultScriptsFile: YAML file holding the default scripts configuration
+	DefaultScriptsFile string
+	// DefaultScriptsConfigMap: ConfigMap (namespace/name) holding the default scripts configuration
+	DefaultScriptsConfigMap string
+
+	// ReadTimeout, WriteTimeout, MaxHeaderBytes: HTTP server limits, zero means no limit
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	MaxHeaderBytes int
+	// ShutdownTimeout: how long in-flight requests may take to complete once Run is cancelled
+	ShutdownTimeout time.Duration
+
+	// Logger: logger of the server and its components, writes to stdout when nil
+	Logger *log.Logger
+}
+
+// DefaultConfig: returns the configuration of the glua-webhook webhook command defaults
+func DefaultConfig() Config {
+	return Config{
+		Port:             8443,
+		CertFile:         "/etc/webhook/certs/tls.crt",
+		KeyFile:          "/etc/webhook/certs/tls.key",
+		MutatingPath:     "/mutate",
+		ValidatingPath:   "/validate",
+		EnableMutating:   true,
+		EnableValidation: true,
+		HandlerOptions: webhook.HandlerOptions{
+			BudgetFailureMode: webhook.FailureModeAllow,
+			Filters: webhook.ServerFilters{
+				PreFilters: webhook.DefaultPreFilters(),
+			},
+		},
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+// Run: serves admission requests until ctx is cancelled, then shuts the server down gracefully
+// Returns nil once shut down, or the error that prevented the server from starting or serving
+func Run(ctx context.Context, config Config) error {
+	logger := config.Logger
+	if logger == nil {
+		logger = log.New(os.Stdout, "[glua-webhook] ", log.LstdFlags|log.Lshortfile)
+	}
+
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	clientset := config.Clientset
+	if clientset == nil {
+		var err error
+		clientset, err = newClientset(config.Kubeconfig, config.TokenFile, logger)
+		if err != nil {
+			return err
+		}
+		logger.Printf("INFO: Successfully connected to Kubernetes API")
+	}
+
+	handlerOptions := config.HandlerOptions
+	if handlerOptions.RunnerOptions.Identity == (luarunner.Identity{}) {
+		handlerOptions.RunnerOptions.Identity = DetectIdentity()
+	}
+	logger.Printf("INFO: Running in namespace %q as pod %q", handlerOptions.RunnerOptions.Identity.Namespace, handlerOptions.RunnerOptions.Identity.PodName)
+
+	if handlerOptions.ScriptLoader == nil {
+		handlerOptions.ScriptLoader = scriptloader.NewScriptLoaderWithOptions(clientset, logger, handlerOptions.LoaderOptions)
+	}
+	scriptLoader := handlerOptions.ScriptLoader
+
+	if config.WatchConfigMaps {
+		if err := scriptLoader.WatchConfigMaps(ctx, WatchResync); err != nil {
+			return fmt.Errorf("failed to watch ConfigMaps: %w", err)
+		}
+	}
+
+	if handlerOptions.ClusterLookup == nil {
+		handlerOptions.ClusterLookup = cluster.NewLookup(clientset, logger, config.ClusterOptions)
+	}
+	if handlerOptions.InFlightTracker == nil {
+		handlerOptions.InFlightTracker = webhook.NewInFlightTracker()
+	}
+
+	if err := loadDefaultScripts(ctx, config, clientset, &handlerOptions, logger); err != nil {
+		return err
+	}
+
+	endpoints := webhook.Endpoints{
+		MutatingPath:   config.MutatingPath,
+		ValidatingPath: config.ValidatingPath,
+	}
+	if config.EnableMutating {
+		endpoints.Mutating = webhook.NewWebhookHandlerWithOptions(clientset, logger, "mutating", handlerOptions)
+	}
+	if config.EnableValidation {
+		endpoints.Validating = webhook.NewWebhookHandlerWithOptions(clientset, logger, "validating", handlerOptions)
+	}
+
+	mux := http.NewServeMux()
+	endpoints.Register(mux)
+	mux.HandleFunc(HealthzPath, HealthzHandler)
+	if config.ReadyzSkipAPIServer {
+		mux.HandleFunc(ReadyzPath, ReadyzHandler)
+	} else {
+		mux.HandleFunc(ReadyzPath, APIServerReadyzHandlerWithLogger(clientset, logger))
+	}
+	mux.Handle(MetricsPath, metrics.Handler())
+
+	debugHandler := webhook.NewDebugHandler(scriptLoader, logger, config.EnableDebug)
+	debugHandler.SetClusterLookup(handlerOptions.ClusterLookup)
+	debugHandler.SetWebhookHandlers(endpoints.Handlers()...)
+	debugHandler.Register(mux)
+
+	logRegisteredHandlers(logger, config, endpoints)
+
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	certFile, keyFile := config.CertFile, config.KeyFile
+	if len(tlsConfig.Certificates) > 0 || tlsConfig.GetCertificate != nil {
+		certFile, keyFile = "", ""
+	} else {
+		logger.Printf("INFO: Using TLS certificate: %s", certFile)
+		logger.Printf("INFO: Using TLS key: %s", keyFile)
+	}
+
+	listener := config.Listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
+		if err != nil {
+			return fmt.Errorf("failed to listen on port %d: %w", config.Port, err)
+		}
+	}
+
+	server := &http.Server{
+		Handler:        mux,
+		TLSConfig:      tlsConfig,
+		ReadTimeout:    config.ReadTimeout,
+		WriteTimeout:   config.WriteTimeout,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+		ErrorLog:       logger,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Printf("INFO: Starting HTTPS server on %s", listener.Addr())
+		serveErr <- server.ServeTLS(listener, certFile, keyFile)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("failed to serve: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownTimeout := config.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	if err := shutdown(server, handlerOptions.InFlightTracker, shutdownTimeout, logger); err != nil {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+
+	logger.Printf("INFO: Server stopped gracefully")
+	return nil
+}
+
+// shutdown: shuts server down gracefully within timeout, logging the admission requests of tracker
+// still in flight every DrainLogInterval until they complete, and the ones left when timeout is hit
+func shutdown(server *http.Server, tracker *webhook.InFlightTracker, timeout time.Duration, logger *log.Logger) error {
+	inFlight := tracker.Count()
+	logger.Printf("INFO: Shutting down server gracefully, %d admission requests in flight...", inFlight)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(DrainLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				logger.Printf("INFO: Drained the %d admission requests in flight", inFlight)
+				return nil
+			}
+			if remaining := tracker.Requests(); len(remaining) > 0 {
+				pending := make([]string, 0, len(remaining))
+				for _, request := range remaining {
+					pending = append(pending, fmt.Sprintf("%s (%s, running for %s)", request.UID, request.Webhook, time.Since(request.Started).Round(time.Millisecond)))
+				}
+				logger.Printf("ERROR: Shutdown timeout of %s hit with %d admission requests still in flight: %s",
+					timeout, len(remaining), strings.Join(pending, ", "))
+			}
+			return err
+		case <-ticker.C:
+			logger.Printf("INFO: Draining: %d admission requests still in flight", tracker.Count())
+		}
+	}
+}
+
+// validate: rejects configurations the server cannot run with
+func (c Config) validate() error {
+	if !c.EnableMutating && !c.EnableValidation {
+		return fmt.Errorf("at least one of the mutating and validating endpoints must be enabled")
+	}
+	if c.DefaultScriptsFile != "" && c.DefaultScriptsConfigMap != "" {
+		return fmt.Errorf("default scripts file and ConfigMap are mutually exclusive")
+	}
+	switch c.HandlerOptions.BudgetFailureMode {
+	case "", webhook.FailureModeAllow, webhook.FailureModeDeny:
+	default:
+		return fmt.Errorf("invalid budget failure mode %q (expected %s or %s)", c.HandlerOptions.BudgetFailureMode, webhook.FailureModeAllow, webhook.FailureModeDeny)
+	}
+	switch c.HandlerOptions.ShedFailureMode {
+	case "", webhook.FailureModeAllow, webhook.FailureModeDeny:
+	default:
+		return fmt.Errorf("invalid shed failure mode %q (expected %s or %s)", c.HandlerOptions.ShedFailureMode, webhook.FailureModeAllow, webhook.FailureModeDeny)
+	}
+	switch c.HandlerOptions.ValidationSource {
+	case "", webhook.ValidationSourceRequest, webhook.ValidationSourceMutated:
+	default:
+		return fmt.Errorf("invalid validation source %q (expected %s or %s)", c.HandlerOptions.ValidationSource, webhook.ValidationSourceRequest, webhook.ValidationSourceMutated)
+	}
+	switch c.HandlerOptions.RemoveMode {
+	case "", webhook.RemoveModeReject, webhook.RemoveModeDrop:
+	default:
+		return fmt.Errorf("invalid remove mode %q (expected %s or %s)", c.HandlerOptions.RemoveMode, webhook.RemoveModeReject, webhook.RemoveModeDrop)
+	}
+	switch c.HandlerOptions.PatchGenerator {
+	case "", webhook.PatchGeneratorDiff, webhook.PatchGeneratorReplace:
+	default:
+		return fmt.Errorf("invalid patch generator %q (expected %s or %s)", c.HandlerOptions.PatchGenerator, webhook.PatchGeneratorDiff, webhook.PatchGeneratorReplace)
+	}
+	// Fields replaced as a whole hide the removals and the changes outside metadata they hold
+	if c.HandlerOptions.PatchGenerator == webhook.PatchGeneratorReplace {
+		if c.HandlerOptions.RemoveMode != "" {
+			return fmt.Errorf("the %s patch generator cannot be used with a remove mode", webhook.PatchGeneratorReplace)
+		}
+		if c.HandlerOptions.MetadataOnly {
+			return fmt.Errorf("the %s patch generator cannot be used with metadata-only mode", webhook.PatchGeneratorReplace)
+		}
+	}
+	if c.HandlerOptions.DefaultParams != "" {
+		if _, ok := scriptloader.ParseParamsRef(c.HandlerOptions.DefaultParams); !ok {
+			return fmt.Errorf("invalid default params %q (expected namespace/configmap)", c.HandlerOptions.DefaultParams)
+		}
+	}
+	return nil
+}
+
+// newClientset: creates a clientset from a kubeconfig file, or from the in-cluster configuration,
+// authenticating with the token of tokenFile when set
+// Exec credential plugins and token files are refreshed by client-go as they expire
+func newClientset(kubeconfig, tokenFile string, logger *log.Logger) (kubernetes.Interface, error) {
+	var restConfig *rest.Config
+	var err error
+
+	if kubeconfig != "" {
+		logger.Printf("INFO: Using kubeconfig file: %s", kubeconfig)
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		logger.Printf("INFO: Using in-cluster configuration")
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes config: %w", err)
+	}
+
+	if tokenFile != "" {
+		logger.Printf("INFO: Using bearer token file: %s", tokenFile)
+		restConfig.BearerToken = ""
+		restConfig.BearerTokenFile = tokenFile
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes clientset: %w", err)
+	}
+	return clientset, nil
+}
+
+// loadDefaultScripts: sets the default scripts of the handler options from the file or ConfigMap configured
+func loadDefaultScripts(ctx context.Context, config Config, clientset kubernetes.Interface, options *webhook.HandlerOptions, logger *log.Logger) error {
+	var err error
+
+	switch {
+	case config.DefaultScriptsFile != "":
+		options.DefaultScripts, err = scriptloader.LoadDefaultScriptsFile(config.DefaultScriptsFile)
+		if err != nil {
+			return fmt.Errorf("failed to load default scripts: %w", err)
+		}
+		logger.Printf("INFO: Loaded default scripts from %s", config.DefaultScriptsFile)
+
+	case config.DefaultScriptsConfigMap != "":
+		namespace, name, ok := strings.Cut(config.DefaultScriptsConfigMap, "/")
+		if !ok {
+			return fmt.Errorf("invalid default scripts ConfigMap %q (expected namespace/name)", config.DefaultScriptsConfigMap)
+		}
+		options.DefaultScripts, err = scriptloader.LoadDefaultScriptsConfigMap(ctx, clientset, namespace, name)
+		if err != nil {
+			return fmt.Errorf("failed to load default scripts: %w", err)
+		}
+		logger.Printf("INFO: Loaded default scripts from ConfigMap %s", config.DefaultScriptsConfigMap)
+	}
+
+	return nil
+}
+
+// logRegisteredHandlers: lists the endpoints served
+func logRegisteredHandlers(logger *log.Logger, config Config, endpoints webhook.Endpoints) {
+	logger.Printf("INFO: Registered handlers:")
+	if endpoints.Mutating != nil {
+		logger.Printf("INFO:   - %s (mutating webhook)", endpoints.MutatingPath)
+	}
+	if endpoints.Validating != nil {
+		logger.Printf("INFO:   - %s (validating webhook)", endpoints.ValidatingPath)
+	}
+	logger.Printf("INFO:   - %s (health check)", HealthzPath)
+	if config.ReadyzSkipAPIServer {
+		logger.Printf("INFO:   - %s (readiness check)", ReadyzPath)
+	} else {
+		logger.Printf("INFO:   - %s (readiness check, API server included)", ReadyzPath)
+	}
+	logger.Printf("INFO:   - %s (Prometheus metrics)", MetricsPath)
+	logger.Printf("INFO:   - %s (cached scripts)", webhook.DebugScriptsPath)
+	if config.EnableDebug {
+		logger.Printf("INFO:   - %s (script, compiled script and namespace cache flush)", webhook.DebugScriptsFlushPath)
+		logger.Printf("INFO:   - %s (alias of %s)", webhook.DebugFlushCachePath, webhook.DebugScriptsFlushPath)
+	}
+}
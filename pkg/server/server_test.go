@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/webhook"
+)
+
+// selfSignedTLSConfig: TLS configuration holding a throwaway certificate for 127.0.0.1
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// startServer: runs the server on a free port until the test ends, returning its base URL
+func startServer(t *testing.T, config Config) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	config.Listener = listener
+	config.TLSConfig = selfSignedTLSConfig(t)
+	config.Logger = log.New(io.Discard, "", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, config)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run returned an error after cancellation: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Run did not return after cancellation")
+		}
+	})
+
+	return "https://" + listener.Addr().String()
+}
+
+// testClient: trusts the self-signed certificate of the test server
+func testClient() *http.Client {
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+}
+
+func TestRun(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data: map[string]string{"script.lua": `
+			object.metadata.labels = object.metadata.labels or {}
+			object.metadata.labels["served-by"] = "server"
+		`},
+	})
+
+	config := DefaultConfig()
+	config.Clientset = clientset
+	baseURL := startServer(t, config)
+	client := testClient()
+
+	resp, err := client.Get(baseURL + HealthzPath)
+	if err != nil {
+		t.Fatalf("Failed to reach %s: %v", HealthzPath, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("Unexpected %s response: %d %s", HealthzPath, resp.StatusCode, body)
+	}
+
+	pod, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":        "test",
+			"namespace":   "default",
+			"annotations": map[string]string{scriptloader.AnnotationScripts: "default/label"},
+		},
+	})
+	review, _ := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: pod},
+		},
+	})
+
+	resp, err = client.Post(baseURL+config.MutatingPath, "application/json", bytes.NewReader(review))
+	if err != nil {
+		t.Fatalf("Failed to reach %s: %v", config.MutatingPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+
+	var response admissionv1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Response == nil || !response.Response.Allowed {
+		t.Fatalf("Expected the request to be allowed, got %+v", response.Response)
+	}
+	if !bytes.Contains(response.Response.Patch, []byte("served-by")) {
+		t.Errorf("Expected the patch to add the label, got %s", response.Response.Patch)
+	}
+}
+
+func TestRunDisabledEndpoint(t *testing.T) {
+	config := DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.EnableValidation = false
+	baseURL := startServer(t, config)
+
+	resp, err := testClient().Post(baseURL+config.ValidatingPath, "application/json", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		t.Fatalf("Failed to reach server: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for the disabled endpoint, got %d", resp.StatusCode)
+	}
+
+	resp, err = testClient().Get(baseURL + ReadyzPath)
+	if err != nil {
+		t.Fatalf("Failed to reach %s: %v", ReadyzPath, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected %s to succeed, got %d", ReadyzPath, resp.StatusCode)
+	}
+}
+
+func TestRunReadyz(t *testing.T) {
+	tests := []struct {
+		name         string
+		skip         bool
+		expectedCode int
+		expectedBody string
+	}{
+		{"API server checked", false, http.StatusServiceUnavailable, "not ready: authentication failed: token has expired"},
+		{"API server skipped", true, http.StatusOK, "ready"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			clientset.PrependReactor("get", "version", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, apierrors.NewUnauthorized("token has expired")
+			})
+			config := DefaultConfig()
+			config.Clientset = clientset
+			config.ReadyzSkipAPIServer = tt.skip
+			baseURL := startServer(t, config)
+
+			resp, err := testClient().Get(baseURL + ReadyzPath)
+			if err != nil {
+				t.Fatalf("Failed to reach %s: %v", ReadyzPath, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.expectedCode || string(body) != tt.expectedBody {
+				t.Errorf("Expected %d %q, got %d %q", tt.expectedCode, tt.expectedBody, resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.EnableMutating = false
+	config.EnableValidation = false
+
+	if err := Run(context.Background(), config); err == nil {
+		t.Error("Expected an error with both endpoints disabled")
+	}
+
+	config = DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.HandlerOptions.BudgetFailureMode = "maybe"
+	if err := Run(context.Background(), config); err == nil {
+		t.Error("Expected an error with an invalid budget failure mode")
+	}
+
+	config = DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.HandlerOptions.ShedFailureMode = "alow"
+	if err := Run(context.Background(), config); err == nil {
+		t.Error("Expected an error with an invalid shed failure mode")
+	}
+
+	config = DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.HandlerOptions.RemoveMode = "keep"
+	if err := Run(context.Background(), config); err == nil {
+		t.Error("Expected an error with an invalid remove mode")
+	}
+
+	config = DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.HandlerOptions.PatchGenerator = "merge"
+	if err := Run(context.Background(), config); err == nil {
+		t.Error("Expected an error with an invalid patch generator")
+	}
+
+	config = DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.HandlerOptions.PatchGenerator = webhook.PatchGeneratorReplace
+	config.HandlerOptions.RemoveMode = webhook.RemoveModeDrop
+	if err := Run(context.Background(), config); err == nil {
+		t.Error("Expected an error with the replace patch generator and a remove mode")
+	}
+
+	config = DefaultConfig()
+	config.Clientset = fake.NewSimpleClientset()
+	config.HandlerOptions.PatchGenerator = webhook.PatchGeneratorReplace
+	config.HandlerOptions.MetadataOnly = true
+	if err := Run(context.Background(), config); err == nil {
+		t.Error("Expected an error with the replace patch generator and metadata-only mode")
+	}
+}
+
+// lockedBuffer: log output written by the server while the test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRunShutdownDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		drained  bool
+		expected string
+	}{
+		{name: "requests complete", timeout: 5 * time.Second, drained: true, expected: "Drained the 1 admission requests in flight"},
+		{name: "timeout hit", timeout: 100 * time.Millisecond, expected: "still in flight: slow-uid (mutating"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Scripts block in gate.wait() until the gate is opened
+			gate := make(chan struct{})
+			config := DefaultConfig()
+			config.Clientset = fake.NewSimpleClientset(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "slow", Namespace: "default"},
+				Data:       map[string]string{"script.lua": `require("gate").wait()`},
+			})
+			config.HandlerOptions.RunnerOptions.ExtraModules = map[string]lua.LGFunction{"gate": func(L *lua.LState) int {
+				L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{"wait": func(L *lua.LState) int {
+					<-gate
+					return 0
+				}}))
+				return 1
+			}}
+			tracker := webhook.NewInFlightTracker()
+			config.HandlerOptions.InFlightTracker = tracker
+			config.ShutdownTimeout = tt.timeout
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			config.Listener = listener
+			config.TLSConfig = selfSignedTLSConfig(t)
+			logs := &lockedBuffer{}
+			config.Logger = log.New(logs, "", 0)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- Run(ctx, config)
+			}()
+
+			pod, _ := json.Marshal(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata": map[string]interface{}{
+					"name":        "slow",
+					"namespace":   "default",
+					"annotations": map[string]string{scriptloader.AnnotationScripts: "default/slow"},
+				},
+			})
+			review, _ := json.Marshal(admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "slow-uid",
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Namespace: "default",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: pod},
+				},
+			})
+			answered := make(chan error, 1)
+			go func() {
+				resp, err := testClient().Post("https://"+listener.Addr().String()+config.MutatingPath, "application/json", bytes.NewReader(review))
+				if err == nil {
+					_ = resp.Body.Close()
+				}
+				answered <- err
+			}()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for tracker.Count() != 1 {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected the request to be in flight")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// Shut down while the request runs, letting it complete in time or not
+			cancel()
+			if tt.drained {
+				time.Sleep(50 * time.Millisecond)
+				close(gate)
+			}
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Run did not return after cancellation")
+			}
+			if !tt.drained {
+				close(gate)
+			}
+			<-answered
+
+			if tt.drained && err != nil {
+				t.Errorf("Expected a graceful shutdown, got %v", err)
+			}
+			if !tt.drained && err == nil {
+				t.Errorf("Expected the shutdown timeout to be reported")
+			}
+			output := logs.String()
+			if !strings.Contains(output, "Shutting down server gracefully, 1 admission requests in flight") || !strings.Contains(output, tt.expected) {
+				t.Errorf("Expected the drain to be logged with %q, got:\n%s", tt.expected, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName: instrumentation scope of the spans of the webhook
+const ScopeName = "glua-webhook"
+
+// Span attributes set by the webhook
+const (
+	// AttrWebhook: webhook type, mutating or validating
+	AttrWebhook = attribute.Key("glua.webhook")
+	// AttrKind: kind of the admitted object
+	AttrKind = attribute.Key("k8s.object.kind")
+	// AttrNamespace: namespace of the admitted object
+	AttrNamespace = attribute.Key("k8s.namespace.name")
+	// AttrName: name of the admitted object
+	AttrName = attribute.Key("k8s.object.name")
+	// AttrUID: UID of the admission request
+	AttrUID = attribute.Key("k8s.admission.uid")
+	// AttrOperation: admission operation, CREATE, UPDATE, DELETE or CONNECT
+	AttrOperation = attribute.Key("k8s.admission.operation")
+	// AttrAllowed: whether the request was allowed
+	AttrAllowed = attribute.Key("k8s.admission.allowed")
+	// AttrScript: name of a script, namespace/name[#key]
+	AttrScript = attribute.Key("glua.script")
+	// AttrScripts: number of scripts loaded
+	AttrScripts = attribute.Key("glua.scripts")
+	// AttrDurationMs: time a script took, conversions included, in milliseconds
+	AttrDurationMs = attribute.Key("glua.script.duration_ms")
+)
+
+// Tracer: returns the tracer of the webhook, a no-op one until Setup installs an exporter
+func Tracer() trace.Tracer {
+	return otel.Tracer(ScopeName)
+}
+
+// Setup: exports the spans of the webhook to the OTLP/HTTP endpoint, such as
+// http://otel-collector:4318, and propagates W3C trace context from incoming requests
+// Returns a function flushing the pending spans, to call on shutdown. An empty endpoint leaves
+// tracing disabled, spans are then no-ops
+func Setup(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected an http:// or https:// URL", endpoint)
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the OTLP exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ScopeName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Fail: marks span as failed with err, when not nil
+func Fail(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSetup(t *testing.T) {
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	shutdown, err := Setup(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Setup failed without an endpoint: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Expected the no-op shutdown to succeed, got %v", err)
+	}
+	if _, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); ok {
+		t.Error("Expected no tracer provider to be installed without an endpoint")
+	}
+
+	// The exporter only connects when spans are flushed
+	shutdown, err = Setup(context.Background(), "http://127.0.0.1:4318")
+	if err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	if _, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); !ok {
+		t.Errorf("Expected an SDK tracer provider, got %T", otel.GetTracerProvider())
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Expected shutdown to succeed without pending spans, got %v", err)
+	}
+
+	if _, err := Setup(context.Background(), "://bad"); err == nil {
+		t.Error("Expected an error with an invalid endpoint")
+	}
+}
+
+func TestFail(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(ScopeName)
+
+	_, ok := tracer.Start(context.Background(), "ok")
+	Fail(ok, nil)
+	ok.End()
+	_, failed := tracer.Start(context.Background(), "failed")
+	Fail(failed, errors.New("boom"))
+	failed.End()
+
+	spans := recorder.Ended()
+	if spans[0].Status().Code != codes.Unset {
+		t.Errorf("Expected a nil error to leave the status unset, got %v", spans[0].Status())
+	}
+	if spans[1].Status().Code != codes.Error || spans[1].Status().Description != "boom" || len(spans[1].Events()) != 1 {
+		t.Errorf("Expected the error to be recorded, got %v", spans[1].Status())
+	}
+}
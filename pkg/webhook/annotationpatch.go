@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/mattbaird/jsonpatch"
+)
+
+// annotationsPath: JSON pointer of the annotations of the admitted object
+const annotationsPath = "/metadata/annotations"
+
+// splitAnnotations: rewrites the "add" and "replace" operations setting the annotations map as a
+// whole into the add of an empty map followed by an add per annotation, at
+// /metadata/annotations/<escaped key>, so that the patch only ever sets the annotations it writes
+// and composes with the patches of other mutating webhooks
+// Such operations are only generated where the object had no annotations map, missing ("add") or
+// null ("replace"), an existing map being diffed key by key: operations on a single annotation,
+// "replace" included, and values that are not maps are passed through as is
+func splitAnnotations(operations []jsonpatch.JsonPatchOperation) ([]jsonpatch.JsonPatchOperation, error) {
+	split := make([]jsonpatch.JsonPatchOperation, 0, len(operations))
+	for _, operation := range operations {
+		if operation.Path != annotationsPath || (operation.Operation != "add" && operation.Operation != "replace") {
+			split = append(split, operation)
+			continue
+		}
+
+		encoded, err := json.Marshal(operation.Value)
+		if err != nil {
+			return nil, err
+		}
+		var annotations map[string]json.RawMessage
+		if !isJSONObject(encoded) || json.Unmarshal(encoded, &annotations) != nil {
+			split = append(split, operation)
+			continue
+		}
+
+		keys := make([]string, 0, len(annotations))
+		for key := range annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		split = append(split, jsonpatch.NewPatch("add", annotationsPath, map[string]interface{}{}))
+		for _, key := range keys {
+			split = append(split, jsonpatch.NewPatch("add", annotationsPath+"/"+escapePointerToken(key), annotations[key]))
+		}
+	}
+	return split, nil
+}
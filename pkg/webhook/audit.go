@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/luarunner"
+)
+
+const (
+	// AuditAnnotationScriptLog: audit annotation holding the condensed script logs of a request
+	// The API server prefixes it with the webhook name, e.g. mutate.glua.maurice.fr/script-log
+	AuditAnnotationScriptLog = "script-log"
+
+	// DefaultAuditMaxEntries: log entries kept per request when HandlerOptions.AuditMaxEntries is zero
+	DefaultAuditMaxEntries = 20
+
+	// AuditAnnotationMaxLength: longest script-log value written, every audit event of the request stores it
+	AuditAnnotationMaxLength = 4096
+
+	// auditEllipsis: marker appended to a truncated script-log value
+	auditEllipsis = "..."
+)
+
+// auditScriptLogs: records the logs of the scripts into the response audit annotations, when enabled
+func (h *WebhookHandler) auditScriptLogs(response *admissionv1.AdmissionResponse, results []luarunner.ScriptResult) {
+	if !h.options.AuditScriptLogs {
+		return
+	}
+
+	maxEntries := h.options.AuditMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultAuditMaxEntries
+	}
+
+	value := condenseScriptLogs(results, maxEntries)
+	if value == "" {
+		return
+	}
+
+	if response.AuditAnnotations == nil {
+		response.AuditAnnotations = make(map[string]string)
+	}
+	response.AuditAnnotations[AuditAnnotationScriptLog] = value
+}
+
+// condenseScriptLogs: joins up to maxEntries log entries prefixed with their script name,
+// truncated to AuditAnnotationMaxLength
+func condenseScriptLogs(results []luarunner.ScriptResult, maxEntries int) string {
+	var entries []string
+	total := 0
+	for _, result := range results {
+		for _, entry := range result.Logs {
+			total++
+			if len(entries) < maxEntries {
+				entries = append(entries, fmt.Sprintf("%s: %s", result.Name, entry))
+			}
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	if dropped := total - len(entries); dropped > 0 {
+		entries = append(entries, fmt.Sprintf("(%d more)", dropped))
+	}
+
+	return truncate(strings.Join(entries, "; "), AuditAnnotationMaxLength)
+}
+
+// truncate: shortens s to at most max bytes, ending with auditEllipsis when cut
+// The cut never splits a UTF-8 sequence
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	cut := max - len(auditEllipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + auditEllipsis
+}
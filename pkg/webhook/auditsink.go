@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/metrics"
+)
+
+const (
+	// DefaultAuditSinkQueue: patches waiting to be shipped to the audit sink, newer ones are dropped beyond it
+	DefaultAuditSinkQueue = 1000
+
+	// DefaultAuditSinkTimeout: time the audit sink is given to accept a record
+	DefaultAuditSinkTimeout = 5 * time.Second
+)
+
+// AuditRecord: a mutation shipped to the audit sink
+type AuditRecord struct {
+	// UID: UID of the admission request
+	UID string `json:"uid"`
+	// Kind: kind of the object
+	Kind string `json:"kind"`
+	// Namespace: namespace of the object, empty for cluster-scoped objects
+	Namespace string `json:"namespace,omitempty"`
+	// Name: name of the object, empty when generated by the API server
+	Name string `json:"name"`
+	// Patch: JSON patch of the response
+	Patch json.RawMessage `json:"patch"`
+	// Scripts: scripts run for the request, in execution order
+	Scripts []string `json:"scripts"`
+}
+
+// AuditSink: ships the patches of the mutating webhook to an external audit system, out of the
+// admission path. Records are queued and sent one at a time by a worker, they are dropped when the
+// queue is full, and failures to ship them never affect admission
+type AuditSink struct {
+	target  string
+	write   func(ctx context.Context, record []byte) error
+	file    *os.File
+	logger  *log.Logger
+	records chan []byte
+	done    chan struct{}
+
+	mu        sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+// NewAuditSink: creates a sink POSTing each record as JSON to an http(s) URL, or appending it as
+// a line of JSON to the file of a file:// URL, and starts its worker
+// The sink must be closed once the handlers using it are done
+func NewAuditSink(target string, logger *log.Logger) (*AuditSink, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit sink URL %q: %w", target, err)
+	}
+
+	sink := &AuditSink{
+		target:  parsed.Redacted(),
+		logger:  logger,
+		records: make(chan []byte, DefaultAuditSinkQueue),
+		done:    make(chan struct{}),
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		client := &http.Client{Timeout: DefaultAuditSinkTimeout}
+		sink.write = func(ctx context.Context, record []byte) error {
+			return postRecord(ctx, client, target, record)
+		}
+	case "file":
+		file, err := os.OpenFile(parsed.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit sink file: %w", err)
+		}
+		sink.file = file
+		sink.write = func(ctx context.Context, record []byte) error {
+			_, err := file.Write(append(record, '\n'))
+			return err
+		}
+	default:
+		return nil, fmt.Errorf("invalid audit sink URL %q: scheme must be http, https or file", target)
+	}
+
+	go sink.run()
+	return sink, nil
+}
+
+// postRecord: POSTs a record to target, any status but 2xx failing
+func postRecord(ctx context.Context, client *http.Client, target string, record []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// run: ships the queued records until the sink is closed and its queue drained
+func (s *AuditSink) run() {
+	defer close(s.done)
+
+	for record := range s.records {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultAuditSinkTimeout)
+		err := s.write(ctx, record)
+		cancel()
+		if err != nil {
+			s.logger.Printf("WARNING: Failed to ship a patch to the audit sink %s: %v", s.target, err)
+			metrics.AuditSinkFailures.WithLabelValues("error").Inc()
+		}
+	}
+}
+
+// send: queues the patch of a response for the sink, without waiting for it to be shipped
+// Nothing is sent by a nil sink, nor for responses without a patch
+func (s *AuditSink) send(req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse, scripts []string) {
+	if s == nil || len(response.Patch) == 0 {
+		return
+	}
+
+	record, err := json.Marshal(AuditRecord{
+		UID:       string(req.UID),
+		Kind:      req.Kind.Kind,
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		Patch:     response.Patch,
+		Scripts:   scripts,
+	})
+	if err != nil {
+		s.logger.Printf("WARNING: Failed to encode the audit record of %s: %v", req.UID, err)
+		metrics.AuditSinkFailures.WithLabelValues("error").Inc()
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.records <- record:
+	default:
+		s.logger.Printf("WARNING: Dropping the patch of %s, %d patches already waiting for the audit sink", req.UID, cap(s.records))
+		metrics.AuditSinkFailures.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Close: stops accepting records, and waits for the queued ones to be shipped
+func (s *AuditSink) Close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		close(s.records)
+		s.mu.Unlock()
+
+		<-s.done
+		if s.file != nil {
+			if err := s.file.Close(); err != nil {
+				s.logger.Printf("WARNING: Failed to close the audit sink file: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultMaxRequestBytes: largest request body, once decompressed, when HandlerOptions.MaxRequestBytes
+// is zero. An admission review holds at most two objects of the 1.5MiB etcd limit
+const DefaultMaxRequestBytes = 8 << 20
+
+// errRequestTooLarge: the request body, once decompressed, exceeds the request size limit
+var errRequestTooLarge = errors.New("request body too large")
+
+// unsupportedEncodingError: a Content-Encoding the handler cannot decode
+type unsupportedEncodingError struct {
+	encoding string
+}
+
+// Error: implements error
+func (e unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q (expected gzip or identity)", e.encoding)
+}
+
+// limitedReader: fails reads going past max bytes with errRequestTooLarge, rather than stopping
+// silently like io.LimitReader and handing a truncated document to the decoder
+type limitedReader struct {
+	reader io.Reader
+	left   int64
+}
+
+// Read: implements io.Reader
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// Reading a byte more tells a body of exactly the limit from a larger one
+		var probe [1]byte
+		if n, _ := l.reader.Read(probe[:]); n > 0 {
+			return 0, errRequestTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.reader.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// maxRequestBytes: returns the largest request body, compressed or not
+func (h *WebhookHandler) maxRequestBytes() int64 {
+	if h.options.MaxRequestBytes > 0 {
+		return h.options.MaxRequestBytes
+	}
+	return DefaultMaxRequestBytes
+}
+
+// requestBody: returns the body of r decoded according to its Content-Encoding header, encodings
+// being undone from the last applied to the first. The body is read as it arrives whether it has
+// a Content-Length or is chunked, and reads fail with errRequestTooLarge past MaxRequestBytes,
+// compressed and decompressed, so that a small compressed body cannot expand without bound
+// The returned function releases the decoders
+func (h *WebhookHandler) requestBody(r *http.Request) (io.Reader, func(), error) {
+	limit := h.maxRequestBytes()
+	var body io.Reader = &limitedReader{reader: r.Body, left: limit}
+	var closers []io.Closer
+	release := func() {
+		for _, closer := range closers {
+			_ = closer.Close()
+		}
+	}
+
+	var encodings []string
+	for _, header := range r.Header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "identity":
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(body)
+			if err != nil {
+				release()
+				if errors.Is(err, errRequestTooLarge) {
+					return nil, nil, err
+				}
+				return nil, nil, fmt.Errorf("invalid gzip body: %w", err)
+			}
+			closers = append(closers, reader)
+			body = &limitedReader{reader: reader, left: limit}
+		default:
+			release()
+			return nil, nil, unsupportedEncodingError{encoding: encodings[i]}
+		}
+	}
+	return body, release, nil
+}
+
+// rejectBody: answers a request whose body could not be read or decoded, with 415 for unsupported
+// encodings, 413 for bodies over the size limit and 400 otherwise
+func (h *WebhookHandler) rejectBody(w http.ResponseWriter, err error) {
+	h.logger.Printf("ERROR: Failed to decode admission review: %v", err)
+
+	var unsupported unsupportedEncodingError
+	switch {
+	case errors.As(err, &unsupported):
+		h.writeReview(w, http.StatusUnsupportedMediaType, buildReview("", "", rejectReview(http.StatusUnsupportedMediaType, metav1.StatusReasonUnsupportedMediaType, "%v", err)))
+	case errors.Is(err, errRequestTooLarge):
+		h.writeReview(w, http.StatusRequestEntityTooLarge, buildReview("", "", rejectReview(http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge, "request body exceeds %d bytes", h.maxRequestBytes())))
+	default:
+		h.writeReview(w, http.StatusBadRequest, buildReview("", "", rejectReview(http.StatusBadRequest, metav1.StatusReasonBadRequest, "failed to decode request: %v", err)))
+	}
+}
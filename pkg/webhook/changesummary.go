@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/mattbaird/jsonpatch"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+// AnnotationChangeSummary: annotation written on mutated objects when HandlerOptions.ChangeSummary
+// is set, a JSON ChangeSummary of what the scripts changed
+const AnnotationChangeSummary = scriptloader.AnnotationPrefix + "/change-summary"
+
+// ChangeSummary: machine-readable record of the changes the scripts made to an object
+type ChangeSummary struct {
+	// Changes: changed paths, sorted
+	Changes []PathChange `json:"changes"`
+}
+
+// PathChange: a path changed by the scripts
+type PathChange struct {
+	// Path: JSON pointer of the changed value
+	Path string `json:"path"`
+	// Scripts: scripts that changed it, in execution order
+	Scripts []string `json:"scripts"`
+}
+
+// changeRecorder: collects the paths each script of a chain changed
+type changeRecorder struct {
+	changes map[string][]string // path -> scripts
+}
+
+// filter: returns next, recording the paths the result it keeps differs from the object the script received
+func (c *changeRecorder) filter(next luarunner.ScriptFilter) luarunner.ScriptFilter {
+	return func(scriptName string, before, after []byte) ([]byte, []string, error) {
+		result, warnings, err := after, []string(nil), error(nil)
+		if next != nil {
+			result, warnings, err = next(scriptName, before, after)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		operations, err := jsonpatch.CreatePatch(before, result)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to diff script changes: %w", err)
+		}
+		for _, operation := range operations {
+			scripts := c.changes[operation.Path]
+			if len(scripts) == 0 || scripts[len(scripts)-1] != scriptName {
+				c.changes[operation.Path] = append(scripts, scriptName)
+			}
+		}
+		return result, warnings, nil
+	}
+}
+
+// summary: returns the changes recorded, sorted by path
+func (c *changeRecorder) summary() ChangeSummary {
+	summary := ChangeSummary{Changes: make([]PathChange, 0, len(c.changes))}
+	for path, scripts := range c.changes {
+		summary.Changes = append(summary.Changes, PathChange{Path: path, Scripts: scripts})
+	}
+	sort.Slice(summary.Changes, func(i, j int) bool { return summary.Changes[i].Path < summary.Changes[j].Path })
+	return summary
+}
+
+// scripts: returns the scripts that changed anything, sorted
+func (c *changeRecorder) scripts() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, scripts := range c.changes {
+		for _, name := range scripts {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withChangeSummary: returns object with the AnnotationChangeSummary annotation set to summary
+func withChangeSummary(object []byte, summary ChangeSummary) ([]byte, error) {
+	value, err := json.Marshal(summary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode change summary: %w", err)
+	}
+
+	doc, err := decodeNumbers(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	doc = pointerSet(doc, []string{"metadata", "annotations", AnnotationChangeSummary}, string(value))
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,43 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/metrics"
+	"thechat/pkg/scriptloader"
+)
+
+// checkConsistency: runs scripts again against the object they mutated, as the validating webhook
+// would, and warns when one of them denies it. The mutation is not undone, the warning only tells
+// the scripts disagree on the object, before the validating webhook rejects it
+// Scripts run a second time, side effects such as HTTP calls and audit entries included, and what
+// they report during that run is discarded
+func (h *WebhookHandler) checkConsistency(ctx context.Context, response *admissionv1.AdmissionResponse, key string, order []string, scripts map[string]string, mutated []byte, recorder *changeRecorder) {
+	mutators := recorder.scripts()
+	if len(mutators) == 0 {
+		return
+	}
+
+	_, results, err := h.scriptRunner.RunOrderedScriptsWithContext(ctx, order, scripts, mutated)
+	if err != nil {
+		h.logger.Printf("WARNING: Failed to check the consistency of the scripts on %s: %v", key, err)
+		return
+	}
+	for _, result := range results {
+		var denial *luarunner.Denial
+		if !errors.As(result.Err, &denial) {
+			continue
+		}
+
+		message := fmt.Sprintf("%s would deny the object as mutated by %s: %s", result.Name, strings.Join(mutators, ", "), denial.Message)
+		h.logger.Printf("WARNING: Inconsistent scripts on %s: %s", key, message)
+		metrics.ConsistencyConflicts.WithLabelValues(scriptloader.ConfigMapOf(result.Name)).Inc()
+		response.Warnings = append(response.Warnings, message)
+	}
+}
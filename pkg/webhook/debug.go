@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"thechat/pkg/cluster"
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+const (
+	// DebugScriptsPath: lists the scripts currently cached by the loader
+	DebugScriptsPath = "/debug/scripts"
+	// DebugScriptsFlushPath: drops every cache derived from scripts and cluster objects
+	// (POST only, requires flushing to be enabled)
+	DebugScriptsFlushPath = "/debug/scripts/flush"
+	// DebugFlushCachePath: alias of DebugScriptsFlushPath
+	DebugFlushCachePath = "/debug/flush-cache"
+)
+
+// DebugHandler: serves introspection endpoints about the scripts held in memory
+// Script content is never returned, only hashes and metadata
+type DebugHandler struct {
+	scriptLoader  *scriptloader.ScriptLoader
+	clusterLookup *cluster.Lookup
+	handlers      []*WebhookHandler
+	logger        *log.Logger
+	allowFlush    bool
+}
+
+// NewDebugHandler: creates a debug handler for the given loader
+// allowFlush enables the cache flush endpoint
+func NewDebugHandler(scriptLoader *scriptloader.ScriptLoader, logger *log.Logger, allowFlush bool) *DebugHandler {
+	return &DebugHandler{
+		scriptLoader: scriptLoader,
+		logger:       logger,
+		allowFlush:   allowFlush,
+	}
+}
+
+// SetClusterLookup: includes the cluster lookup cache statistics in the scripts listing
+func (d *DebugHandler) SetClusterLookup(lookup *cluster.Lookup) {
+	d.clusterLookup = lookup
+}
+
+// SetWebhookHandlers: lets the cache flush endpoint drop the compiled scripts and cached responses
+// of the given handlers, and includes the modules their scripts use in the scripts listing
+func (d *DebugHandler) SetWebhookHandlers(handlers ...*WebhookHandler) {
+	d.handlers = handlers
+}
+
+// Register: registers the debug endpoints on the given mux
+func (d *DebugHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc(DebugScriptsPath, d.serveScripts)
+	mux.HandleFunc(DebugScriptsFlushPath, d.serveFlush)
+	mux.HandleFunc(DebugFlushCachePath, d.serveFlush)
+}
+
+// serveScripts: returns the cached scripts metadata as JSON
+func (d *DebugHandler) serveScripts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload := struct {
+		Scripts []scriptloader.CachedScript `json:"scripts"`
+		Cluster *cluster.Stats              `json:"cluster,omitempty"`
+		// Usage: modules and module functions used by the scripts, by webhook type
+		Usage map[string][]luarunner.ScriptUsage `json:"usage,omitempty"`
+	}{
+		Scripts: d.scriptLoader.CachedScripts(),
+	}
+	if d.clusterLookup != nil {
+		stats := d.clusterLookup.Stats()
+		payload.Cluster = &stats
+	}
+	for _, handler := range d.handlers {
+		if payload.Usage == nil {
+			payload.Usage = make(map[string][]luarunner.ScriptUsage)
+		}
+		payload.Usage[handler.webhookType] = handler.scriptRunner.Usage()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		d.logger.Printf("ERROR: Failed to encode debug scripts payload: %v", err)
+	}
+}
+
+// serveFlush: drops the script content, compiled scripts, cached responses and cached namespaces
+func (d *DebugHandler) serveFlush(w http.ResponseWriter, r *http.Request) {
+	if !d.allowFlush {
+		http.Error(w, "cache flushing is disabled", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d.logger.Printf("Flushing all caches on request from %s", r.RemoteAddr)
+	d.scriptLoader.Flush()
+	for _, handler := range d.handlers {
+		handler.scriptRunner.FlushCompiled()
+		if handler.responses != nil {
+			handler.responses.flush()
+		}
+	}
+	if d.clusterLookup != nil {
+		d.clusterLookup.FlushNamespaces()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
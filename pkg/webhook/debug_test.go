@@ -0,0 +1,247 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"thechat/pkg/cluster"
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+// debugPayload: decoded body of the debug scripts endpoint
+type debugPayload struct {
+	Scripts []scriptloader.CachedScript        `json:"scripts"`
+	Cluster *cluster.Stats                     `json:"cluster"`
+	Usage   map[string][]luarunner.ScriptUsage `json:"usage"`
+}
+
+func getDebugScripts(t *testing.T, mux *http.ServeMux) debugPayload {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, DebugScriptsPath, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var payload debugPayload
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("Failed to unmarshal debug payload: %v", err)
+	}
+
+	return payload
+}
+
+func TestDebugHandler_ScriptsAndFlush(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.metadata.labels = {first = "true"}`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "second", Namespace: "default"},
+			Data:       map[string]string{"policy.lua": `warn("second")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "encode", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `warn(require("json").stringify({encoded = true}))`},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := scriptloader.NewScriptLoaderWithOptions(clientset, logger, scriptloader.Options{CacheTTL: time.Minute})
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ScriptLoader: loader})
+
+	serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/first,default/second",
+	}))
+
+	mux := http.NewServeMux()
+	NewDebugHandler(loader, logger, true).Register(mux)
+
+	payload := getDebugScripts(t, mux)
+	if len(payload.Scripts) != 2 {
+		t.Fatalf("Expected 2 cached scripts, got %d", len(payload.Scripts))
+	}
+
+	first, second := payload.Scripts[0], payload.Scripts[1]
+	if first.Ref != "default/first" || first.Name != "default/first" || first.Key != "script.lua" {
+		t.Errorf("Unexpected first script: %+v", first)
+	}
+
+	if second.Ref != "default/second" || second.Name != "default/second#policy.lua" || second.Key != "policy.lua" {
+		t.Errorf("Unexpected second script: %+v", second)
+	}
+
+	// sha256 of `warn("second")`
+	if second.Hash != "475ec179fdeb10c6e8a1e241159c18aad23799048937a940fef0e1678ed1ca96" {
+		t.Errorf("Expected the SHA-256 of the script content, got %q", second.Hash)
+	}
+
+	if first.Source != scriptloader.SourceConfigMap || first.Size != len(`object.metadata.labels = {first = "true"}`) {
+		t.Errorf("Unexpected source or size: %+v", first)
+	}
+
+	if first.Priority != nil || first.Timeout != "" || first.FailurePolicy != scriptloader.FailurePolicyIgnore {
+		t.Errorf("Expected the default options of the server, got %+v", first)
+	}
+
+	if first.ExpiresAt == nil || !first.ExpiresAt.Equal(first.LoadedAt.Add(time.Minute)) {
+		t.Errorf("Expected cache expiry one TTL after load, got %v", first.ExpiresAt)
+	}
+
+	if payload.Usage != nil {
+		t.Errorf("Expected no usage without webhook handlers, got %v", payload.Usage)
+	}
+	debugHandler := NewDebugHandler(loader, logger, true)
+	debugHandler.SetWebhookHandlers(handler)
+	usageMux := http.NewServeMux()
+	debugHandler.Register(usageMux)
+	serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/encode",
+	}))
+	usage := getDebugScripts(t, usageMux).Usage["mutating"]
+	if len(usage) != 3 || usage[0].Name != "default/encode" || usage[0].Modules["json"] != 1 || usage[0].Functions["json.stringify"] != 1 {
+		t.Errorf("Expected the modules used by each script, got %+v", usage)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, DebugScriptsFlushPath, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	if payload := getDebugScripts(t, mux); len(payload.Scripts) != 0 {
+		t.Errorf("Expected empty cache after flush, got %d scripts", len(payload.Scripts))
+	}
+}
+
+func TestDebugHandler_FlushDisabled(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := scriptloader.NewScriptLoader(clientset, logger)
+
+	mux := http.NewServeMux()
+	NewDebugHandler(loader, logger, false).Register(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, DebugScriptsFlushPath, nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestDebugHandler_ClusterStats(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"env": "prod"}},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "env", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				local cluster = require("cluster")
+				local ns = cluster.get_namespace("default")
+				object.metadata.labels = {env = ns.metadata.labels.env}
+			`},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := scriptloader.NewScriptLoader(clientset, logger)
+	lookup := cluster.NewLookup(clientset, logger, cluster.Options{})
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		ScriptLoader:  loader,
+		ClusterLookup: lookup,
+	})
+
+	mux := http.NewServeMux()
+	debugHandler := NewDebugHandler(loader, logger, false)
+	debugHandler.SetClusterLookup(lookup)
+	debugHandler.Register(mux)
+
+	for i := 0; i < 2; i++ {
+		serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+			"glua.maurice.fr/scripts": "default/env",
+		}))
+	}
+
+	payload := getDebugScripts(t, mux)
+	if payload.Cluster == nil {
+		t.Fatal("Expected cluster lookup statistics in the payload")
+	}
+	if payload.Cluster.Fetches != 1 || payload.Cluster.NamespaceHits != 1 {
+		t.Errorf("Expected one fetch and one namespace cache hit, got %+v", payload.Cluster)
+	}
+}
+
+func TestDebugHandler_FlushCache(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.metadata.labels = {flushed = "true"}`},
+		},
+	)
+
+	gets := 0
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := scriptloader.NewScriptLoaderWithOptions(clientset, logger, scriptloader.Options{CacheTTL: time.Hour})
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ScriptLoader: loader})
+	body := newPodAdmissionReview(t, map[string]string{"glua.maurice.fr/scripts": "default/label"})
+
+	flush := func(path string, allowFlush bool) int {
+		mux := http.NewServeMux()
+		debugHandler := NewDebugHandler(loader, logger, allowFlush)
+		debugHandler.SetWebhookHandlers(handler)
+		debugHandler.Register(mux)
+
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code
+	}
+
+	for i, path := range []string{DebugScriptsFlushPath, DebugFlushCachePath} {
+		serveAdmissionReview(t, handler, body)
+		serveAdmissionReview(t, handler, body)
+		if gets != i+1 {
+			t.Fatalf("Expected the script to be cached after the first request, got %d GETs", gets)
+		}
+
+		if code := flush(path, false); code != http.StatusForbidden {
+			t.Errorf("Expected status %d from %s without --enable-debug, got %d", http.StatusForbidden, path, code)
+		}
+		serveAdmissionReview(t, handler, body)
+		if gets != i+1 {
+			t.Errorf("Expected the cache to survive a rejected flush, got %d GETs", gets)
+		}
+
+		if code := flush(path, true); code != http.StatusNoContent {
+			t.Fatalf("Expected status %d from %s, got %d", http.StatusNoContent, path, code)
+		}
+
+		response := serveAdmissionReview(t, handler, body)
+		if gets != i+2 {
+			t.Errorf("Expected the script to be fetched again after the flush of %s, got %d GETs", path, gets)
+		}
+		if response.Patch == nil {
+			t.Error("Expected the re-fetched script to still mutate the object")
+		}
+	}
+}
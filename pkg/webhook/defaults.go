@@ -0,0 +1,212 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// defaultField: a field the API server defaults when missing, path may hold "*" for every element of an array
+type defaultField struct {
+	path  []string
+	value interface{}
+}
+
+// appliedDefault: a default set on an object, at a concrete path
+// names holds, for each array index of path, the name of the element it designates, so that the
+// default is found again once scripts reorder, insert or remove elements such as containers
+type appliedDefault struct {
+	path  []string
+	names []string
+	value interface{}
+}
+
+// podSpecDefaults: defaults of a pod spec found at prefix
+func podSpecDefaults(prefix ...string) []defaultField {
+	at := func(path ...string) []string {
+		return append(append([]string{}, prefix...), path...)
+	}
+	return []defaultField{
+		{at("restartPolicy"), "Always"},
+		{at("dnsPolicy"), "ClusterFirst"},
+		{at("schedulerName"), "default-scheduler"},
+		{at("terminationGracePeriodSeconds"), json.Number("30")},
+		{at("securityContext"), map[string]interface{}{}},
+		{at("containers", "*", "terminationMessagePath"), "/dev/termination-log"},
+		{at("containers", "*", "terminationMessagePolicy"), "File"},
+		{at("initContainers", "*", "terminationMessagePath"), "/dev/termination-log"},
+		{at("initContainers", "*", "terminationMessagePolicy"), "File"},
+	}
+}
+
+// kindDefaults: fields the API server defaults on objects of well-known kinds, applied with
+// HandlerOptions.ApplyDefaults so that scripts see the values the object will be stored with
+// Defaults depending on other fields, such as imagePullPolicy, are left to the API server
+var kindDefaults = map[string][]defaultField{
+	"Pod": podSpecDefaults("spec"),
+	"Deployment": append([]defaultField{
+		{[]string{"spec", "replicas"}, json.Number("1")},
+		{[]string{"spec", "revisionHistoryLimit"}, json.Number("10")},
+		{[]string{"spec", "progressDeadlineSeconds"}, json.Number("600")},
+	}, podSpecDefaults("spec", "template", "spec")...),
+	"StatefulSet": append([]defaultField{
+		{[]string{"spec", "replicas"}, json.Number("1")},
+		{[]string{"spec", "podManagementPolicy"}, "OrderedReady"},
+		{[]string{"spec", "revisionHistoryLimit"}, json.Number("10")},
+	}, podSpecDefaults("spec", "template", "spec")...),
+	"DaemonSet": append([]defaultField{
+		{[]string{"spec", "revisionHistoryLimit"}, json.Number("10")},
+	}, podSpecDefaults("spec", "template", "spec")...),
+	"Job": append([]defaultField{
+		{[]string{"spec", "backoffLimit"}, json.Number("6")},
+		{[]string{"spec", "completions"}, json.Number("1")},
+		{[]string{"spec", "parallelism"}, json.Number("1")},
+	}, podSpecDefaults("spec", "template", "spec")...),
+	"Service": {
+		{[]string{"spec", "sessionAffinity"}, "None"},
+		{[]string{"spec", "type"}, "ClusterIP"},
+	},
+}
+
+// applyDefaults: returns object with the defaults of its kind set where missing, along with the
+// defaults set. Objects of kinds without defaults are returned as is
+// Defaults are only set within objects that exist, a Pod without spec gets none
+func applyDefaults(kind string, object []byte) ([]byte, []appliedDefault, error) {
+	fields, ok := kindDefaults[kind]
+	if !ok {
+		return object, nil, nil
+	}
+
+	doc, err := decodeNumbers(object)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+
+	var applied []appliedDefault
+	for _, field := range fields {
+		for _, path := range expandPath(doc, field.path) {
+			parent, ok := pointerGet(doc, path[:len(path)-1])
+			if !ok {
+				continue
+			}
+			node, ok := parent.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, exists := node[path[len(path)-1]]; exists {
+				continue
+			}
+			node[path[len(path)-1]] = field.value
+			applied = append(applied, appliedDefault{path: path, names: elementNames(doc, path), value: field.value})
+		}
+	}
+	if len(applied) == 0 {
+		return object, nil, nil
+	}
+
+	defaulted, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode object: %w", err)
+	}
+	return defaulted, applied, nil
+}
+
+// expandPath: returns the concrete paths path designates in doc, one per element of the arrays
+// found where it holds "*"
+func expandPath(doc interface{}, path []string) [][]string {
+	for i, token := range path {
+		if token != "*" {
+			continue
+		}
+		items, ok := pointerGet(doc, path[:i])
+		if !ok {
+			return nil
+		}
+		array, ok := items.([]interface{})
+		if !ok {
+			return nil
+		}
+
+		var paths [][]string
+		for index := range array {
+			concrete := append(append(append([]string{}, path[:i]...), strconv.Itoa(index)), path[i+1:]...)
+			paths = append(paths, expandPath(doc, concrete)...)
+		}
+		return paths
+	}
+	return [][]string{path}
+}
+
+// removeDefaults: returns the object left by the scripts without the defaults they did not change,
+// so that the patch computed against the original object only holds the changes of the scripts
+// original is returned when the scripts changed nothing in the defaulted object
+func removeDefaults(original, defaulted, modified []byte, applied []appliedDefault) ([]byte, error) {
+	if bytes.Equal(modified, defaulted) {
+		return original, nil
+	}
+
+	doc, err := decodeNumbers(modified)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	for _, field := range applied {
+		path, ok := field.resolve(doc)
+		if !ok {
+			continue
+		}
+		if value, ok := pointerGet(doc, path); ok && reflect.DeepEqual(value, field.value) {
+			doc = pointerRemove(doc, path)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// elementNames: returns, for each token of path in doc, the name of the array element it
+// designates, empty for object fields and elements without name
+func elementNames(doc interface{}, path []string) []string {
+	names := make([]string, len(path))
+	for i := range path {
+		parent, _ := pointerGet(doc, path[:i])
+		if _, ok := parent.([]interface{}); !ok {
+			continue
+		}
+		if element, ok := pointerGet(doc, path[:i+1]); ok {
+			if fields, ok := element.(map[string]interface{}); ok {
+				names[i], _ = fields["name"].(string)
+			}
+		}
+	}
+	return names
+}
+
+// resolve: returns the path of the default in doc, its array elements found by name rather than
+// by position, false when an element is gone or has no name to be found by
+func (d appliedDefault) resolve(doc interface{}) ([]string, bool) {
+	path := append([]string{}, d.path...)
+	for i, name := range d.names {
+		parent, ok := pointerGet(doc, path[:i])
+		if !ok {
+			return nil, false
+		}
+		elements, ok := parent.([]interface{})
+		if !ok {
+			continue
+		}
+		if name == "" {
+			return nil, false
+		}
+		found := false
+		for index, element := range elements {
+			if fields, ok := element.(map[string]interface{}); ok && fields["name"] == name {
+				path[i], found = strconv.Itoa(index), true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return path, true
+}
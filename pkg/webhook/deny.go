@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"thechat/pkg/luarunner"
+)
+
+// denialStatuses: status reason and code of the admission response for each denial reason of the scripts
+var denialStatuses = map[string]struct {
+	reason metav1.StatusReason
+	code   int32
+}{
+	luarunner.DenyForbidden: {metav1.StatusReasonForbidden, http.StatusForbidden},
+	luarunner.DenyInvalid:   {metav1.StatusReasonInvalid, http.StatusUnprocessableEntity},
+	luarunner.DenyConflict:  {metav1.StatusReasonConflict, http.StatusConflict},
+}
+
+// denied: denies the request when scripts of the chain called one of the deny helpers, with the
+// status reason and code matching the helper. Returns true when the request was denied
+// A single denial is reported in the message of the status. Several denials, from the validating
+// webhook which runs every script, are summed up in the message and reported as one cause each in
+// the details of the status, the reason and code being those of the first denial. Denials naming a
+// field always come with their causes. Denials listing causes are reported with one cause each,
+// a single such denial keeping its message
+func (h *WebhookHandler) denied(response *admissionv1.AdmissionResponse, results []luarunner.ScriptResult) bool {
+	var causes []metav1.StatusCause
+	var first *luarunner.Denial
+	var firstScript string
+	var listed bool
+	for _, result := range results {
+		var denial *luarunner.Denial
+		if !errors.As(result.Err, &denial) {
+			continue
+		}
+
+		h.logger.Printf("WARNING: Script %s denied the request (%s): %s", result.Name, denial.Reason, denial.Message)
+		if first == nil {
+			first, firstScript = denial, result.Name
+		}
+		if len(denial.Causes) == 0 {
+			causes = append(causes, metav1.StatusCause{
+				Type:    metav1.CauseType(denialStatuses[denial.Reason].reason),
+				Message: fmt.Sprintf("%s: %s", result.Name, denial.Message),
+				Field:   denial.Field,
+			})
+			continue
+		}
+		for _, cause := range denial.Causes {
+			causeType := metav1.CauseType(cause.Type)
+			if causeType == "" {
+				causeType = metav1.CauseType(denialStatuses[denial.Reason].reason)
+			}
+			causes = append(causes, metav1.StatusCause{
+				Type:    causeType,
+				Message: fmt.Sprintf("%s: %s", result.Name, cause.Message),
+				Field:   cause.Field,
+			})
+		}
+		listed = true
+	}
+	if first == nil {
+		return false
+	}
+
+	status := denialStatuses[first.Reason]
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: fmt.Sprintf("%s: %s", firstScript, first.Message),
+		Reason:  status.reason,
+		Code:    status.code,
+	}
+	if len(causes) > 1 && !(listed && len(first.Causes) == len(causes)) {
+		response.Result.Message = fmt.Sprintf("%d policy violations (see details)", len(causes))
+	}
+	if len(causes) > 1 || first.Field != "" || listed {
+		response.Result.Details = &metav1.StatusDetails{Causes: causes}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mattbaird/jsonpatch"
+)
+
+// diffRaw: appends the operations turning before into after, found at pointer, to operations
+// Subtrees encoded identically are skipped without being decoded, which is most of a large object
+// scripts barely touch. Objects are compared key by key, anything else is diffed by jsonpatch
+func diffRaw(pointer string, before, after json.RawMessage, operations []jsonpatch.JsonPatchOperation) ([]jsonpatch.JsonPatchOperation, error) {
+	if bytes.Equal(before, after) {
+		return operations, nil
+	}
+
+	var beforeFields, afterFields map[string]json.RawMessage
+	if isJSONObject(before) && isJSONObject(after) &&
+		json.Unmarshal(before, &beforeFields) == nil && json.Unmarshal(after, &afterFields) == nil {
+		keys := make([]string, 0, len(beforeFields)+len(afterFields))
+		for key := range beforeFields {
+			keys = append(keys, key)
+		}
+		for key := range afterFields {
+			if _, ok := beforeFields[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			path := pointer + "/" + escapePointerToken(key)
+			beforeValue, inBefore := beforeFields[key]
+			afterValue, inAfter := afterFields[key]
+			switch {
+			case !inAfter:
+				operations = append(operations, jsonpatch.NewPatch("remove", path, nil))
+			case !inBefore:
+				operations = append(operations, jsonpatch.NewPatch("add", path, afterValue))
+			default:
+				var err error
+				if operations, err = diffRaw(path, beforeValue, afterValue, operations); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return operations, nil
+	}
+
+	// jsonpatch only diffs objects, the values are wrapped into one
+	wrapped, err := jsonpatch.CreatePatch(wrapValue(before), wrapValue(after))
+	if err != nil {
+		return nil, err
+	}
+	for _, operation := range wrapped {
+		operation.Path = pointer + strings.TrimPrefix(operation.Path, "/v")
+		operations = append(operations, operation)
+	}
+	return operations, nil
+}
+
+// sameJSON: reports whether a and b encode the same value, whatever the order of their fields and
+// their spacing
+func sameJSON(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	left, err := decodeNumbers(a)
+	if err != nil {
+		return false
+	}
+	right, err := decodeNumbers(b)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// emptyPatch: reports whether a JSON patch holds no operation
+func emptyPatch(patch []byte) bool {
+	var operations []json.RawMessage
+	return json.Unmarshal(patch, &operations) == nil && len(operations) == 0
+}
+
+// isJSONObject: reports whether data encodes a JSON object, from its first significant byte
+func isJSONObject(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// wrapValue: returns the encoding of an object holding value under the "v" key
+func wrapValue(value json.RawMessage) []byte {
+	wrapped := make([]byte, 0, len(value)+6)
+	wrapped = append(wrapped, `{"v":`...)
+	wrapped = append(wrapped, value...)
+	return append(wrapped, '}')
+}
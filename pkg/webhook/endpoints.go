@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"net/http"
+)
+
+// Endpoints: admission endpoints served by the webhook
+// A nil handler disables its endpoint, which is then not registered at all
+type Endpoints struct {
+	// MutatingPath: path of the mutating endpoint
+	MutatingPath string
+	// Mutating: mutating handler, nil when the mutating webhook is disabled
+	Mutating *WebhookHandler
+	// ValidatingPath: path of the validating endpoint
+	ValidatingPath string
+	// Validating: validating handler, nil when the validating webhook is disabled
+	Validating *WebhookHandler
+}
+
+// Register: registers the enabled admission endpoints on the given mux
+func (e Endpoints) Register(mux *http.ServeMux) {
+	if e.Mutating != nil {
+		mux.Handle(e.MutatingPath, e.Mutating)
+	}
+	if e.Validating != nil {
+		mux.Handle(e.ValidatingPath, e.Validating)
+	}
+}
+
+// Handlers: returns the enabled handlers
+func (e Endpoints) Handlers() []*WebhookHandler {
+	var handlers []*WebhookHandler
+	if e.Mutating != nil {
+		handlers = append(handlers, e.Mutating)
+	}
+	if e.Validating != nil {
+		handlers = append(handlers, e.Validating)
+	}
+	return handlers
+}
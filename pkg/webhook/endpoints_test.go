@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEndpoints_DisabledPathNotFound(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	body := newPodAdmissionReview(t, nil)
+
+	tests := []struct {
+		name       string
+		endpoints  Endpoints
+		mutating   int
+		validating int
+		handlers   int
+	}{
+		{
+			name: "both enabled",
+			endpoints: Endpoints{
+				MutatingPath: "/mutate", Mutating: NewWebhookHandler(clientset, logger, "mutating"),
+				ValidatingPath: "/validate", Validating: NewWebhookHandler(clientset, logger, "validating"),
+			},
+			mutating: http.StatusOK, validating: http.StatusOK, handlers: 2,
+		},
+		{
+			name: "validation disabled",
+			endpoints: Endpoints{
+				MutatingPath: "/mutate", Mutating: NewWebhookHandler(clientset, logger, "mutating"),
+				ValidatingPath: "/validate",
+			},
+			mutating: http.StatusOK, validating: http.StatusNotFound, handlers: 1,
+		},
+		{
+			name: "mutating disabled",
+			endpoints: Endpoints{
+				MutatingPath:   "/mutate",
+				ValidatingPath: "/validate", Validating: NewWebhookHandler(clientset, logger, "validating"),
+			},
+			mutating: http.StatusNotFound, validating: http.StatusOK, handlers: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			tt.endpoints.Register(mux)
+
+			for path, expected := range map[string]int{"/mutate": tt.mutating, "/validate": tt.validating} {
+				req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+				rec := httptest.NewRecorder()
+				mux.ServeHTTP(rec, req)
+
+				if rec.Code != expected {
+					t.Errorf("Expected status %d on %s, got %d", expected, path, rec.Code)
+				}
+			}
+
+			if got := len(tt.endpoints.Handlers()); got != tt.handlers {
+				t.Errorf("Expected %d enabled handlers, got %d", tt.handlers, got)
+			}
+		})
+	}
+}
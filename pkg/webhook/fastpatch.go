@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/mattbaird/jsonpatch"
+
+	"thechat/pkg/luarunner"
+)
+
+// bookkeepingAnnotations: annotations the webhook itself writes on mutated objects, after the scripts ran
+var bookkeepingAnnotations = []string{AnnotationChangeSummary, AnnotationAppliedScripts, AnnotationProcessedGeneration}
+
+// metadataPatch: builds the patch of a chain whose only changes went through add_label and
+// add_annotation, from the changes recorded, without diffing the objects
+// The bookkeeping annotations of modified are patched along with them
+// Returns false when the scripts changed anything else, the patch must then come from the diff
+func metadataPatch(original, modified []byte, results []luarunner.ScriptResult) ([]byte, bool) {
+	var changes []luarunner.MetadataChange
+	for _, result := range results {
+		if result.Err == nil {
+			changes = append(changes, result.Metadata...)
+		}
+	}
+
+	expected, err := decodeNumbers(modified)
+	if err != nil {
+		return nil, false
+	}
+	changes = append(changes, bookkeepingChanges(expected)...)
+	if len(changes) == 0 {
+		return nil, false
+	}
+
+	object, err := decodeNumbers(original)
+	if err != nil {
+		return nil, false
+	}
+	root, ok := object.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	metadata, _ := root["metadata"].(map[string]interface{})
+	if metadata == nil {
+		return nil, false
+	}
+
+	// Replay the changes on the original object, the first change of a missing map adds the whole
+	// map, which the following changes then fill
+	operations := make([]jsonpatch.JsonPatchOperation, 0, len(changes))
+	added := make(map[string]bool, 2)
+	for _, change := range changes {
+		entries, exists := metadata[change.Field].(map[string]interface{})
+		if !exists {
+			entries = map[string]interface{}{}
+			metadata[change.Field] = entries
+			added[change.Field] = true
+			operations = append(operations, jsonpatch.NewPatch("add", "/metadata/"+change.Field, entries))
+		}
+		if added[change.Field] {
+			entries[change.Key] = change.Value
+			continue
+		}
+		if current, ok := entries[change.Key]; ok && current == change.Value {
+			continue
+		}
+		entries[change.Key] = change.Value
+		operations = append(operations, jsonpatch.NewPatch("add", "/metadata/"+change.Field+"/"+escapePointerToken(change.Key), change.Value))
+	}
+
+	// The recorded changes must account for everything the scripts did
+	if !reflect.DeepEqual(object, expected) {
+		return nil, false
+	}
+
+	operations, err = splitAnnotations(operations)
+	if err != nil {
+		return nil, false
+	}
+	patch, err := json.Marshal(operations)
+	if err != nil {
+		return nil, false
+	}
+	return patch, true
+}
+
+// bookkeepingChanges: returns the bookkeeping annotations set on object, as metadata changes
+func bookkeepingChanges(object interface{}) []luarunner.MetadataChange {
+	annotations, _ := pointerGet(object, []string{"metadata", "annotations"})
+	entries, _ := annotations.(map[string]interface{})
+
+	var changes []luarunner.MetadataChange
+	for _, key := range bookkeepingAnnotations {
+		if value, ok := entries[key].(string); ok {
+			changes = append(changes, luarunner.MetadataChange{Field: "annotations", Key: key, Value: value})
+		}
+	}
+	return changes
+}
+
+// escapePointerToken: escapes a map key for use in a JSON pointer (RFC 6901)
+func escapePointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
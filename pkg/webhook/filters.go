@@ -0,0 +1,38 @@
+package webhook
+
+import (
+	"fmt"
+)
+
+// ServerFilters: filters applied by the server before loading any script
+// They complement the namespaceSelector/objectSelector of the webhook configuration
+type ServerFilters struct {
+	// SkipNamespaces: namespaces whose objects are allowed as-is
+	SkipNamespaces []string
+	// OnlyKinds: kinds processed by the server, every kind when empty
+	OnlyKinds []string
+	// PreFilters: conditions on the object allowing it as-is when one matches, see ParsePreFilter
+	PreFilters []PreFilter
+	// MatchConditions: CEL conditions a request must all meet for scripts to run, see CompileMatchConditions
+	MatchConditions []MatchCondition
+}
+
+// Processes: reports whether the server runs scripts for an object, with the reason when it does not
+func (f ServerFilters) Processes(namespace, kind string) (bool, string) {
+	for _, skipped := range f.SkipNamespaces {
+		if namespace != "" && namespace == skipped {
+			return false, fmt.Sprintf("namespace %s is skipped", namespace)
+		}
+	}
+
+	if len(f.OnlyKinds) == 0 {
+		return true, ""
+	}
+	for _, only := range f.OnlyKinds {
+		if kind == only {
+			return true, ""
+		}
+	}
+
+	return false, fmt.Sprintf("kind %s is not in the processed kinds", kind)
+}
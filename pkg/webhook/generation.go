@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"thechat/pkg/scriptloader"
+)
+
+// AnnotationProcessedGeneration: annotation written on mutated objects when HandlerOptions.TrackGeneration
+// is set, the metadata.generation the scripts last ran for
+const AnnotationProcessedGeneration = scriptloader.AnnotationPrefix + "/processed-generation"
+
+// alreadyProcessed: reports whether the scripts already ran for the generation object will have once
+// req is admitted
+// Only updates leaving the generation as it is, such as status or metadata updates, can be processed already
+func alreadyProcessed(req *admissionv1.AdmissionRequest, object *unstructured.Unstructured) bool {
+	if req.Operation != admissionv1.Update {
+		return false
+	}
+	generation := admittedGeneration(req, object)
+	if generation == 0 {
+		return false
+	}
+	return object.GetAnnotations()[AnnotationProcessedGeneration] == strconv.FormatInt(generation, 10)
+}
+
+// admittedGeneration: returns the metadata.generation object will have once req is admitted, zero when
+// the kind of object does not track generations
+// The API server sets and bumps the generation after mutating admission: objects being created get
+// generation 1, updates changing anything but the metadata and status the generation after the old one
+func admittedGeneration(req *admissionv1.AdmissionRequest, object *unstructured.Unstructured) int64 {
+	generation := objectGeneration(object)
+	switch req.Operation {
+	case admissionv1.Create:
+		if generation == 0 {
+			return 1
+		}
+		return generation
+	case admissionv1.Update:
+		if generation == 0 {
+			return 0
+		}
+		var old unstructured.Unstructured
+		if err := json.Unmarshal(req.OldObject.Raw, &old.Object); err != nil || old.Object == nil {
+			return generation
+		}
+		if specChanged(&old, object) {
+			return objectGeneration(&old) + 1
+		}
+		return generation
+	default:
+		return generation
+	}
+}
+
+// specChanged: reports whether object differs from old outside of its metadata and status, which is
+// what bumps the generation of an object
+func specChanged(old, object *unstructured.Unstructured) bool {
+	strip := func(content map[string]interface{}) map[string]interface{} {
+		stripped := make(map[string]interface{}, len(content))
+		for field, value := range content {
+			if field != "metadata" && field != "status" {
+				stripped[field] = value
+			}
+		}
+		return stripped
+	}
+	return !reflect.DeepEqual(strip(old.Object), strip(object.Object))
+}
+
+// objectGeneration: returns metadata.generation, zero when unset
+// Objects decoded by encoding/json hold float64 numbers, which Unstructured.GetGeneration ignores
+func objectGeneration(object *unstructured.Unstructured) int64 {
+	value, found, err := unstructured.NestedFieldNoCopy(object.Object, "metadata", "generation")
+	if !found || err != nil {
+		return 0
+	}
+	switch generation := value.(type) {
+	case float64:
+		return int64(generation)
+	case int64:
+		return generation
+	default:
+		return 0
+	}
+}
+
+// withProcessedGeneration: returns object with the AnnotationProcessedGeneration annotation set to generation
+func withProcessedGeneration(object []byte, generation int64) ([]byte, error) {
+	doc, err := decodeNumbers(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	doc = pointerSet(doc, []string{"metadata", "annotations", AnnotationProcessedGeneration}, strconv.FormatInt(generation, 10))
+
+	return json.Marshal(doc)
+}
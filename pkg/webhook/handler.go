@@ -3,17 +3,46 @@ package webhook
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/mattbaird/jsonpatch"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	admissionv1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
 
+	"thechat/pkg/cluster"
 	"thechat/pkg/luarunner"
+	"thechat/pkg/metrics"
 	"thechat/pkg/scriptloader"
+	"thechat/pkg/tracing"
+)
+
+const (
+	// BudgetHeader: request header overriding the latency budget of a single request, as a Go duration
+	BudgetHeader = "X-Glua-Latency-Budget"
+
+	// FailureModeAllow: finalize the response with the mutations made so far
+	FailureModeAllow = "allow"
+	// FailureModeDeny: deny the request
+	FailureModeDeny = "deny"
+
+	// ValidationSourceRequest: validating scripts run against the object of the request
+	ValidationSourceRequest = "request"
+	// ValidationSourceMutated: validating scripts run against the object the scripts turn the request
+	// object into, as the mutating webhook would patch it
+	ValidationSourceMutated = "mutated"
 )
 
 // WebhookHandler: handles admission webhook requests (both mutating and validating)
@@ -23,73 +52,318 @@ type WebhookHandler struct {
 	scriptRunner *luarunner.ScriptRunner
 	logger       *log.Logger
 	webhookType  string // "mutating" or "validating"
+	options      HandlerOptions
+	responses    *responseCache
+	inFlight     chan struct{}
+	diffPatch    func(original, modified []byte) ([]byte, error)
+}
+
+// HandlerOptions: optional configuration for a WebhookHandler
+type HandlerOptions struct {
+	// LoaderOptions: caching and stale-serving options for the script loader
+	LoaderOptions scriptloader.Options
+	// ScriptLoader: loader shared with other handlers, LoaderOptions is ignored when set
+	ScriptLoader *scriptloader.ScriptLoader
+	// ClusterLookup: cluster access shared with other handlers, one is created from the clientset when nil
+	ClusterLookup *cluster.Lookup
+	// RunnerOptions: custom modules, globals and sandbox allowlist for the script runner
+	RunnerOptions luarunner.Options
+	// DefaultScripts: scripts run for every object of a GroupVersionKind, merged with annotation scripts
+	DefaultScripts *scriptloader.DefaultScripts
+	// Filters: namespaces and kinds the server skips regardless of annotations
+	Filters ServerFilters
+	// Timeout: latency budget of a request, scripts that cannot complete within it are skipped
+	// Zero disables the budget unless the request carries BudgetHeader
+	Timeout time.Duration
+	// BudgetFailureMode: FailureModeAllow or FailureModeDeny, what to do once the budget is exhausted
+	BudgetFailureMode string
+	// AuditScriptLogs: write the messages scripts log through the log and audit modules into the
+	// AuditAnnotationScriptLog audit annotation, and the version of the scripts run into the
+	// AuditAnnotationScriptVersions one, at the cost of etcd and audit backend space
+	AuditScriptLogs bool
+	// AuditMaxEntries: log entries kept per request, DefaultAuditMaxEntries when zero
+	AuditMaxEntries int
+	// StrictDecoding: reject request bodies holding anything after the AdmissionReview JSON value
+	StrictDecoding bool
+	// ScriptLabel: label ("true") marking the ConfigMaps whose scripts are compiled when they are
+	// created or updated, denying them on syntax errors. scriptloader.LabelScript when empty
+	ScriptLabel string
+	// ValidationSource: ValidationSourceRequest (default) or ValidationSourceMutated, the object
+	// validating scripts run against. Mutated covers API server orderings where the validating
+	// webhook sees the object before the mutating one patched it
+	ValidationSource string
+	// DefaultParams: "namespace/configmap" params ConfigMap of objects without the
+	// scriptloader.AnnotationParams annotation, none when empty
+	DefaultParams string
+	// SkipAllowedUsers: users whose requests may bypass the scripts through AnnotationSkip,
+	// anyone when empty
+	SkipAllowedUsers []string
+	// ChangeSummary: write the AnnotationChangeSummary annotation, listing the paths the scripts
+	// changed and which scripts changed them, on the objects they mutate
+	ChangeSummary bool
+	// AppliedScripts: write the AnnotationAppliedScripts annotation, listing the scripts that ran
+	// along with the hash and ConfigMap resourceVersion of their content, on the objects they mutate
+	AppliedScripts bool
+	// ApplyDefaults: set the fields the API server defaults on well-known kinds before running the
+	// scripts, so that they see them. The patch still only holds the changes of the scripts
+	ApplyDefaults bool
+	// TrackGeneration: record the metadata.generation the scripts ran for in the
+	// AnnotationProcessedGeneration annotation, and skip mutating objects whose generation was processed
+	TrackGeneration bool
+	// RemoveMode: RemoveModeReject or RemoveModeDrop, what to do with patches removing fields
+	// Empty lets scripts remove fields
+	RemoveMode string
+	// MetadataOnly: take every change outside metadata out of the patch of the mutating webhook,
+	// with a warning, so that scripts can only ever set labels, annotations and the like
+	MetadataOnly bool
+	// ProcessSubResources: run the scripts against the object of subresource requests carrying one
+	// of their own, such as the Eviction of pods/eviction, rather than allowing them as-is
+	ProcessSubResources bool
+	// CopyAnnotationToTemplate: copy the scripts annotation of Deployments, StatefulSets, DaemonSets
+	// and Jobs to their pod template when it lacks it, rather than only warning about it
+	CopyAnnotationToTemplate bool
+	// StrictAnnotations: deny objects whose scripts annotations hold malformed references, rather
+	// than skipping them with an admission warning
+	StrictAnnotations bool
+	// AllowSecretData: let scripts read and write Secret data in plaintext through the k8s.secret
+	// module, which fails otherwise
+	AllowSecretData bool
+	// CheckConsistency: run the scripts of the mutating webhook again against the object they
+	// mutated, warning when one of them would deny it once validated
+	CheckConsistency bool
+	// InjectedAnnotation: annotation marking objects the scripts already injected, such as the one
+	// set through the once helper. The mutating webhook leaves objects carrying it alone, none when empty
+	InjectedAnnotation string
+	// SummaryLogger: receives one Info record per answered admission request, summing up the
+	// request, the scripts run and their timings, and the response. None when nil
+	SummaryLogger *slog.Logger
+	// ResponseCacheTTL: how long the response to a request is reused for identical requests run
+	// through scripts of identical content, responses are not cached when zero
+	ResponseCacheTTL time.Duration
+	// MaxInFlight: requests processed at once, unlimited when zero. Requests finding no slot within
+	// ShedWait are shed according to ShedFailureMode, rather than queueing
+	MaxInFlight int
+	// ShedWait: how long a request waits for an in-flight slot, DefaultShedWait when zero
+	ShedWait time.Duration
+	// ShedFailureMode: FailureModeAllow or FailureModeDeny, what to do with shed requests
+	ShedFailureMode string
+	// ShadowScripts: scripts run in the shadow of the scripts of objects without the
+	// AnnotationShadowScripts annotation, in the same format, none when empty
+	ShadowScripts string
+	// ShadowTimeout: time shadow scripts are given to complete, DefaultShadowTimeout when zero
+	ShadowTimeout time.Duration
+	// MaxRequestBytes: largest request body, checked both before and after decompression,
+	// DefaultMaxRequestBytes when zero
+	MaxRequestBytes int64
+	// AuditSink: receives the patch of every request the mutating webhook patches, nothing is
+	// shipped when nil
+	AuditSink *AuditSink
+	// PatchGenerator: PatchGeneratorDiff or PatchGeneratorReplace, how patches of the objects the
+	// scripts changed are built, PatchGeneratorDiff when empty
+	PatchGenerator string
+	// ComparePatchGenerators: build the patches with both generators, logging and counting the
+	// objects the diff patch would not turn into what the scripts made of them
+	ComparePatchGenerators bool
+	// InFlightTracker: records the requests being processed, shared with other handlers and the
+	// server reporting them on shutdown. Requests are not tracked when nil
+	InFlightTracker *InFlightTracker
 }
 
 // NewWebhookHandler: creates a new webhook handler
 func NewWebhookHandler(clientset kubernetes.Interface, logger *log.Logger, webhookType string) *WebhookHandler {
+	return NewWebhookHandlerWithOptions(clientset, logger, webhookType, HandlerOptions{})
+}
+
+// NewWebhookHandlerWithOptions: creates a new webhook handler with the given options
+func NewWebhookHandlerWithOptions(clientset kubernetes.Interface, logger *log.Logger, webhookType string, options HandlerOptions) *WebhookHandler {
+	loader := options.ScriptLoader
+	if loader == nil {
+		loader = scriptloader.NewScriptLoaderWithOptions(clientset, logger, options.LoaderOptions)
+	}
+
+	lookup := options.ClusterLookup
+	if lookup == nil {
+		lookup = cluster.NewLookup(clientset, logger, cluster.Options{})
+	}
+	runnerOptions := options.RunnerOptions
+	runnerOptions.Cluster = lookup
+	// Validating scripts leave the object alone, they all run so that every denial is reported
+	runnerOptions.ContinueAfterDenial = webhookType == "validating"
+
+	// Drop compiled bytecode whenever the loader invalidates a ConfigMap
+	runner := luarunner.NewScriptRunnerWithOptions(logger, runnerOptions)
+	loader.AddInvalidationHook(runner.EvictCompiled)
+
+	// Drop the responses of the scripts of a ConfigMap as soon as it changes
+	responses := newResponseCache(options.ResponseCacheTTL)
+	if responses != nil {
+		loader.AddInvalidationHook(responses.invalidate)
+	}
+
 	return &WebhookHandler{
 		clientset:    clientset,
-		scriptLoader: scriptloader.NewScriptLoader(clientset, logger),
-		scriptRunner: luarunner.NewScriptRunner(logger),
+		scriptLoader: loader,
+		scriptRunner: runner,
 		logger:       logger,
 		webhookType:  webhookType,
+		options:      options,
+		responses:    responses,
+		inFlight:     newInFlightLimiter(options.MaxInFlight),
+		diffPatch:    createJSONPatch,
 	}
 }
 
 // ServeHTTP: implements http.Handler interface for webhook requests
 func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	h.logger.Printf("Received %s webhook request from %s", h.webhookType, r.RemoteAddr)
 
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
 		h.logger.Printf("ERROR: Invalid method %s, only POST allowed", r.Method)
-		http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+		h.writeReview(w, http.StatusMethodNotAllowed, buildReview("", "", rejectReview(http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "only POST requests are allowed")))
 		return
 	}
 
-	// Decode the admission review request
+	// Decode the admission review request, decompressed as needed
+	body, release, err := h.requestBody(r)
+	if err != nil {
+		h.rejectBody(w, err)
+		return
+	}
+	defer release()
 	var admissionReview admissionv1.AdmissionReview
-	if err := json.NewDecoder(r.Body).Decode(&admissionReview); err != nil {
-		h.logger.Printf("ERROR: Failed to decode admission review: %v", err)
-		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+	decoder := json.NewDecoder(body)
+	if err := decoder.Decode(&admissionReview); err != nil {
+		h.rejectBody(w, err)
 		return
 	}
 
-	// Process the request
-	response := h.handleAdmissionRequest(r.Context(), admissionReview.Request)
+	// A review without request cannot be answered
+	if admissionReview.Request == nil {
+		h.logger.Printf("ERROR: Admission review holds no request")
+		h.writeReview(w, http.StatusBadRequest, buildReview(admissionReview.APIVersion, "", rejectReview(http.StatusBadRequest, metav1.StatusReasonBadRequest, "admission review holds no request")))
+		return
+	}
 
-	// Construct the response
-	admissionReview.Response = response
-	admissionReview.Response.UID = admissionReview.Request.UID
+	// In strict mode, the body must hold exactly one JSON value
+	if h.options.StrictDecoding {
+		if _, err := decoder.Token(); err != io.EOF {
+			h.logger.Printf("ERROR: Request body contains data after the admission review")
+			h.writeReview(w, http.StatusBadRequest, buildReview(admissionReview.APIVersion, admissionReview.Request.UID,
+				rejectReview(http.StatusBadRequest, metav1.StatusReasonBadRequest, "request body must contain a single JSON document")))
+			return
+		}
+	}
 
-	// Send the response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(admissionReview); err != nil {
-		h.logger.Printf("ERROR: Failed to encode response: %v", err)
-		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	// Shed the request rather than queueing it behind too many others
+	if !h.acquire(r.Context()) {
+		h.shed(w, admissionReview)
 		return
 	}
+	defer h.release()
+	defer h.options.InFlightTracker.track(h.webhookType, admissionReview.Request)()
+
+	// Trace the request, as part of the trace of the API server when it propagates one
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, h.webhookType+" admission", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	req := admissionReview.Request
+	span.SetAttributes(
+		tracing.AttrWebhook.String(h.webhookType),
+		tracing.AttrKind.String(req.Kind.Kind),
+		tracing.AttrNamespace.String(req.Namespace),
+		tracing.AttrName.String(req.Name),
+		tracing.AttrUID.String(string(req.UID)),
+		tracing.AttrOperation.String(string(req.Operation)),
+	)
+
+	// Bound the processing time by the latency budget
+	if budget := h.budget(r); budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+
+	// Process the request
+	ctx, summary := withSummary(ctx)
+	response := h.handleAdmissionRequest(ctx, req)
+	span.SetAttributes(tracing.AttrAllowed.Bool(response.Allowed))
 
+	// A failure to encode the response is answered with an error, the API server then applies the
+	// failurePolicy of the webhook
+	h.writeReview(w, http.StatusOK, buildReview(admissionReview.APIVersion, req.UID, response))
 	h.logger.Printf("Successfully sent %s webhook response (allowed: %v)", h.webhookType, response.Allowed)
+	h.logSummary(ctx, req, response, summary, time.Since(start))
+	h.options.AuditSink.send(req, response, summary.scripts())
+}
+
+// Review: answers an admission request as ServeHTTP does, without latency budget nor in-flight limit,
+// for callers running the scripts outside of an HTTP server
+func (h *WebhookHandler) Review(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := h.handleAdmissionRequest(ctx, req)
+	response.UID = req.UID
+	return response
+}
+
+// budget: returns the latency budget of a request, from BudgetHeader when valid, else the configured timeout
+func (h *WebhookHandler) budget(r *http.Request) time.Duration {
+	if header := r.Header.Get(BudgetHeader); header != "" {
+		budget, err := time.ParseDuration(header)
+		if err == nil && budget > 0 {
+			return budget
+		}
+		h.logger.Printf("WARNING: Ignoring invalid %s header %q", BudgetHeader, header)
+	}
+	return h.options.Timeout
 }
 
 // handleAdmissionRequest: processes an admission request and returns a response
 func (h *WebhookHandler) handleAdmissionRequest(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
-	h.logger.Printf("Processing %s admission request: Kind=%s, Namespace=%s, Name=%s, Operation=%s",
-		h.webhookType, req.Kind.Kind, req.Namespace, req.Name, req.Operation)
+	metadata, decoded := decodeMetadata(req)
+	key := objectKey(req, metadata)
+	h.logger.Printf("Processing %s admission request: Kind=%s, Object=%s, Operation=%s, UID=%s",
+		h.webhookType, req.Kind.Kind, key, req.Operation, req.UID)
 
 	// Default response: allow with no changes
 	response := &admissionv1.AdmissionResponse{
 		Allowed: true,
 	}
 
-	// Extract object metadata to get annotations
-	var metadata struct {
-		Metadata metav1.ObjectMeta `json:"metadata"`
+	if processed, reason := h.options.Filters.Processes(req.Namespace, req.Kind.Kind); !processed {
+		h.logger.Printf("Skipping request for %s: %s", key, reason)
+		return response
 	}
 
-	if err := json.Unmarshal(req.Object.Raw, &metadata); err != nil {
-		h.logger.Printf("ERROR: Failed to unmarshal object metadata: %v", err)
+	// Evictions, Bindings and the like are not the object of the resource they target, scripts
+	// expecting that object would misread them
+	if h.skippedSubResource(req) {
+		h.logger.Printf("Skipping %s: %s/%s request carries a %s", key, req.Resource.Resource, req.SubResource, req.Kind.Kind)
+		return response
+	}
+
+	// Objects no script applies to are allowed before decoding them, webhook rules usually match
+	// far more objects than the ones annotated
+	if h.withoutScripts(req, metadata, decoded) {
+		h.logger.Printf("No scripts to execute for %s, allowing request as-is", key)
+		return response
+	}
+
+	// Requests not meeting the match conditions are allowed as the API server would not have sent them
+	if condition, unmatched, err := h.options.Filters.Unmatched(req); err != nil {
+		h.logger.Printf("WARNING: Processing %s: %v", key, err)
+	} else if unmatched {
+		h.logger.Printf("DEBUG: Skipping %s: match condition %s not met", key, condition.Name)
+		metrics.MatchConditionSkipped.WithLabelValues(h.webhookType, condition.Name).Inc()
+		return response
+	}
+
+	// Read the object as unstructured content, which keeps every field whatever its kind
+	// DELETE requests carry the object being deleted as their old object only
+	raw := admittedObject(req)
+	var object unstructured.Unstructured
+	if err := json.Unmarshal(raw, &object.Object); err != nil {
+		h.logger.Printf("ERROR: Failed to unmarshal object: %v", err)
 		response.Allowed = false
 		response.Result = &metav1.Status{
 			Message: fmt.Sprintf("failed to parse object metadata: %v", err),
@@ -97,12 +371,60 @@ func (h *WebhookHandler) handleAdmissionRequest(ctx context.Context, req *admiss
 		return response
 	}
 
-	h.logger.Printf("Object annotations: %v", metadata.Metadata.Annotations)
+	// Objects matching a pre-filter are allowed before any script is loaded
+	if filter, matched := h.options.Filters.PreFiltered(req.Kind.Kind, object.Object); matched {
+		h.logger.Printf("DEBUG: Skipping %s: pre-filter %s matched", key, filter.Expression)
+		metrics.PreFiltered.WithLabelValues(h.webhookType, filter.Expression).Inc()
+		return response
+	}
+
+	annotations := object.GetAnnotations()
+
+	// Script ConfigMaps are checked before they can reach the cluster
+	if h.denyInvalidScripts(response, req, &object) {
+		return response
+	}
+
+	h.logger.Printf("Object annotations: %v", annotations)
+
+	// Objects opting out of the webhook are allowed as-is
+	if h.skipped(response, req, annotations) {
+		h.logger.Printf("Skipping %s: %s annotation set", key, AnnotationSkip)
+		return response
+	}
+
+	// Objects whose generation the scripts already mutated are left alone, not to fight other controllers
+	if h.webhookType == "mutating" && h.options.TrackGeneration && alreadyProcessed(req, &object) {
+		h.logger.Printf("Skipping %s: generation %d already processed", key, objectGeneration(&object))
+		return response
+	}
+
+	// Objects already injected are not injected twice, on UPDATE in particular
+	if h.webhookType == "mutating" && h.options.InjectedAnnotation != "" {
+		if _, injected := annotations[h.options.InjectedAnnotation]; injected {
+			h.logger.Printf("Skipping %s: %s annotation set", key, h.options.InjectedAnnotation)
+			return response
+		}
+	}
+
+	// Workloads annotated on their metadata only do not get their Pods mutated
+	var templateScripts string
+	if h.webhookType == "mutating" {
+		templateScripts = h.checkTemplateScripts(response, req.Kind.Kind, key, &object)
+	}
 
-	// Load scripts from ConfigMaps based on annotations
-	scripts, err := h.scriptLoader.LoadScriptsFromAnnotations(ctx, metadata.Metadata.Annotations)
+	// Malformed references would otherwise be skipped silently
+	if h.checkScriptReferences(response, string(req.Operation), key, annotations) {
+		return response
+	}
+
+	// Load scripts from ConfigMaps based on annotations, with the key of the kind when enabled
+	ctx = scriptloader.WithKind(ctx, req.Kind.Kind)
+	loadStart := time.Now()
+	set, err := h.scriptLoader.LoadScriptSetForOperation(ctx, annotations, string(req.Operation))
+	summaryFrom(ctx).load = time.Since(loadStart)
 	if err != nil {
-		h.logger.Printf("ERROR: Failed to load scripts: %v", err)
+		h.logger.Printf("ERROR: Failed to load scripts for %s: %v", key, err)
 		response.Allowed = false
 		response.Result = &metav1.Status{
 			Message: fmt.Sprintf("failed to load scripts: %v", err),
@@ -110,69 +432,465 @@ func (h *WebhookHandler) handleAdmissionRequest(ctx context.Context, req *admiss
 		return response
 	}
 
+	// Merge scripts configured for the object GroupVersionKind
+	if refs := h.options.DefaultScripts.ScriptsFor(req.Kind); len(refs) > 0 {
+		h.logger.Printf("Found %d default scripts for %s", len(refs), req.Kind.String())
+		defaults, err := h.scriptLoader.LoadScriptSet(ctx, refs)
+		if err != nil {
+			h.logger.Printf("ERROR: Failed to load default scripts for %s: %v", key, err)
+			response.Allowed = false
+			response.Result = &metav1.Status{
+				Message: fmt.Sprintf("failed to load default scripts: %v", err),
+			}
+			return response
+		}
+		set.Merge(defaults)
+	}
+	scripts := set.Scripts
+
+	// Scripts of sampled ConfigMaps only run for their share of the objects
+	h.sampleScripts(scripts, sampleKey(req, &object))
+
 	// If no scripts found, allow the request as-is
 	if len(scripts) == 0 {
-		h.logger.Printf("No scripts to execute, allowing request as-is")
+		h.logger.Printf("No scripts to execute for %s, allowing request as-is", key)
+		return response
+	}
+
+	// Order scripts alphabetically, honoring the after annotations of their ConfigMaps
+	order, err := h.scriptLoader.OrderScripts(scripts)
+	if err != nil {
+		h.logger.Printf("ERROR: Failed to order scripts for %s: %v", key, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Message: fmt.Sprintf("failed to order scripts: %v", err),
+		}
+		return response
+	}
+
+	// Expose the params ConfigMap of the object to every script of the chain
+	params, err := h.loadParams(ctx, annotations)
+	if err != nil {
+		h.logger.Printf("ERROR: Failed to load params for %s: %v", key, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Message: fmt.Sprintf("failed to load params: %v", err),
+		}
 		return response
 	}
+	if params != nil {
+		ctx = luarunner.WithParams(ctx, params)
+	}
+
+	// Expose the options of the operation, such as fieldManager or fieldValidation
+	if len(req.Options.Raw) > 0 {
+		var options map[string]interface{}
+		if err := json.Unmarshal(req.Options.Raw, &options); err != nil {
+			h.logger.Printf("WARNING: Ignoring undecodable options of %s: %v", key, err)
+		} else {
+			ctx = luarunner.WithRequestOptions(ctx, options)
+		}
+	}
+
+	// Scripts of ConfigMaps with a timeout of their own are stopped after it
+	if len(set.Timeouts) > 0 {
+		ctx = luarunner.WithScriptTimeouts(ctx, set.Timeouts)
+	}
+
+	// Secret data stays opaque to scripts unless the server opts in
+	if h.options.AllowSecretData {
+		ctx = luarunner.WithSecretData(ctx)
+	}
+
+	// Identical requests run through scripts of identical content get the same response, unless
+	// the object opted out, while its scripts are debugged
+	if h.responses != nil && annotations[AnnotationNoCache] == "true" {
+		h.logger.Printf("DEBUG: Not using the response cache for %s: %s annotation set", key, AnnotationNoCache)
+	} else if h.responses != nil {
+		cacheKey, err := responseCacheKey(h.webhookType, req, order, scripts, params)
+		if err != nil {
+			h.logger.Printf("WARNING: Not caching the response for %s: %v", key, err)
+		} else if cached := h.responses.get(cacheKey); cached != nil {
+			h.logger.Printf("DEBUG: Serving the cached response for %s", key)
+			metrics.ResponseCacheHits.WithLabelValues(h.webhookType).Inc()
+			summaryFrom(ctx).cached = true
+			return cached
+		} else {
+			defer func() { h.responses.store(cacheKey, response, summaryFrom(ctx).results) }()
+		}
+	}
+
+	// Scripts see the apiVersion and kind of the request when the object lacks them, and get the
+	// authoritative ones as the gvk global regardless
+	ctx = luarunner.WithGVK(ctx, schema.GroupVersionKind(req.Kind))
+	typed, filledTypeMeta := raw, map[string]string(nil)
+	if withMeta, filled, err := withTypeMeta(raw, req.Kind); err != nil {
+		h.logger.Printf("WARNING: Failed to fill the apiVersion and kind of %s, running scripts on the object as received: %v", key, err)
+	} else if filled != nil {
+		typed, filledTypeMeta = withMeta, filled
+		h.logger.Printf("DEBUG: Filled the missing apiVersion and kind of %s from the request: %v", key, filled)
+	}
+
+	// Scripts see the fields the API server would default
+	input, defaulted := typed, []appliedDefault(nil)
+	if h.options.ApplyDefaults {
+		withDefaults, applied, err := applyDefaults(req.Kind.Kind, typed)
+		if err != nil {
+			h.logger.Printf("WARNING: Failed to apply defaults to %s, running scripts on the object as received: %v", key, err)
+		} else {
+			input, defaulted = withDefaults, applied
+			h.logger.Printf("DEBUG: Applied %d defaults to %s", len(applied), key)
+		}
+	}
 
 	// For validating webhooks, we don't modify the object
 	if h.webhookType == "validating" {
-		h.logger.Printf("Validating webhook: executing %d scripts for validation", len(scripts))
+		validated := h.validatedObject(ctx, order, set, input)
+		h.logger.Printf("Validating webhook: executing %d scripts for validation of %s against the %s object", len(scripts), key, h.validationSource())
 		// Run scripts to validate (errors are logged but ignored per requirements)
-		_, err := h.scriptRunner.RunScriptsSequentially(scripts, req.Object.Raw)
+		_, results, err := h.scriptRunner.RunOrderedScriptsWithContext(ctx, order, scripts, validated)
 		if err != nil {
 			h.logger.Printf("WARNING: Validation scripts encountered errors (ignoring): %v", err)
 		}
-		// Always allow for now (per requirements: ignore script failures)
+		stampVersions(results, set)
+		h.observeResults(results)
+		summaryFrom(ctx).results = results
+		h.runShadow(ctx, key, annotations, validated, outcomeOf(results, nil))
+		response.Warnings = append(response.Warnings, collectWarnings(results)...)
+		h.auditScriptLogs(response, results)
+		h.auditScriptVersions(response, results)
+		if h.denied(response, results) {
+			return response
+		}
+		if h.budgetExhausted(response, results) {
+			return response
+		}
+		if h.failedClosed(response, results, set) {
+			return response
+		}
+		// No script denied or failed closed and the latency budget was not exhausted: allow it
 		response.Allowed = true
 		return response
 	}
 
 	// For mutating webhooks, execute scripts and return patches
-	h.logger.Printf("Mutating webhook: executing %d scripts", len(scripts))
-	modifiedJSON, err := h.scriptRunner.RunScriptsSequentially(scripts, req.Object.Raw)
+	h.logger.Printf("Mutating webhook: executing %d scripts on %s", len(scripts), key)
+	if h.denyUnknownScopes(response, order, set) {
+		return response
+	}
+	filter := h.scopeFilter(set)
+	var recorder *changeRecorder
+	if h.options.ChangeSummary || h.options.CheckConsistency {
+		recorder = &changeRecorder{changes: make(map[string][]string)}
+		filter = recorder.filter(filter)
+	}
+	modifiedJSON, results, err := h.scriptRunner.RunFilteredScriptsWithContext(ctx, order, scripts, input, filter)
 	if err != nil {
-		h.logger.Printf("ERROR: Failed to execute scripts: %v", err)
+		h.logger.Printf("ERROR: Failed to execute scripts on %s: %v", key, err)
 		response.Allowed = false
 		response.Result = &metav1.Status{
 			Message: fmt.Sprintf("failed to execute scripts: %v", err),
 		}
 		return response
 	}
+	stampVersions(results, set)
+	h.observeResults(results)
+	summaryFrom(ctx).results = results
+	h.runShadow(ctx, key, annotations, input, outcomeOf(results, modifiedJSON))
+	response.Warnings = append(response.Warnings, collectWarnings(results)...)
+	h.auditScriptLogs(response, results)
+	h.auditScriptVersions(response, results)
+	if h.denied(response, results) {
+		return response
+	}
+	if h.budgetExhausted(response, results) {
+		return response
+	}
+	if h.failedClosed(response, results, set) {
+		return response
+	}
+
+	// A deleted object cannot be patched, scripts may only deny its deletion or warn about it
+	if req.Operation == admissionv1.Delete {
+		h.logger.Printf("Not patching %s: the object is being deleted", key)
+		return response
+	}
+
+	// The API server cannot patch an object into another type
+	if h.denyTypeMetaChanges(response, key, typed, modifiedJSON) {
+		return response
+	}
+
+	// Tell when the validating webhook would deny what the scripts made of the object
+	if h.options.CheckConsistency {
+		h.checkConsistency(ctx, response, key, order, scripts, modifiedJSON, recorder)
+	}
+
+	// The patch applies to the object as received, defaults the scripts left alone stay out of it
+	if defaulted != nil {
+		modifiedJSON, err = removeDefaults(req.Object.Raw, input, modifiedJSON, defaulted)
+		if err != nil {
+			h.logger.Printf("ERROR: Failed to remove defaults from %s: %v", key, err)
+			response.Allowed = false
+			response.Result = &metav1.Status{
+				Message: fmt.Sprintf("failed to remove defaults: %v", err),
+			}
+			return response
+		}
+	}
+
+	// Nor does it add the apiVersion and kind filled for the scripts, unless they changed them
+	if filledTypeMeta != nil {
+		modifiedJSON, err = removeTypeMeta(req.Object.Raw, typed, modifiedJSON, filledTypeMeta)
+		if err != nil {
+			h.logger.Printf("ERROR: Failed to remove the filled apiVersion and kind from %s: %v", key, err)
+			response.Allowed = false
+			response.Result = &metav1.Status{
+				Message: fmt.Sprintf("failed to remove the filled apiVersion and kind: %v", err),
+			}
+			return response
+		}
+	}
 
-	// Check if the object was modified
-	if string(modifiedJSON) != string(req.Object.Raw) {
+	// Let the Pods of the workload run the scripts as well
+	if templateScripts != "" {
+		copied, err := withTemplateScripts(modifiedJSON, templateScripts)
+		if err != nil {
+			h.logger.Printf("WARNING: Failed to copy the scripts annotation to the pod template of %s: %v", key, err)
+		} else {
+			modifiedJSON = copied
+		}
+	}
+
+	// Record the generation processed, as part of the patch
+	if generation := admittedGeneration(req, &object); h.options.TrackGeneration && generation > 0 {
+		tracked, err := withProcessedGeneration(modifiedJSON, generation)
+		if err != nil {
+			h.logger.Printf("WARNING: Failed to record the processed generation of %s: %v", key, err)
+		} else {
+			modifiedJSON = tracked
+		}
+	}
+
+	// Check if the object was modified, the runner encoding its fields in another order than the
+	// API server
+	if !sameJSON(req.Object.Raw, modifiedJSON) {
 		h.logger.Printf("Object was modified by scripts, creating JSON merge patch")
 
+		if h.options.ChangeSummary {
+			summarized, err := withChangeSummary(modifiedJSON, recorder.summary())
+			if err != nil {
+				h.logger.Printf("WARNING: Failed to write the change summary of %s: %v", key, err)
+			} else {
+				modifiedJSON = summarized
+			}
+		}
+
+		if h.options.AppliedScripts {
+			applied, err := withAppliedScripts(modifiedJSON, results)
+			if err != nil {
+				h.logger.Printf("WARNING: Failed to record the applied scripts of %s: %v", key, err)
+			} else {
+				modifiedJSON = applied
+			}
+		}
+
 		// Create a JSON Patch (RFC 6902) using the json-patch library
 		patchType := admissionv1.PatchTypeJSONPatch
 		response.PatchType = &patchType
 
+		// Scripts that only set labels and annotations through add_label and add_annotation get
+		// their patch from the recorded changes, skipping the diff
+		if patch, ok := metadataPatch(req.Object.Raw, modifiedJSON, results); ok {
+			response.Patch = patch
+			h.logger.Printf("Applied metadata JSON patch of length %d bytes to %s", len(patch), key)
+			h.restrictToMetadata(response, key)
+			h.restrictRemovals(response, key, req.Object.Raw)
+			return response
+		}
+
 		// Generate JSON Patch
-		patch, err := createJSONPatch(req.Object.Raw, modifiedJSON)
+		patch, err := h.generatePatch(key, req.Object.Raw, modifiedJSON)
 		if err != nil {
-			h.logger.Printf("ERROR: Failed to create JSON patch: %v", err)
+			h.logger.Printf("ERROR: Failed to create JSON patch for %s: %v", key, err)
 			response.Allowed = false
 			response.Result = &metav1.Status{
 				Message: fmt.Sprintf("failed to create patch: %v", err),
 			}
 			return response
 		}
+		if emptyPatch(patch) {
+			h.logger.Printf("Object %s was not modified by scripts", key)
+			response.PatchType = nil
+			return response
+		}
 
 		response.Patch = patch
-		h.logger.Printf("Applied JSON patch of length %d bytes", len(patch))
+		h.logger.Printf("Applied JSON patch of length %d bytes to %s", len(patch), key)
+		h.restrictToMetadata(response, key)
+		h.restrictRemovals(response, key, req.Object.Raw)
 	} else {
-		h.logger.Printf("Object was not modified by scripts")
+		h.logger.Printf("Object %s was not modified by scripts", key)
 	}
 
 	return response
 }
 
+// loadParams: loads the params ConfigMap named by the scriptloader.AnnotationParams annotation,
+// or the default one, nil when there is none
+func (h *WebhookHandler) loadParams(ctx context.Context, annotations map[string]string) (map[string]interface{}, error) {
+	value, ok := annotations[scriptloader.AnnotationParams]
+	if !ok {
+		value = h.options.DefaultParams
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	ref, ok := scriptloader.ParseParamsRef(value)
+	if !ok {
+		return nil, fmt.Errorf("invalid params reference %q (expected namespace/configmap)", value)
+	}
+	return h.scriptLoader.LoadParams(ctx, ref)
+}
+
+// validationSource: returns the object validating scripts run against, ValidationSourceRequest by default
+func (h *WebhookHandler) validationSource() string {
+	if h.options.ValidationSource == "" {
+		return ValidationSourceRequest
+	}
+	return h.options.ValidationSource
+}
+
+// validatedObject: returns the object validating scripts run against
+// With ValidationSourceMutated, the scripts first run as for the mutating webhook, without emitting
+// a patch nor reporting anything, and the object they produce is validated
+func (h *WebhookHandler) validatedObject(ctx context.Context, order []string, set scriptloader.ScriptSet, object []byte) []byte {
+	if h.validationSource() != ValidationSourceMutated {
+		return object
+	}
+
+	h.logger.Printf("Validating webhook: executing %d scripts to build the mutated object", len(set.Scripts))
+	mutated, _, err := h.scriptRunner.RunFilteredScriptsWithContext(ctx, order, set.Scripts, object, h.scopeFilter(set))
+	if err != nil {
+		h.logger.Printf("WARNING: Failed to build the mutated object, validating the request object: %v", err)
+		return object
+	}
+	return mutated
+}
+
+// observeResults: counts the executions of the scripts of a chain in metrics.ScriptExecutions,
+// records the time the successful ones spent in each phase, and the CPU time of those that ran
+func (h *WebhookHandler) observeResults(results []luarunner.ScriptResult) {
+	for _, result := range results {
+		outcome := metrics.ResultSuccess
+		switch {
+		case errors.Is(result.Err, luarunner.ErrBudgetExhausted):
+			outcome = metrics.ResultSkipped
+		case errors.As(result.Err, new(*luarunner.Denial)):
+			outcome = metrics.ResultDenied
+		case result.Err != nil:
+			outcome = metrics.ResultError
+		}
+		metrics.ObserveScriptExecution(h.webhookType, scriptloader.ConfigMapOf(result.Name), outcome)
+		if result.Err == nil {
+			metrics.ConversionToLuaDuration.WithLabelValues(h.webhookType).Observe(result.Timings.ToLua.Seconds())
+			metrics.ScriptExecuteDuration.WithLabelValues(h.webhookType).Observe(result.Timings.Execute.Seconds())
+			metrics.ConversionFromLuaDuration.WithLabelValues(h.webhookType).Observe(result.Timings.FromLua.Seconds())
+		}
+		if result.CPUTime > 0 {
+			clock := metrics.ClockCPU
+			if result.CPUTimeWallClock {
+				clock = metrics.ClockWall
+			}
+			metrics.ScriptCPUDuration.WithLabelValues(h.webhookType, clock).Observe(result.CPUTime.Seconds())
+		}
+	}
+}
+
+// budgetExhausted: records scripts skipped for lack of latency budget on the response
+// Returns true when the failure mode denied the request, which must then be returned as-is
+func (h *WebhookHandler) budgetExhausted(response *admissionv1.AdmissionResponse, results []luarunner.ScriptResult) bool {
+	var skipped []string
+	for _, result := range results {
+		if errors.Is(result.Err, luarunner.ErrBudgetExhausted) {
+			skipped = append(skipped, result.Name)
+		}
+	}
+	if len(skipped) == 0 {
+		return false
+	}
+
+	metrics.BudgetExhausted.WithLabelValues(h.webhookType).Inc()
+	message := fmt.Sprintf("latency budget exhausted, skipped scripts: %s", strings.Join(skipped, ", "))
+	h.logger.Printf("WARNING: %s", message)
+
+	if h.options.BudgetFailureMode == FailureModeDeny {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Message: message,
+		}
+		return true
+	}
+
+	response.Warnings = append(response.Warnings, message)
+	return false
+}
+
+// failedClosed: denies the request when scripts whose failure policy is scriptloader.FailurePolicyFail
+// failed, denials and scripts skipped for lack of latency budget aside
+func (h *WebhookHandler) failedClosed(response *admissionv1.AdmissionResponse, results []luarunner.ScriptResult, set scriptloader.ScriptSet) bool {
+	var failures []string
+	for _, result := range results {
+		if result.Err == nil || errors.As(result.Err, new(*luarunner.Denial)) || errors.Is(result.Err, luarunner.ErrBudgetExhausted) {
+			continue
+		}
+		if set.FailurePolicy(result.Name) == scriptloader.FailurePolicyFail {
+			failures = append(failures, fmt.Sprintf("%s: %s", result.Name, result.ErrSummary()))
+		}
+	}
+	if len(failures) == 0 {
+		return false
+	}
+
+	message := fmt.Sprintf("scripts failed with the %s failure policy: %s", scriptloader.FailurePolicyFail, strings.Join(failures, "; "))
+	h.logger.Printf("WARNING: Denying the request: %s", message)
+	response.Allowed = false
+	response.Patch = nil
+	response.PatchType = nil
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusInternalServerError,
+		Reason:  metav1.StatusReasonInternalError,
+		Message: message,
+	}
+	return true
+}
+
+// collectWarnings: gathers warnings emitted by scripts, prefixed with the emitting script name
+func collectWarnings(results []luarunner.ScriptResult) []string {
+	var warnings []string
+	for _, result := range results {
+		for _, warning := range result.Warnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", result.Name, warning))
+		}
+	}
+	return warnings
+}
+
 // createJSONPatch: creates a JSON patch between original and modified objects using RFC 6902
 func createJSONPatch(original, modified []byte) ([]byte, error) {
-	// Use the mattbaird/jsonpatch library to create a proper RFC 6902 JSON Patch
-	patch, err := jsonpatch.CreatePatch(original, modified)
+	// Use the mattbaird/jsonpatch library to create a proper RFC 6902 JSON Patch, on the subtrees
+	// that are not encoded identically
+	if !json.Valid(original) || !json.Valid(modified) {
+		return nil, fmt.Errorf("failed to create JSON patch: invalid JSON document")
+	}
+	patch, err := diffRaw("", original, modified, []jsonpatch.JsonPatchOperation{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JSON patch: %w", err)
+	}
+	// Annotations are patched one by one, never as a whole map
+	patch, err = splitAnnotations(patch)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create JSON patch: %w", err)
 	}
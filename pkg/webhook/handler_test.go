@@ -2,21 +2,138 @@ package webhook
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
-
+	"time"
+
+	"github.com/mattbaird/jsonpatch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	lua "github.com/yuin/gopher-lua"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	evanphxpatch "gopkg.in/evanphx/json-patch.v4"
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"thechat/pkg/benchmarks"
+	"thechat/pkg/luarunner"
+	"thechat/pkg/metrics"
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/tracing"
 )
 
+// newPodAdmissionReview: builds a Pod admission review carrying the given annotations
+func newPodAdmissionReview(t *testing.T, annotations map[string]string) []byte {
+	t.Helper()
+
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: "nginx:latest",
+				},
+			},
+		},
+	}
+
+	podJSON, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("Failed to marshal pod: %v", err)
+	}
+
+	admissionReview := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID: "test-uid",
+			Kind: metav1.GroupVersionKind{
+				Group:   "",
+				Version: "v1",
+				Kind:    "Pod",
+			},
+			Namespace: "default",
+			Name:      "test-pod",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: podJSON,
+			},
+		},
+	}
+
+	admissionJSON, err := json.Marshal(admissionReview)
+	if err != nil {
+		t.Fatalf("Failed to marshal admission review: %v", err)
+	}
+
+	return admissionJSON
+}
+
+// serveAdmissionReview: posts an admission review to the handler and decodes the response
+func serveAdmissionReview(t *testing.T, handler http.Handler, body []byte) *admissionv1.AdmissionResponse {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var response admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	if response.Response == nil {
+		t.Fatal("Expected a response in the admission review")
+	}
+
+	return response.Response
+}
+
 func TestServeHTTP_InvalidMethod(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
@@ -47,6 +164,112 @@ func TestServeHTTP_InvalidJSON(t *testing.T) {
 	}
 }
 
+func TestServeHTTP_ConcatenatedDocuments(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	review := newPodAdmissionReview(t, nil)
+	body := append(append([]byte{}, review...), review...)
+
+	// Lenient mode only reads the first document
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+	serveAdmissionReview(t, handler, body)
+
+	// Strict mode rejects the trailing document
+	handler = NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{StrictDecoding: true})
+
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	// A single document with trailing whitespace is fine
+	serveAdmissionReview(t, handler, append(review, '\n', ' '))
+}
+
+func TestServeHTTP_EarlyExitReviews(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// withObject: the object is spliced into the encoded review as is, json.Marshal rejecting a
+	// RawExtension that is not a JSON object
+	withObject := func(raw string, annotations map[string]string, apiVersion string) []byte {
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(newPodAdmissionReview(t, annotations), &review); err != nil {
+			t.Fatalf("Failed to unmarshal admission review: %v", err)
+		}
+		review.APIVersion = apiVersion
+		if raw != "" {
+			review.Request.Object.Raw = nil
+		}
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatalf("Failed to marshal admission review: %v", err)
+		}
+		if raw != "" {
+			body = bytes.Replace(body, []byte(`"object":null`), []byte(`"object":`+raw), 1)
+		}
+		return body
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		body       []byte
+		code       int
+		apiVersion string
+		uid        types.UID
+	}{
+		{"method", http.MethodGet, nil, http.StatusMethodNotAllowed, "admission.k8s.io/v1", ""},
+		{"bad JSON", http.MethodPost, []byte("invalid json"), http.StatusBadRequest, "admission.k8s.io/v1", ""},
+		{"nil request", http.MethodPost, []byte(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`),
+			http.StatusBadRequest, "admission.k8s.io/v1beta1", ""},
+		{"metadata parse failure", http.MethodPost, withObject(`"not an object"`, nil, "admission.k8s.io/v1"),
+			http.StatusOK, "admission.k8s.io/v1", "test-uid"},
+		{"loader error", http.MethodPost, withObject("", map[string]string{"glua.maurice.fr/scripts": "default/nonexistent"}, "admission.k8s.io/v1beta1"),
+			http.StatusOK, "admission.k8s.io/v1beta1", "test-uid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewWebhookHandler(fake.NewSimpleClientset(), logger, "mutating")
+
+			req := httptest.NewRequest(tt.method, "/mutate", bytes.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Errorf("Expected status %d, got %d", tt.code, rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected a JSON body, got content type %q", ct)
+			}
+
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v: %s", err, rec.Body.String())
+			}
+			if review.APIVersion != tt.apiVersion || review.Kind != "AdmissionReview" {
+				t.Errorf("Expected an %s AdmissionReview, got %s %s", tt.apiVersion, review.APIVersion, review.Kind)
+			}
+			if review.Response == nil {
+				t.Fatal("Expected a response in the admission review")
+			}
+			if review.Response.UID != tt.uid {
+				t.Errorf("Expected UID %q, got %q", tt.uid, review.Response.UID)
+			}
+			if review.Response.Allowed {
+				t.Error("Expected the request to be denied")
+			}
+			if result := review.Response.Result; result == nil || result.Status != metav1.StatusFailure || result.Message == "" {
+				t.Errorf("Expected a failure status with a message, got %+v", result)
+			}
+		})
+	}
+}
+
 func TestServeHTTP_NoScripts(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
@@ -209,287 +432,3582 @@ func TestServeHTTP_WithScripts_Mutating(t *testing.T) {
 	}
 }
 
-func TestServeHTTP_Validating(t *testing.T) {
+func TestServeHTTP_MutatingWithWarnings(t *testing.T) {
 	clientset := fake.NewSimpleClientset(
 		&corev1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      "validate-script",
+				Name:      "inject-sidecar",
 				Namespace: "default",
 			},
 			Data: map[string]string{
 				"script.lua": `
-					-- Simple validation script
-					if object.metadata.name == "invalid" then
-						error("Invalid name")
-					end
+					table.insert(object.spec.containers, {name = "sidecar", image = "busybox:latest"})
+					warn("injected sidecar container")
 				`,
 			},
 		},
 	)
 
 	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
-	handler := NewWebhookHandler(clientset, logger, "validating")
+	handler := NewWebhookHandler(clientset, logger, "mutating")
 
-	pod := corev1.Pod{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "v1",
-			Kind:       "Pod",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "valid-pod",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"glua.maurice.fr/scripts": "default/validate-script",
-			},
-		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:  "nginx",
-					Image: "nginx:latest",
-				},
-			},
-		},
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/inject-sidecar",
+	}))
+
+	if !response.Allowed {
+		t.Error("Expected request to be allowed")
 	}
 
-	podJSON, _ := json.Marshal(pod)
+	if response.Patch == nil {
+		t.Error("Expected patch to be present")
+	}
 
-	admissionReview := admissionv1.AdmissionReview{
-		Request: &admissionv1.AdmissionRequest{
-			UID: "test-uid",
-			Kind: metav1.GroupVersionKind{
-				Group:   "",
-				Version: "v1",
-				Kind:    "Pod",
+	if len(response.Warnings) != 1 || response.Warnings[0] != "default/inject-sidecar: injected sidecar container" {
+		t.Errorf("Expected the script warning in the response, got %v", response.Warnings)
+	}
+}
+
+func TestServeHTTP_DefaultScriptsForGVK(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "standard-deployment-policy",
+				Namespace: "platform",
 			},
-			Namespace: "default",
-			Name:      "valid-pod",
-			Operation: admissionv1.Create,
-			Object: runtime.RawExtension{
-				Raw: podJSON,
+			Data: map[string]string{
+				"script.lua": `
+					if object.metadata.labels == nil then
+						object.metadata.labels = {}
+					end
+					object.metadata.labels["policy"] = "standard"
+				`,
 			},
 		},
-	}
-
-	admissionJSON, _ := json.Marshal(admissionReview)
-
-	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewBuffer(admissionJSON))
-	req.Header.Set("Content-Type", "application/json")
-	rec := httptest.NewRecorder()
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "team",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `
+					if object.metadata.labels == nil then
+						object.metadata.labels = {}
+					end
+					object.metadata.labels["team"] = "web"
+				`,
+			},
+		},
+	)
 
-	handler.ServeHTTP(rec, req)
+	defaults, err := scriptloader.ParseDefaultScripts([]byte(`
+defaults:
+  - group: apps
+    version: v1
+    kind: Deployment
+    scripts:
+      - platform/standard-deployment-policy
+`))
+	if err != nil {
+		t.Fatalf("ParseDefaultScripts failed: %v", err)
+	}
 
-	if rec.Code != http.StatusOK {
-		t.Errorf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{DefaultScripts: defaults})
+
+	newDeploymentReview := func(annotations map[string]string) []byte {
+		deploymentJSON, _ := json.Marshal(map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]interface{}{
+				"name":        "web",
+				"namespace":   "default",
+				"annotations": annotations,
+			},
+		})
+		body, _ := json.Marshal(admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "test-uid",
+				Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+				Namespace: "default",
+				Name:      "web",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: deploymentJSON},
+			},
+		})
+		return body
 	}
 
-	var response admissionv1.AdmissionReview
-	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
-		t.Fatalf("Failed to unmarshal response: %v", err)
+	// A bare Deployment gets the default script
+	response := serveAdmissionReview(t, handler, newDeploymentReview(nil))
+	if !response.Allowed || !bytes.Contains(response.Patch, []byte(`"standard"`)) {
+		t.Errorf("Expected the default script to label the Deployment, got patch %s", response.Patch)
 	}
 
-	// Should be allowed even if validation logic runs
-	if !response.Response.Allowed {
-		t.Error("Expected request to be allowed (validation errors are ignored)")
+	// Annotation scripts are merged with the default ones, running in name order
+	response = serveAdmissionReview(t, handler, newDeploymentReview(map[string]string{
+		scriptloader.AnnotationScripts: "default/team",
+	}))
+	if !bytes.Contains(response.Patch, []byte(`"standard"`)) || !bytes.Contains(response.Patch, []byte(`"web"`)) {
+		t.Errorf("Expected default and annotation scripts to both apply, got patch %s", response.Patch)
 	}
 
-	// Validating webhooks should not have patches
-	if response.Response.Patch != nil {
-		t.Error("Expected no patch for validating webhook")
+	// Other kinds are left alone
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, nil))
+	if response.Patch != nil {
+		t.Errorf("Expected no patch for a Pod, got %s", response.Patch)
 	}
 }
 
-func TestServeHTTP_ConfigMapNotFound(t *testing.T) {
-	clientset := fake.NewSimpleClientset()
-	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
-	handler := NewWebhookHandler(clientset, logger, "mutating")
+func TestServeHTTP_CompressedScriptRunsLikePlaintext(t *testing.T) {
+	script := `
+		object.metadata.labels = object.metadata.labels or {}
+		object.metadata.labels["sidecar"] = "injected"
+		table.insert(object.spec.containers, {name = "sidecar", image = "busybox:latest"})
+	`
 
-	pod := corev1.Pod{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "v1",
-			Kind:       "Pod",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "test-pod",
-			Namespace: "default",
-			Annotations: map[string]string{
-				"glua.maurice.fr/scripts": "default/nonexistent",
-			},
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, _ = writer.Write([]byte(script))
+	_ = writer.Close()
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"},
+			Data:       map[string]string{"script.lua": script},
 		},
-		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:  "nginx",
-					Image: "nginx:latest",
-				},
-			},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "compressed", Namespace: "default"},
+			Data:       map[string]string{"script.lua.gz": base64.StdEncoding.EncodeToString(buf.Bytes())},
 		},
-	}
+	)
 
-	podJSON, _ := json.Marshal(pod)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
 
-	admissionReview := admissionv1.AdmissionReview{
-		Request: &admissionv1.AdmissionRequest{
-			UID: "test-uid",
-			Kind: metav1.GroupVersionKind{
-				Group:   "",
-				Version: "v1",
-				Kind:    "Pod",
-			},
-			Namespace: "default",
-			Name:      "test-pod",
-			Operation: admissionv1.Create,
-			Object: runtime.RawExtension{
-				Raw: podJSON,
-			},
-		},
+	plain := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/plain",
+	}))
+	compressed := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/compressed",
+	}))
+
+	// Operations of a patch come in no particular order
+	sortedOperations := func(patch []byte) []string {
+		var operations []json.RawMessage
+		if err := json.Unmarshal(patch, &operations); err != nil {
+			t.Fatalf("Failed to unmarshal patch: %v", err)
+		}
+		sorted := make([]string, len(operations))
+		for i, operation := range operations {
+			sorted[i] = string(operation)
+		}
+		sort.Strings(sorted)
+		return sorted
 	}
 
-	admissionJSON, _ := json.Marshal(admissionReview)
+	if plain.Patch == nil || !reflect.DeepEqual(sortedOperations(plain.Patch), sortedOperations(compressed.Patch)) {
+		t.Errorf("Expected identical patches, got plain %s and compressed %s", plain.Patch, compressed.Patch)
+	}
+}
 
-	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewBuffer(admissionJSON))
-	req.Header.Set("Content-Type", "application/json")
-	rec := httptest.NewRecorder()
+func TestServeHTTP_OperationScopedScripts(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "always", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `warn("always")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "sidecar", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `warn("sidecar")`},
+		},
+	)
 
-	handler.ServeHTTP(rec, req)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
 
-	if rec.Code != http.StatusOK {
-		t.Errorf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	body := newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts:       "default/always",
+		scriptloader.AnnotationScriptsCreate: "default/sidecar",
+	})
+
+	tests := []struct {
+		operation admissionv1.Operation
+		expected  []string
+	}{
+		{operation: admissionv1.Create, expected: []string{"default/always: always", "default/sidecar: sidecar"}},
+		{operation: admissionv1.Update, expected: []string{"default/always: always"}},
 	}
 
-	var response admissionv1.AdmissionReview
-	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
-		t.Fatalf("Failed to unmarshal response: %v", err)
+	for _, tt := range tests {
+		t.Run(string(tt.operation), func(t *testing.T) {
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(body, &review); err != nil {
+				t.Fatalf("Failed to unmarshal review: %v", err)
+			}
+			review.Request.Operation = tt.operation
+			reviewBody, _ := json.Marshal(review)
+
+			response := serveAdmissionReview(t, handler, reviewBody)
+			if !reflect.DeepEqual(response.Warnings, tt.expected) {
+				t.Errorf("Expected scripts %v to run, got warnings %v", tt.expected, response.Warnings)
+			}
+		})
 	}
+}
+
+func TestServeHTTP_DeleteReadsOldObject(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "create", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `warn("create")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "protect", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `deny_forbidden("pod is protected")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.metadata.labels = {mutated = "true"}; warn("deleting " .. object.metadata.name)`},
+		},
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	// The API server sends DELETE requests with a null object and the deleted object as old object
+	deletion := func(annotations map[string]string) []byte {
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(newPodAdmissionReview(t, annotations), &review); err != nil {
+			t.Fatalf("Failed to unmarshal review: %v", err)
+		}
+		review.Request.Operation = admissionv1.Delete
+		review.Request.OldObject = review.Request.Object
+		review.Request.Object = runtime.RawExtension{Raw: []byte("null")}
+		body, _ := json.Marshal(review)
+		return body
+	}
+
+	response := serveAdmissionReview(t, handler, deletion(nil))
+	if !response.Allowed {
+		t.Errorf("Expected the deletion of an unannotated object to be allowed, got %+v", response.Result)
+	}
+
+	response = serveAdmissionReview(t, handler, deletion(map[string]string{scriptloader.AnnotationScriptsCreate: "default/create"}))
+	if !response.Allowed || len(response.Warnings) != 0 {
+		t.Errorf("Expected CREATE scripts not to run on deletion, got warnings %v", response.Warnings)
+	}
+
+	// Scripts see the deleted object, but it cannot be patched
+	response = serveAdmissionReview(t, handler, deletion(map[string]string{scriptloader.AnnotationScriptsDelete: "default/label"}))
+	if !response.Allowed {
+		t.Errorf("Expected the deletion to be allowed, got %+v", response.Result)
+	}
+	if !reflect.DeepEqual(response.Warnings, []string{"default/label: deleting test-pod"}) {
+		t.Errorf("Expected the DELETE script to run on the deleted object, got warnings %v", response.Warnings)
+	}
+	if response.Patch != nil {
+		t.Errorf("Expected no patch for a deletion, got %s", response.Patch)
+	}
+
+	response = serveAdmissionReview(t, handler, deletion(map[string]string{scriptloader.AnnotationScriptsDelete: "default/protect"}))
+	if response.Allowed {
+		t.Fatal("Expected the DELETE script to deny the deletion")
+	}
+	if response.Result == nil || !strings.Contains(response.Result.Message, "pod is protected") {
+		t.Errorf("Expected the denial of the script, got %+v", response.Result)
+	}
+}
+
+func TestServeHTTP_LatencyBudget(t *testing.T) {
+	slow := func(label string) string {
+		return `
+			local start = os.clock()
+			while os.clock() - start < 0.15 do end
+			object.metadata.labels = object.metadata.labels or {}
+			object.metadata.labels["` + label + `"] = "true"
+		`
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "a-slow", Namespace: "default"},
+			Data:       map[string]string{"script.lua": slow("first")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "b-slow", Namespace: "default"},
+			Data:       map[string]string{"script.lua": slow("second")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "c-slow", Namespace: "default"},
+			Data:       map[string]string{"script.lua": slow("third")},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	body := newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/a-slow,default/b-slow,default/c-slow",
+	})
+
+	newHandler := func(mode string, timeout time.Duration) *WebhookHandler {
+		return NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+			Timeout:           timeout,
+			BudgetFailureMode: mode,
+			RunnerOptions:     luarunner.Options{ScriptTimeout: 300 * time.Millisecond},
+		})
+	}
+
+	t.Run("allow keeps mutations made so far", func(t *testing.T) {
+		before := testutil.ToFloat64(metrics.BudgetExhausted.WithLabelValues("mutating"))
+
+		start := time.Now()
+		response := serveAdmissionReview(t, newHandler(FailureModeAllow, 500*time.Millisecond), body)
+		if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+			t.Errorf("Expected early finalization within the budget, took %s", elapsed)
+		}
+
+		if !response.Allowed {
+			t.Fatalf("Expected request to be allowed, got %v", response.Result)
+		}
+		if !bytes.Contains(response.Patch, []byte("first")) || !bytes.Contains(response.Patch, []byte("second")) ||
+			bytes.Contains(response.Patch, []byte("third")) {
+			t.Errorf("Expected the mutations of the first two scripts only, got %s", response.Patch)
+		}
+		if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "default/c-slow") {
+			t.Errorf("Expected a budget exhausted warning naming the skipped script, got %v", response.Warnings)
+		}
+		if got := testutil.ToFloat64(metrics.BudgetExhausted.WithLabelValues("mutating")); got != before+1 {
+			t.Errorf("Expected the metric to be incremented once, got %v", got-before)
+		}
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		response := serveAdmissionReview(t, newHandler(FailureModeDeny, 500*time.Millisecond), body)
+		if response.Allowed || response.Result == nil || !strings.Contains(response.Result.Message, "budget exhausted") {
+			t.Errorf("Expected request to be denied, got %+v", response)
+		}
+	})
+
+	t.Run("header overrides the configured timeout", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+		req.Header.Set(BudgetHeader, "350ms")
+		rec := httptest.NewRecorder()
+		newHandler(FailureModeAllow, 0).ServeHTTP(rec, req)
+
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		if !bytes.Contains(review.Response.Patch, []byte("first")) || bytes.Contains(review.Response.Patch, []byte("second")) {
+			t.Errorf("Expected only the first script to fit in the header budget, got %s", review.Response.Patch)
+		}
+	})
+}
+
+func TestServeHTTP_RunnerOptionsPassThrough(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "naming",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `
+					local naming = require("naming")
+					object.metadata.labels = {team = naming.team()}
+				`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		RunnerOptions: luarunner.Options{
+			ExtraModules: map[string]lua.LGFunction{
+				"naming": func(L *lua.LState) int {
+					L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+						"team": func(L *lua.LState) int {
+							L.Push(lua.LString("platform"))
+							return 1
+						},
+					}))
+					return 1
+				},
+			},
+		},
+	})
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/naming",
+	}))
+
+	if !bytes.Contains(response.Patch, []byte("platform")) {
+		t.Errorf("Expected the custom module to be available to scripts, got patch %s", response.Patch)
+	}
+}
+
+func TestServeHTTP_Validating(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "validate-script",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `
+					-- Simple validation script
+					if object.metadata.name == "invalid" then
+						error("Invalid name")
+					end
+				`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "validating")
+
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "valid-pod",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"glua.maurice.fr/scripts": "default/validate-script",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: "nginx:latest",
+				},
+			},
+		},
+	}
+
+	podJSON, _ := json.Marshal(pod)
+
+	admissionReview := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID: "test-uid",
+			Kind: metav1.GroupVersionKind{
+				Group:   "",
+				Version: "v1",
+				Kind:    "Pod",
+			},
+			Namespace: "default",
+			Name:      "valid-pod",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: podJSON,
+			},
+		},
+	}
+
+	admissionJSON, _ := json.Marshal(admissionReview)
+
+	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewBuffer(admissionJSON))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var response admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	// Should be allowed even if validation logic runs
+	if !response.Response.Allowed {
+		t.Error("Expected request to be allowed (validation errors are ignored)")
+	}
+
+	// Validating webhooks should not have patches
+	if response.Response.Patch != nil {
+		t.Error("Expected no patch for validating webhook")
+	}
+}
+
+func TestServeHTTP_ValidationSource(t *testing.T) {
+	// The check sorts before the script adding the label it requires
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "a-require-team", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				if object.metadata.labels == nil or object.metadata.labels.team == nil then
+					warn("missing team label")
+				end
+			`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "b-add-team", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				object.metadata.labels = object.metadata.labels or {}
+				object.metadata.labels.team = "platform"
+			`},
+		},
+	)
+	body := newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/a-require-team,default/b-add-team",
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	response := serveAdmissionReview(t, NewWebhookHandler(clientset, logger, "validating"), body)
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "missing team label") {
+		t.Errorf("Expected the request object to fail the check, got warnings %v", response.Warnings)
+	}
+
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "validating", HandlerOptions{
+		ValidationSource: ValidationSourceMutated,
+	})
+	response = serveAdmissionReview(t, handler, body)
+	if len(response.Warnings) != 0 {
+		t.Errorf("Expected the mutated object to pass the check, got warnings %v", response.Warnings)
+	}
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("Expected the request to be allowed without a patch, got %+v", response)
+	}
+}
+
+// newConfigMapAdmissionReview: encodes a CREATE admission review for a ConfigMap
+func newConfigMapAdmissionReview(t *testing.T, labels map[string]string, data map[string]string) []byte {
+	t.Helper()
+
+	configMap, err := json.Marshal(corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "scripts", Namespace: "default", Labels: labels},
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal ConfigMap: %v", err)
+	}
+
+	review, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "configmap-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			Namespace: "default",
+			Name:      "scripts",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: configMap},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal review: %v", err)
+	}
+	return review
+}
+
+func TestServeHTTP_ScriptConfigMapCheck(t *testing.T) {
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(fake.NewSimpleClientset(), logger, "validating")
+	scriptLabel := map[string]string{scriptloader.LabelScript: "true"}
+
+	broken := map[string]string{
+		"script.lua": "local labels = {}\nif labels then\n  labels.team = = \"platform\"\nend\n",
+		"README.md":  "not a script = =",
+	}
+	response := serveAdmissionReview(t, handler, newConfigMapAdmissionReview(t, scriptLabel, broken))
+	if response.Allowed || response.Result == nil || !strings.Contains(response.Result.Message, "script.lua:3:") {
+		t.Errorf("Expected the ConfigMap to be denied with the line of the error, got %+v", response.Result)
+	}
+
+	valid := map[string]string{"script.lua": "object.metadata.labels = {team = \"platform\"}\n"}
+	response = serveAdmissionReview(t, handler, newConfigMapAdmissionReview(t, scriptLabel, valid))
+	if !response.Allowed {
+		t.Errorf("Expected the valid ConfigMap to be allowed, got %+v", response.Result)
+	}
+
+	// Without the label, the ConfigMap is not a script ConfigMap
+	response = serveAdmissionReview(t, handler, newConfigMapAdmissionReview(t, nil, broken))
+	if !response.Allowed {
+		t.Errorf("Expected the unlabeled ConfigMap to be allowed, got %+v", response.Result)
+	}
+}
+
+func TestServeHTTP_ConfigMapNotFound(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "default",
+			Annotations: map[string]string{
+				"glua.maurice.fr/scripts": "default/nonexistent",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: "nginx:latest",
+				},
+			},
+		},
+	}
+
+	podJSON, _ := json.Marshal(pod)
+
+	admissionReview := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID: "test-uid",
+			Kind: metav1.GroupVersionKind{
+				Group:   "",
+				Version: "v1",
+				Kind:    "Pod",
+			},
+			Namespace: "default",
+			Name:      "test-pod",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: podJSON,
+			},
+		},
+	}
+
+	admissionJSON, _ := json.Marshal(admissionReview)
+
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewBuffer(admissionJSON))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var response admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	// Should be rejected when ConfigMap is not found
+	if response.Response.Allowed {
+		t.Error("Expected request to be rejected when ConfigMap not found")
+	}
+}
+
+func TestServeHTTP_StaleScriptFallback(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "add-label-script",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `
+					if object.metadata.labels == nil then
+						object.metadata.labels = {}
+					end
+					object.metadata.labels["injected"] = "true"
+				`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		LoaderOptions: scriptloader.Options{MaxStaleness: time.Hour},
+	})
+
+	body := newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/add-label-script",
+	})
+
+	// Prime the cache
+	if response := serveAdmissionReview(t, handler, body); response.Patch == nil {
+		t.Fatal("Expected patch to be present")
+	}
+
+	// The API server becomes unreachable
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("apiserver unavailable")
+	})
+
+	response := serveAdmissionReview(t, handler, body)
+	if !response.Allowed {
+		t.Errorf("Expected request to be allowed using the stale script, got: %v", response.Result)
+	}
+
+	if response.Patch == nil {
+		t.Error("Expected the stale script to still mutate the object")
+	}
+}
+
+func TestServeHTTP_StaleScriptFallbackDisabled(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "add-label-script",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `object.metadata.labels = {injected = "true"}`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	body := newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/add-label-script",
+	})
+
+	serveAdmissionReview(t, handler, body)
+
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("apiserver unavailable")
+	})
+
+	if response := serveAdmissionReview(t, handler, body); response.Allowed {
+		t.Error("Expected request to be rejected when stale serving is disabled")
+	}
+}
+
+func TestServeHTTP_ConfigMapUpdateInvalidatesCache(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "versioned-script",
+			Namespace:       "default",
+			ResourceVersion: "1",
+		},
+		Data: map[string]string{
+			"script.lua": `object.metadata.labels = {version = "v1"}`,
+		},
+	}
+	clientset := fake.NewSimpleClientset(cm)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := scriptloader.NewScriptLoaderWithOptions(clientset, logger, scriptloader.Options{CacheTTL: time.Hour})
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ScriptLoader: loader})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := loader.WatchConfigMaps(ctx, 0); err != nil {
+		t.Fatalf("WatchConfigMaps failed: %v", err)
+	}
+
+	body := newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/versioned-script",
+	})
+
+	if response := serveAdmissionReview(t, handler, body); !bytes.Contains(response.Patch, []byte("v1")) {
+		t.Fatalf("Expected v1 patch, got %s", response.Patch)
+	}
+
+	updated := cm.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Data["script.lua"] = `object.metadata.labels = {version = "v2"}`
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response := serveAdmissionReview(t, handler, body)
+		if bytes.Contains(response.Patch, []byte("v2")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the updated script to run despite the cache TTL, got %s", response.Patch)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleAdmissionRequest_InvalidObjectJSON(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	req := &admissionv1.AdmissionRequest{
+		UID: "test-uid",
+		Kind: metav1.GroupVersionKind{
+			Group:   "",
+			Version: "v1",
+			Kind:    "Pod",
+		},
+		Namespace: "default",
+		Name:      "test-pod",
+		Operation: admissionv1.Create,
+		Object: runtime.RawExtension{
+			Raw: []byte(`{invalid json}`),
+		},
+	}
+
+	response := handler.handleAdmissionRequest(context.Background(), req)
+
+	if response.Allowed {
+		t.Error("Expected request to be rejected for invalid JSON")
+	}
+
+	if response.Result == nil || response.Result.Message == "" {
+		t.Error("Expected error message in response")
+	}
+}
+
+func TestCreateJSONPatch(t *testing.T) {
+	original := []byte(`{"name": "test", "value": 1}`)
+	modified := []byte(`{"name": "test", "value": 2, "new": "field"}`)
+
+	patch, err := createJSONPatch(original, modified)
+	if err != nil {
+		t.Fatalf("createJSONPatch failed: %v", err)
+	}
+
+	if patch == nil {
+		t.Error("Expected non-nil patch")
+	}
+
+	// Verify patch is valid JSON (JSON Patch is an array of operations)
+	var patchOps []map[string]interface{}
+	if err := json.Unmarshal(patch, &patchOps); err != nil {
+		t.Fatalf("Patch is not valid JSON: %v", err)
+	}
+
+	// JSON Patch should be an array with operations
+	if len(patchOps) == 0 {
+		t.Error("Expected patch to have operations")
+	}
+
+	// Each operation should have at least "op" and "path" fields
+	for _, op := range patchOps {
+		if _, ok := op["op"]; !ok {
+			t.Error("Expected operation to have 'op' field")
+		}
+		if _, ok := op["path"]; !ok {
+			t.Error("Expected operation to have 'path' field")
+		}
+	}
+}
+
+func TestCreateJSONPatch_InvalidJSON(t *testing.T) {
+	original := []byte(`{invalid}`)
+	modified := []byte(`{"valid": "json"}`)
+
+	_, err := createJSONPatch(original, modified)
+	if err == nil {
+		t.Error("Expected error for invalid original JSON")
+	}
+
+	original = []byte(`{"valid": "json"}`)
+	modified = []byte(`{invalid}`)
+
+	_, err = createJSONPatch(original, modified)
+	if err == nil {
+		t.Error("Expected error for invalid modified JSON")
+	}
+}
+
+func TestCreateJSONPatch_Subtrees(t *testing.T) {
+	original := []byte(`{"a":{"b":[1,2],"c":"x","d/e":1},"same":{"k":[1.0,{"deep":true}]},"type":{"x":1}}`)
+	modified := []byte(`{"a":{"b":[1,3],"c":"y"},"same":{"k":[1.0,{"deep":true}]},"type":[1],"n":true}`)
+
+	patch, err := createJSONPatch(original, modified)
+	if err != nil {
+		t.Fatalf("createJSONPatch failed: %v", err)
+	}
+
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		t.Fatalf("Patch is not valid JSON: %v", err)
+	}
+	var got []string
+	for _, operation := range operations {
+		value, _ := json.Marshal(operation["value"])
+		got = append(got, fmt.Sprintf("%s %s %s", operation["op"], operation["path"], value))
+	}
+	sort.Strings(got)
+
+	expected := []string{
+		"add /n true",
+		"remove /a/d~1e null",
+		"replace /a/b/1 3",
+		"replace /a/c \"y\"",
+		"replace /type [1]",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected patch:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestCreateJSONPatch_Annotations(t *testing.T) {
+	modified := []byte(`{"metadata":{"name":"test","annotations":{"glua.maurice.fr/applied-scripts":"[]","a~b":"x"}}}`)
+	operations := func(t *testing.T, patch []byte) []string {
+		t.Helper()
+		var decoded []map[string]interface{}
+		if err := json.Unmarshal(patch, &decoded); err != nil {
+			t.Fatalf("Patch is not valid JSON: %v", err)
+		}
+		var got []string
+		for _, operation := range decoded {
+			value, _ := json.Marshal(operation["value"])
+			got = append(got, fmt.Sprintf("%s %s %s", operation["op"], operation["path"], value))
+		}
+		return got
+	}
+
+	// Missing or null annotations get an empty map first, then an add per annotation
+	for _, original := range []string{
+		`{"metadata":{"name":"test"}}`,
+		`{"metadata":{"name":"test","annotations":null}}`,
+	} {
+		patch, err := createJSONPatch([]byte(original), modified)
+		if err != nil {
+			t.Fatalf("createJSONPatch failed: %v", err)
+		}
+		expected := []string{
+			"add /metadata/annotations {}",
+			`add /metadata/annotations/a~0b "x"`,
+			`add /metadata/annotations/glua.maurice.fr~1applied-scripts "[]"`,
+		}
+		if got := operations(t, patch); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %v for %s, got %v", expected, original, got)
+		}
+	}
+
+	// Existing annotations are patched key by key, those of other webhooks survive the patch
+	original := []byte(`{"metadata":{"name":"test","annotations":{"a~b":"old"}}}`)
+	patch, err := createJSONPatch(original, modified)
+	if err != nil {
+		t.Fatalf("createJSONPatch failed: %v", err)
+	}
+	expected := []string{
+		`replace /metadata/annotations/a~0b "x"`,
+		`add /metadata/annotations/glua.maurice.fr~1applied-scripts "[]"`,
+	}
+	if got := operations(t, patch); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	decoded, err := evanphxpatch.DecodePatch(patch)
+	if err != nil {
+		t.Fatalf("Failed to decode patch: %v", err)
+	}
+	applied, err := decoded.Apply([]byte(`{"metadata":{"name":"test","annotations":{"a~b":"old","other.io/owner":"team-a"}}}`))
+	if err != nil {
+		t.Fatalf("Failed to apply patch: %v", err)
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(applied, &object); err != nil {
+		t.Fatalf("Failed to decode patched object: %v", err)
+	}
+	annotations := object["metadata"].(map[string]interface{})["annotations"]
+	if !reflect.DeepEqual(annotations, map[string]interface{}{
+		"a~b": "x", "glua.maurice.fr/applied-scripts": "[]", "other.io/owner": "team-a",
+	}) {
+		t.Errorf("Expected the annotation of the other webhook to survive, got %v", annotations)
+	}
+}
+
+func TestSplitAnnotations(t *testing.T) {
+	operations := []jsonpatch.JsonPatchOperation{
+		jsonpatch.NewPatch("replace", "/metadata/annotations/team", "core"),
+		jsonpatch.NewPatch("replace", "/metadata/annotations", map[string]interface{}{"b": "2", "a": "1"}),
+		jsonpatch.NewPatch("replace", "/metadata/annotations", "not a map"),
+		jsonpatch.NewPatch("replace", "/metadata/labels", map[string]interface{}{"a": "1"}),
+	}
+
+	split, err := splitAnnotations(operations)
+	if err != nil {
+		t.Fatalf("splitAnnotations failed: %v", err)
+	}
+	patch, err := json.Marshal(split)
+	if err != nil {
+		t.Fatalf("Failed to marshal patch: %v", err)
+	}
+	expected := `[{"op":"replace","path":"/metadata/annotations/team","value":"core"},` +
+		`{"op":"add","path":"/metadata/annotations","value":{}},` +
+		`{"op":"add","path":"/metadata/annotations/a","value":"1"},` +
+		`{"op":"add","path":"/metadata/annotations/b","value":"2"},` +
+		`{"op":"replace","path":"/metadata/annotations","value":"not a map"},` +
+		`{"op":"replace","path":"/metadata/labels","value":{"a":"1"}}]`
+	if string(patch) != expected {
+		t.Errorf("Expected %s, got %s", expected, patch)
+	}
+
+	// The replace of an existing annotation only touches that annotation
+	single, err := json.Marshal(split[:1])
+	if err != nil {
+		t.Fatalf("Failed to marshal patch: %v", err)
+	}
+	decoded, err := evanphxpatch.DecodePatch(single)
+	if err != nil {
+		t.Fatalf("Failed to decode patch: %v", err)
+	}
+	applied, err := decoded.Apply([]byte(`{"metadata":{"annotations":{"team":"web","other.io/owner":"team-a"}}}`))
+	if err != nil {
+		t.Fatalf("Failed to apply patch: %v", err)
+	}
+	if expected := `{"metadata":{"annotations":{"other.io/owner":"team-a","team":"core"}}}`; string(applied) != expected {
+		t.Errorf("Expected %s, got %s", expected, applied)
+	}
+}
+
+func TestMetadataPatch_Annotations(t *testing.T) {
+	original := []byte(`{"metadata":{"name":"test"}}`)
+	modified := []byte(`{"metadata":{"name":"test","annotations":{"team":"core","glua.maurice.fr/change-summary":"{}"}}}`)
+	results := []luarunner.ScriptResult{{Name: "a", Metadata: []luarunner.MetadataChange{{Field: "annotations", Key: "team", Value: "core"}}}}
+
+	patch, ok := metadataPatch(original, modified, results)
+	if !ok {
+		t.Fatal("Expected a metadata patch")
+	}
+	expected := `[{"op":"add","path":"/metadata/annotations","value":{}},` +
+		`{"op":"add","path":"/metadata/annotations/glua.maurice.fr~1change-summary","value":"{}"},` +
+		`{"op":"add","path":"/metadata/annotations/team","value":"core"}]`
+	if string(patch) != expected {
+		t.Errorf("Expected %s, got %s", expected, patch)
+	}
+}
+
+func TestCreateJSONPatch_NoopCustomResource(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	fixture := benchmarks.CustomResource(benchmarks.CRDShards)
+
+	modified, _, err := luarunner.NewScriptRunner(logger).RunScriptsWithContext(context.Background(),
+		map[string]string{"noop": benchmarks.NoopScript}, fixture.Object)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+	patch, err := createJSONPatch(fixture.Object, modified)
+	if err != nil {
+		t.Fatalf("createJSONPatch failed: %v", err)
+	}
+	if string(patch) != "[]" {
+		t.Errorf("Expected no operations for a no-op script, got %.500s", patch)
+	}
+
+	// Changing one number of a series only patches that number
+	modified, _, err = luarunner.NewScriptRunner(logger).RunScriptsWithContext(context.Background(),
+		map[string]string{"one": `object.spec.shards[3].series[5] = 8`}, fixture.Object)
+	if err != nil {
+		t.Fatalf("Failed to run script: %v", err)
+	}
+	patch, err = createJSONPatch(fixture.Object, modified)
+	if err != nil {
+		t.Fatalf("createJSONPatch failed: %v", err)
+	}
+	if string(patch) != `[{"op":"replace","path":"/spec/shards/2/series/4","value":8}]` {
+		t.Errorf("Expected a single replace operation, got %.500s", patch)
+	}
+
+	// Through the handler, no patch at all
+	clientset := fake.NewSimpleClientset(benchmarks.ScriptConfigMap("default", "noop", benchmarks.NoopScript))
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+	response := serveAdmissionReview(t, handler, benchmarks.AdmissionReview(fixture, map[string]string{
+		"glua.maurice.fr/scripts": "default/noop",
+	}))
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("Expected the custom resource allowed without a patch, got %.500s", response.Patch)
+	}
+}
+
+// BenchmarkCreateJSONPatch: patch generation for the fixtures, after a script added a label and an annotation
+func BenchmarkCreateJSONPatch(b *testing.B) {
+	logger := log.New(io.Discard, "", 0)
+	runner := luarunner.NewScriptRunner(logger)
+
+	for _, fixture := range benchmarks.Fixtures() {
+		modified, _, err := runner.RunScriptsWithContext(context.Background(),
+			map[string]string{"mutate": benchmarks.MutatingScript}, fixture.Object)
+		if err != nil {
+			b.Fatalf("Failed to mutate fixture %s: %v", fixture.Name, err)
+		}
+
+		b.Run(fixture.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(fixture.Object)))
+			for i := 0; i < b.N; i++ {
+				if _, err := createJSONPatch(fixture.Object, modified); err != nil {
+					b.Fatalf("Failed to create patch: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewWebhookHandler(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	if handler == nil {
+		t.Fatal("Expected non-nil handler")
+	}
+
+	if handler.clientset == nil {
+		t.Error("Expected clientset to be set")
+	}
+
+	if handler.logger != logger {
+		t.Error("Expected logger to be set")
+	}
+
+	if handler.webhookType != "mutating" {
+		t.Errorf("Expected webhook type 'mutating', got %s", handler.webhookType)
+	}
+
+	if handler.scriptLoader == nil {
+		t.Error("Expected script loader to be initialized")
+	}
+
+	if handler.scriptRunner == nil {
+		t.Error("Expected script runner to be initialized")
+	}
+}
+
+func TestNewWebhookHandler_Validating(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	handler := NewWebhookHandler(clientset, logger, "validating")
+
+	if handler.webhookType != "validating" {
+		t.Errorf("Expected webhook type 'validating', got %s", handler.webhookType)
+	}
+}
+
+func TestServeHTTP_ServerFilters(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "label",
+				Namespace: "default",
+			},
+			Data: map[string]string{
+				"script.lua": `object.metadata.labels = {processed = "true"}`,
+			},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	body := newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/label",
+	})
+
+	tests := []struct {
+		name      string
+		filters   ServerFilters
+		processed bool
+	}{
+		{name: "no filters", processed: true},
+		{name: "skipped namespace", filters: ServerFilters{SkipNamespaces: []string{"default"}}},
+		{name: "other namespace skipped", filters: ServerFilters{SkipNamespaces: []string{"kube-system"}}, processed: true},
+		{name: "kind not processed", filters: ServerFilters{OnlyKinds: []string{"Deployment"}}},
+		{name: "kind processed", filters: ServerFilters{OnlyKinds: []string{"Deployment", "Pod"}}, processed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{Filters: tt.filters})
+			response := serveAdmissionReview(t, handler, body)
+
+			if !response.Allowed {
+				t.Errorf("Expected request to be allowed, got %v", response.Result)
+			}
+			if (response.Patch != nil) != tt.processed {
+				t.Errorf("Expected processed=%v, got patch %s", tt.processed, response.Patch)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_AuditScriptLogs(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-label", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				local log = require("log")
+				local audit = require("audit")
+				log.info("checking team label")
+				audit.log("added team label ", "platform")
+				log.warn("image uses latest tag")
+			`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "verbose", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				require("audit").log(string.rep("x", 10000))
+			`},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	t.Run("disabled by default", func(t *testing.T) {
+		handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{})
+		response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+			scriptloader.AnnotationScripts: "default/team-label",
+		}))
+		if len(response.AuditAnnotations) != 0 {
+			t.Errorf("Expected no audit annotations, got %v", response.AuditAnnotations)
+		}
+	})
+
+	t.Run("three log lines", func(t *testing.T) {
+		handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{AuditScriptLogs: true})
+		response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+			scriptloader.AnnotationScripts: "default/team-label",
+		}))
+
+		expected := "default/team-label: info: checking team label; " +
+			"default/team-label: added team label platform; " +
+			"default/team-label: warn: image uses latest tag"
+		if got := response.AuditAnnotations[AuditAnnotationScriptLog]; got != expected {
+			t.Errorf("Expected audit annotation %q, got %q", expected, got)
+		}
+	})
+
+	t.Run("entry limit", func(t *testing.T) {
+		handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{AuditScriptLogs: true, AuditMaxEntries: 2})
+		response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+			scriptloader.AnnotationScripts: "default/team-label",
+		}))
+
+		got := response.AuditAnnotations[AuditAnnotationScriptLog]
+		if strings.Contains(got, "latest tag") || !strings.HasSuffix(got, "; (1 more)") {
+			t.Errorf("Expected two entries and a count of the dropped one, got %q", got)
+		}
+	})
+
+	t.Run("truncation", func(t *testing.T) {
+		handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{AuditScriptLogs: true})
+		response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+			scriptloader.AnnotationScripts: "default/verbose",
+		}))
+
+		got := response.AuditAnnotations[AuditAnnotationScriptLog]
+		if len(got) != AuditAnnotationMaxLength || !strings.HasPrefix(got, "default/verbose: xxx") || !strings.HasSuffix(got, "x...") {
+			t.Errorf("Expected the annotation to be truncated to %d bytes with an ellipsis, got %d bytes ending with %q",
+				AuditAnnotationMaxLength, len(got), got[len(got)-10:])
+		}
+	})
+}
+
+func TestTruncate_KeepsRunesWhole(t *testing.T) {
+	if got := truncate("héllo", 10); got != "héllo" {
+		t.Errorf("Expected short strings to be kept, got %q", got)
+	}
+
+	// Cutting at byte 5 would split the second é
+	got := truncate("ééééé", 8)
+	if got != "éé..." {
+		t.Errorf("Expected the cut to fall on a rune boundary, got %q", got)
+	}
+}
+
+func TestServeHTTP_ScriptVersions(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default", ResourceVersion: "41"},
+		Data:       map[string]string{"script.lua": `object.metadata.labels = {team = "core"}`},
+	}
+	clientset := fake.NewSimpleClientset(configMap)
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{AuditScriptLogs: true, AppliedScripts: true})
+	body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"})
+
+	hash := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	before := serveAdmissionReview(t, handler, body)
+	expected := "default/label sha256:" + hash(configMap.Data["script.lua"])[:12] + " rv:41"
+	if got := before.AuditAnnotations[AuditAnnotationScriptVersions]; got != expected {
+		t.Errorf("Expected audit annotation %q, got %q", expected, got)
+	}
+	applied := `[{\"name\":\"default/label\",\"sha256\":\"` + hash(configMap.Data["script.lua"]) + `\",\"resourceVersion\":\"41\"}]`
+	if !strings.Contains(string(before.Patch), "/metadata/annotations") || !strings.Contains(string(before.Patch), applied) {
+		t.Errorf("Expected the applied scripts annotation in the patch, got %s", before.Patch)
+	}
+
+	updated := configMap.DeepCopy()
+	updated.ResourceVersion = "42"
+	updated.Data["script.lua"] = `object.metadata.labels = {team = "platform"}`
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+
+	after := serveAdmissionReview(t, handler, body)
+	expected = "default/label sha256:" + hash(updated.Data["script.lua"])[:12] + " rv:42"
+	if got := after.AuditAnnotations[AuditAnnotationScriptVersions]; got != expected {
+		t.Errorf("Expected audit annotation %q after the update, got %q", expected, got)
+	}
+	if before.AuditAnnotations[AuditAnnotationScriptVersions] == after.AuditAnnotations[AuditAnnotationScriptVersions] {
+		t.Error("Expected the two decisions to carry different script versions")
+	}
+}
+
+func TestServeHTTP_AuditSink(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `object.metadata.labels = {team = "core"}`},
+	})
+	logger := log.New(io.Discard, "", 0)
+	body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"})
+
+	received := make(chan AuditRecord, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record AuditRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			t.Errorf("Failed to decode audit record: %v", err)
+		}
+		received <- record
+	}))
+	defer server.Close()
+
+	sink, err := NewAuditSink(server.URL, logger)
+	if err != nil {
+		t.Fatalf("Failed to create audit sink: %v", err)
+	}
+	defer sink.Close()
+
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{AuditSink: sink})
+	response := serveAdmissionReview(t, handler, body)
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Fatalf("Expected the pod to be patched, got %+v", response)
+	}
+
+	select {
+	case record := <-received:
+		if record.UID != "test-uid" || record.Kind != "Pod" || record.Namespace != "default" || record.Name != "test-pod" ||
+			!reflect.DeepEqual(record.Scripts, []string{"default/label"}) {
+			t.Errorf("Unexpected audit record %+v", record)
+		}
+		if !bytes.Equal(record.Patch, response.Patch) {
+			t.Errorf("Expected the patch of the response %s, got %s", response.Patch, record.Patch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the patch to reach the audit sink")
+	}
+
+	// A failing sink leaves admission alone
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	failingSink, err := NewAuditSink(failing.URL, logger)
+	if err != nil {
+		t.Fatalf("Failed to create audit sink: %v", err)
+	}
+	failures := testutil.ToFloat64(metrics.AuditSinkFailures.WithLabelValues("error"))
+
+	handler = NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{AuditSink: failingSink})
+	response = serveAdmissionReview(t, handler, body)
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Errorf("Expected the pod to be patched despite the sink failing, got %+v", response)
+	}
+	failingSink.Close()
+	if got := testutil.ToFloat64(metrics.AuditSinkFailures.WithLabelValues("error")) - failures; got != 1 {
+		t.Errorf("Expected one audit sink failure, got %v", got)
+	}
+}
+
+func TestServeHTTP_ScriptDependencies(t *testing.T) {
+	appendScript := func(step string) string {
+		return `
+			object.metadata.labels = object.metadata.labels or {}
+			local steps = object.metadata.labels.steps
+			object.metadata.labels.steps = steps and (steps .. "." .. "` + step + `") or "` + step + `"
+		`
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "a-finalize", Namespace: "default",
+				Annotations: map[string]string{scriptloader.AnnotationAfter: "default/z-base"}},
+			Data: map[string]string{"script.lua": appendScript("finalize")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "z-base", Namespace: "default"},
+			Data:       map[string]string{"script.lua": appendScript("base")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "loop", Namespace: "default",
+				Annotations: map[string]string{scriptloader.AnnotationAfter: "default/a-finalize"}},
+			Data: map[string]string{"script.lua": appendScript("loop")},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/a-finalize,default/z-base",
+	}))
+	if !response.Allowed {
+		t.Fatalf("Expected request to be allowed, got %v", response.Result)
+	}
+	if !bytes.Contains(response.Patch, []byte(`"base.finalize"`)) {
+		t.Errorf("Expected z-base to run before a-finalize, got patch %s", response.Patch)
+	}
+
+	// z-base now runs after loop, which runs after a-finalize, which runs after z-base
+	zBase, err := clientset.CoreV1().ConfigMaps("default").Get(context.Background(), "z-base", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ConfigMap: %v", err)
+	}
+	zBase.Annotations = map[string]string{scriptloader.AnnotationAfter: "default/loop"}
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(context.Background(), zBase, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/a-finalize,default/z-base,default/loop",
+	}))
+	if response.Allowed || response.Result == nil || !strings.Contains(response.Result.Message, "dependency cycle") {
+		t.Errorf("Expected the request to be denied because of the cycle, got %+v", response)
+	}
+}
+
+func TestServeHTTP_PreservesUnknownFields(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `object.metadata.labels = {mutated = "true"}`},
+	})
+
+	object := []byte(`{
+		"apiVersion": "example.com/v1",
+		"kind": "Widget",
+		"metadata": {
+			"name": "w",
+			"namespace": "default",
+			"annotations": {"glua.maurice.fr/scripts": "default/label"},
+			"x-unknown-metadata": {"kept": true}
+		},
+		"spec": {"replicas": 9007199254740993, "ratio": 1.0, "args": [], "selector": {}, "gone": null, "list": [null, "a"]}
+	}`)
+	review, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "unknown-fields",
+			Kind:      metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"},
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: object},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal review: %v", err)
+	}
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	response := serveAdmissionReview(t, NewWebhookHandler(clientset, logger, "mutating"), review)
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(response.Patch, &ops); err != nil {
+		t.Fatalf("Failed to unmarshal patch %s: %v", response.Patch, err)
+	}
+	if len(ops) != 1 || ops[0]["op"] != "add" || ops[0]["path"] != "/metadata/labels" {
+		t.Errorf("Expected a single operation adding the labels, got %s", response.Patch)
+	}
+}
+
+func TestServeHTTP_ScriptScope(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "labels-only", Namespace: "default",
+				Annotations: map[string]string{scriptloader.AnnotationScope: "/metadata/labels"}},
+			Data: map[string]string{"script.lua": `
+				object.metadata.labels = {team = "platform"}
+				object.metadata.annotations["scoped"] = "dropped"
+				object.spec.containers[1].image = "evil:latest"
+			`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "unscoped", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.metadata.annotations["unscoped"] = "kept"`},
+		},
+	)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/labels-only,default/unscoped",
+	}))
+	if !response.Allowed {
+		t.Fatalf("Expected request to be allowed, got %v", response.Result)
+	}
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(response.Patch, &ops); err != nil {
+		t.Fatalf("Failed to unmarshal patch %s: %v", response.Patch, err)
+	}
+	paths := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		paths[op["path"].(string)] = true
+	}
+	if !paths["/metadata/labels"] || !paths["/metadata/annotations/unscoped"] {
+		t.Errorf("Expected the in-scope and unscoped changes in the patch, got %s", response.Patch)
+	}
+	if paths["/metadata/annotations/scoped"] || bytes.Contains(response.Patch, []byte("evil")) {
+		t.Errorf("Expected the out-of-scope changes to be dropped, got %s", response.Patch)
+	}
+
+	if len(response.Warnings) != 1 ||
+		!strings.Contains(response.Warnings[0], "default/labels-only: changes outside scope /metadata/labels dropped") ||
+		!strings.Contains(response.Warnings[0], "/spec/containers/0/image") {
+		t.Errorf("Expected a warning listing the dropped changes, got %v", response.Warnings)
+	}
+}
+
+// flushingSource: a script source flushing the loader cache while it resolves
+type flushingSource struct {
+	loader *scriptloader.ScriptLoader
+}
+
+func (s flushingSource) Resolve(ctx context.Context, ref scriptloader.ScriptRef) ([]scriptloader.Script, error) {
+	s.loader.Flush()
+	return []scriptloader.Script{{Name: "flush:" + ref.Name, Content: "-- flushed"}}, nil
+}
+
+func TestServeHTTP_ScriptScopeSurvivesFlush(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "labels-only", Namespace: "default",
+			Annotations: map[string]string{scriptloader.AnnotationScope: "/metadata/labels"}},
+		Data: map[string]string{"script.lua": `object.spec.containers[1].image = "evil:latest"`},
+	})
+	logger := log.New(io.Discard, "", 0)
+
+	// The cache is flushed after the scoped script was loaded, before it runs
+	sources := make(map[string]scriptloader.ScriptSource)
+	loader := scriptloader.NewScriptLoaderWithOptions(clientset, logger, scriptloader.Options{Sources: sources})
+	sources["flush"] = flushingSource{loader: loader}
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ScriptLoader: loader})
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/labels-only,flush:now",
+	}))
+	if !response.Allowed {
+		t.Fatalf("Expected request to be allowed, got %v", response.Result)
+	}
+	if bytes.Contains(response.Patch, []byte("evil")) {
+		t.Errorf("Expected the out-of-scope change to be dropped despite the flush, got %s", response.Patch)
+	}
+}
+
+func TestDenyUnknownScopes(t *testing.T) {
+	handler := NewWebhookHandler(fake.NewSimpleClientset(), log.New(io.Discard, "", 0), "mutating")
+	set := scriptloader.ScriptSet{
+		Scripts: map[string]string{"default/known": "", "default/unknown": ""},
+		Scopes:  map[string][]string{"default/known": nil},
+	}
+
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	if handler.denyUnknownScopes(response, []string{"default/known"}, set) || !response.Allowed {
+		t.Errorf("Expected scripts of known scope to run, got %+v", response.Result)
+	}
+	if !handler.denyUnknownScopes(response, []string{"default/known", "default/unknown"}, set) || response.Allowed {
+		t.Fatal("Expected a script of unknown scope to deny the request")
+	}
+	if !strings.Contains(response.Result.Message, "default/unknown") {
+		t.Errorf("Expected the denial to name the script, got %q", response.Result.Message)
+	}
+
+	if _, _, err := handler.scopeFilter(set)("default/unknown", []byte(`{}`), []byte(`{"a":1}`)); err == nil {
+		t.Error("Expected the filter to fail a script of unknown scope")
+	}
+}
+
+func TestServeHTTP_RequestRawHash(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "sign", Namespace: "default"},
+		Data: map[string]string{"script.lua": `
+			local hash = require("hash")
+			object.metadata.annotations["example.com/sha256"] = hash.sha256(request.raw)
+		`},
+	})
+
+	body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/sign"})
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil {
+		t.Fatalf("Failed to unmarshal review: %v", err)
+	}
+	sum := sha256.Sum256(review.Request.Object.Raw)
+
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	response := serveAdmissionReview(t, NewWebhookHandler(clientset, logger, "mutating"), body)
+	if !response.Allowed {
+		t.Fatalf("Expected request to be allowed, got %v", response.Result)
+	}
+	if !bytes.Contains(response.Patch, []byte(hex.EncodeToString(sum[:]))) {
+		t.Errorf("Expected the patch to carry the hash of the raw object, got %s", response.Patch)
+	}
+}
+
+func TestServeHTTP_MetadataFastPath(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "annotate", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_annotation(object, "example.com/owner", "platform")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "image", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.spec.containers[1].image = "nginx:stable"`},
+		},
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	patchOf := func(scripts string) []map[string]interface{} {
+		t.Helper()
+		response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: scripts}))
+		var ops []map[string]interface{}
+		if err := json.Unmarshal(response.Patch, &ops); err != nil {
+			t.Fatalf("Failed to unmarshal patch %s: %v", response.Patch, err)
+		}
+		return ops
+	}
+
+	ops := patchOf("default/label")
+	if len(ops) != 1 || ops[0]["op"] != "add" || ops[0]["path"] != "/metadata/labels" ||
+		!reflect.DeepEqual(ops[0]["value"], map[string]interface{}{"team": "platform"}) {
+		t.Errorf("Expected a single operation adding the label, got %v", ops)
+	}
+
+	ops = patchOf("default/annotate")
+	if len(ops) != 1 || ops[0]["path"] != "/metadata/annotations/example.com~1owner" || ops[0]["value"] != "platform" {
+		t.Errorf("Expected a single operation adding the escaped annotation, got %v", ops)
+	}
+
+	// Other changes cannot be covered by the recorded ones, the patch comes from the diff
+	ops = patchOf("default/label,default/image")
+	paths := make([]string, 0, len(ops))
+	for _, op := range ops {
+		paths = append(paths, op["path"].(string))
+	}
+	sort.Strings(paths)
+	if !reflect.DeepEqual(paths, []string{"/metadata/labels", "/spec/containers/0/image"}) {
+		t.Errorf("Expected the label and image changes, got %v", ops)
+	}
+}
+
+func TestServeHTTP_MetadataFastPathWithBookkeeping(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	})
+	var logs bytes.Buffer
+	handler := NewWebhookHandlerWithOptions(clientset, log.New(&logs, "", 0), "mutating", HandlerOptions{ChangeSummary: true})
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"}))
+	if !strings.Contains(logs.String(), "Applied metadata JSON patch") {
+		t.Errorf("Expected the change summary not to prevent the metadata fast path, got logs:\n%s", logs.String())
+	}
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(response.Patch, &ops); err != nil {
+		t.Fatalf("Failed to unmarshal patch %s: %v", response.Patch, err)
+	}
+	paths := make([]string, 0, len(ops))
+	for _, op := range ops {
+		paths = append(paths, op["path"].(string))
+	}
+	if !reflect.DeepEqual(paths, []string{"/metadata/labels", "/metadata/annotations/" + escapePointerToken(AnnotationChangeSummary)}) {
+		t.Errorf("Expected the label and the change summary to be patched, got %v", ops)
+	}
+}
+
+func TestServeHTTP_TypeMetaChanges(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "kind", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.kind = "Deployment"`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "version", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.apiVersion = "apps/v1"`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.metadata.labels = {team = "platform"}`},
+		},
+	)
+	handler := NewWebhookHandler(clientset, log.New(io.Discard, "", 0), "mutating")
+
+	tests := []struct {
+		scripts string
+		message string
+	}{
+		{scripts: "default/kind", message: `scripts changed the kind of the object from "Pod" to "Deployment"`},
+		{scripts: "default/version", message: `scripts changed the apiVersion of the object from "v1" to "apps/v1"`},
+		{scripts: "default/label,default/kind,default/version", message: "scripts changed the apiVersion and kind of the object from v1 Pod to apps/v1 Deployment"},
+		{scripts: "default/label"},
+	}
+	for _, tt := range tests {
+		response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: tt.scripts}))
+		if tt.message == "" {
+			if !response.Allowed || response.Patch == nil {
+				t.Errorf("%s: expected the request to be patched, got %+v", tt.scripts, response.Result)
+			}
+			continue
+		}
+		if response.Allowed {
+			t.Errorf("%s: expected the request to be denied", tt.scripts)
+			continue
+		}
+		if !strings.Contains(response.Result.Message, tt.message) {
+			t.Errorf("%s: expected message %q, got %q", tt.scripts, tt.message, response.Result.Message)
+		}
+		if response.Patch != nil {
+			t.Errorf("%s: expected no patch, got %s", tt.scripts, response.Patch)
+		}
+	}
+}
+
+func TestServeHTTP_MissingTypeMeta(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+if object.apiVersion == "v1" and object.kind == "Pod" and gvk.api_version == "v1" and gvk.kind == "Pod" then
+  object.metadata.labels = {pod = "true"}
+end`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "noop", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `local kind = object.kind`},
+		},
+	)
+	handler := NewWebhookHandler(clientset, log.New(io.Discard, "", 0), "mutating")
+
+	// Aggregated API servers may send objects without their apiVersion and kind
+	withoutTypeMeta := func(scripts string) []byte {
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: scripts}), &review); err != nil {
+			t.Fatalf("Failed to unmarshal admission review: %v", err)
+		}
+		var object map[string]interface{}
+		if err := json.Unmarshal(review.Request.Object.Raw, &object); err != nil {
+			t.Fatalf("Failed to unmarshal pod: %v", err)
+		}
+		delete(object, "apiVersion")
+		delete(object, "kind")
+		raw, err := json.Marshal(object)
+		if err != nil {
+			t.Fatalf("Failed to marshal pod: %v", err)
+		}
+		review.Request.Object.Raw = raw
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatalf("Failed to marshal admission review: %v", err)
+		}
+		return body
+	}
+
+	response := serveAdmissionReview(t, handler, withoutTypeMeta("default/pods"))
+	if !response.Allowed {
+		t.Fatalf("Expected the request to be allowed, got %+v", response.Result)
+	}
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(response.Patch, &operations); err != nil {
+		t.Fatalf("Failed to unmarshal patch %s: %v", response.Patch, err)
+	}
+	if len(operations) == 0 {
+		t.Fatal("Expected the kind-branching script to label the pod")
+	}
+	for _, operation := range operations {
+		path, _ := operation["path"].(string)
+		if !strings.HasPrefix(path, "/metadata/labels") {
+			t.Errorf("Expected only label operations, got %v", operation)
+		}
+	}
+
+	response = serveAdmissionReview(t, handler, withoutTypeMeta("default/noop"))
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("Expected the untouched pod to be allowed without a patch, got %s", response.Patch)
+	}
+}
+
+func TestServeHTTP_MalformedScriptReferences(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `object.metadata.labels = {team = "platform"}`},
+	})
+	annotations := map[string]string{scriptloader.AnnotationScripts: "default/label,Default/My-Script,/my-script,"}
+	expected := []string{
+		scriptloader.AnnotationScripts + `: invalid script reference "Default/My-Script": invalid namespace "Default"`,
+		scriptloader.AnnotationScripts + `: invalid script reference "/my-script": empty namespace`,
+	}
+
+	// The valid references still run, the malformed ones are reported
+	handler := NewWebhookHandler(clientset, log.New(io.Discard, "", 0), "mutating")
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, annotations))
+	if !response.Allowed || response.Patch == nil {
+		t.Fatalf("Expected the valid reference to patch the object, got %+v", response.Result)
+	}
+	if len(response.Warnings) != len(expected) {
+		t.Fatalf("Expected %d warnings, got %v", len(expected), response.Warnings)
+	}
+	for i, message := range expected {
+		if !strings.HasPrefix(response.Warnings[i], message) {
+			t.Errorf("Expected warning %q, got %q", message, response.Warnings[i])
+		}
+	}
+
+	// Strict mode denies the request
+	handler = NewWebhookHandlerWithOptions(clientset, log.New(io.Discard, "", 0), "mutating", HandlerOptions{StrictAnnotations: true})
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, annotations))
+	if response.Allowed {
+		t.Fatal("Expected malformed references to deny the request in strict mode")
+	}
+	if !strings.Contains(response.Result.Message, `"Default/My-Script"`) || !strings.Contains(response.Result.Message, `"/my-script"`) {
+		t.Errorf("Expected the message to name every malformed reference, got %q", response.Result.Message)
+	}
+
+	// References to unknown sources are reported, and still fail the load
+	handler = NewWebhookHandler(clientset, log.New(io.Discard, "", 0), "mutating")
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default:my-script"}))
+	if response.Allowed || len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "use namespace/name to reference a ConfigMap") {
+		t.Errorf("Expected the colon to be explained, got %v, %+v", response.Warnings, response.Result)
+	}
+}
+
+func TestServeHTTP_Concurrent(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				local ns = require("cluster").get_namespace("default")
+				object.metadata.labels = {copied = object.metadata.name, namespace = tostring(ns ~= nil)}
+				require("audit").log("labelled ", object.metadata.name)
+			`},
+		},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	)
+
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		LoaderOptions:   scriptloader.Options{CacheTTL: time.Minute},
+		AuditScriptLogs: true,
+	})
+	body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"})
+
+	const calls = 100
+	var wg sync.WaitGroup
+	responses := make(chan *admissionv1.AdmissionResponse, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil || review.Response == nil {
+				responses <- nil
+				return
+			}
+			responses <- review.Response
+		}()
+	}
+	wg.Wait()
+	close(responses)
+
+	for response := range responses {
+		if response == nil {
+			t.Error("Expected a response to every request")
+			continue
+		}
+		if !response.Allowed || !bytes.Contains(response.Patch, []byte(`"copied":"test-pod"`)) {
+			t.Errorf("Expected every request to be patched, got %+v", response)
+		}
+	}
+}
+
+func TestServeHTTP_GenerateNameLogs(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	})
+
+	var logs bytes.Buffer
+	handler := NewWebhookHandler(clientset, log.New(&logs, "", 0), "mutating")
+
+	for _, uid := range []string{"uid-1", "uid-2"} {
+		pod, _ := json.Marshal(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata": map[string]interface{}{
+				"generateName": "web-",
+				"namespace":    "default",
+				"annotations":  map[string]string{scriptloader.AnnotationScripts: "default/label"},
+			},
+		})
+		body, _ := json.Marshal(admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       types.UID(uid),
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Namespace: "default",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: pod},
+			},
+		})
+
+		response := serveAdmissionReview(t, handler, body)
+		if !response.Allowed || len(response.Patch) == 0 {
+			t.Fatalf("Expected the request to be allowed with a patch, got %+v", response)
+		}
+	}
+
+	output := logs.String()
+	for _, expected := range []string{
+		"Object=default/web-[uid-1], Operation=CREATE, UID=uid-1",
+		"Object=default/web-[uid-2], Operation=CREATE, UID=uid-2",
+		"executing 1 scripts on default/web-[uid-1]",
+		"bytes to default/web-[uid-2]",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected the logs to contain %q, got:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, "Object=default/,") {
+		t.Errorf("Expected no empty object name in the logs, got:\n%s", output)
+	}
+}
+
+func TestServeHTTP_Params(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "mirror", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.spec.containers[1].image = params.registry .. "/" .. object.spec.containers[1].image`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "params", Namespace: "default"},
+			Data:       map[string]string{"registry": "mirror.example.com"},
+		},
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/mirror",
+		scriptloader.AnnotationParams:  "default/params",
+	}))
+	if !response.Allowed || !bytes.Contains(response.Patch, []byte("mirror.example.com/nginx:latest")) {
+		t.Errorf("Expected the image to be rewritten from the params, got %+v", response)
+	}
+
+	// The default params apply to objects without the annotation
+	handler = NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{DefaultParams: "default/params"})
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/mirror"}))
+	if !response.Allowed || !bytes.Contains(response.Patch, []byte("mirror.example.com/nginx:latest")) {
+		t.Errorf("Expected the image to be rewritten from the default params, got %+v", response)
+	}
+
+	// A missing params ConfigMap fails the request like a missing script ConfigMap
+	missing := newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/mirror",
+		scriptloader.AnnotationParams:  "default/missing",
+	})
+	response = serveAdmissionReview(t, NewWebhookHandler(clientset, logger, "mutating"), missing)
+	if response.Allowed || response.Result == nil || !strings.Contains(response.Result.Message, "failed to load params") {
+		t.Errorf("Expected the request to be denied, got %+v", response)
+	}
+
+	// Unless scripts are loaded in best-effort mode: the scripts then run with empty params
+	handler = NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		LoaderOptions: scriptloader.Options{BestEffort: true},
+	})
+	response = serveAdmissionReview(t, handler, missing)
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("Expected the request to be allowed unchanged, got %+v", response)
+	}
+}
+
+func TestServeHTTP_SkipAnnotation(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	reviewBy := func(username string) []byte {
+		t.Helper()
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(newPodAdmissionReview(t, map[string]string{
+			scriptloader.AnnotationScripts: "default/label",
+			AnnotationSkip:                 "true",
+		}), &review); err != nil {
+			t.Fatalf("Failed to unmarshal review: %v", err)
+		}
+		review.Request.UserInfo.Username = username
+		body, _ := json.Marshal(review)
+		return body
+	}
+
+	response := serveAdmissionReview(t, NewWebhookHandler(clientset, logger, "mutating"), reviewBy("alice"))
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("Expected the skipped object to be allowed unchanged, got %+v", response)
+	}
+
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{SkipAllowedUsers: []string{"admin"}})
+	response = serveAdmissionReview(t, handler, reviewBy("admin"))
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("Expected the object of an allowed user to be skipped, got %+v", response)
+	}
+
+	response = serveAdmissionReview(t, handler, reviewBy("alice"))
+	if !response.Allowed || !bytes.Contains(response.Patch, []byte("platform")) {
+		t.Errorf("Expected the scripts to run for a user not allowed to skip, got %+v", response)
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], AnnotationSkip+" ignored") {
+		t.Errorf("Expected a warning about the ignored annotation, got %v", response.Warnings)
+	}
+}
+
+func TestServeHTTP_ScriptExecutionMetrics(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "metrics-ok", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "metrics-fail", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `error("boom")`},
+		},
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+	serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/metrics-ok,default/metrics-fail"}))
+	serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/metrics-ok"}))
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	var series []string
+	active := -1.0
+	for _, family := range families {
+		switch family.GetName() {
+		case "glua_webhook_script_executions_total":
+			for _, metric := range family.GetMetric() {
+				labels := make([]string, 0, len(metric.GetLabel()))
+				for _, label := range metric.GetLabel() {
+					labels = append(labels, label.GetName()+"="+label.GetValue())
+				}
+				line := fmt.Sprintf("%s{%s} %v", family.GetName(), strings.Join(labels, ","), metric.GetCounter().GetValue())
+				if strings.Contains(line, "configmap=default/metrics-") {
+					series = append(series, line)
+				}
+			}
+		case "glua_webhook_scripts_active":
+			active = family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	sort.Strings(series)
+
+	expected := []string{
+		"glua_webhook_script_executions_total{configmap=default/metrics-fail,result=error,webhook=mutating} 1",
+		"glua_webhook_script_executions_total{configmap=default/metrics-ok,result=success,webhook=mutating} 2",
+	}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("Expected series %v, got %v", expected, series)
+	}
+	if active < 2 {
+		t.Errorf("Expected at least the two ConfigMaps to be active, got %v", active)
+	}
+}
+
+func TestServeHTTP_ChangeSummary(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "a-label", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "b-image", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				object.metadata.labels.team = "core"
+				object.spec.containers[1].image = "nginx:stable"
+			`},
+		},
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ChangeSummary: true})
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/a-label,default/b-image"}))
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(response.Patch, &ops); err != nil {
+		t.Fatalf("Failed to unmarshal patch %s: %v", response.Patch, err)
+	}
+
+	var value string
+	for _, op := range ops {
+		if op["path"] == "/metadata/annotations/glua.maurice.fr~1change-summary" {
+			value, _ = op["value"].(string)
+		}
+	}
+	if value == "" {
+		t.Fatalf("Expected the patch to add the change summary, got %s", response.Patch)
+	}
+
+	var summary ChangeSummary
+	if err := json.Unmarshal([]byte(value), &summary); err != nil {
+		t.Fatalf("Failed to unmarshal change summary %s: %v", value, err)
+	}
+	expected := ChangeSummary{Changes: []PathChange{
+		{Path: "/metadata/labels", Scripts: []string{"default/a-label"}},
+		{Path: "/metadata/labels/team", Scripts: []string{"default/b-image"}},
+		{Path: "/spec/containers/0/image", Scripts: []string{"default/b-image"}},
+	}}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected summary %+v, got %+v", expected, summary)
+	}
+
+	// Objects the scripts leave unchanged get no summary
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, nil))
+	if len(response.Patch) != 0 {
+		t.Errorf("Expected no patch for an unchanged object, got %s", response.Patch)
+	}
+}
+
+func TestServeHTTP_CheckConsistency(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "a-reserved", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				if object.metadata.labels and object.metadata.labels.team == "platform" then
+					deny_forbidden("team platform is reserved")
+				end
+			`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "b-label", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+		},
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{CheckConsistency: true})
+
+	before := testutil.ToFloat64(metrics.ConsistencyConflicts.WithLabelValues("default/a-reserved"))
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/a-reserved,default/b-label"}))
+	if !response.Allowed || len(response.Patch) == 0 {
+		t.Fatalf("Expected the object to be allowed and patched, got allowed=%v patch=%s", response.Allowed, response.Patch)
+	}
+	if len(response.Warnings) != 1 {
+		t.Fatalf("Expected one consistency warning, got %v", response.Warnings)
+	}
+	for _, name := range []string{"default/a-reserved", "default/b-label"} {
+		if !strings.Contains(response.Warnings[0], name) {
+			t.Errorf("Expected the warning to name %s, got %q", name, response.Warnings[0])
+		}
+	}
+	if after := testutil.ToFloat64(metrics.ConsistencyConflicts.WithLabelValues("default/a-reserved")); after != before+1 {
+		t.Errorf("Expected the conflict to be counted, got %v -> %v", before, after)
+	}
+
+	// Scripts agreeing on the mutated object raise no warning
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/b-label"}))
+	if len(response.Warnings) != 0 {
+		t.Errorf("Expected no warning, got %v", response.Warnings)
+	}
+}
+
+func TestServeHTTP_IdempotentInjection(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "sidecar", Namespace: "default"},
+		Data: map[string]string{"script.lua": `
+			if not once(object, "example.com/sidecar-injected") then
+				return
+			end
+			table.insert(object.spec.containers, {name = "sidecar", image = "busybox:latest"})
+		`},
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+
+	tests := []struct {
+		name     string
+		options  HandlerOptions
+		injected bool
+		patched  bool
+	}{
+		{"first admission", HandlerOptions{}, false, true},
+		{"already injected", HandlerOptions{}, true, false},
+		{"already injected, skipped by the webhook", HandlerOptions{InjectedAnnotation: "example.com/sidecar-injected"}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", tt.options)
+			annotations := map[string]string{scriptloader.AnnotationScripts: "default/sidecar"}
+			if tt.injected {
+				annotations["example.com/sidecar-injected"] = "true"
+			}
+
+			response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, annotations))
+			if !response.Allowed {
+				t.Fatalf("Expected the pod to be allowed, got %+v", response.Result)
+			}
+			if !tt.patched {
+				if len(response.Patch) != 0 {
+					t.Errorf("Expected no second sidecar, got patch %s", response.Patch)
+				}
+				return
+			}
+
+			patch := string(response.Patch)
+			for _, expected := range []string{`busybox:latest`, `"/metadata/annotations/example.com~1sidecar-injected"`} {
+				if !strings.Contains(patch, expected) {
+					t.Errorf("Expected the patch to hold %s, got %s", expected, patch)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTP_SummaryLog(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	})
+	var output bytes.Buffer
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		SummaryLogger: slog.New(slog.NewJSONHandler(&output, nil)),
+	})
+
+	serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"}))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single summary line, got %q", output.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Failed to decode summary %q: %v", lines[0], err)
+	}
+
+	expected := map[string]interface{}{
+		"level":     "INFO",
+		"webhook":   "mutating",
+		"uid":       "test-uid",
+		"kind":      "Pod",
+		"namespace": "default",
+		"name":      "test-pod",
+		"operation": "CREATE",
+		"scripts":   []interface{}{"default/label"},
+		"allowed":   true,
+		"patch_ops": float64(1),
+		"errors":    "",
+	}
+	for field, value := range expected {
+		if !reflect.DeepEqual(record[field], value) {
+			t.Errorf("Expected %s to be %v, got %v", field, value, record[field])
+		}
+	}
+	for _, field := range []string{"duration", "load", "to_lua", "execute", "from_lua"} {
+		if _, ok := record[field].(float64); !ok {
+			t.Errorf("Expected duration %s in the summary, got %v", field, record[field])
+		}
+	}
+}
+
+func TestServeHTTP_ResponseCache(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cached-label", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	}
+	clientset := fake.NewSimpleClientset(cm)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	loader := scriptloader.NewScriptLoaderWithOptions(clientset, logger, scriptloader.Options{CacheTTL: time.Hour})
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		ScriptLoader:     loader,
+		ResponseCacheTTL: time.Hour,
+	})
+
+	invalidated := make(chan string, 10)
+	loader.AddInvalidationHook(func(namespace, name string) {
+		invalidated <- namespace + "/" + name
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := loader.WatchConfigMaps(ctx, 0); err != nil {
+		t.Fatalf("WatchConfigMaps failed: %v", err)
+	}
+
+	body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/cached-label"})
+	hits := func() float64 { return testutil.ToFloat64(metrics.ResponseCacheHits.WithLabelValues("mutating")) }
+
+	before := hits()
+	if response := serveAdmissionReview(t, handler, body); !strings.Contains(string(response.Patch), "platform") {
+		t.Fatalf("Expected the label to be patched, got %s", response.Patch)
+	}
+	if response := serveAdmissionReview(t, handler, body); !strings.Contains(string(response.Patch), "platform") {
+		t.Fatalf("Expected the cached patch, got %s", response.Patch)
+	}
+	if after := hits(); after != before+1 {
+		t.Fatalf("Expected the identical request to be served from the cache, got %v -> %v hits", before, after)
+	}
+
+	updated := cm.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Data["script.lua"] = `add_label(object, "team", "core")`
+	if _, err := clientset.CoreV1().ConfigMaps("default").Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+	select {
+	case <-invalidated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the ConfigMap to be invalidated")
+	}
+
+	before = hits()
+	if response := serveAdmissionReview(t, handler, body); !strings.Contains(string(response.Patch), "core") {
+		t.Errorf("Expected the scripts to run again with the new content, got %s", response.Patch)
+	}
+	if after := hits(); after != before {
+		t.Errorf("Expected no cache hit after the update, got %v -> %v hits", before, after)
+	}
+}
+
+func TestServeHTTP_ResponseCacheNonDeterministic(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "stamp", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_label(object, "stamp", os.date("%Y"))`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "dice", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_label(object, "dice", tostring(math.random(6)))`},
+		},
+	)
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ResponseCacheTTL: time.Hour})
+	hits := func() float64 { return testutil.ToFloat64(metrics.ResponseCacheHits.WithLabelValues("mutating")) }
+
+	for _, script := range []string{"default/stamp", "default/dice"} {
+		body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: script})
+		before := hits()
+		serveAdmissionReview(t, handler, body)
+		serveAdmissionReview(t, handler, body)
+		if after := hits(); after != before {
+			t.Errorf("Expected the response of %s to never be cached, got %v -> %v hits", script, before, after)
+		}
+	}
+}
+
+func TestServeHTTP_ResponseCacheNonDeterministicDenial(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "curfew", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `if os.time() > 0 then deny_forbidden("x") end`},
+	})
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "validating", HandlerOptions{ResponseCacheTTL: time.Hour})
+	hits := func() float64 { return testutil.ToFloat64(metrics.ResponseCacheHits.WithLabelValues("validating")) }
+
+	body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/curfew"})
+	before := hits()
+	for i := 0; i < 2; i++ {
+		if response := serveAdmissionReview(t, handler, body); response.Allowed {
+			t.Fatalf("Expected the request to be denied")
+		}
+	}
+	if after := hits(); after != before {
+		t.Errorf("Expected a denial depending on the clock to never be cached, got %v -> %v hits", before, after)
+	}
+}
+
+func TestServeHTTP_ResponseCacheBypass(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cached-label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	})
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ResponseCacheTTL: time.Hour})
+	body := newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/cached-label",
+		AnnotationNoCache:              "true",
+	})
+	hits := func() float64 { return testutil.ToFloat64(metrics.ResponseCacheHits.WithLabelValues("mutating")) }
+
+	before := hits()
+	for i := 0; i < 3; i++ {
+		if response := serveAdmissionReview(t, handler, body); !strings.Contains(string(response.Patch), "platform") {
+			t.Fatalf("Expected the label to be patched, got %s", response.Patch)
+		}
+	}
+	if after := hits(); after != before {
+		t.Errorf("Expected every request to run the scripts, got %v -> %v cache hits", before, after)
+	}
+	if len(handler.responses.entries) != 0 {
+		t.Errorf("Expected nothing to be cached, got %d responses", len(handler.responses.entries))
+	}
+}
+
+func TestServeHTTP_LoadShedding(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	body := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"})
+
+	for _, mode := range []string{FailureModeAllow, FailureModeDeny} {
+		t.Run(mode, func(t *testing.T) {
+			handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+				MaxInFlight:     1,
+				ShedWait:        10 * time.Millisecond,
+				ShedFailureMode: mode,
+			})
+
+			// Saturate the limiter with a request that never completes
+			handler.inFlight <- struct{}{}
+
+			before := testutil.ToFloat64(metrics.ShedRequests.WithLabelValues("mutating"))
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if after := testutil.ToFloat64(metrics.ShedRequests.WithLabelValues("mutating")); after != before+1 {
+				t.Errorf("Expected the request to be shed, got %v -> %v", before, after)
+			}
+
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+			if mode == FailureModeAllow {
+				if rec.Code != http.StatusOK || !review.Response.Allowed || len(review.Response.Patch) != 0 || len(review.Response.Warnings) != 1 {
+					t.Errorf("Expected the request to be allowed as-is with a warning, got %d %+v", rec.Code, review.Response)
+				}
+			} else if rec.Code != http.StatusServiceUnavailable || review.Response.Allowed {
+				t.Errorf("Expected a 503, got %d %+v", rec.Code, review.Response)
+			}
+
+			// Once the slot is free, requests run the scripts again
+			<-handler.inFlight
+			if response := serveAdmissionReview(t, handler, body); len(response.Patch) == 0 {
+				t.Errorf("Expected the scripts to run once the limiter has room, got %+v", response)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_ShadowScripts(t *testing.T) {
+	configMap := func(name, script string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Data:       map[string]string{"script.lua": script},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		configMap("labels", `add_label(object, "team", "core")`),
+		configMap("labels-v2", `object.metadata.labels = object.metadata.labels or {} object.metadata.labels.team = "core"`),
+		configMap("labels-v3", `add_label(object, "team", "platform")`),
+		configMap("strict", `deny_forbidden("no team")`),
+	)
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{})
+	divergences := metrics.ShadowDivergence.WithLabelValues("mutating")
+
+	tests := []struct {
+		name     string
+		shadow   string
+		diverges bool
+	}{
+		{name: "agreeing rewrite", shadow: "default/labels-v2"},
+		{name: "different label", shadow: "default/labels-v3", diverges: true},
+		{name: "denial", shadow: "default/strict", diverges: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(divergences)
+			response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+				scriptloader.AnnotationScripts: "default/labels",
+				AnnotationShadowScripts:        tt.shadow,
+			}))
+
+			// The response is the one of the primary scripts whatever the shadow scripts did
+			if !response.Allowed || !strings.Contains(string(response.Patch), `"team":"core"`) || len(response.Warnings) != 0 {
+				t.Errorf("Expected the primary label and no warning, got allowed=%v patch %s warnings %v", response.Allowed, response.Patch, response.Warnings)
+			}
+			diverged := testutil.ToFloat64(divergences) - before
+			if tt.diverges && diverged != 1 {
+				t.Errorf("Expected a divergence to be counted, got %v", diverged)
+			}
+			if !tt.diverges && diverged != 0 {
+				t.Errorf("Expected no divergence, got %v", diverged)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_ComparePatchGenerators(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "mutate", Namespace: "default"},
+		Data: map[string]string{"script.lua": `
+object.metadata.labels = {team = "core"}
+object.spec.containers[1].image = "nginx:1.27"`},
+	})
+	var logs bytes.Buffer
+	divergences := metrics.PatchGeneratorDivergence.WithLabelValues("mutating")
+	review := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/mutate"})
+
+	tests := []struct {
+		name      string
+		generator string
+		// stub: drops the image change from the diff patch
+		stub     bool
+		diverges bool
+		replaced bool
+	}{
+		{name: "diff"},
+		{name: "replace returned", generator: PatchGeneratorReplace, replaced: true},
+		{name: "discrepancy", stub: true, diverges: true},
+		{name: "discrepancy replace returned", generator: PatchGeneratorReplace, stub: true, diverges: true, replaced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			handler := NewWebhookHandlerWithOptions(clientset, log.New(&logs, "", 0), "mutating", HandlerOptions{
+				PatchGenerator:         tt.generator,
+				ComparePatchGenerators: true,
+			})
+			if tt.stub {
+				handler.diffPatch = func(original, modified []byte) ([]byte, error) {
+					patch, err := createJSONPatch(original, modified)
+					if err != nil {
+						return nil, err
+					}
+					var operations []map[string]interface{}
+					if err := json.Unmarshal(patch, &operations); err != nil {
+						return nil, err
+					}
+					kept := operations[:0]
+					for _, operation := range operations {
+						if !strings.HasSuffix(operation["path"].(string), "/image") {
+							kept = append(kept, operation)
+						}
+					}
+					return json.Marshal(kept)
+				}
+			}
+
+			before := testutil.ToFloat64(divergences)
+			response := serveAdmissionReview(t, handler, review)
+			if !response.Allowed || response.Patch == nil {
+				t.Fatalf("Expected the request to be patched, got %+v", response.Result)
+			}
+			if replaced := strings.Contains(string(response.Patch), `"path":"/spec"`); replaced != tt.replaced {
+				t.Errorf("Expected the patch of the %q generator, got %s", tt.generator, response.Patch)
+			}
+
+			diverged := testutil.ToFloat64(divergences) - before
+			if tt.diverges {
+				if diverged != 1 {
+					t.Errorf("Expected a divergence to be counted, got %v", diverged)
+				}
+				if !strings.Contains(logs.String(), "Patch generators diverge on default/test-pod at [/spec/containers/0/image]") {
+					t.Errorf("Expected the divergent path to be logged, got %s", logs.String())
+				}
+			} else if diverged != 0 {
+				t.Errorf("Expected no divergence, got %v: %s", diverged, logs.String())
+			}
+		})
+	}
+}
+
+func TestServeHTTP_ReplacePatchAnnotations(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "mutate", Namespace: "default"},
+		Data: map[string]string{"script.lua": `
+add_annotation(object, "team", "core")
+object.spec.containers[1].image = "nginx:1.27"`},
+	})
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{PatchGenerator: PatchGeneratorReplace})
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/mutate"}))
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(response.Patch, &operations); err != nil {
+		t.Fatalf("Failed to decode patch %s: %v", response.Patch, err)
+	}
+	paths := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		paths = append(paths, operation["op"].(string)+" "+operation["path"].(string))
+	}
+	expected := []string{"add /metadata/annotations/team", "replace /spec"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected the annotation patched on its own and the spec replaced, got %s", response.Patch)
+	}
+}
+
+func TestServeHTTP_ScriptOptions(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: "default", Annotations: map[string]string{
+				scriptloader.AnnotationFailurePolicy: scriptloader.FailurePolicyFail,
+			}},
+			Data: map[string]string{"script.lua": `error("boom")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "tolerated", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `error("boom")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "slow", Namespace: "default", Annotations: map[string]string{
+				scriptloader.AnnotationTimeout:       "50ms",
+				scriptloader.AnnotationFailurePolicy: scriptloader.FailurePolicyFail,
+			}},
+			Data: map[string]string{"script.lua": `while true do end`},
+		},
+	)
+	logger := log.New(io.Discard, "", 0)
 
-	// Should be rejected when ConfigMap is not found
-	if response.Response.Allowed {
-		t.Error("Expected request to be rejected when ConfigMap not found")
+	for _, webhookType := range []string{"mutating", "validating"} {
+		handler := NewWebhookHandler(clientset, logger, webhookType)
+
+		// Failing scripts deny the request with the fail policy only
+		response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/broken"}))
+		if response.Allowed || response.Result == nil || !strings.Contains(response.Result.Message, "default/broken: ") || strings.Contains(response.Result.Message, "\n") {
+			t.Errorf("Expected the %s webhook to deny the request, naming the failed script, got %+v", webhookType, response.Result)
+		}
+		response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/tolerated"}))
+		if !response.Allowed {
+			t.Errorf("Expected the %s webhook to ignore the failed script, got %+v", webhookType, response.Result)
+		}
+
+		// Scripts are stopped after the timeout of their ConfigMap, without any server-wide one
+		started := time.Now()
+		response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/slow"}))
+		if response.Allowed || time.Since(started) > 5*time.Second {
+			t.Errorf("Expected the %s webhook to stop the script at its timeout and deny the request, got %+v after %s", webhookType, response.Result, time.Since(started))
+		}
 	}
 }
 
-func TestHandleAdmissionRequest_InvalidObjectJSON(t *testing.T) {
-	clientset := fake.NewSimpleClientset()
+func TestServeHTTP_ContentEncoding(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "core")`},
+	})
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{MaxRequestBytes: 64 << 10})
+
+	compress := func(data []byte) []byte {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, _ = writer.Write(data)
+		_ = writer.Close()
+		return buf.Bytes()
+	}
+	serve := func(body []byte, encoding string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		if chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	review := newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"})
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		chunked  bool
+		status   int
+	}{
+		{name: "gzip", body: compress(review), encoding: "gzip", status: http.StatusOK},
+		{name: "gzip twice", body: compress(compress(review)), encoding: "gzip, gzip", status: http.StatusOK},
+		{name: "chunked gzip", body: compress(review), encoding: "gzip", chunked: true, status: http.StatusOK},
+		{name: "chunked", body: review, chunked: true, status: http.StatusOK},
+		{name: "identity", body: review, encoding: "identity", status: http.StatusOK},
+		{name: "zip bomb", body: compress(bytes.Repeat([]byte(" "), 10<<20)), encoding: "gzip", status: http.StatusRequestEntityTooLarge},
+		{name: "too large", body: append(bytes.Repeat([]byte(" "), 64<<10), review...), status: http.StatusRequestEntityTooLarge},
+		{name: "corrupt gzip", body: review, encoding: "gzip", status: http.StatusBadRequest},
+		{name: "unsupported encoding", body: review, encoding: "br", status: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(tt.body, tt.encoding, tt.chunked)
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			var response admissionv1.AdmissionReview
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || response.Response == nil {
+				t.Fatalf("Expected an admission review, got %s", rec.Body.String())
+			}
+			if tt.status == http.StatusOK && !strings.Contains(string(response.Response.Patch), `"team":"core"`) {
+				t.Errorf("Expected the scripts to run on the decoded object, got patch %s", response.Response.Patch)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_PreFilters(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+	})
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+		Filters: ServerFilters{PreFilters: DefaultPreFilters()},
+	})
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"}))
+	if !response.Allowed || !bytes.Contains(response.Patch, []byte("platform")) {
+		t.Errorf("Expected a running pod to be processed, got %+v", response)
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"}), &review); err != nil {
+		t.Fatalf("Failed to unmarshal review: %v", err)
+	}
+	var pod map[string]interface{}
+	if err := json.Unmarshal(review.Request.Object.Raw, &pod); err != nil {
+		t.Fatalf("Failed to unmarshal pod: %v", err)
+	}
+	pod["metadata"].(map[string]interface{})["deletionTimestamp"] = "2026-01-01T00:00:00Z"
+	review.Request.Object.Raw, _ = json.Marshal(pod)
+	body, _ := json.Marshal(review)
+
+	before := testutil.ToFloat64(metrics.PreFiltered.WithLabelValues("mutating", "metadata.deletionTimestamp"))
+	response = serveAdmissionReview(t, handler, body)
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("Expected a terminating pod to be allowed unchanged, got %+v", response)
+	}
+	if got := testutil.ToFloat64(metrics.PreFiltered.WithLabelValues("mutating", "metadata.deletionTimestamp")); got != before+1 {
+		t.Errorf("Expected the pre-filter to be counted, got %v (was %v)", got, before)
+	}
+}
+
+func TestServeHTTP_MatchConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		processed  bool
+	}{
+		{"matching", `object.metadata.name == "test-pod"`, true},
+		{"not matching", `request.namespace != "default"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditions, err := CompileMatchConditions([]admissionregistrationv1.MatchCondition{{Name: "condition", Expression: tt.expression}})
+			if err != nil {
+				t.Fatalf("CompileMatchConditions failed: %v", err)
+			}
+
+			clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+				Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
+			})
+			logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+			handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{
+				Filters: ServerFilters{MatchConditions: conditions},
+			})
+
+			before := testutil.ToFloat64(metrics.MatchConditionSkipped.WithLabelValues("mutating", "condition"))
+			response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/label"}))
+			if !response.Allowed {
+				t.Fatalf("Expected the request to be allowed, got %+v", response)
+			}
+			if processed := bytes.Contains(response.Patch, []byte("platform")); processed != tt.processed {
+				t.Errorf("Expected scripts to run: %v, got patch %s", tt.processed, response.Patch)
+			}
+
+			// Skipped requests never load their scripts
+			loaded := false
+			for _, action := range clientset.Actions() {
+				if action.GetResource().Resource == "configmaps" {
+					loaded = true
+				}
+			}
+			if loaded != tt.processed {
+				t.Errorf("Expected ConfigMaps to be fetched: %v, got %v", tt.processed, loaded)
+			}
+
+			skipped := testutil.ToFloat64(metrics.MatchConditionSkipped.WithLabelValues("mutating", "condition")) - before
+			if (skipped == 1) == tt.processed {
+				t.Errorf("Expected the skip to be counted only when the condition is not met, got %v", skipped)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_Sample(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "canary", Namespace: "default",
+			Annotations: map[string]string{scriptloader.AnnotationSample: "50"}},
+		Data: map[string]string{"script.lua": `add_label(object, "canary", "true")`},
+	})
 	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
 	handler := NewWebhookHandler(clientset, logger, "mutating")
 
-	req := &admissionv1.AdmissionRequest{
-		UID: "test-uid",
-		Kind: metav1.GroupVersionKind{
-			Group:   "",
-			Version: "v1",
-			Kind:    "Pod",
+	reviewWithUID := func(uid string) []byte {
+		t.Helper()
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/canary"}), &review); err != nil {
+			t.Fatalf("Failed to unmarshal review: %v", err)
+		}
+		review.Request.UID = types.UID(uid)
+		body, _ := json.Marshal(review)
+		return body
+	}
+
+	selected := 0
+	for i := 0; i < 20; i++ {
+		uid := fmt.Sprintf("uid-%d", i)
+		expected := inSample(uid, "default/canary", 50)
+		for attempt := 0; attempt < 2; attempt++ {
+			response := serveAdmissionReview(t, handler, reviewWithUID(uid))
+			if mutated := len(response.Patch) > 0; mutated != expected {
+				t.Errorf("Expected the request %s to be mutated: %v, got %v", uid, expected, mutated)
+			}
+		}
+		if expected {
+			selected++
+		}
+	}
+	if selected == 0 || selected == 20 {
+		t.Errorf("Expected a 50%% sample to select some of 20 requests, got %d", selected)
+	}
+}
+
+func TestServeHTTP_NaNScriptResult(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `add_label(object, "team", "platform")`},
 		},
-		Namespace: "default",
-		Name:      "test-pod",
-		Operation: admissionv1.Create,
-		Object: runtime.RawExtension{
-			Raw: []byte(`{invalid json}`),
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "nan", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.x = 0/0`},
+		},
+	)
+	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/label,default/nan",
+	})))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+		t.Fatalf("Expected a parseable response, got %q: %v", recorder.Body.String(), err)
+	}
+	if review.Response == nil || !review.Response.Allowed {
+		t.Fatalf("Expected the request to be allowed, got %+v", review.Response)
+	}
+	if !bytes.Contains(review.Response.Patch, []byte("platform")) || bytes.Contains(review.Response.Patch, []byte(`"/x"`)) {
+		t.Errorf("Expected only the label change in the patch, got %s", review.Response.Patch)
+	}
+}
+
+func TestServeHTTP_DenyHelpers(t *testing.T) {
+	tests := map[string]struct {
+		reason metav1.StatusReason
+		code   int32
+	}{
+		"deny_forbidden": {metav1.StatusReasonForbidden, http.StatusForbidden},
+		"deny_invalid":   {metav1.StatusReasonInvalid, http.StatusUnprocessableEntity},
+		"deny_conflict":  {metav1.StatusReasonConflict, http.StatusConflict},
+	}
+
+	for helper, expected := range tests {
+		for _, webhookType := range []string{"mutating", "validating"} {
+			clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: "default"},
+				Data: map[string]string{
+					"script.lua": `
+						object.metadata.labels = {denied = "true"}
+						` + helper + `("not today")
+					`,
+				},
+			})
+
+			logger := log.New(io.Discard, "", 0)
+			handler := NewWebhookHandler(clientset, logger, webhookType)
+
+			response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+				"glua.maurice.fr/scripts": "default/policy",
+			}))
+
+			if response.Allowed || response.Patch != nil {
+				t.Errorf("%s (%s): expected the request to be denied without a patch", helper, webhookType)
+				continue
+			}
+			if response.Result == nil || response.Result.Reason != expected.reason || response.Result.Code != expected.code ||
+				response.Result.Message != "default/policy: not today" || response.Result.Details != nil {
+				t.Errorf("%s (%s): unexpected status %+v", helper, webhookType, response.Result)
+			}
+		}
+	}
+}
+
+func TestServeHTTP_ApplyDefaults(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "defaults", Namespace: "default"},
+		Data: map[string]string{
+			"script.lua": `
+				object.metadata.labels = {restart = object.spec.restartPolicy}
+				object.spec.dnsPolicy = "None"
+			`,
 		},
+	})
+
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ApplyDefaults: true})
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/defaults",
+	}))
+	if !response.Allowed {
+		t.Fatalf("Expected request to be allowed, got %+v", response.Result)
 	}
 
-	response := handler.handleAdmissionRequest(context.Background(), req)
+	var operations []map[string]interface{}
+	if err := json.Unmarshal(response.Patch, &operations); err != nil {
+		t.Fatalf("Failed to decode patch %s: %v", response.Patch, err)
+	}
+	paths := make(map[string]interface{})
+	for _, operation := range operations {
+		paths[operation["path"].(string)] = operation["value"]
+	}
 
-	if response.Allowed {
-		t.Error("Expected request to be rejected for invalid JSON")
+	// The script saw the defaulted restartPolicy, and its own changes are patched
+	labels, _ := paths["/metadata/labels"].(map[string]interface{})
+	if labels["restart"] != "Always" {
+		t.Errorf("Expected the script to see the default restart policy, got patch %s", response.Patch)
+	}
+	if paths["/spec/dnsPolicy"] != "None" {
+		t.Errorf("Expected the dnsPolicy set by the script in the patch, got %s", response.Patch)
 	}
 
-	if response.Result == nil || response.Result.Message == "" {
-		t.Error("Expected error message in response")
+	// Defaults the script left alone are not
+	if len(paths) != 2 {
+		t.Errorf("Expected only the changes of the script in the patch, got %s", response.Patch)
+	}
+
+	// Defaults alone produce no patch at all
+	clientset = fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "reader", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `local policy = object.spec.restartPolicy`},
+	})
+	handler = NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ApplyDefaults: true})
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/reader",
+	}))
+	if response.Patch != nil {
+		t.Errorf("Expected no patch when scripts change nothing, got %s", response.Patch)
 	}
 }
 
-func TestCreateJSONPatch(t *testing.T) {
-	original := []byte(`{"name": "test", "value": 1}`)
-	modified := []byte(`{"name": "test", "value": 2, "new": "field"}`)
+func TestRemoveDefaults_ContainersByName(t *testing.T) {
+	original := []byte(`{"spec":{"restartPolicy":"Always","dnsPolicy":"ClusterFirst","schedulerName":"default-scheduler",` +
+		`"terminationGracePeriodSeconds":30,"securityContext":{},"containers":[{"name":"app","image":"app:1"},` +
+		`{"name":"proxy","image":"proxy:1","terminationMessagePolicy":"FallbackToLogsOnError"}]}}`)
+	defaulted, applied, err := applyDefaults("Pod", original)
+	if err != nil {
+		t.Fatalf("applyDefaults failed: %v", err)
+	}
 
-	patch, err := createJSONPatch(original, modified)
+	// The script puts a sidecar first and drops the proxy, the defaults of app move to index 1
+	doc, err := decodeNumbers(defaulted)
 	if err != nil {
-		t.Fatalf("createJSONPatch failed: %v", err)
+		t.Fatalf("Failed to decode defaulted object: %v", err)
+	}
+	spec := doc.(map[string]interface{})["spec"].(map[string]interface{})
+	containers := spec["containers"].([]interface{})
+	spec["containers"] = []interface{}{
+		map[string]interface{}{"name": "sidecar", "image": "sidecar:1", "terminationMessagePolicy": "File"},
+		containers[0],
+	}
+	modified, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Failed to encode modified object: %v", err)
 	}
 
-	if patch == nil {
-		t.Error("Expected non-nil patch")
+	cleaned, err := removeDefaults(original, defaulted, modified, applied)
+	if err != nil {
+		t.Fatalf("removeDefaults failed: %v", err)
 	}
+	expected := `{"spec":{"containers":[{"image":"sidecar:1","name":"sidecar","terminationMessagePolicy":"File"},` +
+		`{"image":"app:1","name":"app"}],"dnsPolicy":"ClusterFirst","restartPolicy":"Always",` +
+		`"schedulerName":"default-scheduler","securityContext":{},"terminationGracePeriodSeconds":30}}`
+	if string(cleaned) != expected {
+		t.Errorf("Expected the defaults of app to be removed and the sidecar left as set, got %s", cleaned)
+	}
+}
 
-	// Verify patch is valid JSON (JSON Patch is an array of operations)
-	var patchOps []map[string]interface{}
-	if err := json.Unmarshal(patch, &patchOps); err != nil {
-		t.Fatalf("Patch is not valid JSON: %v", err)
+func TestServeHTTP_RequestOptions(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "options", Namespace: "default"},
+		Data: map[string]string{
+			"script.lua": `
+				object.metadata.labels = {
+					manager = request.options.fieldManager,
+					strict = tostring(request.options.fieldValidation == "Strict"),
+				}
+			`,
+		},
+	})
+
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/options",
+	}), &review); err != nil {
+		t.Fatal(err)
+	}
+	options, _ := json.Marshal(metav1.CreateOptions{FieldManager: "kubectl-client-side-apply", FieldValidation: "Strict"})
+	review.Request.Options = runtime.RawExtension{Raw: options}
+	body, _ := json.Marshal(review)
+
+	response := serveAdmissionReview(t, handler, body)
+	if !strings.Contains(string(response.Patch), `"manager":"kubectl-client-side-apply"`) ||
+		!strings.Contains(string(response.Patch), `"strict":"true"`) {
+		t.Errorf("Expected the script to see the request options, got patch %s", response.Patch)
 	}
 
-	// JSON Patch should be an array with operations
-	if len(patchOps) == 0 {
-		t.Error("Expected patch to have operations")
+	// Without options, request.options is an empty table
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/options",
+	}))
+	if !strings.Contains(string(response.Patch), `"strict":"false"`) || strings.Contains(string(response.Patch), "manager") {
+		t.Errorf("Expected empty request options, got patch %s", response.Patch)
 	}
+}
 
-	// Each operation should have at least "op" and "path" fields
-	for _, op := range patchOps {
-		if _, ok := op["op"]; !ok {
-			t.Error("Expected operation to have 'op' field")
+func TestServeHTTP_TrackGeneration(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "mutated", "true")`},
+	})
+
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{TrackGeneration: true})
+
+	// update: returns an UPDATE of the generation 3 pod from a pod running image, the scripts
+	// having processed the generation annotated
+	update := func(image, annotated string) []byte {
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(newPodAdmissionReview(t, map[string]string{
+			"glua.maurice.fr/scripts":     "default/label",
+			AnnotationProcessedGeneration: annotated,
+		}), &review); err != nil {
+			t.Fatal(err)
 		}
-		if _, ok := op["path"]; !ok {
-			t.Error("Expected operation to have 'path' field")
+		var pod corev1.Pod
+		if err := json.Unmarshal(review.Request.Object.Raw, &pod); err != nil {
+			t.Fatal(err)
 		}
+		pod.Generation = 3
+		pod.Labels = map[string]string{"mutated": "true"}
+		old := pod.DeepCopy()
+		old.Spec.Containers[0].Image = image
+		review.Request.Operation = admissionv1.Update
+		review.Request.Object.Raw, _ = json.Marshal(pod)
+		review.Request.OldObject.Raw, _ = json.Marshal(old)
+		body, _ := json.Marshal(review)
+		return body
+	}
+
+	// Creation: mutated, and generation 1, which the API server sets after admission, recorded in the same patch
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/label",
+	}))
+	if !strings.Contains(string(response.Patch), `{"op":"add","path":"/metadata/labels","value":{"mutated":"true"}}`) {
+		t.Errorf("Expected the script change in the patch, got %s", response.Patch)
+	}
+	if !strings.Contains(string(response.Patch), `"path":"/metadata/annotations/glua.maurice.fr~1processed-generation","value":"1"`) {
+		t.Errorf("Expected generation 1 recorded in the patch, got %s", response.Patch)
+	}
+
+	// Update leaving the spec as it is: the generation stays 3, already processed
+	response = serveAdmissionReview(t, handler, update("nginx:latest", "3"))
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("Expected generation 3 not to be mutated again, got patch %s", response.Patch)
+	}
+
+	// Update changing the spec: still generation 3 during admission, but processed as generation 4
+	response = serveAdmissionReview(t, handler, update("nginx:1.25", "3"))
+	if !strings.Contains(string(response.Patch), `"path":"/metadata/annotations/glua.maurice.fr~1processed-generation","value":"4"`) {
+		t.Errorf("Expected the scripts to run and record generation 4, got patch %s", response.Patch)
 	}
 }
 
-func TestCreateJSONPatch_InvalidJSON(t *testing.T) {
-	original := []byte(`{invalid}`)
-	modified := []byte(`{"valid": "json"}`)
+func TestServeHTTP_RemoveMode(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "strip-image", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				add_label(object, "team", "core")
+				object.spec.containers[1].image = nil
+			`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "only-strip", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.spec.containers[1].image = nil`},
+		},
+	)
+	logger := log.New(io.Discard, "", 0)
 
-	_, err := createJSONPatch(original, modified)
-	if err == nil {
-		t.Error("Expected error for invalid original JSON")
+	// Reject: the request is denied, naming the removed path
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{RemoveMode: RemoveModeReject})
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/strip-image"}))
+	if response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the request to be denied without a patch, got allowed=%v patch %s", response.Allowed, response.Patch)
+	}
+	if response.Result == nil || !strings.Contains(response.Result.Message, "/spec/containers/0/image") {
+		t.Errorf("Expected the denial to name the removed path, got %+v", response.Result)
 	}
 
-	original = []byte(`{"valid": "json"}`)
-	modified = []byte(`{invalid}`)
+	// Drop: the removal is taken out of the patch, the other changes are kept
+	handler = NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{RemoveMode: RemoveModeDrop})
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/strip-image"}))
+	if !response.Allowed {
+		t.Fatalf("Expected the request to be allowed, got %+v", response.Result)
+	}
+	if strings.Contains(string(response.Patch), `"remove"`) || !strings.Contains(string(response.Patch), `"team":"core"`) {
+		t.Errorf("Expected only the label in the patch, got %s", response.Patch)
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "/spec/containers/0/image") {
+		t.Errorf("Expected a warning about the dropped removal, got %v", response.Warnings)
+	}
 
-	_, err = createJSONPatch(original, modified)
-	if err == nil {
-		t.Error("Expected error for invalid modified JSON")
+	// Drop with nothing left: no patch at all
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/only-strip"}))
+	if !response.Allowed || response.Patch != nil || response.PatchType != nil {
+		t.Errorf("Expected no patch once the removal is dropped, got %s", response.Patch)
 	}
 }
 
-func TestNewWebhookHandler(t *testing.T) {
-	clientset := fake.NewSimpleClientset()
-	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+func TestServeHTTP_RemoveModeDropArrayElement(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "drop-first", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `table.remove(object.spec.containers, 1)`},
+	})
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{RemoveMode: RemoveModeDrop})
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/drop-first"}), &review); err != nil {
+		t.Fatal(err)
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(review.Request.Object.Raw, &pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Spec.Containers = []corev1.Container{{Name: "a", Image: "a"}, {Name: "b", Image: "b"}, {Name: "c", Image: "c"}}
+	review.Request.Object.Raw, _ = json.Marshal(pod)
+	body, _ := json.Marshal(review)
+
+	// Dropping the removal would leave the shifted elements with the last one duplicated: denied
+	response := serveAdmissionReview(t, handler, body)
+	if response.Allowed || response.Patch != nil {
+		t.Fatalf("Expected the request to be denied without a patch, got allowed=%v patch %s", response.Allowed, response.Patch)
+	}
+	if response.Result == nil || !strings.Contains(response.Result.Message, "array elements /spec/containers/") {
+		t.Errorf("Expected the denial to name the removed array element, got %+v", response.Result)
+	}
+}
 
-	handler := NewWebhookHandler(clientset, logger, "mutating")
+func TestServeHTTP_MetadataOnly(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "retag", Namespace: "default"},
+			Data: map[string]string{"script.lua": `
+				object.metadata.labels = {team = "core"}
+				object.spec.containers[1].image = "nginx:1.27"
+			`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "only-image", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `object.spec.containers[1].image = "nginx:1.27"`},
+		},
+	)
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{MetadataOnly: true})
 
-	if handler == nil {
-		t.Fatal("Expected non-nil handler")
+	// The change to spec is stripped, the label is kept
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/retag"}))
+	if !response.Allowed {
+		t.Fatalf("Expected the request to be allowed, got %+v", response.Result)
 	}
-
-	if handler.clientset == nil {
-		t.Error("Expected clientset to be set")
+	if strings.Contains(string(response.Patch), "/spec") || !strings.Contains(string(response.Patch), `"core"`) {
+		t.Errorf("Expected only the label in the patch, got %s", response.Patch)
+	}
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "/spec/containers/0/image") {
+		t.Errorf("Expected a warning about the dropped change, got %v", response.Warnings)
 	}
 
-	if handler.logger != logger {
-		t.Error("Expected logger to be set")
+	// Nothing left once the change to spec is stripped: no patch at all
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{scriptloader.AnnotationScripts: "default/only-image"}))
+	if !response.Allowed || response.Patch != nil || response.PatchType != nil {
+		t.Errorf("Expected no patch once the change to spec is dropped, got %s", response.Patch)
 	}
+}
 
-	if handler.webhookType != "mutating" {
-		t.Errorf("Expected webhook type 'mutating', got %s", handler.webhookType)
+func TestServeHTTP_Eviction(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "pods-only", Namespace: "default"},
+		Data: map[string]string{"script.lua": `
+			if object.kind == "Eviction" then
+				object.metadata.labels = {evicted = "true"}
+			else
+				object.spec.containers[1].image = "nginx:1.27"
+			end
+		`},
+	})
+	logger := log.New(io.Discard, "", 0)
+
+	eviction, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "policy/v1",
+		"kind":       "Eviction",
+		"metadata": map[string]interface{}{
+			"name":        "test-pod",
+			"namespace":   "default",
+			"annotations": map[string]string{scriptloader.AnnotationScripts: "default/pods-only"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal eviction: %v", err)
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:         "test-uid",
+			Kind:        metav1.GroupVersionKind{Group: "policy", Version: "v1", Kind: "Eviction"},
+			Resource:    metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			SubResource: "eviction",
+			Namespace:   "default",
+			Name:        "test-pod",
+			Operation:   admissionv1.Create,
+			Object:      runtime.RawExtension{Raw: eviction},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal admission review: %v", err)
 	}
 
-	if handler.scriptLoader == nil {
-		t.Error("Expected script loader to be initialized")
+	// Skipped by default, the scripts never see the Eviction
+	response := serveAdmissionReview(t, NewWebhookHandler(clientset, logger, "mutating"), body)
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("Expected the eviction to be allowed as-is, got %+v", response)
 	}
 
-	if handler.scriptRunner == nil {
-		t.Error("Expected script runner to be initialized")
+	// Processed on demand, the scripts get the Eviction as sent
+	handler := NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{ProcessSubResources: true})
+	response = serveAdmissionReview(t, handler, body)
+	if !response.Allowed {
+		t.Fatalf("Expected the eviction to be allowed, got %+v", response.Result)
+	}
+	if !strings.Contains(string(response.Patch), `"evicted"`) || strings.Contains(string(response.Patch), "/spec") {
+		t.Errorf("Expected the eviction to be labelled, got %s", response.Patch)
 	}
 }
 
-func TestNewWebhookHandler_Validating(t *testing.T) {
-	clientset := fake.NewSimpleClientset()
-	logger := log.New(os.Stdout, "[test] ", log.LstdFlags)
+func TestServeHTTP_DenialCauses(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "pinned", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `deny_invalid("image must be pinned", "spec.containers[0].image")`},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "labels", Namespace: "default"},
+			Data:       map[string]string{"script.lua": `deny_forbidden{message = "team label required"}`},
+		},
+	)
+	logger := log.New(io.Discard, "", 0)
+	handler := NewWebhookHandler(clientset, logger, "validating")
+
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/pinned,default/labels",
+	}))
+	if response.Allowed || response.Result == nil {
+		t.Fatalf("Expected the request to be denied, got %+v", response)
+	}
+	if response.Result.Message != "2 policy violations (see details)" ||
+		response.Result.Reason != metav1.StatusReasonForbidden || response.Result.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status %+v", response.Result)
+	}
+	expected := &metav1.StatusDetails{Causes: []metav1.StatusCause{
+		{Type: metav1.CauseType(metav1.StatusReasonForbidden), Message: "default/labels: team label required"},
+		{Type: metav1.CauseType(metav1.StatusReasonInvalid), Message: "default/pinned: image must be pinned", Field: "spec.containers[0].image"},
+	}}
+	if !reflect.DeepEqual(response.Result.Details, expected) {
+		t.Errorf("Expected details %+v, got %+v", expected, response.Result.Details)
+	}
+
+	// A single denial naming a field keeps a plain message, its cause carrying the field
+	response = serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/pinned",
+	}))
+	if response.Result == nil || response.Result.Message != "default/pinned: image must be pinned" ||
+		response.Result.Details == nil || len(response.Result.Details.Causes) != 1 ||
+		response.Result.Details.Causes[0].Field != "spec.containers[0].image" {
+		t.Errorf("Unexpected status for a single denial %+v", response.Result)
+	}
+}
 
+func TestServeHTTP_DenialCausesFromScript(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "containers", Namespace: "default"},
+		Data: map[string]string{"script.lua": `
+			local causes = {}
+			for i, container in ipairs(object.spec.containers) do
+				if not container.image:find("@sha256:") then
+					table.insert(causes, {message = "image must be pinned", field = "spec.containers[" .. (i - 1) .. "].image"})
+				end
+				if container.resources == nil or container.resources.limits == nil then
+					table.insert(causes, {message = "limits are required", field = "spec.containers[" .. (i - 1) .. "].resources.limits", type = "FieldValueRequired"})
+				end
+			end
+			if #causes > 0 then
+				deny_invalid{message = "invalid containers", causes = causes}
+			end
+		`},
+	})
+	logger := log.New(io.Discard, "", 0)
 	handler := NewWebhookHandler(clientset, logger, "validating")
 
-	if handler.webhookType != "validating" {
-		t.Errorf("Expected webhook type 'validating', got %s", handler.webhookType)
+	response := serveAdmissionReview(t, handler, newPodAdmissionReview(t, map[string]string{
+		"glua.maurice.fr/scripts": "default/containers",
+	}))
+	if response.Allowed || response.Result == nil {
+		t.Fatalf("Expected the request to be denied, got %+v", response)
+	}
+	if response.Result.Message != "default/containers: invalid containers" ||
+		response.Result.Reason != metav1.StatusReasonInvalid || response.Result.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Unexpected status %+v", response.Result)
+	}
+	expected := &metav1.StatusDetails{Causes: []metav1.StatusCause{
+		{Type: metav1.CauseType(metav1.StatusReasonInvalid), Message: "default/containers: image must be pinned", Field: "spec.containers[0].image"},
+		{Type: metav1.CauseTypeFieldValueRequired, Message: "default/containers: limits are required", Field: "spec.containers[0].resources.limits"},
+	}}
+	if !reflect.DeepEqual(response.Result.Details, expected) {
+		t.Errorf("Expected details %+v, got %+v", expected, response.Result.Details)
+	}
+}
+
+func TestServeHTTP_TemplateAnnotation(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "mutated", "true")`},
+	})
+	logger := log.New(io.Discard, "", 0)
+
+	newDeploymentReview := func(templateAnnotations map[string]string) []byte {
+		deploymentJSON, _ := json.Marshal(map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata": map[string]interface{}{
+				"name":        "web",
+				"namespace":   "default",
+				"annotations": map[string]string{scriptloader.AnnotationScripts: "default/label"},
+			},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{"annotations": templateAnnotations},
+				},
+			},
+		})
+		body, _ := json.Marshal(admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "test-uid",
+				Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+				Namespace: "default",
+				Name:      "web",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: deploymentJSON},
+			},
+		})
+		return body
+	}
+
+	// Warn only: the Deployment itself is mutated, the template left alone
+	handler := NewWebhookHandler(clientset, logger, "mutating")
+	response := serveAdmissionReview(t, handler, newDeploymentReview(nil))
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "spec.template.metadata.annotations") {
+		t.Errorf("Expected a warning about the pod template, got %v", response.Warnings)
+	}
+	if !strings.Contains(string(response.Patch), `"mutated":"true"`) || strings.Contains(string(response.Patch), "/spec/template") {
+		t.Errorf("Expected only the label in the patch, got %s", response.Patch)
+	}
+
+	// Templates already annotated are fine
+	response = serveAdmissionReview(t, handler, newDeploymentReview(map[string]string{scriptloader.AnnotationScripts: "default/label"}))
+	if len(response.Warnings) != 0 {
+		t.Errorf("Expected no warning for an annotated template, got %v", response.Warnings)
+	}
+
+	// Auto-copy: the annotation is added to the template in the same patch
+	handler = NewWebhookHandlerWithOptions(clientset, logger, "mutating", HandlerOptions{CopyAnnotationToTemplate: true})
+	response = serveAdmissionReview(t, handler, newDeploymentReview(nil))
+	if len(response.Warnings) != 1 || !strings.Contains(response.Warnings[0], "copied") {
+		t.Errorf("Expected a warning about the copy, got %v", response.Warnings)
+	}
+	if !strings.Contains(string(response.Patch), `"path":"/spec/template/metadata/annotations","value":{"glua.maurice.fr/scripts":"default/label"}`) ||
+		!strings.Contains(string(response.Patch), `"mutated":"true"`) {
+		t.Errorf("Expected the label and the template annotation in the patch, got %s", response.Patch)
+	}
+}
+
+func TestServeHTTP_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "mutated", "true")`},
+	})
+	handler := NewWebhookHandler(clientset, log.New(io.Discard, "", 0), "mutating")
+
+	// The trace of the API server is continued
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(newPodAdmissionReview(t, map[string]string{
+		scriptloader.AnnotationScripts: "default/label",
+	})))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected span %s to belong to the trace of the request, got %s", span.Name(), span.SpanContext().TraceID())
+		}
+	}
+
+	expected := map[string]map[attribute.Key]string{
+		"mutating admission": {
+			tracing.AttrKind:      "Pod",
+			tracing.AttrNamespace: "default",
+			tracing.AttrUID:       "test-uid",
+			tracing.AttrAllowed:   "true",
+		},
+		"load scripts": {tracing.AttrScripts: "1"},
+		"run script":   {tracing.AttrScript: "default/label"},
+	}
+	for name, attributes := range expected {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %q span, got %v", name, spans)
+			continue
+		}
+		values := make(map[attribute.Key]string)
+		for _, attr := range span.Attributes() {
+			values[attr.Key] = attr.Value.Emit()
+		}
+		for key, value := range attributes {
+			if values[key] != value {
+				t.Errorf("Expected %s of span %q to be %q, got %q", key, name, value, values[key])
+			}
+		}
+	}
+	if _, ok := spans["run script"]; ok && spans["run script"].Parent().SpanID() != spans["mutating admission"].SpanContext().SpanID() {
+		t.Errorf("Expected the script span to be a child of the admission span")
+	}
+}
+
+func TestServeHTTP_WithoutScripts(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "label", Namespace: "default"},
+		Data:       map[string]string{"script.lua": `add_label(object, "mutated", "true")`},
+	})
+	handler := NewWebhookHandler(clientset, log.New(io.Discard, "", 0), "mutating")
+
+	// The annotations come after a large spec, they must still be found
+	large := strings.Repeat(`{"name":"entry","values":[1,2,3],"nested":{"a":{"b":"c"}}},`, 5000)
+	review := func(annotations string) []byte {
+		object := `{"apiVersion":"v1","kind":"Pod","spec":{"entries":[` + large + `{}]},"metadata":{"name":"test-pod","namespace":"default"` + annotations + `}}`
+		body, _ := json.Marshal(admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "test-uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Namespace: "default",
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: []byte(object)},
+			},
+		})
+		return body
+	}
+
+	tests := []struct {
+		name        string
+		annotations string
+		mutated     bool
+	}{
+		{name: "no annotations"},
+		{name: "other annotations", annotations: `,"annotations":{"team":"core"}`},
+		{name: "scripts annotation", annotations: `,"annotations":{"team":"core","glua.maurice.fr/scripts":"default/label"}`, mutated: true},
+		{name: "create annotation", annotations: `,"annotations":{"glua.maurice.fr/scripts-create":"default/label"}`, mutated: true},
+		{name: "update annotation", annotations: `,"annotations":{"glua.maurice.fr/scripts-update":"default/label"}`},
+	}
+	for _, tt := range tests {
+		response := serveAdmissionReview(t, handler, review(tt.annotations))
+		if !response.Allowed {
+			t.Errorf("%s: expected the request to be allowed, got %+v", tt.name, response.Result)
+		}
+		if mutated := strings.Contains(string(response.Patch), `"mutated":"true"`); mutated != tt.mutated {
+			t.Errorf("%s: expected mutated=%v, got patch %s", tt.name, tt.mutated, response.Patch)
+		}
+	}
+
+	// Default scripts apply to unannotated objects
+	defaults, err := scriptloader.ParseDefaultScripts([]byte(`
+defaults:
+  - version: v1
+    kind: Pod
+    scripts:
+      - default/label
+`))
+	if err != nil {
+		t.Fatalf("ParseDefaultScripts failed: %v", err)
+	}
+	handler = NewWebhookHandlerWithOptions(clientset, log.New(io.Discard, "", 0), "mutating", HandlerOptions{DefaultScripts: defaults})
+	if response := serveAdmissionReview(t, handler, review("")); !strings.Contains(string(response.Patch), `"mutated":"true"`) {
+		t.Errorf("Expected the default script to run, got patch %s", response.Patch)
 	}
 }
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// objectMetadata: the identity fields and annotations of an admitted object, decoded without
+// building the rest of it. Other fields are only scanned, whatever their size
+type objectMetadata struct {
+	Metadata struct {
+		Name         string            `json:"name"`
+		Namespace    string            `json:"namespace"`
+		GenerateName string            `json:"generateName"`
+		Annotations  map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+// admittedObject: returns the object a request admits, the object being deleted for DELETE
+// requests, whose object is null, and requests without object
+func admittedObject(req *admissionv1.AdmissionRequest) []byte {
+	if req.Operation == admissionv1.Delete || len(req.Object.Raw) == 0 {
+		return req.OldObject.Raw
+	}
+	return req.Object.Raw
+}
+
+// decodeMetadata: decodes the metadata of the object of req, once per request
+// Returns false when the object cannot be decoded
+func decodeMetadata(req *admissionv1.AdmissionRequest) (objectMetadata, bool) {
+	var object objectMetadata
+	raw := admittedObject(req)
+	if len(raw) == 0 || json.Unmarshal(raw, &object) != nil {
+		return objectMetadata{}, false
+	}
+	return object, true
+}
+
+// objectKey: returns the key identifying the object of a request in logs, namespace/name, from the
+// decoded metadata of the object
+// Objects created with only generateName have no name yet, they are keyed namespace/generateName[uid]
+// so that two of them admitted with the same prefix never share a key
+// Cluster-scoped objects are keyed without the namespace
+func objectKey(req *admissionv1.AdmissionRequest, object objectMetadata) string {
+	name, namespace := req.Name, req.Namespace
+	if name == "" {
+		name = object.Metadata.Name
+	}
+	if namespace == "" {
+		namespace = object.Metadata.Namespace
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("%s[%s]", object.Metadata.GenerateName, req.UID)
+	}
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newIdentityRequest: builds an admission request for an object with the given metadata
+func newIdentityRequest(t *testing.T, uid types.UID, namespace string, metadata map[string]interface{}) *admissionv1.AdmissionRequest {
+	t.Helper()
+
+	raw, err := json.Marshal(map[string]interface{}{"apiVersion": "v1", "kind": "Pod", "metadata": metadata})
+	if err != nil {
+		t.Fatalf("Failed to marshal object: %v", err)
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:       uid,
+		Namespace: namespace,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+// requestKey: returns the key of the object of a request, decoding its metadata
+func requestKey(req *admissionv1.AdmissionRequest) string {
+	object, _ := decodeMetadata(req)
+	return objectKey(req, object)
+}
+
+func TestObjectKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  *admissionv1.AdmissionRequest
+		expected string
+	}{
+		{
+			name:     "named object",
+			request:  newIdentityRequest(t, "uid-1", "default", map[string]interface{}{"name": "web"}),
+			expected: "default/web",
+		},
+		{
+			name:     "generateName only",
+			request:  newIdentityRequest(t, "uid-1", "default", map[string]interface{}{"generateName": "web-"}),
+			expected: "default/web-[uid-1]",
+		},
+		{
+			name:     "cluster-scoped object",
+			request:  newIdentityRequest(t, "uid-1", "", map[string]interface{}{"name": "node-1"}),
+			expected: "node-1",
+		},
+		{
+			name:     "namespace from the object",
+			request:  newIdentityRequest(t, "uid-1", "", map[string]interface{}{"name": "web", "namespace": "apps"}),
+			expected: "apps/web",
+		},
+		{
+			name:     "undecodable object",
+			request:  &admissionv1.AdmissionRequest{UID: "uid-1", Namespace: "default", Object: runtime.RawExtension{Raw: []byte("{")}},
+			expected: "default/[uid-1]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := requestKey(tt.request); key != tt.expected {
+				t.Errorf("Expected key %q, got %q", tt.expected, key)
+			}
+		})
+	}
+}
+
+func TestObjectKey_GenerateNameDistinctRequests(t *testing.T) {
+	first := requestKey(newIdentityRequest(t, "uid-1", "default", map[string]interface{}{"generateName": "web-"}))
+	second := requestKey(newIdentityRequest(t, "uid-2", "default", map[string]interface{}{"generateName": "web-"}))
+	if first == second {
+		t.Errorf("Expected distinct keys for distinct requests, both are %q", first)
+	}
+}
+
+func TestObjectKey_DeleteUsesOldObject(t *testing.T) {
+	request := newIdentityRequest(t, "uid-1", "default", map[string]interface{}{"generateName": "web-"})
+	request.OldObject, request.Object = request.Object, runtime.RawExtension{}
+	if key := requestKey(request); key != "default/web-[uid-1]" {
+		t.Errorf("Expected the key of the old object, got %q", key)
+	}
+}
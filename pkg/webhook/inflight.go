@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// InFlightTracker: admission requests being processed, shared by the handlers of a server so that
+// it can report what is left to drain when shutting down. Safe for concurrent use
+type InFlightTracker struct {
+	mu       sync.Mutex
+	next     uint64
+	requests map[uint64]InFlightRequest
+}
+
+// InFlightRequest: an admission request being processed
+type InFlightRequest struct {
+	// UID: UID of the admission request
+	UID string
+	// Webhook: mutating or validating
+	Webhook string
+	// Started: when the handler started processing the request
+	Started time.Time
+}
+
+// NewInFlightTracker: creates a tracker with no request in flight
+func NewInFlightTracker() *InFlightTracker {
+	return &InFlightTracker{requests: make(map[uint64]InFlightRequest)}
+}
+
+// track: records a request as in flight until the returned function is called
+// A nil tracker tracks nothing
+func (t *InFlightTracker) track(webhookType string, req *admissionv1.AdmissionRequest) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := t.next
+	t.next++
+	t.requests[id] = InFlightRequest{UID: string(req.UID), Webhook: webhookType, Started: time.Now()}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.requests, id)
+	}
+}
+
+// Count: returns the number of requests in flight
+func (t *InFlightTracker) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.requests)
+}
+
+// Requests: returns the requests in flight, oldest first
+func (t *InFlightTracker) Requests() []InFlightRequest {
+	t.mu.Lock()
+	requests := make([]InFlightRequest, 0, len(t.requests))
+	for _, request := range t.requests {
+		requests = append(requests, request)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Started.Before(requests[j].Started) })
+	return requests
+}
@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/cel-go/cel"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// MatchConditionsConfig: configuration file of the match conditions, written as the matchConditions
+// of a webhook configuration
+//
+// Example:
+//
+//	matchConditions:
+//	  - name: exclude-leases
+//	    expression: '!(request.resource.group == "coordination.k8s.io" && request.resource.resource == "leases")'
+//	  - name: annotated-only
+//	    expression: 'has(object.metadata.annotations)'
+type MatchConditionsConfig struct {
+	MatchConditions []admissionregistrationv1.MatchCondition `json:"matchConditions"`
+}
+
+// MatchCondition: compiled CEL condition a request must meet for scripts to run, like the
+// matchConditions of webhook configurations on clusters that do not support them
+// Expressions see the object, oldObject and request variables, null when the request has none
+type MatchCondition struct {
+	// Name: name of the condition, naming it in logs and metrics
+	Name string
+	// Expression: CEL expression as written, evaluating to a bool
+	Expression string
+
+	program cel.Program
+}
+
+// LoadMatchConditions: reads and compiles the match conditions of a YAML or JSON configuration file
+func LoadMatchConditions(path string) ([]MatchCondition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read match conditions file %s: %w", path, err)
+	}
+
+	var config MatchConditionsConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse match conditions file %s: %w", path, err)
+	}
+	return CompileMatchConditions(config.MatchConditions)
+}
+
+// CompileMatchConditions: compiles match conditions, failing on the first invalid or non-boolean expression
+// Names must be unique, as in webhook configurations
+func CompileMatchConditions(conditions []admissionregistrationv1.MatchCondition) ([]MatchCondition, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("request", cel.DynType),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", err)
+	}
+
+	compiled := make([]MatchCondition, 0, len(conditions))
+	names := make(map[string]bool, len(conditions))
+	for i, condition := range conditions {
+		if condition.Name == "" {
+			return nil, fmt.Errorf("match condition %d has no name", i)
+		}
+		if names[condition.Name] {
+			return nil, fmt.Errorf("duplicate match condition %s", condition.Name)
+		}
+		names[condition.Name] = true
+
+		ast, issues := env.Compile(condition.Expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("invalid match condition %s: %w", condition.Name, issues.Err())
+		}
+		if output := ast.OutputType(); !output.IsExactType(cel.BoolType) && !output.IsExactType(cel.DynType) {
+			return nil, fmt.Errorf("invalid match condition %s: evaluates to %s, expected bool", condition.Name, output)
+		}
+
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match condition %s: %w", condition.Name, err)
+		}
+		compiled = append(compiled, MatchCondition{Name: condition.Name, Expression: condition.Expression, program: program})
+	}
+	return compiled, nil
+}
+
+// matchConditionVariables: returns the variables match conditions are evaluated against
+// The request is exposed as its JSON form, as the API server does
+func matchConditionVariables(req *admissionv1.AdmissionRequest) (map[string]interface{}, error) {
+	variables := map[string]interface{}{"object": nil, "oldObject": nil}
+	for name, raw := range map[string][]byte{"object": req.Object.Raw, "oldObject": req.OldObject.Raw} {
+		if len(raw) == 0 {
+			continue
+		}
+		var value map[string]interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		variables[name] = value
+	}
+
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal(encoded, &request); err != nil {
+		return nil, fmt.Errorf("failed to decode request: %w", err)
+	}
+	variables["request"] = request
+	return variables, nil
+}
+
+// Unmatched: returns the first match condition a request does not meet, if any
+// As in the API server, a condition evaluating to false skips the request even when others failed
+// to evaluate; when none is false, evaluation errors are returned and the request is processed
+func (f ServerFilters) Unmatched(req *admissionv1.AdmissionRequest) (MatchCondition, bool, error) {
+	if len(f.MatchConditions) == 0 {
+		return MatchCondition{}, false, nil
+	}
+
+	variables, err := matchConditionVariables(req)
+	if err != nil {
+		return MatchCondition{}, false, err
+	}
+
+	var evalErr error
+	for _, condition := range f.MatchConditions {
+		value, _, err := condition.program.Eval(variables)
+		if err != nil {
+			if evalErr == nil {
+				evalErr = fmt.Errorf("match condition %s failed: %w", condition.Name, err)
+			}
+			continue
+		}
+		matched, ok := value.Value().(bool)
+		if !ok {
+			if evalErr == nil {
+				evalErr = fmt.Errorf("match condition %s evaluated to %v, expected bool", condition.Name, value.Value())
+			}
+			continue
+		}
+		if !matched {
+			return condition, true, nil
+		}
+	}
+	return MatchCondition{}, false, evalErr
+}
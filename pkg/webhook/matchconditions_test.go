@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCompileMatchConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []admissionregistrationv1.MatchCondition
+	}{
+		{"no name", []admissionregistrationv1.MatchCondition{{Expression: "true"}}},
+		{"duplicate", []admissionregistrationv1.MatchCondition{{Name: "a", Expression: "true"}, {Name: "a", Expression: "false"}}},
+		{"syntax error", []admissionregistrationv1.MatchCondition{{Name: "a", Expression: "object.metadata.("}}},
+		{"not a bool", []admissionregistrationv1.MatchCondition{{Name: "a", Expression: `"yes"`}}},
+		{"unknown variable", []admissionregistrationv1.MatchCondition{{Name: "a", Expression: "authorizer.allowed()"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileMatchConditions(tt.conditions); err == nil {
+				t.Errorf("Expected the conditions to be rejected")
+			}
+		})
+	}
+}
+
+func TestLoadMatchConditions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conditions.yaml")
+	content := `matchConditions:
+  - name: not-deleting
+    expression: 'request.operation != "DELETE"'
+  - name: annotated
+    expression: 'has(object.metadata.annotations)'
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write conditions: %v", err)
+	}
+
+	conditions, err := LoadMatchConditions(path)
+	if err != nil {
+		t.Fatalf("LoadMatchConditions failed: %v", err)
+	}
+	if len(conditions) != 2 || conditions[0].Name != "not-deleting" || conditions[1].Name != "annotated" {
+		t.Errorf("Unexpected conditions: %+v", conditions)
+	}
+
+	if err := os.WriteFile(path, []byte("matchConditions:\n  - name: a\n    expresion: 'true'\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write conditions: %v", err)
+	}
+	if _, err := LoadMatchConditions(path); err == nil {
+		t.Errorf("Expected unknown fields to be rejected")
+	}
+}
+
+func TestUnmatched(t *testing.T) {
+	conditions, err := CompileMatchConditions([]admissionregistrationv1.MatchCondition{
+		{Name: "not-deleting", Expression: `request.operation != "DELETE"`},
+		{Name: "team-label", Expression: `object.metadata.labels.team == "platform"`},
+	})
+	if err != nil {
+		t.Fatalf("CompileMatchConditions failed: %v", err)
+	}
+	filters := ServerFilters{MatchConditions: conditions}
+
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		object    string
+		unmatched string
+		wantErr   bool
+	}{
+		{"all met", admissionv1.Create, `{"metadata":{"labels":{"team":"platform"}}}`, "", false},
+		{"label differs", admissionv1.Create, `{"metadata":{"labels":{"team":"data"}}}`, "team-label", false},
+		{"false wins over errors", admissionv1.Delete, "", "not-deleting", false},
+		{"errors without false", admissionv1.Create, `{"metadata":{}}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &admissionv1.AdmissionRequest{Operation: tt.operation}
+			if tt.object != "" {
+				req.Object = runtime.RawExtension{Raw: []byte(tt.object)}
+			}
+
+			condition, unmatched, err := filters.Unmatched(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if unmatched != (tt.unmatched != "") || condition.Name != tt.unmatched {
+				t.Errorf("Expected unmatched condition %q, got %q (%v)", tt.unmatched, condition.Name, unmatched)
+			}
+		})
+	}
+
+	if _, unmatched, err := (ServerFilters{}).Unmatched(&admissionv1.AdmissionRequest{}); unmatched || err != nil {
+		t.Errorf("Expected requests to meet an empty set of conditions, got %v, %v", unmatched, err)
+	}
+}
@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// restrictToMetadata: takes the operations outside /metadata out of the patch of a mutating
+// response when HandlerOptions.MetadataOnly is set, with a warning naming them
+// Unlike the scope of a script, this holds whatever the scripts and their annotations say
+func (h *WebhookHandler) restrictToMetadata(response *admissionv1.AdmissionResponse, key string) {
+	if !h.options.MetadataOnly || response.Patch == nil {
+		return
+	}
+
+	var operations []patchOperation
+	if err := json.Unmarshal(response.Patch, &operations); err != nil {
+		h.logger.Printf("ERROR: Failed to decode the patch of %s: %v", key, err)
+		return
+	}
+
+	kept := make([]patchOperation, 0, len(operations))
+	var dropped []string
+	for _, operation := range operations {
+		if operation.Path != "/metadata" && !strings.HasPrefix(operation.Path, "/metadata/") {
+			dropped = append(dropped, operation.Path)
+			continue
+		}
+		kept = append(kept, operation)
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	h.logger.Printf("WARNING: Dropping the changes to %s from the patch of %s, only metadata may be changed", strings.Join(dropped, ", "), key)
+	response.Warnings = append(response.Warnings, fmt.Sprintf("changes to %s dropped, the webhook only allows changing metadata", strings.Join(dropped, ", ")))
+	if len(kept) == 0 {
+		response.Patch = nil
+		response.PatchType = nil
+		return
+	}
+
+	patch, err := json.Marshal(kept)
+	if err != nil {
+		h.logger.Printf("ERROR: Failed to encode the patch of %s: %v", key, err)
+		return
+	}
+	response.Patch = patch
+}
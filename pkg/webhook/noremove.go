@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RemoveModeReject: deny requests whose patch removes fields
+	RemoveModeReject = "reject"
+	// RemoveModeDrop: take the remove operations out of the patch, keeping the other changes
+	// Removals of array elements cannot be dropped, the operations after them shifting the elements
+	// left: such requests are denied
+	RemoveModeDrop = "drop"
+)
+
+// patchOperation: an operation of a JSON patch, its value kept as encoded
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// restrictRemovals: applies HandlerOptions.RemoveMode to the patch of a mutating response, turning
+// original into the object the scripts left
+// Returns false when the request was denied, the response is then final
+func (h *WebhookHandler) restrictRemovals(response *admissionv1.AdmissionResponse, key string, original []byte) bool {
+	if h.options.RemoveMode == "" || response.Patch == nil {
+		return true
+	}
+
+	var operations []patchOperation
+	if err := json.Unmarshal(response.Patch, &operations); err != nil {
+		h.logger.Printf("ERROR: Failed to decode the patch of %s: %v", key, err)
+		return true
+	}
+
+	kept := make([]patchOperation, 0, len(operations))
+	var removed []string
+	for _, operation := range operations {
+		if operation.Op == "remove" {
+			removed = append(removed, operation.Path)
+			continue
+		}
+		kept = append(kept, operation)
+	}
+	if len(removed) == 0 {
+		return true
+	}
+
+	if h.options.RemoveMode == RemoveModeReject {
+		h.logger.Printf("Denying %s: scripts removed %s", key, strings.Join(removed, ", "))
+		denyRemovals(response, "scripts removed %s, the webhook does not allow removing fields", removed)
+		return false
+	}
+
+	// The diff of an array shifts the elements after a removed one with replace operations: without
+	// the removal, the last element would be duplicated
+	if elements := arrayElements(original, removed); len(elements) > 0 {
+		h.logger.Printf("Denying %s: scripts removed the array elements %s, which cannot be dropped", key, strings.Join(elements, ", "))
+		denyRemovals(response, "scripts removed the array elements %s, the webhook does not allow removing fields", elements)
+		return false
+	}
+
+	h.logger.Printf("WARNING: Dropping the removal of %s from the patch of %s", strings.Join(removed, ", "), key)
+	response.Warnings = append(response.Warnings, fmt.Sprintf("removal of %s dropped, the webhook does not allow removing fields", strings.Join(removed, ", ")))
+	if len(kept) == 0 {
+		response.Patch = nil
+		response.PatchType = nil
+		return true
+	}
+
+	patch, err := json.Marshal(kept)
+	if err != nil {
+		h.logger.Printf("ERROR: Failed to encode the patch of %s: %v", key, err)
+		return true
+	}
+	response.Patch = patch
+	return true
+}
+
+// denyRemovals: denies the request of response, formatting the removed paths into message
+func denyRemovals(response *admissionv1.AdmissionResponse, message string, removed []string) {
+	response.Allowed = false
+	response.Patch = nil
+	response.PatchType = nil
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusForbidden,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: fmt.Sprintf(message, strings.Join(removed, ", ")),
+	}
+}
+
+// arrayElements: returns the paths of removed that point at an element of an array of original
+func arrayElements(original []byte, removed []string) []string {
+	doc, err := decodeNumbers(original)
+	if err != nil {
+		return nil
+	}
+
+	var elements []string
+	for _, path := range removed {
+		tokens := pointerTokens(path)
+		if len(tokens) == 0 {
+			continue
+		}
+		parent, ok := pointerGet(doc, tokens[:len(tokens)-1])
+		if _, isArray := parent.([]interface{}); ok && isArray {
+			elements = append(elements, path)
+		}
+	}
+	return elements
+}
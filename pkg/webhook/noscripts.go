@@ -0,0 +1,30 @@
+package webhook
+
+import (
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/scriptloader"
+)
+
+// withoutScripts: reports whether no script can apply to the object of req, which may then be
+// allowed from its decoded metadata alone: no scripts annotation for the operation, no default scripts for
+// its kind, and neither a skip annotation to warn about nor a ConfigMap to check
+// Objects whose annotations cannot be decoded take the regular path, which reports the error
+func (h *WebhookHandler) withoutScripts(req *admissionv1.AdmissionRequest, object objectMetadata, decoded bool) bool {
+	if req.Kind.Group == "" && req.Kind.Kind == "ConfigMap" {
+		return false
+	}
+	if len(h.options.DefaultScripts.ScriptsFor(req.Kind)) > 0 {
+		return false
+	}
+
+	if !decoded {
+		return false
+	}
+	for _, key := range []string{scriptloader.AnnotationScripts, scriptloader.OperationAnnotation(string(req.Operation)), AnnotationSkip} {
+		if _, ok := object.Metadata.Annotations[key]; ok {
+			return false
+		}
+	}
+	return true
+}
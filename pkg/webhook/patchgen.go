@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/mattbaird/jsonpatch"
+	evanphxpatch "gopkg.in/evanphx/json-patch.v4"
+
+	"thechat/pkg/metrics"
+)
+
+const (
+	// PatchGeneratorDiff: patches hold an RFC 6902 operation per field the scripts changed
+	PatchGeneratorDiff = "diff"
+	// PatchGeneratorReplace: patches replace each top-level field the scripts changed as a whole
+	PatchGeneratorReplace = "replace"
+)
+
+// replacePatch: returns a patch replacing, adding or removing each top-level field of original
+// that modified changed, with its value in modified
+// The metadata is patched field by field and the annotations key by key like the diff generator
+// does, so that the patch composes with the annotations and metadata other mutating webhooks set
+func replacePatch(original, modified []byte) ([]byte, error) {
+	var before, after map[string]json.RawMessage
+	if err := json.Unmarshal(original, &before); err != nil {
+		return nil, fmt.Errorf("failed to create replace patch: %w", err)
+	}
+	if err := json.Unmarshal(modified, &after); err != nil {
+		return nil, fmt.Errorf("failed to create replace patch: %w", err)
+	}
+
+	operations, err := splitAnnotations(replaceFields("", before, after, []jsonpatch.JsonPatchOperation{}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replace patch: %w", err)
+	}
+	return json.Marshal(operations)
+}
+
+// replaceFields: appends to operations the operations replacing, adding or removing the fields of
+// the object at path that changed between before and after
+// The metadata and the annotations are descended into when they are objects on both sides
+func replaceFields(path string, before, after map[string]json.RawMessage, operations []jsonpatch.JsonPatchOperation) []jsonpatch.JsonPatchOperation {
+	fields := make([]string, 0, len(after))
+	for field := range after {
+		fields = append(fields, field)
+	}
+	for field := range before {
+		if _, ok := after[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		child := path + "/" + escapePointerToken(field)
+		value, kept := after[field]
+		previous, existed := before[field]
+		switch {
+		case !kept:
+			operations = append(operations, jsonpatch.NewPatch("remove", child, nil))
+		case !existed:
+			operations = append(operations, jsonpatch.NewPatch("add", child, value))
+		case bytes.Equal(previous, value):
+		case child == "/metadata" || child == annotationsPath:
+			var previousFields, valueFields map[string]json.RawMessage
+			if isJSONObject(previous) && isJSONObject(value) &&
+				json.Unmarshal(previous, &previousFields) == nil && json.Unmarshal(value, &valueFields) == nil {
+				operations = replaceFields(child, previousFields, valueFields, operations)
+				continue
+			}
+			operations = append(operations, jsonpatch.NewPatch("replace", child, value))
+		default:
+			operations = append(operations, jsonpatch.NewPatch("replace", child, value))
+		}
+	}
+	return operations
+}
+
+// generatePatch: returns the patch of the response turning original into modified, built by
+// HandlerOptions.PatchGenerator
+// With HandlerOptions.ComparePatchGenerators, both generators run and the diff patch is applied to
+// original: the paths where the result differs from modified, which the replace patch yields by
+// construction, are logged and counted in metrics.PatchGeneratorDivergence. The comparison never
+// changes the patch returned
+func (h *WebhookHandler) generatePatch(key string, original, modified []byte) ([]byte, error) {
+	replace := h.options.PatchGenerator == PatchGeneratorReplace
+	if !h.options.ComparePatchGenerators {
+		if replace {
+			return replacePatch(original, modified)
+		}
+		return h.diffPatch(original, modified)
+	}
+
+	replaced, replaceErr := replacePatch(original, modified)
+	diffed, diffErr := h.diffPatch(original, modified)
+	if diffErr != nil {
+		h.logger.Printf("WARNING: Patch generators diverge on %s: the diff generator failed: %v", key, diffErr)
+		metrics.PatchGeneratorDivergence.WithLabelValues(h.webhookType).Inc()
+	} else if paths, err := divergentPaths(original, modified, diffed); err != nil {
+		h.logger.Printf("WARNING: Patch generators diverge on %s: the diff patch %s does not apply: %v", key, diffed, err)
+		metrics.PatchGeneratorDivergence.WithLabelValues(h.webhookType).Inc()
+	} else if len(paths) > 0 {
+		h.logger.Printf("WARNING: Patch generators diverge on %s at %v: diff patch %s, replace patch %s", key, paths, diffed, replaced)
+		metrics.PatchGeneratorDivergence.WithLabelValues(h.webhookType).Inc()
+	}
+
+	if replace {
+		return replaced, replaceErr
+	}
+	return diffed, diffErr
+}
+
+// divergentPaths: applies patch to original and returns the JSON pointers where the result
+// differs from modified, compared decoded
+func divergentPaths(original, modified, patch []byte) ([]string, error) {
+	decoded, err := evanphxpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := decoded.Apply(original)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(patched, modified) {
+		return nil, nil
+	}
+
+	got, err := decodeNumbers(patched)
+	if err != nil {
+		return nil, err
+	}
+	want, err := decodeNumbers(modified)
+	if err != nil {
+		return nil, err
+	}
+	return appendDivergentPaths(nil, "", got, want), nil
+}
+
+// appendDivergentPaths: appends to paths the JSON pointers under path where got differs from want
+func appendDivergentPaths(paths []string, path string, got, want interface{}) []string {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		got, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		fields := make([]string, 0, len(want))
+		for field := range want {
+			fields = append(fields, field)
+		}
+		for field := range got {
+			if _, ok := want[field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			child := path + "/" + escapePointerToken(field)
+			gotValue, inGot := got[field]
+			wantValue, inWant := want[field]
+			if inGot != inWant {
+				paths = append(paths, child)
+				continue
+			}
+			paths = appendDivergentPaths(paths, child, gotValue, wantValue)
+		}
+		return paths
+	case []interface{}:
+		got, ok := got.([]interface{})
+		if !ok || len(got) != len(want) {
+			break
+		}
+		for i := range want {
+			paths = appendDivergentPaths(paths, path+"/"+strconv.Itoa(i), got[i], want[i])
+		}
+		return paths
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// PreFilterExists: the path holds a value other than null
+	PreFilterExists = "exists"
+	// PreFilterDoesNotExist: the path is missing or null
+	PreFilterDoesNotExist = "!exists"
+	// PreFilterEquals: the value at the path, as a string, equals the filter value
+	PreFilterEquals = "="
+	// PreFilterNotEquals: the value at the path is missing or, as a string, differs from the filter value
+	PreFilterNotEquals = "!="
+)
+
+// DefaultPreFilterExpressions: pre-filters of the webhook command unless configured otherwise,
+// skipping terminating objects and the mirror pods the kubelet creates for static pods
+var DefaultPreFilterExpressions = []string{
+	"metadata.deletionTimestamp",
+	"Pod:/metadata/annotations/kubernetes.io~1config.mirror",
+}
+
+// PreFilter: condition on the object skipping it before any script is loaded when it matches
+type PreFilter struct {
+	// Expression: the filter as written, naming it in logs and metrics
+	Expression string
+	// Kind: kind the filter applies to, every kind when empty
+	Kind string
+	// Path: reference tokens of the value tested
+	Path []string
+	// Operator: one of PreFilterExists, PreFilterDoesNotExist, PreFilterEquals, PreFilterNotEquals
+	Operator string
+	// Value: value compared by PreFilterEquals and PreFilterNotEquals
+	Value string
+}
+
+// ParsePreFilter: parses a field selector like pre-filter expression, [Kind:]path[operator value]
+// The path is a JSON pointer when it starts with /, dot-separated otherwise. Without an operator,
+// the filter matches when the path holds a value, a leading ! matches when it does not
+// Examples: "metadata.deletionTimestamp", "Pod:spec.nodeName", "!spec.schedulerName",
+// "Pod:spec.schedulerName!=default-scheduler", "/metadata/labels/app.kubernetes.io~1managed-by==helm"
+func ParsePreFilter(expression string) (PreFilter, error) {
+	filter := PreFilter{Expression: expression, Operator: PreFilterExists}
+	rest := strings.TrimSpace(expression)
+
+	if idx := strings.Index(rest, ":"); idx > 0 && !strings.ContainsAny(rest[:idx], "./=!") {
+		filter.Kind, rest = rest[:idx], rest[idx+1:]
+	}
+
+	negated := strings.HasPrefix(rest, "!")
+	if negated {
+		filter.Operator = PreFilterDoesNotExist
+		rest = rest[1:]
+	}
+
+	path := rest
+	if idx := strings.Index(rest, "="); idx >= 0 {
+		if negated {
+			return PreFilter{}, fmt.Errorf("invalid pre-filter %q: ! cannot be combined with an operator", expression)
+		}
+		path, filter.Operator, filter.Value = rest[:idx], PreFilterEquals, strings.TrimPrefix(rest[idx+1:], "=")
+		if strings.HasSuffix(path, "!") {
+			path, filter.Operator = strings.TrimSuffix(path, "!"), PreFilterNotEquals
+		}
+	}
+
+	path = strings.TrimSpace(path)
+	if path == "" || path == "/" {
+		return PreFilter{}, fmt.Errorf("invalid pre-filter %q: missing path", expression)
+	}
+	if strings.HasPrefix(path, "/") {
+		filter.Path = pointerTokens(path)
+	} else {
+		filter.Path = strings.Split(path, ".")
+	}
+	return filter, nil
+}
+
+// ParsePreFilters: parses every expression, see ParsePreFilter
+func ParsePreFilters(expressions []string) ([]PreFilter, error) {
+	filters := make([]PreFilter, 0, len(expressions))
+	for _, expression := range expressions {
+		if strings.TrimSpace(expression) == "" {
+			continue
+		}
+		filter, err := ParsePreFilter(expression)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// DefaultPreFilters: returns the parsed DefaultPreFilterExpressions
+func DefaultPreFilters() []PreFilter {
+	filters, err := ParsePreFilters(DefaultPreFilterExpressions)
+	if err != nil {
+		panic(err)
+	}
+	return filters
+}
+
+// Matches: reports whether the filter matches an object of the given kind
+func (f PreFilter) Matches(kind string, object map[string]interface{}) bool {
+	if f.Kind != "" && f.Kind != kind {
+		return false
+	}
+
+	value, exists := pointerGet(object, f.Path)
+	exists = exists && value != nil
+
+	switch f.Operator {
+	case PreFilterExists:
+		return exists
+	case PreFilterDoesNotExist:
+		return !exists
+	case PreFilterEquals:
+		return exists && preFilterString(value) == f.Value
+	case PreFilterNotEquals:
+		return !exists || preFilterString(value) != f.Value
+	default:
+		return false
+	}
+}
+
+// preFilterString: returns a value as compared by pre-filters, strings as is, anything else as JSON
+func preFilterString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// PreFiltered: returns the first pre-filter matching an object, if any
+func (f ServerFilters) PreFiltered(kind string, object map[string]interface{}) (PreFilter, bool) {
+	for _, filter := range f.PreFilters {
+		if filter.Matches(kind, object) {
+			return filter, true
+		}
+	}
+	return PreFilter{}, false
+}
@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePreFilter(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   PreFilter
+	}{
+		{"metadata.deletionTimestamp", PreFilter{Path: []string{"metadata", "deletionTimestamp"}, Operator: PreFilterExists}},
+		{"Pod:spec.nodeName", PreFilter{Kind: "Pod", Path: []string{"spec", "nodeName"}, Operator: PreFilterExists}},
+		{"!spec.schedulerName", PreFilter{Path: []string{"spec", "schedulerName"}, Operator: PreFilterDoesNotExist}},
+		{"Pod:spec.schedulerName!=default-scheduler", PreFilter{Kind: "Pod", Path: []string{"spec", "schedulerName"}, Operator: PreFilterNotEquals, Value: "default-scheduler"}},
+		{"spec.replicas==0", PreFilter{Path: []string{"spec", "replicas"}, Operator: PreFilterEquals, Value: "0"}},
+		{"/metadata/labels/app.kubernetes.io~1managed-by=helm", PreFilter{Path: []string{"metadata", "labels", "app.kubernetes.io/managed-by"}, Operator: PreFilterEquals, Value: "helm"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			filter, err := ParsePreFilter(tt.expression)
+			if err != nil {
+				t.Fatalf("ParsePreFilter failed: %v", err)
+			}
+			tt.expected.Expression = tt.expression
+			if !reflect.DeepEqual(filter, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, filter)
+			}
+		})
+	}
+
+	for _, expression := range []string{"", "Pod:", "=value", "!spec.nodeName=node-1"} {
+		if _, err := ParsePreFilter(expression); err == nil {
+			t.Errorf("Expected %q to be rejected", expression)
+		}
+	}
+}
+
+func TestPreFilterMatches(t *testing.T) {
+	pod := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"kubernetes.io/config.mirror": "abc"},
+			"labels":      nil,
+		},
+		"spec": map[string]interface{}{"nodeName": "node-1", "priority": float64(10)},
+	}
+
+	tests := []struct {
+		expression string
+		kind       string
+		expected   bool
+	}{
+		{"metadata.deletionTimestamp", "Pod", false},
+		{"Pod:/metadata/annotations/kubernetes.io~1config.mirror", "Pod", true},
+		{"Pod:/metadata/annotations/kubernetes.io~1config.mirror", "Deployment", false},
+		{"metadata.labels", "Pod", false},
+		{"!metadata.labels", "Pod", true},
+		{"spec.nodeName=node-1", "Pod", true},
+		{"spec.nodeName!=node-1", "Pod", false},
+		{"spec.priority=10", "Pod", true},
+		{"spec.schedulerName!=default-scheduler", "Pod", true},
+	}
+
+	for _, tt := range tests {
+		filter, err := ParsePreFilter(tt.expression)
+		if err != nil {
+			t.Fatalf("ParsePreFilter(%q) failed: %v", tt.expression, err)
+		}
+		if matched := filter.Matches(tt.kind, pod); matched != tt.expected {
+			t.Errorf("Expected %q on a %s to match: %v, got %v", tt.expression, tt.kind, tt.expected, matched)
+		}
+	}
+}
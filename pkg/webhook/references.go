@@ -0,0 +1,43 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"thechat/pkg/scriptloader"
+)
+
+// checkScriptReferences: reports the malformed entries of the scripts annotations applying to the
+// request, which the loader skips, as admission warnings. With HandlerOptions.StrictAnnotations,
+// the request is denied instead. Returns whether the request was denied
+func (h *WebhookHandler) checkScriptReferences(response *admissionv1.AdmissionResponse, operation, key string, annotations map[string]string) bool {
+	var messages []string
+	for _, name := range []string{scriptloader.AnnotationScripts, scriptloader.OperationAnnotation(operation)} {
+		value, ok := annotations[name]
+		if name == "" || !ok {
+			continue
+		}
+
+		_, errs := scriptloader.ParseAnnotationErrors(value, h.scriptLoader.Schemes()...)
+		for _, err := range errs {
+			h.logger.Printf("WARNING: %s annotation of %s: %v", name, key, err)
+			messages = append(messages, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(messages) == 0 {
+		return false
+	}
+
+	if h.options.StrictAnnotations {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Message: strings.Join(messages, ", "),
+		}
+		return true
+	}
+	response.Warnings = append(response.Warnings, messages...)
+	return false
+}
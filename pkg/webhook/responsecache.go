@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/cluster"
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+// DefaultResponseCacheSize: responses kept by the response cache
+const DefaultResponseCacheSize = 10000
+
+// AnnotationNoCache: object annotation ("true") running the scripts for every request of the
+// object, its requests neither served from nor stored into the response cache
+const AnnotationNoCache = scriptloader.AnnotationPrefix + "/no-cache"
+
+// nonDeterministicModules: modules whose results depend on more than the request and the scripts,
+// responses of chains requiring any of them are never cached
+var nonDeterministicModules = []string{"http", "time", "fs", cluster.ModuleName}
+
+// nonDeterministicFunctions: base library functions reading the time or drawing random numbers,
+// responses of chains calling any of them are never cached
+var nonDeterministicFunctions = []string{"os.clock", "os.date", "os.time", "math.random"}
+
+// responseCache: responses of identical requests run through identical scripts
+// Entries are keyed by the request and the content of the scripts resolved for it, so that a
+// script edit misses the cache as soon as the loader serves the new content
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedResponse
+	now     func() time.Time
+}
+
+// cachedResponse: a response along with the ConfigMaps of the scripts that produced it
+type cachedResponse struct {
+	response   *admissionv1.AdmissionResponse
+	configMaps map[string]bool
+	expires    time.Time
+}
+
+// newResponseCache: creates a cache keeping responses for ttl, nil when ttl is not positive
+func newResponseCache(ttl time.Duration) *responseCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &responseCache{ttl: ttl, entries: make(map[string]cachedResponse), now: time.Now}
+}
+
+// responseCacheKey: returns the key of a request run through the scripts of order, hashing their
+// content as resolved for this request, along with the params of the object
+func responseCacheKey(webhookType string, req *admissionv1.AdmissionRequest, order []string, scripts map[string]string, params map[string]interface{}) (string, error) {
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	userInfo, err := json.Marshal(req.UserInfo)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, part := range [][]byte{
+		[]byte(webhookType), []byte(req.Operation), []byte(req.Kind.String()), []byte(req.Resource.String()),
+		[]byte(req.SubResource), []byte(req.Namespace), []byte(req.Name), userInfo,
+		req.Object.Raw, req.OldObject.Raw, req.Options.Raw, encodedParams,
+	} {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	for _, name := range order {
+		content := sha256.Sum256([]byte(scripts[name]))
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+		hash.Write(content[:])
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// get: returns a copy of the response cached under key, nil when there is none or it expired
+func (c *responseCache) get(key string) *admissionv1.AdmissionResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if c.now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.response.DeepCopy()
+}
+
+// store: caches a copy of response under key when the scripts of results make it reproducible,
+// that is when they all ran, none failed but through a denial, none required a non-deterministic
+// module and none called a non-deterministic function
+func (c *responseCache) store(key string, response *admissionv1.AdmissionResponse, results []luarunner.ScriptResult) {
+	if len(results) == 0 {
+		return
+	}
+	configMaps := make(map[string]bool, len(results))
+	for _, result := range results {
+		if result.Err != nil && !errors.As(result.Err, new(*luarunner.Denial)) {
+			return
+		}
+		for _, module := range nonDeterministicModules {
+			if result.Usage.Uses(module) {
+				return
+			}
+		}
+		for _, function := range nonDeterministicFunctions {
+			if result.Usage.Calls(function) {
+				return
+			}
+		}
+		configMaps[scriptloader.ConfigMapOf(result.Name)] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= DefaultResponseCacheSize {
+		for existing, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, existing)
+			}
+		}
+	}
+	// Still full of live entries, make room for the new one
+	for existing := range c.entries {
+		if len(c.entries) < DefaultResponseCacheSize {
+			break
+		}
+		delete(c.entries, existing)
+	}
+	c.entries[key] = cachedResponse{response: response.DeepCopy(), configMaps: configMaps, expires: now.Add(c.ttl)}
+}
+
+// invalidate: drops the responses produced by scripts of a ConfigMap, registered as an
+// invalidation hook of the script loader
+func (c *responseCache) invalidate(namespace, name string) {
+	configMap := namespace + "/" + name
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if entry.configMaps[configMap] {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// flush: drops every cached response
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]cachedResponse)
+}
@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reviewAPIVersions: AdmissionReview versions the webhook answers in, the version of the request
+var reviewAPIVersions = map[string]bool{
+	"admission.k8s.io/v1":      true,
+	"admission.k8s.io/v1beta1": true,
+}
+
+// buildReview: the AdmissionReview answering a request of apiVersion, admission.k8s.io/v1 when
+// unknown, whose UID is uid, empty when the request could not be read
+// Every answer goes through it: a missing response denies the request, and a denial always
+// carries a failure status
+func buildReview(apiVersion string, uid types.UID, response *admissionv1.AdmissionResponse) admissionv1.AdmissionReview {
+	if !reviewAPIVersions[apiVersion] {
+		apiVersion = "admission.k8s.io/v1"
+	}
+	if response == nil {
+		response = &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: "no response"}}
+	}
+	if !response.Allowed {
+		if response.Result == nil {
+			response.Result = &metav1.Status{}
+		}
+		if response.Result.Status == "" {
+			response.Result.Status = metav1.StatusFailure
+		}
+	}
+	response.UID = uid
+
+	return admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: "AdmissionReview"},
+		Response: response,
+	}
+}
+
+// rejectReview: a response denying a request the webhook could not process, with code and reason
+func rejectReview(code int32, reason metav1.StatusReason, format string, args ...interface{}) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Message: fmt.Sprintf(format, args...),
+			Code:    code,
+			Reason:  reason,
+		},
+	}
+}
+
+// writeReview: encodes review and writes it with the HTTP status code
+// The review is encoded before writing anything, so that a failure still yields a well-formed error
+func (h *WebhookHandler) writeReview(w http.ResponseWriter, code int, review admissionv1.AdmissionReview) {
+	body, err := json.Marshal(review)
+	if err != nil {
+		h.logger.Printf("ERROR: Failed to encode response %s: %v", review.Response.UID, err)
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(body); err != nil {
+		h.logger.Printf("ERROR: Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"hash/fnv"
+	"sort"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"thechat/pkg/scriptloader"
+)
+
+// sampleBuckets: granularity of sampling decisions, percentages are honored to two decimals
+const sampleBuckets = 10000
+
+// sampleKey: returns the identity sampling decisions are made on, the object UID, or the request
+// UID for objects being created, which have none yet
+func sampleKey(req *admissionv1.AdmissionRequest, object *unstructured.Unstructured) string {
+	if uid := object.GetUID(); uid != "" {
+		return string(uid)
+	}
+	return string(req.UID)
+}
+
+// inSample: reports whether the scripts of a ConfigMap sampled at percent run for the object of key
+// The decision only depends on both, so an object always gets the same one for a given ConfigMap,
+// and ConfigMaps sampled at the same percentage are rolled out to different objects
+func inSample(key, configMap string, percent float64) bool {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(configMap + "/" + key))
+	return hash.Sum64()%sampleBuckets < uint64(percent*sampleBuckets/100)
+}
+
+// sampleScripts: drops the scripts whose ConfigMap scriptloader.AnnotationSample leaves the object out of
+func (h *WebhookHandler) sampleScripts(scripts map[string]string, key string) {
+	names := make([]string, 0, len(scripts))
+	for name := range scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		percent, sampled := h.scriptLoader.Sample(name)
+		if !sampled || inSample(key, scriptloader.ConfigMapOf(name), percent) {
+			continue
+		}
+		h.logger.Printf("Skipping script %s, sampled at %g%% and not selected for %s", name, percent, key)
+		delete(scripts, name)
+	}
+}
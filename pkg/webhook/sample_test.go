@@ -0,0 +1,30 @@
+package webhook
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInSample(t *testing.T) {
+	selected := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("uid-%d", i)
+		in := inSample(key, "default/canary", 10)
+		if in != inSample(key, "default/canary", 10) {
+			t.Fatalf("Expected the decision for %s to be deterministic", key)
+		}
+		if in {
+			selected++
+		}
+		if inSample(key, "default/canary", 0) {
+			t.Errorf("Expected %s out of a 0%% sample", key)
+		}
+		if !inSample(key, "default/canary", 100) {
+			t.Errorf("Expected %s in a 100%% sample", key)
+		}
+	}
+
+	if selected < 800 || selected > 1200 {
+		t.Errorf("Expected about 10%% of 10000 objects selected, got %d", selected)
+	}
+}
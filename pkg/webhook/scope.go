@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mattbaird/jsonpatch"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+// scopeFilter: keeps the changes of each script within the scope it was loaded with
+// Scripts of ConfigMaps without the scriptloader.AnnotationScope annotation are not restricted,
+// scripts of unknown scope fail
+func (h *WebhookHandler) scopeFilter(set scriptloader.ScriptSet) luarunner.ScriptFilter {
+	return func(scriptName string, before, after []byte) ([]byte, []string, error) {
+		scope, known := set.Scope(scriptName)
+		if !known {
+			return nil, nil, fmt.Errorf("scope of script %s is unknown", scriptName)
+		}
+		if scope == nil {
+			return after, nil, nil
+		}
+
+		result, dropped, err := restrictToScope(before, after, scope)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to apply scope %s: %w", strings.Join(scope, ","), err)
+		}
+		if len(dropped) == 0 {
+			return result, nil, nil
+		}
+
+		h.logger.Printf("WARNING: Script %s changed paths outside its scope %s, dropped: %s",
+			scriptName, strings.Join(scope, ","), strings.Join(dropped, ", "))
+		return result, []string{fmt.Sprintf("changes outside scope %s dropped: %s", strings.Join(scope, ","), strings.Join(dropped, ", "))}, nil
+	}
+}
+
+// denyUnknownScopes: denies the request when the scope of a script to run is unknown, rather than
+// letting the script change anything. Returns true when the request was denied
+func (h *WebhookHandler) denyUnknownScopes(response *admissionv1.AdmissionResponse, order []string, set scriptloader.ScriptSet) bool {
+	for _, name := range order {
+		if _, known := set.Scope(name); known {
+			continue
+		}
+
+		h.logger.Printf("ERROR: Scope of script %s is unknown, denying", name)
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Message: fmt.Sprintf("cannot determine the scope of script %s", name),
+		}
+		return true
+	}
+	return false
+}
+
+// restrictToScope: returns before with the values at the scope pointers taken from after,
+// and the paths of the changes of after left out
+func restrictToScope(before, after []byte, scope []string) ([]byte, []string, error) {
+	original, err := decodeNumbers(before)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	modified, err := decodeNumbers(after)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode script result: %w", err)
+	}
+
+	restricted := original
+	for _, pointer := range scope {
+		tokens := pointerTokens(pointer)
+		if value, ok := pointerGet(modified, tokens); ok {
+			restricted = pointerSet(restricted, tokens, value)
+		} else {
+			restricted = pointerRemove(restricted, tokens)
+		}
+	}
+
+	if reflect.DeepEqual(restricted, modified) {
+		return after, nil, nil
+	}
+
+	result, err := json.Marshal(restricted)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode object: %w", err)
+	}
+
+	operations, err := jsonpatch.CreatePatch(result, after)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to diff out-of-scope changes: %w", err)
+	}
+	dropped := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		dropped = append(dropped, operation.Path)
+	}
+	sort.Strings(dropped)
+
+	return result, dropped, nil
+}
+
+// decodeNumbers: decodes JSON keeping numbers as their literal, so that untouched ones are re-encoded as is
+func decodeNumbers(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// pointerTokens: splits a JSON pointer (RFC 6901) into its unescaped reference tokens
+func pointerTokens(pointer string) []string {
+	if pointer == "" || pointer == "/" {
+		return nil
+	}
+
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens
+}
+
+// pointerGet: returns the value at tokens, and whether it exists
+func pointerGet(doc interface{}, tokens []string) (interface{}, bool) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			doc = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// pointerSet: sets the value at tokens, creating the missing objects on the way
+// Array elements are only replaced, a pointer past the end of an array leaves doc unchanged
+func pointerSet(doc interface{}, tokens []string, value interface{}) interface{} {
+	if len(tokens) == 0 {
+		return value
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[tokens[0]] = pointerSet(node[tokens[0]], tokens[1:], value)
+		return node
+	case []interface{}:
+		index, err := strconv.Atoi(tokens[0])
+		if err != nil || index < 0 || index >= len(node) {
+			return node
+		}
+		node[index] = pointerSet(node[index], tokens[1:], value)
+		return node
+	default:
+		return map[string]interface{}{tokens[0]: pointerSet(nil, tokens[1:], value)}
+	}
+}
+
+// pointerRemove: removes the value at tokens, if it exists
+func pointerRemove(doc interface{}, tokens []string) interface{} {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if len(tokens) == 1 {
+			delete(node, tokens[0])
+		} else if child, ok := node[tokens[0]]; ok {
+			node[tokens[0]] = pointerRemove(child, tokens[1:])
+		}
+		return node
+	case []interface{}:
+		index, err := strconv.Atoi(tokens[0])
+		if err != nil || index < 0 || index >= len(node) {
+			return node
+		}
+		if len(tokens) == 1 {
+			return append(node[:index], node[index+1:]...)
+		}
+		node[index] = pointerRemove(node[index], tokens[1:])
+		return node
+	default:
+		return doc
+	}
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+// isScriptConfigMap: reports whether the request creates or updates a ConfigMap holding scripts,
+// that is carrying the script label set to "true"
+func (h *WebhookHandler) isScriptConfigMap(req *admissionv1.AdmissionRequest, object *unstructured.Unstructured) bool {
+	if req.Kind.Group != "" || req.Kind.Kind != "ConfigMap" {
+		return false
+	}
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return false
+	}
+
+	label := h.options.ScriptLabel
+	if label == "" {
+		label = scriptloader.LabelScript
+	}
+	return object.GetLabels()[label] == "true"
+}
+
+// checkScriptConfigMap: compiles every script of a script ConfigMap
+// Returns the message denying the request, empty when every script compiles
+func checkScriptConfigMap(object *unstructured.Unstructured) string {
+	data, _, _ := unstructured.NestedStringMap(object.Object, "data")
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if scriptloader.IsScriptKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, key := range keys {
+		content, err := scriptloader.DecodeScript(key, data[key])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		for _, issue := range luarunner.Lint(key, content) {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s", issue.File, issue.Line, issue.Message))
+		}
+	}
+
+	if len(problems) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("invalid scripts in ConfigMap %s/%s: %s", object.GetNamespace(), object.GetName(), strings.Join(problems, "; "))
+}
+
+// denyInvalidScripts: denies the admission of a script ConfigMap holding scripts that do not compile
+// Returns true when the request was denied
+func (h *WebhookHandler) denyInvalidScripts(response *admissionv1.AdmissionResponse, req *admissionv1.AdmissionRequest, object *unstructured.Unstructured) bool {
+	if !h.isScriptConfigMap(req, object) {
+		return false
+	}
+
+	message := checkScriptConfigMap(object)
+	if message == "" {
+		h.logger.Printf("Scripts of ConfigMap %s/%s compile", object.GetNamespace(), object.GetName())
+		return false
+	}
+
+	h.logger.Printf("WARNING: Denying ConfigMap: %s", message)
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Message: message,
+	}
+	return true
+}
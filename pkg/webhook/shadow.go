@@ -0,0 +1,142 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/metrics"
+	"thechat/pkg/scriptloader"
+)
+
+// AnnotationShadowScripts: scripts run in the shadow of the scripts of the object, same format as
+// scriptloader.AnnotationScripts. Their outcome is compared with the one of the scripts of the
+// object and never makes it into the response
+const AnnotationShadowScripts = scriptloader.AnnotationPrefix + "/shadow-scripts"
+
+// DefaultShadowTimeout: time shadow scripts are given to complete, so that they hardly delay responses
+const DefaultShadowTimeout = 100 * time.Millisecond
+
+// shadowOutcome: what a chain of scripts would have made of a request
+type shadowOutcome struct {
+	// denial: reason and message of the first denial, empty when the chain allowed the request
+	denial string
+	// object: the object left by the chain, nil for the validating webhook or a denied request
+	object []byte
+}
+
+// outcomeOf: returns the outcome of a chain from its results and the object it left
+func outcomeOf(results []luarunner.ScriptResult, object []byte) shadowOutcome {
+	for _, result := range results {
+		var denial *luarunner.Denial
+		if errors.As(result.Err, &denial) {
+			return shadowOutcome{denial: denial.Reason + ": " + denial.Message}
+		}
+	}
+	return shadowOutcome{object: object}
+}
+
+// describe: formats an outcome for logs, with the patch the object makes of original
+func (o shadowOutcome) describe(original []byte) string {
+	if o.denial != "" {
+		return "denied (" + o.denial + ")"
+	}
+	if o.object == nil {
+		return "allowed"
+	}
+	patch, err := createJSONPatch(original, o.object)
+	if err != nil {
+		return fmt.Sprintf("allowed, patch unavailable: %v", err)
+	}
+	return "allowed with patch " + string(patch)
+}
+
+// equal: reports whether two outcomes admit the request the same way, objects compared decoded
+func (o shadowOutcome) equal(other shadowOutcome) bool {
+	if o.denial != other.denial || (o.object == nil) != (other.object == nil) {
+		return false
+	}
+	if o.object == nil {
+		return true
+	}
+	var left, right interface{}
+	if json.Unmarshal(o.object, &left) != nil || json.Unmarshal(other.object, &right) != nil {
+		return false
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// runShadow: runs the shadow scripts of the object, from AnnotationShadowScripts or
+// HandlerOptions.ShadowScripts, against the object the primary scripts got, and logs and counts in
+// metrics.ShadowDivergence an outcome differing from primary. Nothing of the shadow run reaches
+// the response: its warnings, logs and failures are dropped, and it is given ShadowTimeout at most
+// object is the object the primary scripts ran against, primary the outcome of their chain
+func (h *WebhookHandler) runShadow(ctx context.Context, key string, annotations map[string]string, object []byte, primary shadowOutcome) {
+	references, ok := annotations[AnnotationShadowScripts]
+	if !ok {
+		references = h.options.ShadowScripts
+	}
+	if strings.TrimSpace(references) == "" {
+		return
+	}
+
+	refs, errs := scriptloader.ParseAnnotationErrors(references, h.scriptLoader.Schemes()...)
+	for _, err := range errs {
+		h.logger.Printf("WARNING: Skipping shadow script of %s: %v", key, err)
+	}
+	set, err := h.scriptLoader.LoadScriptSet(ctx, refs)
+	if err != nil {
+		h.logger.Printf("WARNING: Failed to load the shadow scripts of %s: %v", key, err)
+		return
+	}
+	if len(set.Scripts) == 0 {
+		return
+	}
+	order, err := h.scriptLoader.OrderScripts(set.Scripts)
+	if err != nil {
+		h.logger.Printf("WARNING: Failed to order the shadow scripts of %s: %v", key, err)
+		return
+	}
+
+	timeout := h.options.ShadowTimeout
+	if timeout <= 0 {
+		timeout = DefaultShadowTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var mutated []byte
+	var results []luarunner.ScriptResult
+	if h.webhookType == "validating" {
+		_, results, err = h.scriptRunner.RunOrderedScriptsWithContext(ctx, order, set.Scripts, object)
+	} else {
+		mutated, results, err = h.scriptRunner.RunFilteredScriptsWithContext(ctx, order, set.Scripts, object, h.scopeFilter(set))
+	}
+	if err != nil {
+		h.logger.Printf("WARNING: Failed to run the shadow scripts of %s: %v", key, err)
+		return
+	}
+	for _, result := range results {
+		if errors.Is(result.Err, luarunner.ErrBudgetExhausted) || errors.Is(result.Err, luarunner.ErrScriptAbandoned) || ctx.Err() != nil {
+			h.logger.Printf("WARNING: Shadow scripts %s did not complete on %s within %s, not comparing them", strings.Join(order, ", "), key, timeout)
+			return
+		}
+		if result.Err != nil {
+			h.logger.Printf("DEBUG: Shadow script %s failed on %s: %v", result.Name, key, result.Err)
+		}
+	}
+
+	shadow := outcomeOf(results, mutated)
+	if shadow.equal(primary) {
+		h.logger.Printf("DEBUG: Shadow scripts %s agree with the primary scripts on %s", strings.Join(order, ", "), key)
+		return
+	}
+	h.logger.Printf("WARNING: Shadow scripts %s diverge from the primary scripts on %s: primary %s, shadow %s",
+		strings.Join(order, ", "), key, primary.describe(object), shadow.describe(object))
+	metrics.ShadowDivergence.WithLabelValues(h.webhookType).Inc()
+}
@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"thechat/pkg/metrics"
+)
+
+// DefaultShedWait: how long a request waits for an in-flight slot before being shed, when
+// HandlerOptions.ShedWait is zero
+const DefaultShedWait = 100 * time.Millisecond
+
+// newInFlightLimiter: returns the slots of the requests processed at once, nil when unlimited
+func newInFlightLimiter(maxInFlight int) chan struct{} {
+	if maxInFlight <= 0 {
+		return nil
+	}
+	return make(chan struct{}, maxInFlight)
+}
+
+// acquire: takes an in-flight slot, waiting for one at most ShedWait
+// Returns false when the request must be shed, the slot must otherwise be given back with release
+func (h *WebhookHandler) acquire(ctx context.Context) bool {
+	if h.inFlight == nil {
+		return true
+	}
+
+	select {
+	case h.inFlight <- struct{}{}:
+		return true
+	default:
+	}
+
+	wait := h.options.ShedWait
+	if wait <= 0 {
+		wait = DefaultShedWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case h.inFlight <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release: gives back the in-flight slot taken by acquire
+func (h *WebhookHandler) release() {
+	if h.inFlight != nil {
+		<-h.inFlight
+	}
+}
+
+// shed: answers a request no in-flight slot could be found for, without running any script
+// FailureModeAllow allows it as-is with a warning, FailureModeDeny answers 503 Service Unavailable
+// so that the API server applies the failurePolicy of the webhook
+func (h *WebhookHandler) shed(w http.ResponseWriter, review admissionv1.AdmissionReview) {
+	metrics.ShedRequests.WithLabelValues(h.webhookType).Inc()
+	h.logger.Printf("WARNING: Shedding %s request %s: %d requests already in flight", h.webhookType, review.Request.UID, cap(h.inFlight))
+
+	if h.options.ShedFailureMode == FailureModeAllow {
+		h.writeReview(w, http.StatusOK, buildReview(review.APIVersion, review.Request.UID, &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{"webhook overloaded, scripts were not run"},
+		}))
+		return
+	}
+	h.writeReview(w, http.StatusServiceUnavailable, buildReview(review.APIVersion, review.Request.UID,
+		rejectReview(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable, "webhook overloaded, %d requests already in flight", cap(h.inFlight))))
+}
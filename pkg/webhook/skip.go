@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/scriptloader"
+)
+
+// AnnotationSkip: object annotation ("true") bypassing every script, for break-glass resources
+const AnnotationSkip = scriptloader.AnnotationPrefix + "/skip"
+
+// skipped: reports whether the object opted out of the webhook through AnnotationSkip
+// With HandlerOptions.SkipAllowedUsers set, the annotation only counts for the requests of those
+// users, others get a warning and their object goes through the scripts as usual
+func (h *WebhookHandler) skipped(response *admissionv1.AdmissionResponse, req *admissionv1.AdmissionRequest, annotations map[string]string) bool {
+	if annotations[AnnotationSkip] != "true" {
+		return false
+	}
+
+	if len(h.options.SkipAllowedUsers) == 0 {
+		return true
+	}
+	for _, user := range h.options.SkipAllowedUsers {
+		if req.UserInfo.Username == user {
+			return true
+		}
+	}
+
+	h.logger.Printf("WARNING: Ignoring %s annotation set by %q, not in the allowed users", AnnotationSkip, req.UserInfo.Username)
+	response.Warnings = append(response.Warnings,
+		fmt.Sprintf("%s ignored: user %q may not skip the webhook", AnnotationSkip, req.UserInfo.Username))
+	return false
+}
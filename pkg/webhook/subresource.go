@@ -0,0 +1,26 @@
+package webhook
+
+import (
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// wrappingSubResources: subresources whose requests carry an object of their own rather than the
+// object of the resource, such as the Eviction of pods/eviction or the Binding of pods/binding
+var wrappingSubResources = map[string]bool{
+	"eviction": true,
+	"binding":  true,
+	"scale":    true,
+	"token":    true,
+}
+
+// wrappingSubResource: reports whether req targets a subresource whose object is not the object of
+// the resource, scripts written for a Pod then getting an Eviction or a Binding
+func wrappingSubResource(req *admissionv1.AdmissionRequest) bool {
+	return req.SubResource != "" && wrappingSubResources[req.SubResource]
+}
+
+// skippedSubResource: reports whether req is to be allowed as-is for targeting such a subresource,
+// which is the case unless HandlerOptions.ProcessSubResources is set
+func (h *WebhookHandler) skippedSubResource(req *admissionv1.AdmissionRequest) bool {
+	return !h.options.ProcessSubResources && wrappingSubResource(req)
+}
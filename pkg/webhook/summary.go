@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/luarunner"
+)
+
+// requestSummary: what the handling of an admission request went through, logged once it is answered
+type requestSummary struct {
+	// load: time spent loading the scripts
+	load time.Duration
+	// results: results of the scripts run for the response
+	results []luarunner.ScriptResult
+	// cached: whether the response came from the response cache, no script ran
+	cached bool
+}
+
+// summaryKey: context key of the requestSummary of a request
+type summaryKey struct{}
+
+// withSummary: returns ctx carrying a new requestSummary, filled while the request is handled
+func withSummary(ctx context.Context) (context.Context, *requestSummary) {
+	summary := &requestSummary{}
+	return context.WithValue(ctx, summaryKey{}, summary), summary
+}
+
+// summaryFrom: returns the requestSummary of ctx, a throwaway one when there is none
+func summaryFrom(ctx context.Context) *requestSummary {
+	if summary, ok := ctx.Value(summaryKey{}).(*requestSummary); ok {
+		return summary
+	}
+	return &requestSummary{}
+}
+
+// scripts: returns the names of the scripts run for the response, in execution order
+func (s *requestSummary) scripts() []string {
+	scripts := make([]string, 0, len(s.results))
+	for _, result := range s.results {
+		scripts = append(scripts, result.Name)
+	}
+	return scripts
+}
+
+// logSummary: logs the summary of an answered request as a single Info record of SummaryLogger
+func (h *WebhookHandler) logSummary(ctx context.Context, req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse, summary *requestSummary, duration time.Duration) {
+	logger := h.options.SummaryLogger
+	if logger == nil {
+		return
+	}
+
+	scripts := make([]string, 0, len(summary.results))
+	versions := make([]string, 0, len(summary.results))
+	var timings luarunner.PhaseTimings
+	var cpu time.Duration
+	var failures []string
+	for _, result := range summary.results {
+		scripts = append(scripts, result.Name)
+		versions = append(versions, describeVersion(result))
+		timings.ToLua += result.Timings.ToLua
+		timings.Execute += result.Timings.Execute
+		timings.FromLua += result.Timings.FromLua
+		cpu += result.CPUTime
+		if result.Err != nil && !errors.As(result.Err, new(*luarunner.Denial)) {
+			failures = append(failures, fmt.Sprintf("%s: %v", result.Name, result.Err))
+		}
+	}
+	if !response.Allowed && response.Result != nil && response.Result.Message != "" {
+		failures = append(failures, response.Result.Message)
+	}
+
+	var operations []json.RawMessage
+	if len(response.Patch) > 0 {
+		_ = json.Unmarshal(response.Patch, &operations)
+	}
+
+	logger.LogAttrs(ctx, slog.LevelInfo, "admission request",
+		slog.String("webhook", h.webhookType),
+		slog.String("uid", string(req.UID)),
+		slog.String("kind", req.Kind.Kind),
+		slog.String("namespace", req.Namespace),
+		slog.String("name", req.Name),
+		slog.String("operation", string(req.Operation)),
+		slog.Any("scripts", scripts),
+		slog.Any("versions", versions),
+		slog.Duration("duration", duration),
+		slog.Duration("load", summary.load),
+		slog.Duration("to_lua", timings.ToLua),
+		slog.Duration("execute", timings.Execute),
+		slog.Duration("from_lua", timings.FromLua),
+		slog.Duration("cpu", cpu),
+		slog.Bool("allowed", response.Allowed),
+		slog.Int("patch_ops", len(operations)),
+		slog.Bool("cached", summary.cached),
+		slog.String("errors", strings.Join(failures, "; ")),
+	)
+}
@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"thechat/pkg/metrics"
+	"thechat/pkg/scriptloader"
+)
+
+// templateKinds: kinds whose Pods are created from spec.template, the annotations of the pod
+// template are the ones their Pods get
+var templateKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"Job":         true,
+}
+
+// templateScripts: returns the scripts annotation of a workload when its pod template does not
+// carry one, its Pods are then created without it. Empty for any other object
+func templateScripts(kind string, object *unstructured.Unstructured) string {
+	if !templateKinds[kind] {
+		return ""
+	}
+	scripts := object.GetAnnotations()[scriptloader.AnnotationScripts]
+	if scripts == "" {
+		return ""
+	}
+	template, _, _ := unstructured.NestedStringMap(object.Object, "spec", "template", "metadata", "annotations")
+	if _, ok := template[scriptloader.AnnotationScripts]; ok {
+		return ""
+	}
+	return scripts
+}
+
+// checkTemplateScripts: warns about workloads annotated for scripts on their metadata only
+// Returns the annotation to copy to the pod template, when HandlerOptions.CopyAnnotationToTemplate is set
+func (h *WebhookHandler) checkTemplateScripts(response *admissionv1.AdmissionResponse, kind, key string, object *unstructured.Unstructured) string {
+	scripts := templateScripts(kind, object)
+	if scripts == "" {
+		return ""
+	}
+
+	metrics.TemplateAnnotationMissing.WithLabelValues(h.webhookType, kind).Inc()
+	if h.options.CopyAnnotationToTemplate {
+		h.logger.Printf("WARNING: %s has the %s annotation but not its pod template, copying it to the template", key, scriptloader.AnnotationScripts)
+		response.Warnings = append(response.Warnings, fmt.Sprintf(
+			"%s copied to spec.template.metadata.annotations, so that the Pods of this %s run the scripts too", scriptloader.AnnotationScripts, kind))
+		return scripts
+	}
+
+	h.logger.Printf("WARNING: %s has the %s annotation but not its pod template, its Pods will not run the scripts", key, scriptloader.AnnotationScripts)
+	response.Warnings = append(response.Warnings, fmt.Sprintf(
+		"%s only applies the scripts to this %s itself, set it on spec.template.metadata.annotations for its Pods to run them", scriptloader.AnnotationScripts, kind))
+	return ""
+}
+
+// withTemplateScripts: returns object with the scripts annotation of its pod template set to scripts
+func withTemplateScripts(object []byte, scripts string) ([]byte, error) {
+	doc, err := decodeNumbers(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	doc = pointerSet(doc, []string{"spec", "template", "metadata", "annotations", scriptloader.AnnotationScripts}, scripts)
+
+	return json.Marshal(doc)
+}
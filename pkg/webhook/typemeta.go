@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// typeMeta: returns the apiVersion and kind of an object, decoded without the rest of it
+func typeMeta(object []byte) (metav1.TypeMeta, error) {
+	var meta metav1.TypeMeta
+	if err := json.Unmarshal(object, &meta); err != nil {
+		return metav1.TypeMeta{}, err
+	}
+	return meta, nil
+}
+
+// withTypeMeta: fills the apiVersion and kind missing from an object with those of the request, as
+// some aggregated API servers leave them out of the objects they send. Returns the object as given
+// when it has both, along with the fields filled
+func withTypeMeta(object []byte, gvk metav1.GroupVersionKind) ([]byte, map[string]string, error) {
+	meta, err := typeMeta(object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	apiVersion, kind := schema.GroupVersionKind(gvk).ToAPIVersionAndKind()
+	filled := make(map[string]string, 2)
+	if meta.APIVersion == "" && gvk.Version != "" {
+		filled["apiVersion"] = apiVersion
+	}
+	if meta.Kind == "" && kind != "" {
+		filled["kind"] = kind
+	}
+	if len(filled) == 0 {
+		return object, nil, nil
+	}
+
+	doc, err := decodeNumbers(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("object is not a JSON object")
+	}
+	for field, value := range filled {
+		fields[field] = value
+	}
+	typed, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return typed, filled, nil
+}
+
+// removeTypeMeta: removes from what the scripts made of an object the fields filled by
+// withTypeMeta, unless the scripts changed them, so that the patch does not add them
+// Returns original when the scripts left typed alone
+func removeTypeMeta(original, typed, modified []byte, filled map[string]string) ([]byte, error) {
+	if bytes.Equal(modified, typed) || bytes.Equal(modified, original) {
+		return original, nil
+	}
+
+	doc, err := decodeNumbers(modified)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return modified, nil
+	}
+	for field, value := range filled {
+		if fields[field] == value {
+			delete(fields, field)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// denyTypeMetaChanges: denies the request when the scripts changed the apiVersion or kind of the
+// object, which the API server would reject with a confusing error
+// Returns true when the request was denied
+func (h *WebhookHandler) denyTypeMetaChanges(response *admissionv1.AdmissionResponse, key string, original, modified []byte) bool {
+	before, err := typeMeta(original)
+	if err != nil {
+		return false
+	}
+	after, err := typeMeta(modified)
+	if err != nil {
+		h.logger.Printf("WARNING: Failed to decode the apiVersion and kind of %s as mutated: %v", key, err)
+		return false
+	}
+
+	var message string
+	switch {
+	case before.Kind != after.Kind && before.APIVersion != after.APIVersion:
+		message = fmt.Sprintf("scripts changed the apiVersion and kind of the object from %s %s to %s %s",
+			before.APIVersion, before.Kind, after.APIVersion, after.Kind)
+	case before.Kind != after.Kind:
+		message = fmt.Sprintf("scripts changed the kind of the object from %q to %q", before.Kind, after.Kind)
+	case before.APIVersion != after.APIVersion:
+		message = fmt.Sprintf("scripts changed the apiVersion of the object from %q to %q", before.APIVersion, after.APIVersion)
+	default:
+		return false
+	}
+
+	h.logger.Printf("WARNING: Denying %s: %s", key, message)
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Message: message + ", mutating scripts cannot change them",
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"thechat/pkg/luarunner"
+	"thechat/pkg/scriptloader"
+)
+
+const (
+	// AuditAnnotationScriptVersions: audit annotation holding the version of every script run for
+	// a request, written along with AuditAnnotationScriptLog
+	AuditAnnotationScriptVersions = "script-versions"
+
+	// AnnotationAppliedScripts: annotation written on mutated objects when
+	// HandlerOptions.AppliedScripts is set, a JSON list of the AppliedScript that ran for them
+	AnnotationAppliedScripts = scriptloader.AnnotationPrefix + "/applied-scripts"
+)
+
+// AppliedScript: a script that ran for an object, and the version of its content
+type AppliedScript struct {
+	// Name: script identifier
+	Name string `json:"name"`
+	scriptloader.ScriptVersion
+}
+
+// stampVersions: records on each result the version of the content its script was loaded with
+func stampVersions(results []luarunner.ScriptResult, set scriptloader.ScriptSet) {
+	for i := range results {
+		version := set.Version(results[i].Name)
+		results[i].Hash = version.Hash
+		results[i].ResourceVersion = version.ResourceVersion
+	}
+}
+
+// describeVersion: renders the version of the content a script ran with for logs, the hash
+// shortened to 12 characters
+func describeVersion(result luarunner.ScriptResult) string {
+	hash := result.Hash
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	if result.ResourceVersion == "" {
+		return fmt.Sprintf("%s sha256:%s", result.Name, hash)
+	}
+	return fmt.Sprintf("%s sha256:%s rv:%s", result.Name, hash, result.ResourceVersion)
+}
+
+// auditScriptVersions: records the version of every script run into the response audit
+// annotations, along with their logs, when enabled
+func (h *WebhookHandler) auditScriptVersions(response *admissionv1.AdmissionResponse, results []luarunner.ScriptResult) {
+	if !h.options.AuditScriptLogs || len(results) == 0 {
+		return
+	}
+
+	versions := make([]string, len(results))
+	for i, result := range results {
+		versions[i] = describeVersion(result)
+	}
+
+	if response.AuditAnnotations == nil {
+		response.AuditAnnotations = make(map[string]string)
+	}
+	response.AuditAnnotations[AuditAnnotationScriptVersions] = truncate(strings.Join(versions, "; "), AuditAnnotationMaxLength)
+}
+
+// withAppliedScripts: returns object with the AnnotationAppliedScripts annotation listing the
+// scripts of results that ran to completion
+func withAppliedScripts(object []byte, results []luarunner.ScriptResult) ([]byte, error) {
+	applied := make([]AppliedScript, 0, len(results))
+	for _, result := range results {
+		if result.Err != nil || result.Duration == 0 {
+			continue
+		}
+		applied = append(applied, AppliedScript{
+			Name:          result.Name,
+			ScriptVersion: scriptloader.ScriptVersion{Hash: result.Hash, ResourceVersion: result.ResourceVersion},
+		})
+	}
+	value, err := json.Marshal(applied)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode applied scripts: %w", err)
+	}
+
+	doc, err := decodeNumbers(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	doc = pointerSet(doc, []string{"metadata", "annotations", AnnotationAppliedScripts}, string(value))
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,231 @@
+// Package webhooktest provides an in-process harness for end-to-end tests of the webhook handler.
+//
+// Scripts live in ConfigMaps of a fake clientset, AdmissionReviews are posted to an httptest server
+// and the patches of the responses are applied to the submitted objects, so that tests assert on
+// the objects the API server would store, without TLS nor a cluster:
+//
+//	harness := webhooktest.New(t, "mutating", webhook.HandlerOptions{})
+//	ref := harness.AddScript("default", "labels", `object.metadata.labels = {team = "platform"}`)
+//	result := harness.Admit(pod) // pod annotated with glua.maurice.fr/scripts: ref
+//	// result.Object holds the patched pod
+package webhooktest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/webhook"
+)
+
+// Harness: a WebhookHandler served by an httptest server, loading its scripts from a fake clientset
+type Harness struct {
+	// Clientset: fake clientset holding the script ConfigMaps and the objects scripts look up
+	Clientset *fake.Clientset
+	// Handler: handler under test
+	Handler *webhook.WebhookHandler
+	// URL: base URL of the server, which serves the handler on every path
+	URL string
+
+	t      testing.TB
+	server *httptest.Server
+}
+
+// Result: outcome of an admission request
+type Result struct {
+	// Response: admission response of the handler
+	Response *admissionv1.AdmissionResponse
+	// Object: object with the patch of the response applied, as the API server would store it,
+	// nil when the request was denied
+	Object map[string]interface{}
+}
+
+// New: starts a harness for a "mutating" or "validating" handler with the given options, its
+// clientset holding objects. Logs go to the test log, the server is closed when the test ends
+func New(t testing.TB, webhookType string, options webhook.HandlerOptions, objects ...runtime.Object) *Harness {
+	t.Helper()
+
+	clientset := fake.NewSimpleClientset(objects...)
+	logger := log.New(testWriter{t}, "[webhooktest] ", 0)
+	handler := webhook.NewWebhookHandlerWithOptions(clientset, logger, webhookType, options)
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return &Harness{
+		Clientset: clientset,
+		Handler:   handler,
+		URL:       server.URL,
+		t:         t,
+		server:    server,
+	}
+}
+
+// AddScript: stores script under the scriptloader.DefaultScriptKey key of the namespace/name
+// ConfigMap, creating or replacing it, and returns the reference to it for the scripts annotation
+// Loaders caching scripts keep serving the previous content until their cache expires
+func (h *Harness) AddScript(namespace, name, script string) string {
+	h.t.Helper()
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       map[string]string{scriptloader.DefaultScriptKey: script},
+	}
+	configMaps := h.Clientset.CoreV1().ConfigMaps(namespace)
+	_, err := configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		h.t.Fatalf("Failed to store script %s/%s: %v", namespace, name, err)
+	}
+	return namespace + "/" + name
+}
+
+// Admit: sends a CREATE request for object, any value encoding to a Kubernetes object in JSON
+func (h *Harness) Admit(object interface{}) Result {
+	h.t.Helper()
+	return h.Send(Request(h.t, admissionv1.Create, object))
+}
+
+// Send: sends a request, and applies the patch of the response to its object
+func (h *Harness) Send(request *admissionv1.AdmissionRequest) Result {
+	h.t.Helper()
+
+	response := h.Review(request)
+	if !response.Allowed {
+		return Result{Response: response}
+	}
+
+	object := request.Object.Raw
+	if len(object) == 0 {
+		object = request.OldObject.Raw
+	}
+	return Result{Response: response, Object: Apply(h.t, object, response.Patch)}
+}
+
+// Review: posts request in an admission.k8s.io/v1 AdmissionReview, and returns the response
+// The test fails when the server does not answer a review with a response for the request
+func (h *Harness) Review(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	h.t.Helper()
+
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	if err != nil {
+		h.t.Fatalf("Failed to encode admission review: %v", err)
+	}
+
+	resp, err := h.server.Client().Post(h.URL+"/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		h.t.Fatalf("Failed to post admission review: %v", err)
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("Failed to read admission review: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		h.t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, resp.StatusCode, content)
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(content, &review); err != nil {
+		h.t.Fatalf("Failed to decode admission review: %v", err)
+	}
+	if review.Response == nil {
+		h.t.Fatalf("Expected a response in the admission review, got %s", content)
+	}
+	if review.Response.UID != request.UID {
+		h.t.Fatalf("Expected the response to have the UID %q of the request, got %q", request.UID, review.Response.UID)
+	}
+	return review.Response
+}
+
+// Request: builds an admission request for operation on object, reading its kind, namespace and
+// name from it. DELETE requests carry the object as their old object, like the API server does
+func Request(t testing.TB, operation admissionv1.Operation, object interface{}) *admissionv1.AdmissionRequest {
+	t.Helper()
+
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("Failed to encode object: %v", err)
+	}
+
+	var meta struct {
+		metav1.TypeMeta
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		t.Fatalf("Failed to decode object metadata: %v", err)
+	}
+	gvk := schema.FromAPIVersionAndKind(meta.APIVersion, meta.Kind)
+	if gvk.Kind == "" {
+		t.Fatalf("Object has no kind: %s", raw)
+	}
+
+	request := &admissionv1.AdmissionRequest{
+		UID:       types.UID("webhooktest-" + strings.ToLower(gvk.Kind) + "-" + meta.Metadata.Name),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Namespace: meta.Metadata.Namespace,
+		Name:      meta.Metadata.Name,
+		Operation: operation,
+	}
+	if operation == admissionv1.Delete {
+		request.OldObject = runtime.RawExtension{Raw: raw}
+	} else {
+		request.Object = runtime.RawExtension{Raw: raw}
+	}
+	return request
+}
+
+// Apply: returns object with a JSON patch applied, object as is when the patch is empty
+func Apply(t testing.TB, object, patch []byte) map[string]interface{} {
+	t.Helper()
+
+	if len(patch) > 0 {
+		decoded, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			t.Fatalf("Failed to decode patch %s: %v", patch, err)
+		}
+		if object, err = decoded.Apply(object); err != nil {
+			t.Fatalf("Failed to apply patch %s: %v", patch, err)
+		}
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(object, &result); err != nil {
+		t.Fatalf("Failed to decode patched object: %v", err)
+	}
+	return result
+}
+
+// testWriter: sends the handler logs to the test log, shown for failing or verbose tests only
+type testWriter struct {
+	t testing.TB
+}
+
+// Write: implements io.Writer
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,85 @@
+package webhooktest
+
+import (
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"thechat/pkg/scriptloader"
+	"thechat/pkg/webhook"
+)
+
+func newPod(scripts string) *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{scriptloader.AnnotationScripts: scripts},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.27"}}},
+	}
+}
+
+func TestHarness_Mutating(t *testing.T) {
+	harness := New(t, "mutating", webhook.HandlerOptions{})
+	ref := harness.AddScript("default", "labels", `object.metadata.labels = {team = "platform"}`)
+
+	result := harness.Admit(newPod(ref))
+	if !result.Response.Allowed {
+		t.Fatalf("Expected the pod to be allowed, got %+v", result.Response.Result)
+	}
+	labels, _ := result.Object["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels["team"] != "platform" {
+		t.Errorf("Expected the patched pod to have the team label, got %v", result.Object["metadata"])
+	}
+	if result.Object["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})["image"] != "nginx:1.27" {
+		t.Errorf("Expected the rest of the pod to be left alone, got %v", result.Object["spec"])
+	}
+
+	// Replacing the script changes the outcome of the next request
+	harness.AddScript("default", "labels", `object.metadata.labels = {team = "storage"}`)
+	result = harness.Admit(newPod(ref))
+	labels, _ = result.Object["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels["team"] != "storage" {
+		t.Errorf("Expected the updated script to run, got %v", result.Object["metadata"])
+	}
+}
+
+func TestHarness_Validating(t *testing.T) {
+	harness := New(t, "validating", webhook.HandlerOptions{})
+	ref := harness.AddScript("default", "policy", `
+		if object.spec.containers[1].image == "nginx:latest" then
+			deny_forbidden("latest tags are not allowed")
+		end
+	`)
+
+	if result := harness.Admit(newPod(ref)); !result.Response.Allowed || result.Object == nil {
+		t.Errorf("Expected the pod to be allowed as is, got %+v", result.Response.Result)
+	}
+
+	pod := newPod(ref)
+	pod.Spec.Containers[0].Image = "nginx:latest"
+	result := harness.Admit(pod)
+	if result.Response.Allowed || result.Object != nil {
+		t.Fatal("Expected the pod to be denied")
+	}
+	if result.Response.Result.Message != "default/policy: latest tags are not allowed" {
+		t.Errorf("Unexpected denial %+v", result.Response.Result)
+	}
+}
+
+func TestHarness_Delete(t *testing.T) {
+	harness := New(t, "validating", webhook.HandlerOptions{})
+	ref := harness.AddScript("default", "protect", `deny_forbidden("protected")`)
+
+	request := Request(t, admissionv1.Delete, newPod(ref))
+	if len(request.Object.Raw) != 0 || len(request.OldObject.Raw) == 0 {
+		t.Fatal("Expected a DELETE request to carry the pod as its old object")
+	}
+	if result := harness.Send(request); result.Response.Allowed {
+		t.Error("Expected the deletion to be denied")
+	}
+}